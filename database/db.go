@@ -34,6 +34,19 @@ func initModels() error {
 		&model.InboundClientIps{},
 		&xray.ClientTraffic{},
 		&model.Payment{},
+		&model.ClientLinkToken{},
+		&model.SupportTicket{},
+		&model.SupportMessage{},
+		&model.CallbackHash{},
+		&model.ExpiryReminder{},
+		&model.AuditLog{},
+		&model.TrafficRollup{},
+		&model.TrafficResetLog{},
+		&model.RecycledItem{},
+		&model.BlockedUser{},
+		&model.ClientRecord{},
+		&model.Customer{},
+		&model.CustomerClient{},
 	}
 	for _, model := range models {
 		if err := db.AutoMigrate(model); err != nil {
@@ -61,6 +74,25 @@ func initUser() error {
 	return nil
 }
 
+// initClients moves the clients kept in the settings of the inbounds into the
+// clients table, which is their source since.
+func initClients() error {
+	var inbounds []*model.Inbound
+	err := db.Session(&gorm.Session{SkipHooks: true}).Model(model.Inbound{}).Find(&inbounds).Error
+	if err != nil {
+		return err
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		for _, inbound := range inbounds {
+			if err := inbound.MoveClients(tx); err != nil {
+				log.Printf("Error migrating clients of inbound %d: %v", inbound.Id, err)
+				return err
+			}
+		}
+		return nil
+	})
+}
+
 func isTableEmpty(tableName string) (bool, error) {
 	var count int64
 	err := db.Table(tableName).Count(&count).Error
@@ -96,6 +128,9 @@ func InitDB(dbPath string) error {
 	if err := initUser(); err != nil {
 		return err
 	}
+	if err := initClients(); err != nil {
+		return err
+	}
 
 	return nil
 }
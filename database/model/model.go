@@ -1,6 +1,9 @@
 package model
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
 
 	"x-ui/util/json_util"
@@ -39,6 +42,18 @@ type Inbound struct {
 	Enable      bool                 `json:"enable" form:"enable"`
 	ExpiryTime  int64                `json:"expiryTime" form:"expiryTime"`
 	ClientStats []xray.ClientTraffic `gorm:"foreignKey:InboundId;references:Id" json:"clientStats" form:"clientStats"`
+	Clients     []ClientRecord       `gorm:"foreignKey:InboundId;references:Id" json:"-" form:"-"`
+
+	// TrafficReset is the schedule resetting the traffic of the inbound and
+	// of its clients without a schedule of their own, see Client.TrafficReset.
+	TrafficReset     string `json:"trafficReset" form:"trafficReset"`
+	LastTrafficReset int64  `json:"lastTrafficReset" form:"-"`
+	// AutoDisabled marks an inbound the traffic job disabled for its limit or
+	// expiry, which a scheduled traffic reset may enable again.
+	AutoDisabled bool `json:"-" form:"-"`
+
+	// Version is bumped by every save, see BeforeSave.
+	Version int `json:"version" form:"version" gorm:"default:0"`
 
 	// config part
 	Listen         string   `json:"listen" form:"listen"`
@@ -49,6 +64,11 @@ type Inbound struct {
 	Tag            string   `json:"tag" form:"tag" gorm:"unique"`
 	Sniffing       string   `json:"sniffing" form:"sniffing"`
 	Allocate       string   `json:"allocate" form:"allocate"`
+
+	// clients are the clients taken out of the settings by BeforeSave and
+	// clientsSettings the settings with them.
+	clients         []ClientRecord
+	clientsSettings string
 }
 
 type OutboundTraffics struct {
@@ -65,16 +85,161 @@ type InboundClientIps struct {
 	Ips         string `json:"ips" form:"ips"`
 }
 
+type ClientLinkToken struct {
+	Id        int    `json:"id" gorm:"primaryKey;autoIncrement"`
+	Token     string `json:"token" gorm:"unique"`
+	Email     string `json:"email"`
+	ExpiresAt int64  `json:"expiresAt"`
+}
+
+type CallbackHash struct {
+	Hash      string `json:"hash" gorm:"primaryKey"`
+	Value     string `json:"value"`
+	Timestamp int64  `json:"timestamp" gorm:"index"`
+}
+
+// ExpiryReminder records a reminder sent to a customer, so each offset is
+// sent only once per client and expiry date.
+type ExpiryReminder struct {
+	Id         int    `json:"id" gorm:"primaryKey;autoIncrement"`
+	Email      string `json:"email" gorm:"uniqueIndex:idx_expiry_reminder"`
+	ExpiryTime int64  `json:"expiryTime" gorm:"uniqueIndex:idx_expiry_reminder"`
+	DaysBefore int    `json:"daysBefore" gorm:"uniqueIndex:idx_expiry_reminder"`
+	SentAt     int64  `json:"sentAt"`
+}
+
+// TrafficRollup is the traffic of a client summed up over the period which
+// starts at Start (unix seconds).
+type TrafficRollup struct {
+	Id     int    `json:"id" gorm:"primaryKey;autoIncrement"`
+	Kind   string `json:"kind" gorm:"uniqueIndex:idx_traffic_rollup"`
+	Name   string `json:"name" gorm:"uniqueIndex:idx_traffic_rollup"`
+	Period string `json:"period" gorm:"uniqueIndex:idx_traffic_rollup"`
+	Start  int64  `json:"start" gorm:"uniqueIndex:idx_traffic_rollup;index"`
+	Up     int64  `json:"up"`
+	Down   int64  `json:"down"`
+}
+
+// TrafficResetLog keeps the usage of a client or inbound (Kind and Name as in
+// TrafficRollup) at the moment a traffic reset schedule zeroed it.
+type TrafficResetLog struct {
+	Id      int    `json:"id" gorm:"primaryKey;autoIncrement"`
+	Kind    string `json:"kind" gorm:"index:idx_traffic_reset_log"`
+	Name    string `json:"name" gorm:"index:idx_traffic_reset_log"`
+	Up      int64  `json:"up"`
+	Down    int64  `json:"down"`
+	Total   int64  `json:"total"`
+	ResetAt int64  `json:"resetAt"`
+}
+
+// RecycledItem is a deleted client or inbound (Kind and Name as in
+// TrafficRollup) kept until the recycle bin retention. Data holds the client
+// or the inbound, Traffics, Ips and Customers what the deletion removed with
+// it, all as JSON.
+type RecycledItem struct {
+	Id         int    `json:"id" gorm:"primaryKey;autoIncrement"`
+	Kind       string `json:"kind"`
+	Name       string `json:"name"`
+	InboundId  int    `json:"inboundId"`
+	Data       string `json:"data"`
+	Traffics   string `json:"traffics"`
+	Ips        string `json:"ips"`
+	Customers  string `json:"customers"`
+	RecycledAt int64  `json:"recycledAt" gorm:"index"`
+}
+
+// BlockedUser is a Telegram user the bot ignores until ExpiresAt (unix
+// seconds), zero bans for good.
+type BlockedUser struct {
+	Id        int    `json:"id" gorm:"primaryKey;autoIncrement"`
+	TgId      int64  `json:"tgId" gorm:"uniqueIndex"`
+	Reason    string `json:"reason"`
+	CreatedBy string `json:"createdBy"`
+	CreatedAt int64  `json:"createdAt"`
+	ExpiresAt int64  `json:"expiresAt"`
+}
+
+// Customer is a person owning clients across inbounds. TotalGB (bytes) is
+// shared by all of them and ExpiryTime (unix milliseconds) is applied to each,
+// zero meaning unlimited.
+type Customer struct {
+	Id         int                  `json:"id" form:"id" gorm:"primaryKey;autoIncrement"`
+	Name       string               `json:"name" form:"name"`
+	Contact    string               `json:"contact" form:"contact"`
+	TgId       int64                `json:"tgId" form:"tgId" gorm:"index"`
+	Notes      string               `json:"notes" form:"notes"`
+	Tags       string               `json:"tags" form:"tags"`
+	TotalGB    int64                `json:"totalGB" form:"totalGB"`
+	ExpiryTime int64                `json:"expiryTime" form:"expiryTime"`
+	SpeedTier  string               `json:"speedTier" form:"speedTier"`
+	CreatedAt  int64                `json:"createdAt"`
+	Clients    []xray.ClientTraffic `json:"clients" form:"-" gorm:"-"`
+}
+
+// CustomerClient assigns the client with Email to a customer. A client belongs
+// to one customer at most.
+type CustomerClient struct {
+	Id         int    `json:"id" gorm:"primaryKey;autoIncrement"`
+	CustomerId int    `json:"customerId" gorm:"index"`
+	Email      string `json:"email" gorm:"uniqueIndex"`
+}
+
+// AuditLog records a change made by an admin or a customer. Before and After
+// hold the JSON of the fields which changed.
+type AuditLog struct {
+	Id         int    `json:"id" gorm:"primaryKey;autoIncrement"`
+	Actor      string `json:"actor"`
+	Channel    string `json:"channel"`
+	Action     string `json:"action"`
+	TargetType string `json:"targetType" gorm:"index:idx_audit_target"`
+	Target     string `json:"target" gorm:"index:idx_audit_target"`
+	Before     string `json:"before"`
+	After      string `json:"after"`
+	CreatedAt  int64  `json:"createdAt" gorm:"index"`
+}
+
+type SupportTicketStatus string
+
+const (
+	TicketOpen   SupportTicketStatus = "open"
+	TicketClosed SupportTicketStatus = "closed"
+)
+
+type SupportTicket struct {
+	Id        int                 `json:"id" gorm:"primaryKey;autoIncrement"`
+	TgId      int64               `json:"tgId" gorm:"index"`
+	Username  string              `json:"username"`
+	Status    SupportTicketStatus `json:"status"`
+	CreatedAt int64               `json:"createdAt"`
+	UpdatedAt int64               `json:"updatedAt"`
+	Messages  []SupportMessage    `json:"messages,omitempty" gorm:"foreignKey:TicketId;references:Id"`
+}
+
+type SupportMessage struct {
+	Id        int    `json:"id" gorm:"primaryKey;autoIncrement"`
+	TicketId  int    `json:"ticketId" gorm:"index"`
+	SenderId  int64  `json:"senderId"`
+	FromAdmin bool   `json:"fromAdmin"`
+	Text      string `json:"text"`
+	CreatedAt int64  `json:"createdAt"`
+}
+
+// GenXrayInboundConfig returns the inbound as xray expects it. When the
+// client records are loaded, they make up the clients of the settings.
 func (i *Inbound) GenXrayInboundConfig() *xray.InboundConfig {
 	listen := i.Listen
 	if listen != "" {
 		listen = fmt.Sprintf("\"%v\"", listen)
 	}
+	settings := i.Settings
+	if i.Clients != nil {
+		settings = i.xraySettings()
+	}
 	return &xray.InboundConfig{
 		Listen:         json_util.RawMessage(listen),
 		Port:           i.Port,
 		Protocol:       string(i.Protocol),
-		Settings:       json_util.RawMessage(i.Settings),
+		Settings:       json_util.RawMessage(settings),
 		StreamSettings: json_util.RawMessage(i.StreamSettings),
 		Tag:            i.Tag,
 		Sniffing:       json_util.RawMessage(i.Sniffing),
@@ -82,6 +247,282 @@ func (i *Inbound) GenXrayInboundConfig() *xray.InboundConfig {
 	}
 }
 
+// xraySettings replaces the clients of the settings with the enabled client
+// records, keeping only the fields xray knows.
+func (i *Inbound) xraySettings() string {
+	settings := map[string]interface{}{}
+	if json.Unmarshal([]byte(i.Settings), &settings) != nil {
+		return i.Settings
+	}
+	if _, ok := settings["clients"]; !ok {
+		return i.Settings
+	}
+	clients := make([]interface{}, 0, len(i.Clients))
+	for _, record := range i.Clients {
+		if !record.Enable {
+			continue
+		}
+		client := map[string]interface{}{"email": record.Email}
+		if record.UUID != "" {
+			client["id"] = record.UUID
+		}
+		if record.Password != "" {
+			client["password"] = record.Password
+		}
+		if record.Flow != "" {
+			client["flow"] = record.Flow
+			if record.Flow == "xtls-rprx-vision-udp443" {
+				client["flow"] = "xtls-rprx-vision"
+			}
+		}
+		if record.Method != "" {
+			client["method"] = record.Method
+		}
+		if record.Level > 0 {
+			client["level"] = record.Level
+		}
+		clients = append(clients, client)
+	}
+	settings["clients"] = clients
+	data, err := json.MarshalIndent(settings, "", "  ")
+	if err != nil {
+		return i.Settings
+	}
+	return string(data)
+}
+
+// ClientRecords reads the clients of the settings as records.
+func (i *Inbound) ClientRecords() ([]ClientRecord, error) {
+	settings := struct {
+		Clients []Client `json:"clients"`
+	}{}
+	// fields of an unexpected type, like a tgId saved as "", are left empty
+	err := json.Unmarshal([]byte(i.Settings), &settings)
+	if _, isTypeError := err.(*json.UnmarshalTypeError); err != nil && !isTypeError {
+		return nil, err
+	}
+	methods := struct {
+		Clients []struct {
+			Method string `json:"method"`
+		} `json:"clients"`
+	}{}
+	json.Unmarshal([]byte(i.Settings), &methods)
+
+	records := make([]ClientRecord, 0, len(settings.Clients))
+	for position := range settings.Clients {
+		method := ""
+		if position < len(methods.Clients) {
+			method = methods.Clients[position].Method
+		}
+		records = append(records, NewClientRecord(i.Id, position, &settings.Clients[position], method))
+	}
+	return records, nil
+}
+
+// MoveClients moves the clients still kept in the stored settings, by
+// versions before the clients table, into client records. The inbound must
+// be read without hooks, so its settings are the stored ones.
+func (i *Inbound) MoveClients(tx *gorm.DB) error {
+	err := i.splitClients()
+	if err != nil || i.clientsSettings == "" {
+		return err
+	}
+	records, settings := i.clients, i.Settings
+	i.Settings, i.clients, i.clientsSettings = i.clientsSettings, nil, ""
+	if len(records) == 0 {
+		return nil
+	}
+	err = syncClients(tx, i.Id, records)
+	if err != nil {
+		return err
+	}
+	return tx.Model(&Inbound{}).Where("id = ?", i.Id).UpdateColumn("settings", settings).Error
+}
+
+// SaveClients writes the clients of the inbound and bumps its version. Records
+// are matched by email and only the added, changed and removed clients are
+// written.
+func (i *Inbound) SaveClients(tx *gorm.DB, records []ClientRecord) error {
+	err := i.BumpVersion(tx)
+	if err != nil {
+		return err
+	}
+	return syncClients(tx, i.Id, records)
+}
+
+func syncClients(tx *gorm.DB, inboundId int, records []ClientRecord) error {
+	var existing []ClientRecord
+	err := tx.Where("inbound_id = ?", inboundId).Find(&existing).Error
+	if err != nil {
+		return err
+	}
+	byEmail := make(map[string]ClientRecord, len(existing))
+	for _, record := range existing {
+		byEmail[record.Email] = record
+	}
+
+	var created []ClientRecord
+	for _, record := range records {
+		record.InboundId = inboundId
+		old, ok := byEmail[record.Email]
+		if !ok {
+			created = append(created, record)
+			continue
+		}
+		delete(byEmail, record.Email)
+		record.Id = old.Id
+		if record == old {
+			continue
+		}
+		err = tx.Save(&record).Error
+		if err != nil {
+			return err
+		}
+	}
+
+	removed := make([]int, 0, len(byEmail))
+	for _, record := range byEmail {
+		removed = append(removed, record.Id)
+	}
+	if len(removed) > 0 {
+		err = tx.Delete(&ClientRecord{}, removed).Error
+		if err != nil {
+			return err
+		}
+	}
+	if len(created) == 0 {
+		return nil
+	}
+	return tx.CreateInBatches(created, 100).Error
+}
+
+// splitClients takes the clients out of the settings, which are stored
+// without them, and keeps them as records until AfterSave writes them.
+func (i *Inbound) splitClients() error {
+	settings := map[string]interface{}{}
+	err := json.Unmarshal([]byte(i.Settings), &settings)
+	if err != nil {
+		return err
+	}
+	if _, ok := settings["clients"]; !ok {
+		return nil
+	}
+	records, err := i.ClientRecords()
+	if err != nil {
+		return err
+	}
+	settings["clients"] = []interface{}{}
+	data, err := json.MarshalIndent(settings, "", "  ")
+	if err != nil {
+		return err
+	}
+	i.clients = records
+	i.clientsSettings = i.Settings
+	i.Settings = string(data)
+	return nil
+}
+
+// withClients returns the settings with the records as their clients.
+// Settings without clients, like those of a socks inbound, stay as they are.
+func withClients(settings string, records []ClientRecord) string {
+	values := map[string]interface{}{}
+	if json.Unmarshal([]byte(settings), &values) != nil {
+		return settings
+	}
+	if _, ok := values["clients"]; !ok {
+		return settings
+	}
+	clients := make([]interface{}, 0, len(records))
+	for _, record := range records {
+		clients = append(clients, record.settingsClient())
+	}
+	values["clients"] = clients
+	data, err := json.MarshalIndent(values, "", "  ")
+	if err != nil {
+		return settings
+	}
+	return string(data)
+}
+
+// ErrInboundConflict is returned when saving an inbound which was saved by
+// someone else since it was read.
+var ErrInboundConflict = errors.New("the inbound was changed meanwhile, reload it and try again")
+
+// BumpVersion refuses to change an inbound saved since it was read and bumps
+// its version, in one conditional update so that concurrent changes cannot
+// both pass the check.
+func (i *Inbound) BumpVersion(tx *gorm.DB) error {
+	result := tx.Model(&Inbound{}).Where("id = ? AND version = ?", i.Id, i.Version).
+		UpdateColumn("version", gorm.Expr("version + 1"))
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		var count int64
+		err := tx.Model(&Inbound{}).Where("id = ?", i.Id).Count(&count).Error
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			return ErrInboundConflict
+		}
+	}
+	i.Version++
+	return nil
+}
+
+// TouchInbounds bumps the versions of the inbounds whose client records were
+// written without reading the inbounds, so that saves of older reads fail.
+func TouchInbounds(tx *gorm.DB, ids []int) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	return tx.Model(&Inbound{}).Where("id IN ?", ids).UpdateColumn("version", gorm.Expr("version + 1")).Error
+}
+
+// AfterFind fills the clients of the settings from the client records, which
+// are the source of the clients. Preloaded records are used as they are.
+func (i *Inbound) AfterFind(tx *gorm.DB) error {
+	if i.Id == 0 || i.Settings == "" {
+		return nil
+	}
+	records := i.Clients
+	if records == nil {
+		err := tx.Session(&gorm.Session{NewDB: true}).Where("inbound_id = ?", i.Id).Order("position, id").Find(&records).Error
+		if err != nil {
+			return err
+		}
+	}
+	i.Settings = withClients(i.Settings, records)
+	return nil
+}
+
+// BeforeSave versions the inbound, see BumpVersion, and takes the clients out
+// of the settings. Partial updates without the settings are not versioned.
+func (i *Inbound) BeforeSave(tx *gorm.DB) error {
+	if i.Settings == "" {
+		return nil
+	}
+	if i.Id != 0 {
+		err := i.BumpVersion(tx)
+		if err != nil {
+			return err
+		}
+	}
+	return i.splitClients()
+}
+
+// AfterSave writes the clients taken out of the settings as client records,
+// within the transaction saving the inbound.
+func (i *Inbound) AfterSave(tx *gorm.DB) error {
+	if i.clientsSettings == "" {
+		return nil
+	}
+	records := i.clients
+	i.Settings, i.clients, i.clientsSettings = i.clientsSettings, nil, ""
+	return syncClients(tx, i.Id, records)
+}
+
 type Setting struct {
 	Id    int    `json:"id" form:"id" gorm:"primaryKey;autoIncrement"`
 	Key   string `json:"key" form:"key"`
@@ -102,6 +543,121 @@ type Client struct {
 	SubID       string `json:"subId" form:"subId"`
 	Reset       int    `json:"reset" form:"reset"`
 	AutoPayment bool   `json:"autoPayment"`
+	Comment     string `json:"comment" form:"comment"`
+	CapPolicy   string `json:"capPolicy,omitempty" form:"capPolicy"`
+	// RenewDays keeps the days of Reset while the auto-renewal is turned off
+	// by the customer.
+	RenewDays int `json:"renewDays,omitempty" form:"renewDays"`
+	// TrafficReset zeroes the traffic on calendar boundaries in the time
+	// location of the panel: "daily", "weekly" (Mondays), "monthly" (the
+	// 1st), "monthly:<day>" or a cron spec.
+	TrafficReset string `json:"trafficReset,omitempty" form:"trafficReset"`
+	// SpeedTier names the speed tier of the client, which otherwise has the
+	// speed tier of its customer.
+	SpeedTier string `json:"speedTier,omitempty" form:"speedTier"`
+}
+
+// ClientRecord is a client of an inbound in typed columns, keyed by its
+// email. The records are the source of the clients, the settings of an
+// inbound are stored without them and get them back when read.
+type ClientRecord struct {
+	Id          int    `json:"id" gorm:"primaryKey;autoIncrement"`
+	InboundId   int    `json:"inboundId" gorm:"index"`
+	Position    int    `json:"position"`
+	Email       string `json:"email" gorm:"index"`
+	UUID        string `json:"uuid" gorm:"column:uuid;index"`
+	Security    string `json:"security"`
+	Password    string `json:"password"`
+	Flow        string `json:"flow"`
+	Method      string `json:"method"`
+	LimitIP     int    `json:"limitIp"`
+	TotalGB     int64  `json:"totalGB"`
+	ExpiryTime  int64  `json:"expiryTime"`
+	Enable      bool   `json:"enable"`
+	TgID        int64  `json:"tgId" gorm:"index"`
+	SubID       string `json:"subId" gorm:"index"`
+	Reset       int    `json:"reset"`
+	AutoPayment bool   `json:"autoPayment"`
+	Comment     string `json:"comment"`
+	CapPolicy   string `json:"capPolicy"`
+	RenewDays   int    `json:"renewDays"`
+	// TrafficReset is the traffic reset schedule, see Client.TrafficReset.
+	TrafficReset string `json:"trafficReset"`
+	SpeedTier    string `json:"speedTier"`
+	// Level is the xray policy level of the user, set while building the
+	// xray config.
+	Level int `json:"-" gorm:"-"`
+}
+
+func (ClientRecord) TableName() string {
+	return "clients"
+}
+
+func NewClientRecord(inboundId int, position int, client *Client, method string) ClientRecord {
+	return ClientRecord{
+		InboundId:    inboundId,
+		Position:     position,
+		Email:        client.Email,
+		UUID:         client.ID,
+		Security:     client.Security,
+		Password:     client.Password,
+		Flow:         client.Flow,
+		Method:       method,
+		LimitIP:      client.LimitIP,
+		TotalGB:      client.TotalGB,
+		ExpiryTime:   client.ExpiryTime,
+		Enable:       client.Enable,
+		TgID:         client.TgID,
+		SubID:        client.SubID,
+		Reset:        client.Reset,
+		AutoPayment:  client.AutoPayment,
+		Comment:      client.Comment,
+		CapPolicy:    client.CapPolicy,
+		RenewDays:    client.RenewDays,
+		TrafficReset: client.TrafficReset,
+		SpeedTier:    client.SpeedTier,
+	}
+}
+
+// settingsClient returns the record as an entry of the clients of the inbound
+// settings.
+func (r *ClientRecord) settingsClient() map[string]interface{} {
+	client := map[string]interface{}{}
+	data, err := json.Marshal(r.Client())
+	if err != nil {
+		return client
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	decoder.Decode(&client)
+	if r.Method != "" {
+		client["method"] = r.Method
+	}
+	return client
+}
+
+// Client returns the record as the client of the inbound settings.
+func (r *ClientRecord) Client() *Client {
+	return &Client{
+		ID:           r.UUID,
+		Security:     r.Security,
+		Password:     r.Password,
+		Flow:         r.Flow,
+		Email:        r.Email,
+		LimitIP:      r.LimitIP,
+		TotalGB:      r.TotalGB,
+		ExpiryTime:   r.ExpiryTime,
+		Enable:       r.Enable,
+		TgID:         r.TgID,
+		SubID:        r.SubID,
+		Reset:        r.Reset,
+		AutoPayment:  r.AutoPayment,
+		Comment:      r.Comment,
+		CapPolicy:    r.CapPolicy,
+		RenewDays:    r.RenewDays,
+		TrafficReset: r.TrafficReset,
+		SpeedTier:    r.SpeedTier,
+	}
 }
 
 type PaymentStatus string
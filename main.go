@@ -1,11 +1,13 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	_ "unsafe"
 
@@ -387,6 +389,76 @@ func updateWebhookPort(port int) {
 	}
 }
 
+func exportClients(path string, format string) {
+	err := database.InitDB(config.GetDBPath())
+	if err != nil {
+		fmt.Println("Database initialization failed:", err)
+		return
+	}
+	inboundService := service.InboundService{}
+	clients, err := inboundService.ExportClients()
+	if err != nil {
+		fmt.Println("Failed to export clients:", err)
+		return
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		fmt.Println("Failed to create file:", err)
+		return
+	}
+	defer file.Close()
+	if format == "csv" || (format == "" && strings.HasSuffix(path, ".csv")) {
+		err = service.WriteClientsCSV(file, clients)
+	} else {
+		encoder := json.NewEncoder(file)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(clients)
+	}
+	if err != nil {
+		fmt.Println("Failed to write clients:", err)
+		return
+	}
+	fmt.Printf("%d clients exported to %s\n", len(clients), path)
+}
+
+func importClients(path string, dryRun bool) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		fmt.Println("Failed to read file:", err)
+		return
+	}
+	clients, err := service.ParseClients(data)
+	if err != nil {
+		fmt.Println("Failed to parse clients:", err)
+		return
+	}
+	err = database.InitDB(config.GetDBPath())
+	if err != nil {
+		fmt.Println("Database initialization failed:", err)
+		return
+	}
+	inboundService := service.InboundService{}
+	report, _, err := inboundService.ImportClients(clients, dryRun)
+	if err != nil {
+		fmt.Println("Failed to import clients:", err)
+		return
+	}
+	for _, result := range report.Results {
+		if !result.Success {
+			fmt.Printf("%s: %s\n", result.Email, strings.TrimSpace(result.Msg))
+		}
+	}
+	if dryRun {
+		fmt.Printf("Dry run: %d clients can be imported, %d failed\n", report.Succeeded, report.Failed)
+		return
+	}
+	fmt.Printf("%d clients imported, %d failed\n", report.Succeeded, report.Failed)
+	if report.Succeeded > 0 {
+		fmt.Println("Restart x-ui to apply the new clients.")
+	}
+}
+
 func main() {
 	if len(os.Args) < 2 {
 		runWebServer()
@@ -434,6 +506,16 @@ func main() {
 	settingCmd.StringVar(&email, "email", "", "Set email for receipts")
 	settingCmd.IntVar(&webhookPort, "webhookPort", 0, "Set port for yookassa webhooks")
 
+	clientsCmd := flag.NewFlagSet("clients", flag.ExitOnError)
+	var exportPath string
+	var importPath string
+	var format string
+	var dryRun bool
+	clientsCmd.StringVar(&exportPath, "export", "", "Export all clients to a file")
+	clientsCmd.StringVar(&importPath, "import", "", "Import clients from a CSV or JSON file")
+	clientsCmd.StringVar(&format, "format", "", "Export format: csv or json (default by file extension)")
+	clientsCmd.BoolVar(&dryRun, "dryRun", false, "Check the import without changing anything")
+
 	oldUsage := flag.Usage
 	flag.Usage = func() {
 		oldUsage()
@@ -442,6 +524,7 @@ func main() {
 		fmt.Println("    run            run web panel")
 		fmt.Println("    migrate        migrate form other/old x-ui")
 		fmt.Println("    setting        set settings")
+		fmt.Println("    clients        import and export clients")
 	}
 
 	flag.Parse()
@@ -492,6 +575,19 @@ func main() {
 		if webhookPort != 0 {
 			updateWebhookPort(webhookPort)
 		}
+	case "clients":
+		err := clientsCmd.Parse(os.Args[2:])
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		if exportPath != "" {
+			exportClients(exportPath, format)
+		} else if importPath != "" {
+			importClients(importPath, dryRun)
+		} else {
+			clientsCmd.Usage()
+		}
 	case "cert":
 		err := settingCmd.Parse(os.Args[2:])
 		if err != nil {
@@ -510,5 +606,7 @@ func main() {
 		runCmd.Usage()
 		fmt.Println()
 		settingCmd.Usage()
+		fmt.Println()
+		clientsCmd.Usage()
 	}
 }
@@ -88,7 +88,7 @@ func (s *SubJsonService) GetJson(subId string, host string) (string, string, err
 			continue
 		}
 		if len(inbound.Listen) > 0 && inbound.Listen[0] == '@' {
-			listen, port, streamSettings, err := s.SubService.getFallbackMaster(inbound.Listen, inbound.StreamSettings)
+			listen, port, streamSettings, err := s.SubService.links.GetFallbackMaster(inbound.Listen, inbound.StreamSettings)
 			if err == nil {
 				inbound.Listen = listen
 				inbound.Port = port
@@ -196,7 +196,7 @@ func (s *SubJsonService) getConfig(inbound *model.Inbound, client model.Client,
 			newConfigJson[key] = value
 		}
 		newConfigJson["outbounds"] = newOutbounds
-		newConfigJson["remarks"] = s.SubService.genRemark(inbound, client.Email, extPrxy["remark"].(string))
+		newConfigJson["remarks"] = s.SubService.links.GenRemark(inbound, client.Email, extPrxy["remark"].(string))
 
 		newConfig, _ := json.MarshalIndent(newConfigJson, "", "  ")
 		newJsonArray = append(newJsonArray, newConfig)
@@ -3,6 +3,7 @@ package random
 import (
 	"crypto/rand"
 	"fmt"
+	"math/big"
 	mathRand "math/rand"
 	"strings"
 )
@@ -18,6 +19,10 @@ var (
 
 var seq = strings.Split("0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ", "")
 
+func init() {
+	Init()
+}
+
 func Init() {
 	for i := 0; i < 10; i++ {
 		numSeq[i] = rune('0' + i)
@@ -38,10 +43,17 @@ func Init() {
 	copy(allSeq[len(numSeq)+len(lowerSeq):], upperSeq[:])
 }
 
+// Seq returns n random letters and digits. They are drawn from crypto/rand
+// since Seq makes passwords, subscription ids and secrets.
 func Seq(n int) string {
+	size := big.NewInt(int64(len(allSeq)))
 	runes := make([]rune, n)
 	for i := 0; i < n; i++ {
-		runes[i] = allSeq[mathRand.Intn(len(allSeq))]
+		k, err := rand.Int(rand.Reader, size)
+		if err != nil {
+			panic(err)
+		}
+		runes[i] = allSeq[k.Int64()]
 	}
 	return string(runes)
 }
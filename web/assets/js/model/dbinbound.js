@@ -9,6 +9,8 @@ class DBInbound {
         this.remark = "";
         this.enable = true;
         this.expiryTime = 0;
+        this.trafficReset = "";
+        this.version = 0;
 
         this.listen = "";
         this.port = 0;
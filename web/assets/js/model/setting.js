@@ -11,17 +11,35 @@ class AllSetting {
         this.pageSize = 50;
         this.expireDiff = 0;
         this.trafficDiff = 0;
+        this.trafficHourlyDays = 7;
+        this.trafficDailyDays = 365;
+        this.recycleBinDays = 30;
+        this.capPolicy = "disable";
+        this.throttleOutbound = "";
+        this.throttleLevel = 0;
+        this.speedTiers = "";
         this.remarkModel = "-ieo";
         this.datepicker = "gregorian";
         this.tgBotEnable = false;
         this.tgBotToken = "";
         this.tgBotProxy = "";
         this.tgBotChatId = "";
+        this.tgBotRoles = "";
         this.tgRunTime = "@daily";
         this.tgBotBackup = false;
         this.tgBotLoginNotify = true;
         this.tgCpu = 80;
         this.tgLang = "en-US";
+        this.tgLinkTokenTTL = 24;
+        this.tgCallbackTTL = 72;
+        this.tgExpiryReminders = "7,3,1,0";
+        this.tgReports = "";
+        this.tgNotifyDisabled = true;
+        this.tgNotifyRenewed = true;
+        this.tgNotifyDeleted = true;
+        this.tgNotifyPayment = true;
+        this.tgRateLimit = 20;
+        this.tgAutoBanTime = 60;
         this.xrayTemplateConfig = "";
         this.secretEnable = false;
         this.subEnable = false;
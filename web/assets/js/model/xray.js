@@ -2036,7 +2036,11 @@ Inbound.VmessSettings.VMESS = class extends XrayCommonClass {
         enable = true,
         tgId = '',
         subId = RandomUtil.randomLowerAndNum(16),
-        reset = 0
+        reset = 0,
+        capPolicy = '',
+        trafficReset = '',
+        speedTier = '',
+        renewDays = 0
     ) {
         super();
         this.id = id;
@@ -2049,6 +2053,10 @@ Inbound.VmessSettings.VMESS = class extends XrayCommonClass {
         this.tgId = tgId;
         this.subId = subId;
         this.reset = reset;
+        this.capPolicy = capPolicy;
+        this.trafficReset = trafficReset;
+        this.speedTier = speedTier;
+        this.renewDays = renewDays;
     }
 
     static fromJson(json = {}) {
@@ -2063,6 +2071,10 @@ Inbound.VmessSettings.VMESS = class extends XrayCommonClass {
             json.tgId,
             json.subId,
             json.reset,
+            json.capPolicy,
+            json.trafficReset,
+            json.speedTier,
+            json.renewDays,
         );
     }
     get _expiryTime() {
@@ -2142,7 +2154,11 @@ Inbound.VLESSSettings.VLESS = class extends XrayCommonClass {
         enable = true,
         tgId = '',
         subId = RandomUtil.randomLowerAndNum(16),
-        reset = 0
+        reset = 0,
+        capPolicy = '',
+        trafficReset = '',
+        speedTier = '',
+        renewDays = 0
     ) {
         super();
         this.id = id;
@@ -2155,6 +2171,10 @@ Inbound.VLESSSettings.VLESS = class extends XrayCommonClass {
         this.tgId = tgId;
         this.subId = subId;
         this.reset = reset;
+        this.capPolicy = capPolicy;
+        this.trafficReset = trafficReset;
+        this.speedTier = speedTier;
+        this.renewDays = renewDays;
     }
 
     static fromJson(json = {}) {
@@ -2169,6 +2189,10 @@ Inbound.VLESSSettings.VLESS = class extends XrayCommonClass {
             json.tgId,
             json.subId,
             json.reset,
+            json.capPolicy,
+            json.trafficReset,
+            json.speedTier,
+            json.renewDays,
         );
     }
 
@@ -2279,7 +2303,11 @@ Inbound.TrojanSettings.Trojan = class extends XrayCommonClass {
         enable = true,
         tgId = '',
         subId = RandomUtil.randomLowerAndNum(16),
-        reset = 0
+        reset = 0,
+        capPolicy = '',
+        trafficReset = '',
+        speedTier = '',
+        renewDays = 0
     ) {
         super();
         this.password = password;
@@ -2292,6 +2320,10 @@ Inbound.TrojanSettings.Trojan = class extends XrayCommonClass {
         this.tgId = tgId;
         this.subId = subId;
         this.reset = reset;
+        this.capPolicy = capPolicy;
+        this.trafficReset = trafficReset;
+        this.speedTier = speedTier;
+        this.renewDays = renewDays;
     }
 
     toJson() {
@@ -2306,6 +2338,10 @@ Inbound.TrojanSettings.Trojan = class extends XrayCommonClass {
             tgId: this.tgId,
             subId: this.subId,
             reset: this.reset,
+            capPolicy: this.capPolicy,
+            trafficReset: this.trafficReset,
+            speedTier: this.speedTier,
+            renewDays: this.renewDays,
         };
     }
 
@@ -2321,6 +2357,10 @@ Inbound.TrojanSettings.Trojan = class extends XrayCommonClass {
             json.tgId,
             json.subId,
             json.reset,
+            json.capPolicy,
+            json.trafficReset,
+            json.speedTier,
+            json.renewDays,
         );
     }
 
@@ -2435,7 +2475,11 @@ Inbound.ShadowsocksSettings.Shadowsocks = class extends XrayCommonClass {
         enable = true,
         tgId = '',
         subId = RandomUtil.randomLowerAndNum(16),
-        reset = 0
+        reset = 0,
+        capPolicy = '',
+        trafficReset = '',
+        speedTier = '',
+        renewDays = 0
     ) {
         super();
         this.method = method;
@@ -2448,6 +2492,10 @@ Inbound.ShadowsocksSettings.Shadowsocks = class extends XrayCommonClass {
         this.tgId = tgId;
         this.subId = subId;
         this.reset = reset;
+        this.capPolicy = capPolicy;
+        this.trafficReset = trafficReset;
+        this.speedTier = speedTier;
+        this.renewDays = renewDays;
     }
 
     toJson() {
@@ -2462,6 +2510,10 @@ Inbound.ShadowsocksSettings.Shadowsocks = class extends XrayCommonClass {
             tgId: this.tgId,
             subId: this.subId,
             reset: this.reset,
+            capPolicy: this.capPolicy,
+            trafficReset: this.trafficReset,
+            speedTier: this.speedTier,
+            renewDays: this.renewDays,
         };
     }
 
@@ -2477,6 +2529,10 @@ Inbound.ShadowsocksSettings.Shadowsocks = class extends XrayCommonClass {
             json.tgId,
             json.subId,
             json.reset,
+            json.capPolicy,
+            json.trafficReset,
+            json.speedTier,
+            json.renewDays,
         );
     }
 
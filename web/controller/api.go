@@ -39,14 +39,42 @@ func (a *APIController) initRouter(g *gin.RouterGroup) {
 		{"POST", "/update/:id", a.inboundController.updateInbound},
 		{"POST", "/clientIps/:email", a.inboundController.getClientIps},
 		{"POST", "/clearClientIps/:email", a.inboundController.clearClientIps},
+		{"POST", "/clientLink/:email", a.inboundController.getClientLink},
 		{"POST", "/addClient", a.inboundController.addInboundClient},
 		{"POST", "/:id/delClient/:clientId", a.inboundController.delInboundClient},
 		{"POST", "/updateClient/:clientId", a.inboundController.updateInboundClient},
 		{"POST", "/:id/resetClientTraffic/:email", a.inboundController.resetClientTraffic},
+		{"POST", "/clientCapPolicy/:email", a.inboundController.setClientCapPolicy},
+		{"POST", "/clientTrafficReset/:email", a.inboundController.setClientTrafficReset},
+		{"POST", "/clientSpeedTier/:email", a.inboundController.setClientSpeedTier},
+		{"GET", "/speedTiers", a.inboundController.getSpeedTiers},
 		{"POST", "/resetAllTraffics", a.inboundController.resetAllTraffics},
 		{"POST", "/resetAllClientTraffics/:id", a.inboundController.resetAllClientTraffics},
 		{"POST", "/delDepletedClients/:id", a.inboundController.delDepletedClients},
 		{"POST", "/onlines", a.inboundController.onlines},
+		{"GET", "/supportTickets", a.inboundController.getSupportTickets},
+		{"GET", "/supportTicket/:id", a.inboundController.getSupportTicket},
+		{"GET", "/auditLogs", a.inboundController.getAuditLogs},
+		{"GET", "/ranking", a.inboundController.getClientTrafficRanking},
+		{"GET", "/trafficSeries", a.inboundController.getTrafficSeries},
+		{"GET", "/trafficResets", a.inboundController.getTrafficResetLogs},
+		{"GET", "/recycleBin", a.inboundController.getRecycledItems},
+		{"POST", "/recycleBin/restore/:id", a.inboundController.restoreRecycledItem},
+		{"POST", "/recycleBin/del/:id", a.inboundController.delRecycledItem},
+		{"GET", "/customers", a.inboundController.getCustomers},
+		{"GET", "/customer/:id", a.inboundController.getCustomer},
+		{"POST", "/addCustomer", a.inboundController.addCustomer},
+		{"POST", "/updateCustomer/:id", a.inboundController.updateCustomer},
+		{"POST", "/delCustomer/:id", a.inboundController.delCustomer},
+		{"POST", "/customer/:id/addClients", a.inboundController.addCustomerClients},
+		{"POST", "/customer/:id/delClient/:email", a.inboundController.delCustomerClient},
+		{"POST", "/customer/:id/resetTraffic", a.inboundController.resetCustomerTraffic},
+		{"POST", "/bulk/addClients", a.inboundController.bulkAddClients},
+		{"POST", "/bulk/updateClients", a.inboundController.bulkUpdateClients},
+		{"POST", "/bulk/moveClients", a.inboundController.bulkMoveClients},
+		{"POST", "/bulk/delClients", a.inboundController.bulkDelClients},
+		{"GET", "/exportClients", a.inboundController.exportClients},
+		{"POST", "/importClients", a.inboundController.importClients},
 	}
 
 	for _, route := range inboundRoutes {
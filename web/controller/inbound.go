@@ -1,9 +1,14 @@
 package controller
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
 	"strconv"
+	"time"
 
 	"x-ui/database/model"
 	"x-ui/web/service"
@@ -13,8 +18,13 @@ import (
 )
 
 type InboundController struct {
-	inboundService service.InboundService
-	xrayService    service.XrayService
+	inboundService  service.InboundService
+	xrayService     service.XrayService
+	tgbotService    service.Tgbot
+	supportService  service.SupportService
+	auditService    service.AuditService
+	customerService service.CustomerService
+	settingService  service.SettingService
 }
 
 func NewInboundController(g *gin.RouterGroup) *InboundController {
@@ -32,15 +42,43 @@ func (a *InboundController) initRouter(g *gin.RouterGroup) {
 	g.POST("/update/:id", a.updateInbound)
 	g.POST("/clientIps/:email", a.getClientIps)
 	g.POST("/clearClientIps/:email", a.clearClientIps)
+	g.POST("/clientLink/:email", a.getClientLink)
 	g.POST("/addClient", a.addInboundClient)
 	g.POST("/:id/delClient/:clientId", a.delInboundClient)
 	g.POST("/updateClient/:clientId", a.updateInboundClient)
 	g.POST("/:id/resetClientTraffic/:email", a.resetClientTraffic)
+	g.POST("/clientCapPolicy/:email", a.setClientCapPolicy)
+	g.POST("/clientTrafficReset/:email", a.setClientTrafficReset)
+	g.POST("/clientSpeedTier/:email", a.setClientSpeedTier)
+	g.POST("/speedTiers", a.getSpeedTiers)
 	g.POST("/resetAllTraffics", a.resetAllTraffics)
 	g.POST("/resetAllClientTraffics/:id", a.resetAllClientTraffics)
 	g.POST("/delDepletedClients/:id", a.delDepletedClients)
 	g.POST("/import", a.importInbound)
 	g.POST("/onlines", a.onlines)
+	g.POST("/supportTickets", a.getSupportTickets)
+	g.POST("/supportTicket/:id", a.getSupportTicket)
+	g.POST("/auditLogs", a.getAuditLogs)
+	g.POST("/ranking", a.getClientTrafficRanking)
+	g.POST("/trafficSeries", a.getTrafficSeries)
+	g.POST("/trafficResets", a.getTrafficResetLogs)
+	g.POST("/recycleBin", a.getRecycledItems)
+	g.POST("/recycleBin/restore/:id", a.restoreRecycledItem)
+	g.POST("/recycleBin/del/:id", a.delRecycledItem)
+	g.POST("/customers", a.getCustomers)
+	g.POST("/customer/:id", a.getCustomer)
+	g.POST("/addCustomer", a.addCustomer)
+	g.POST("/updateCustomer/:id", a.updateCustomer)
+	g.POST("/delCustomer/:id", a.delCustomer)
+	g.POST("/customer/:id/addClients", a.addCustomerClients)
+	g.POST("/customer/:id/delClient/:email", a.delCustomerClient)
+	g.POST("/customer/:id/resetTraffic", a.resetCustomerTraffic)
+	g.POST("/bulk/addClients", a.bulkAddClients)
+	g.POST("/bulk/updateClients", a.bulkUpdateClients)
+	g.POST("/bulk/moveClients", a.bulkMoveClients)
+	g.POST("/bulk/delClients", a.bulkDelClients)
+	g.POST("/exportClients", a.exportClients)
+	g.POST("/importClients", a.importClients)
 }
 
 func (a *InboundController) getInbounds(c *gin.Context) {
@@ -103,7 +141,7 @@ func (a *InboundController) addInbound(c *gin.Context) {
 	}
 
 	needRestart := false
-	inbound, needRestart, err = a.inboundService.AddInbound(inbound)
+	inbound, needRestart, err = a.inboundService.As(getAuditActor(c)).AddInbound(inbound)
 	jsonMsgObj(c, I18nWeb(c, "pages.inbounds.create"), inbound, err)
 	if err == nil && needRestart {
 		a.xrayService.SetToNeedRestart()
@@ -117,7 +155,7 @@ func (a *InboundController) delInbound(c *gin.Context) {
 		return
 	}
 	needRestart := true
-	needRestart, err = a.inboundService.DelInbound(id)
+	needRestart, err = a.inboundService.As(getAuditActor(c)).DelInbound(id)
 	jsonMsgObj(c, I18nWeb(c, "delete"), id, err)
 	if err == nil && needRestart {
 		a.xrayService.SetToNeedRestart()
@@ -139,7 +177,7 @@ func (a *InboundController) updateInbound(c *gin.Context) {
 		return
 	}
 	needRestart := true
-	inbound, needRestart, err = a.inboundService.UpdateInbound(inbound)
+	inbound, needRestart, err = a.inboundService.As(getAuditActor(c)).UpdateInbound(inbound)
 	jsonMsgObj(c, I18nWeb(c, "pages.inbounds.update"), inbound, err)
 	if err == nil && needRestart {
 		a.xrayService.SetToNeedRestart()
@@ -161,7 +199,7 @@ func (a *InboundController) getClientIps(c *gin.Context) {
 func (a *InboundController) clearClientIps(c *gin.Context) {
 	email := c.Param("email")
 
-	err := a.inboundService.ClearClientIps(email)
+	err := a.inboundService.As(getAuditActor(c)).ClearClientIps(email)
 	if err != nil {
 		jsonMsg(c, "Update", err)
 		return
@@ -169,6 +207,180 @@ func (a *InboundController) clearClientIps(c *gin.Context) {
 	jsonMsg(c, "Log Cleared", nil)
 }
 
+func (a *InboundController) getClientLink(c *gin.Context) {
+	email := c.Param("email")
+
+	link, err := a.tgbotService.GetClientLinkURL(email)
+	if err != nil {
+		jsonMsg(c, "Something went wrong!", err)
+		return
+	}
+	jsonObj(c, link, nil)
+}
+
+func (a *InboundController) getSupportTickets(c *gin.Context) {
+	tickets, err := a.supportService.GetTickets(c.Query("status"))
+	if err != nil {
+		jsonMsg(c, "Something went wrong!", err)
+		return
+	}
+	jsonObj(c, tickets, nil)
+}
+
+func (a *InboundController) getSupportTicket(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, "Something went wrong!", err)
+		return
+	}
+	ticket, err := a.supportService.GetTicket(id)
+	if err != nil {
+		jsonMsg(c, "Something went wrong!", err)
+		return
+	}
+	jsonObj(c, ticket, nil)
+}
+
+// getAuditLogs lists audit entries filtered by the optional targetType,
+// target, actor and limit query parameters.
+func (a *InboundController) getAuditLogs(c *gin.Context) {
+	limit := 100
+	if value := c.Query("limit"); value != "" {
+		var err error
+		limit, err = strconv.Atoi(value)
+		if err != nil {
+			jsonMsg(c, "Something went wrong!", err)
+			return
+		}
+	}
+	logs, err := a.auditService.GetLogs(c.Query("targetType"), c.Query("target"), c.Query("actor"), limit)
+	if err != nil {
+		jsonMsg(c, "Something went wrong!", err)
+		return
+	}
+	jsonObj(c, logs, nil)
+}
+
+// getClientTrafficRanking lists the clients with the most traffic in the
+// period given by the query: today (default), week, month or all.
+func (a *InboundController) getClientTrafficRanking(c *gin.Context) {
+	period := c.DefaultQuery("period", service.RankingToday)
+	switch period {
+	case service.RankingToday, service.RankingWeek, service.RankingMonth, service.RankingAll:
+	default:
+		jsonMsg(c, "Something went wrong!", fmt.Errorf("unknown period: %s", period))
+		return
+	}
+	limit := 10
+	if value := c.Query("limit"); value != "" {
+		var err error
+		limit, err = strconv.Atoi(value)
+		if err != nil {
+			jsonMsg(c, "Something went wrong!", err)
+			return
+		}
+	}
+	ranks, err := a.inboundService.GetClientTrafficRanking(period, limit)
+	if err != nil {
+		jsonMsg(c, "Something went wrong!", err)
+		return
+	}
+	jsonObj(c, ranks, nil)
+}
+
+// getTrafficSeries returns the hourly or daily traffic of a client, inbound
+// or outbound (kind) by email or tag (name) for the buckets starting from
+// the unix seconds from up to to, by default the last 24 hours.
+func (a *InboundController) getTrafficSeries(c *gin.Context) {
+	kind := c.DefaultQuery("kind", service.RollupClient)
+	switch kind {
+	case service.RollupClient, service.RollupInbound, service.RollupOutbound:
+	default:
+		jsonMsg(c, "Something went wrong!", fmt.Errorf("unknown kind: %s", kind))
+		return
+	}
+	period := c.DefaultQuery("period", service.RollupHour)
+	if period != service.RollupHour && period != service.RollupDay {
+		jsonMsg(c, "Something went wrong!", fmt.Errorf("unknown period: %s", period))
+		return
+	}
+	to := time.Now().Unix()
+	from := to - 24*60*60
+	var err error
+	if value := c.Query("from"); value != "" {
+		from, err = strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			jsonMsg(c, "Something went wrong!", err)
+			return
+		}
+	}
+	if value := c.Query("to"); value != "" {
+		to, err = strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			jsonMsg(c, "Something went wrong!", err)
+			return
+		}
+	}
+	points, err := a.inboundService.GetTrafficSeries(kind, c.Query("name"), period, from, to)
+	if err != nil {
+		jsonMsg(c, "Something went wrong!", err)
+		return
+	}
+	jsonObj(c, points, nil)
+}
+
+func (a *InboundController) getTrafficResetLogs(c *gin.Context) {
+	kind := c.Query("kind")
+	if kind != "" && kind != service.RollupClient && kind != service.RollupInbound {
+		jsonMsg(c, "Something went wrong!", fmt.Errorf("unknown kind: %s", kind))
+		return
+	}
+	limit, _ := strconv.Atoi(c.Query("limit"))
+	logs, err := a.inboundService.GetTrafficResetLogs(kind, c.Query("name"), limit)
+	if err != nil {
+		jsonMsg(c, "Something went wrong!", err)
+		return
+	}
+	jsonObj(c, logs, nil)
+}
+
+func (a *InboundController) getRecycledItems(c *gin.Context) {
+	kind := c.Query("kind")
+	if kind != "" && kind != service.RollupClient && kind != service.RollupInbound {
+		jsonMsg(c, "Something went wrong!", fmt.Errorf("unknown kind: %s", kind))
+		return
+	}
+	items, err := a.inboundService.GetRecycledItems(kind)
+	if err != nil {
+		jsonMsg(c, "Something went wrong!", err)
+		return
+	}
+	jsonObj(c, items, nil)
+}
+
+func (a *InboundController) restoreRecycledItem(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.restore"), err)
+		return
+	}
+	needRestart, err := a.inboundService.As(getAuditActor(c)).RestoreRecycledItem(id)
+	jsonMsgObj(c, I18nWeb(c, "pages.inbounds.restore"), id, err)
+	if err == nil && needRestart {
+		a.xrayService.SetToNeedRestart()
+	}
+}
+
+func (a *InboundController) delRecycledItem(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "delete"), err)
+		return
+	}
+	err = a.inboundService.As(getAuditActor(c)).DelRecycledItem(id)
+	jsonMsgObj(c, I18nWeb(c, "delete"), id, err)
+}
+
 func (a *InboundController) addInboundClient(c *gin.Context) {
 	data := &model.Inbound{}
 	err := c.ShouldBind(data)
@@ -179,7 +391,7 @@ func (a *InboundController) addInboundClient(c *gin.Context) {
 
 	needRestart := true
 
-	needRestart, err = a.inboundService.AddInboundClient(data)
+	needRestart, err = a.inboundService.As(getAuditActor(c)).AddInboundClient(data)
 	if err != nil {
 		jsonMsg(c, "Something went wrong!", err)
 		return
@@ -200,7 +412,7 @@ func (a *InboundController) delInboundClient(c *gin.Context) {
 
 	needRestart := true
 
-	needRestart, err = a.inboundService.DelInboundClient(id, clientId)
+	needRestart, err = a.inboundService.As(getAuditActor(c)).DelInboundClient(id, clientId)
 	if err != nil {
 		jsonMsg(c, "Something went wrong!", err)
 		return
@@ -223,7 +435,7 @@ func (a *InboundController) updateInboundClient(c *gin.Context) {
 
 	needRestart := true
 
-	needRestart, err = a.inboundService.UpdateInboundClient(inbound, clientId)
+	needRestart, err = a.inboundService.As(getAuditActor(c)).UpdateInboundClient(inbound, clientId)
 	if err != nil {
 		jsonMsg(c, "Something went wrong!", err)
 		return
@@ -242,7 +454,7 @@ func (a *InboundController) resetClientTraffic(c *gin.Context) {
 	}
 	email := c.Param("email")
 
-	needRestart, err := a.inboundService.ResetClientTraffic(id, email)
+	needRestart, err := a.inboundService.As(getAuditActor(c)).ResetClientTraffic(id, email)
 	if err != nil {
 		jsonMsg(c, "Something went wrong!", err)
 		return
@@ -253,8 +465,62 @@ func (a *InboundController) resetClientTraffic(c *gin.Context) {
 	}
 }
 
+func (a *InboundController) setClientCapPolicy(c *gin.Context) {
+	email := c.Param("email")
+	capPolicy := c.PostForm("capPolicy")
+
+	needRestart, err := a.inboundService.As(getAuditActor(c)).SetClientCapPolicyByEmail(email, capPolicy)
+	if err != nil {
+		jsonMsg(c, "Something went wrong!", err)
+		return
+	}
+	jsonMsg(c, "Client cap policy has been updated", nil)
+	if needRestart {
+		a.xrayService.SetToNeedRestart()
+	}
+}
+
+func (a *InboundController) setClientTrafficReset(c *gin.Context) {
+	email := c.Param("email")
+	schedule := c.PostForm("trafficReset")
+
+	needRestart, err := a.inboundService.As(getAuditActor(c)).SetClientTrafficResetByEmail(email, schedule)
+	if err != nil {
+		jsonMsg(c, "Something went wrong!", err)
+		return
+	}
+	jsonMsg(c, "Client traffic reset schedule has been updated", nil)
+	if needRestart {
+		a.xrayService.SetToNeedRestart()
+	}
+}
+
+func (a *InboundController) setClientSpeedTier(c *gin.Context) {
+	email := c.Param("email")
+	speedTier := c.PostForm("speedTier")
+
+	needRestart, err := a.inboundService.As(getAuditActor(c)).SetClientSpeedTierByEmail(email, speedTier)
+	if err != nil {
+		jsonMsg(c, "Something went wrong!", err)
+		return
+	}
+	jsonMsg(c, "Client speed tier has been updated", nil)
+	if needRestart {
+		a.xrayService.SetToNeedRestart()
+	}
+}
+
+func (a *InboundController) getSpeedTiers(c *gin.Context) {
+	tiers, err := a.settingService.GetSpeedTiers()
+	if err != nil {
+		jsonMsg(c, "Something went wrong!", err)
+		return
+	}
+	jsonObj(c, tiers, nil)
+}
+
 func (a *InboundController) resetAllTraffics(c *gin.Context) {
-	err := a.inboundService.ResetAllTraffics()
+	err := a.inboundService.As(getAuditActor(c)).ResetAllTraffics()
 	if err != nil {
 		jsonMsg(c, "Something went wrong!", err)
 		return
@@ -271,7 +537,7 @@ func (a *InboundController) resetAllClientTraffics(c *gin.Context) {
 		return
 	}
 
-	err = a.inboundService.ResetAllClientTraffics(id)
+	err = a.inboundService.As(getAuditActor(c)).ResetAllClientTraffics(id)
 	if err != nil {
 		jsonMsg(c, "Something went wrong!", err)
 		return
@@ -303,7 +569,7 @@ func (a *InboundController) importInbound(c *gin.Context) {
 	}
 
 	needRestart := false
-	inbound, needRestart, err = a.inboundService.AddInbound(inbound)
+	inbound, needRestart, err = a.inboundService.As(getAuditActor(c)).AddInbound(inbound)
 	jsonMsgObj(c, I18nWeb(c, "pages.inbounds.create"), inbound, err)
 	if err == nil && needRestart {
 		a.xrayService.SetToNeedRestart()
@@ -316,7 +582,7 @@ func (a *InboundController) delDepletedClients(c *gin.Context) {
 		jsonMsg(c, I18nWeb(c, "pages.inbounds.update"), err)
 		return
 	}
-	err = a.inboundService.DelDepletedClients(id)
+	err = a.inboundService.As(getAuditActor(c)).DelDepletedClients(id)
 	if err != nil {
 		jsonMsg(c, "Something went wrong!", err)
 		return
@@ -327,3 +593,238 @@ func (a *InboundController) delDepletedClients(c *gin.Context) {
 func (a *InboundController) onlines(c *gin.Context) {
 	jsonObj(c, a.inboundService.GetOnlineClients(), nil)
 }
+
+// getCustomers lists all customers, or the ones matching the optional query
+// parameter q.
+func (a *InboundController) getCustomers(c *gin.Context) {
+	var customers []*model.Customer
+	var err error
+	if query := c.Query("q"); query != "" {
+		customers, err = a.customerService.SearchCustomers(query, 100)
+	} else {
+		customers, err = a.customerService.GetCustomers()
+	}
+	if err != nil {
+		jsonMsg(c, "Something went wrong!", err)
+		return
+	}
+	jsonObj(c, customers, nil)
+}
+
+func (a *InboundController) getCustomer(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, "Something went wrong!", err)
+		return
+	}
+	customer, err := a.customerService.GetCustomer(id)
+	if err != nil {
+		jsonMsg(c, "Something went wrong!", err)
+		return
+	}
+	jsonObj(c, customer, nil)
+}
+
+func (a *InboundController) addCustomer(c *gin.Context) {
+	customer := &model.Customer{}
+	err := c.ShouldBind(customer)
+	if err != nil {
+		jsonMsg(c, "Something went wrong!", err)
+		return
+	}
+	err = a.customerService.As(getAuditActor(c)).AddCustomer(customer)
+	jsonMsgObj(c, "Add customer", customer, err)
+}
+
+func (a *InboundController) updateCustomer(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, "Something went wrong!", err)
+		return
+	}
+	customer := &model.Customer{}
+	err = c.ShouldBind(customer)
+	if err != nil {
+		jsonMsg(c, "Something went wrong!", err)
+		return
+	}
+	customer.Id = id
+	needRestart, err := a.customerService.As(getAuditActor(c)).UpdateCustomer(customer)
+	jsonMsgObj(c, "Update customer", customer, err)
+	if needRestart {
+		a.xrayService.SetToNeedRestart()
+	}
+}
+
+func (a *InboundController) delCustomer(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, "Something went wrong!", err)
+		return
+	}
+	needRestart, err := a.customerService.As(getAuditActor(c)).DelCustomer(id)
+	jsonMsgObj(c, "Delete customer", id, err)
+	if needRestart {
+		a.xrayService.SetToNeedRestart()
+	}
+}
+
+// addCustomerClients assigns the clients listed in emails to the customer.
+func (a *InboundController) addCustomerClients(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, "Something went wrong!", err)
+		return
+	}
+	data := &struct {
+		Emails []string `json:"emails" form:"emails"`
+	}{}
+	err = c.ShouldBind(data)
+	if err != nil {
+		jsonMsg(c, "Something went wrong!", err)
+		return
+	}
+	needRestart, err := a.customerService.As(getAuditActor(c)).AddCustomerClients(id, data.Emails)
+	jsonMsg(c, "Add clients to customer", err)
+	if needRestart {
+		a.xrayService.SetToNeedRestart()
+	}
+}
+
+func (a *InboundController) delCustomerClient(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, "Something went wrong!", err)
+		return
+	}
+	needRestart, err := a.customerService.As(getAuditActor(c)).DelCustomerClient(id, c.Param("email"))
+	jsonMsg(c, "Remove client from customer", err)
+	if needRestart {
+		a.xrayService.SetToNeedRestart()
+	}
+}
+
+func (a *InboundController) resetCustomerTraffic(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, "Something went wrong!", err)
+		return
+	}
+	needRestart, err := a.customerService.As(getAuditActor(c)).ResetCustomerTraffic(id)
+	if err != nil {
+		jsonMsg(c, "Something went wrong!", err)
+		return
+	}
+	jsonMsg(c, "Traffic has been reset", nil)
+	if needRestart {
+		a.xrayService.SetToNeedRestart()
+	}
+}
+
+// bulkAddClients creates the clients of a template and reports the result of
+// each one.
+func (a *InboundController) bulkAddClients(c *gin.Context) {
+	template := &service.ClientTemplate{}
+	err := c.ShouldBind(template)
+	if err != nil {
+		jsonMsg(c, "Something went wrong!", err)
+		return
+	}
+	report, needRestart, err := a.inboundService.As(getAuditActor(c)).AddClientsFromTemplate(template)
+	a.bulkResult(c, report, needRestart, err)
+}
+
+func (a *InboundController) bulkUpdateClients(c *gin.Context) {
+	update := &service.BulkClientUpdate{}
+	err := c.ShouldBind(update)
+	if err != nil {
+		jsonMsg(c, "Something went wrong!", err)
+		return
+	}
+	report, needRestart, err := a.inboundService.As(getAuditActor(c)).UpdateClients(update)
+	a.bulkResult(c, report, needRestart, err)
+}
+
+func (a *InboundController) bulkMoveClients(c *gin.Context) {
+	move := &service.BulkClientMove{}
+	err := c.ShouldBind(move)
+	if err != nil {
+		jsonMsg(c, "Something went wrong!", err)
+		return
+	}
+	report, needRestart, err := a.inboundService.As(getAuditActor(c)).MoveClients(move)
+	a.bulkResult(c, report, needRestart, err)
+}
+
+func (a *InboundController) bulkDelClients(c *gin.Context) {
+	filter := &service.ClientFilter{}
+	err := c.ShouldBind(filter)
+	if err != nil {
+		jsonMsg(c, "Something went wrong!", err)
+		return
+	}
+	report, needRestart, err := a.inboundService.As(getAuditActor(c)).DelClients(filter)
+	a.bulkResult(c, report, needRestart, err)
+}
+
+func (a *InboundController) bulkResult(c *gin.Context, report *service.BulkClientReport, needRestart bool, err error) {
+	if err != nil {
+		jsonMsg(c, "Something went wrong!", err)
+		return
+	}
+	jsonObj(c, report, nil)
+	if needRestart {
+		a.xrayService.SetToNeedRestart()
+	}
+}
+
+// exportClients returns all clients with their traffic, as a CSV file when
+// the format query parameter is csv.
+func (a *InboundController) exportClients(c *gin.Context) {
+	clients, err := a.inboundService.ExportClients()
+	if err != nil {
+		jsonMsg(c, "Something went wrong!", err)
+		return
+	}
+	if c.Query("format") != "csv" {
+		jsonObj(c, clients, nil)
+		return
+	}
+	var buf bytes.Buffer
+	err = service.WriteClientsCSV(&buf, clients)
+	if err != nil {
+		jsonMsg(c, "Something went wrong!", err)
+		return
+	}
+	c.Header("Content-Disposition", "attachment; filename=clients.csv")
+	c.Data(http.StatusOK, "text/csv", buf.Bytes())
+}
+
+// importClients creates the clients of an uploaded file or of the request
+// body, in CSV or as a JSON array. With dryRun=true nothing is stored.
+func (a *InboundController) importClients(c *gin.Context) {
+	var data []byte
+	var err error
+	if file, fileErr := c.FormFile("file"); fileErr == nil {
+		var f multipart.File
+		f, err = file.Open()
+		if err == nil {
+			data, err = io.ReadAll(f)
+			f.Close()
+		}
+	} else {
+		data, err = io.ReadAll(c.Request.Body)
+	}
+	if err != nil {
+		jsonMsg(c, "Something went wrong!", err)
+		return
+	}
+	clients, err := service.ParseClients(data)
+	if err != nil {
+		jsonMsg(c, "Something went wrong!", err)
+		return
+	}
+	dryRun := c.Query("dryRun") == "true"
+	report, needRestart, err := a.inboundService.As(getAuditActor(c)).ImportClients(clients, dryRun)
+	a.bulkResult(c, report, needRestart, err)
+}
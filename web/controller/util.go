@@ -8,6 +8,8 @@ import (
 	"x-ui/config"
 	"x-ui/logger"
 	"x-ui/web/entity"
+	"x-ui/web/service"
+	"x-ui/web/session"
 
 	"github.com/gin-gonic/gin"
 )
@@ -27,6 +29,19 @@ func getRemoteIp(c *gin.Context) string {
 	return ip
 }
 
+// getAuditActor returns the logged in user as audit actor. Requests through
+// the API group are recorded as api calls.
+func getAuditActor(c *gin.Context) *service.AuditActor {
+	actor := &service.AuditActor{Channel: service.AuditChannelWeb}
+	if strings.Contains(c.FullPath(), "/panel/api/") {
+		actor.Channel = service.AuditChannelApi
+	}
+	if user := session.GetLoginUser(c); user != nil {
+		actor.Name = user.Username
+	}
+	return actor
+}
+
 func jsonMsg(c *gin.Context, msg string, err error) {
 	jsonMsgObj(c, msg, nil, err)
 }
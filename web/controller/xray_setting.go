@@ -50,7 +50,7 @@ func (a *XraySettingController) getXraySetting(c *gin.Context) {
 
 func (a *XraySettingController) updateSetting(c *gin.Context) {
 	xraySetting := c.PostForm("xraySetting")
-	err := a.XraySettingService.SaveXraySetting(xraySetting)
+	err := a.XraySettingService.As(getAuditActor(c)).SaveXraySetting(xraySetting)
 	jsonMsg(c, I18nWeb(c, "pages.settings.toasts.modifySettings"), err)
 }
 
@@ -2,11 +2,14 @@ package entity
 
 import (
 	"crypto/tls"
+	"encoding/json"
 	"net"
 	"strings"
 	"time"
 
 	"x-ui/util/common"
+
+	"github.com/robfig/cron/v3"
 )
 
 type Msg struct {
@@ -16,46 +19,64 @@ type Msg struct {
 }
 
 type AllSetting struct {
-	WebListen        string `json:"webListen" form:"webListen"`
-	WebDomain        string `json:"webDomain" form:"webDomain"`
-	WebPort          int    `json:"webPort" form:"webPort"`
-	WebCertFile      string `json:"webCertFile" form:"webCertFile"`
-	WebKeyFile       string `json:"webKeyFile" form:"webKeyFile"`
-	WebBasePath      string `json:"webBasePath" form:"webBasePath"`
-	SessionMaxAge    int    `json:"sessionMaxAge" form:"sessionMaxAge"`
-	PageSize         int    `json:"pageSize" form:"pageSize"`
-	ExpireDiff       int    `json:"expireDiff" form:"expireDiff"`
-	TrafficDiff      int    `json:"trafficDiff" form:"trafficDiff"`
-	RemarkModel      string `json:"remarkModel" form:"remarkModel"`
-	TgBotEnable      bool   `json:"tgBotEnable" form:"tgBotEnable"`
-	TgBotToken       string `json:"tgBotToken" form:"tgBotToken"`
-	TgBotProxy       string `json:"tgBotProxy" form:"tgBotProxy"`
-	TgBotChatId      string `json:"tgBotChatId" form:"tgBotChatId"`
-	TgRunTime        string `json:"tgRunTime" form:"tgRunTime"`
-	TgBotBackup      bool   `json:"tgBotBackup" form:"tgBotBackup"`
-	TgBotLoginNotify bool   `json:"tgBotLoginNotify" form:"tgBotLoginNotify"`
-	TgCpu            int    `json:"tgCpu" form:"tgCpu"`
-	TgLang           string `json:"tgLang" form:"tgLang"`
-	TimeLocation     string `json:"timeLocation" form:"timeLocation"`
-	SecretEnable     bool   `json:"secretEnable" form:"secretEnable"`
-	SubEnable        bool   `json:"subEnable" form:"subEnable"`
-	SubListen        string `json:"subListen" form:"subListen"`
-	SubPort          int    `json:"subPort" form:"subPort"`
-	SubPath          string `json:"subPath" form:"subPath"`
-	SubDomain        string `json:"subDomain" form:"subDomain"`
-	SubCertFile      string `json:"subCertFile" form:"subCertFile"`
-	SubKeyFile       string `json:"subKeyFile" form:"subKeyFile"`
-	SubUpdates       int    `json:"subUpdates" form:"subUpdates"`
-	SubEncrypt       bool   `json:"subEncrypt" form:"subEncrypt"`
-	SubShowInfo      bool   `json:"subShowInfo" form:"subShowInfo"`
-	SubURI           string `json:"subURI" form:"subURI"`
-	SubJsonPath      string `json:"subJsonPath" form:"subJsonPath"`
-	SubJsonURI       string `json:"subJsonURI" form:"subJsonURI"`
-	SubJsonFragment  string `json:"subJsonFragment" form:"subJsonFragment"`
-	SubJsonNoises    string `json:"subJsonNoises" form:"subJsonNoises"`
-	SubJsonMux       string `json:"subJsonMux" form:"subJsonMux"`
-	SubJsonRules     string `json:"subJsonRules" form:"subJsonRules"`
-	Datepicker       string `json:"datepicker" form:"datepicker"`
+	WebListen         string `json:"webListen" form:"webListen"`
+	WebDomain         string `json:"webDomain" form:"webDomain"`
+	WebPort           int    `json:"webPort" form:"webPort"`
+	WebCertFile       string `json:"webCertFile" form:"webCertFile"`
+	WebKeyFile        string `json:"webKeyFile" form:"webKeyFile"`
+	WebBasePath       string `json:"webBasePath" form:"webBasePath"`
+	SessionMaxAge     int    `json:"sessionMaxAge" form:"sessionMaxAge"`
+	PageSize          int    `json:"pageSize" form:"pageSize"`
+	ExpireDiff        int    `json:"expireDiff" form:"expireDiff"`
+	TrafficDiff       int    `json:"trafficDiff" form:"trafficDiff"`
+	TrafficHourlyDays int    `json:"trafficHourlyDays" form:"trafficHourlyDays"`
+	TrafficDailyDays  int    `json:"trafficDailyDays" form:"trafficDailyDays"`
+	RecycleBinDays    int    `json:"recycleBinDays" form:"recycleBinDays"`
+	CapPolicy         string `json:"capPolicy" form:"capPolicy"`
+	ThrottleOutbound  string `json:"throttleOutbound" form:"throttleOutbound"`
+	ThrottleLevel     int    `json:"throttleLevel" form:"throttleLevel"`
+	SpeedTiers        string `json:"speedTiers" form:"speedTiers"`
+	RemarkModel       string `json:"remarkModel" form:"remarkModel"`
+	TgBotEnable       bool   `json:"tgBotEnable" form:"tgBotEnable"`
+	TgBotToken        string `json:"tgBotToken" form:"tgBotToken"`
+	TgBotProxy        string `json:"tgBotProxy" form:"tgBotProxy"`
+	TgBotChatId       string `json:"tgBotChatId" form:"tgBotChatId"`
+	TgBotRoles        string `json:"tgBotRoles" form:"tgBotRoles"`
+	TgRunTime         string `json:"tgRunTime" form:"tgRunTime"`
+	TgBotBackup       bool   `json:"tgBotBackup" form:"tgBotBackup"`
+	TgBotLoginNotify  bool   `json:"tgBotLoginNotify" form:"tgBotLoginNotify"`
+	TgCpu             int    `json:"tgCpu" form:"tgCpu"`
+	TgLang            string `json:"tgLang" form:"tgLang"`
+	TgLinkTokenTTL    int    `json:"tgLinkTokenTTL" form:"tgLinkTokenTTL"`
+	TgCallbackTTL     int    `json:"tgCallbackTTL" form:"tgCallbackTTL"`
+	TgExpiryReminders string `json:"tgExpiryReminders" form:"tgExpiryReminders"`
+	TgReports         string `json:"tgReports" form:"tgReports"`
+	TgNotifyDisabled  bool   `json:"tgNotifyDisabled" form:"tgNotifyDisabled"`
+	TgNotifyRenewed   bool   `json:"tgNotifyRenewed" form:"tgNotifyRenewed"`
+	TgNotifyDeleted   bool   `json:"tgNotifyDeleted" form:"tgNotifyDeleted"`
+	TgNotifyPayment   bool   `json:"tgNotifyPayment" form:"tgNotifyPayment"`
+	TgRateLimit       int    `json:"tgRateLimit" form:"tgRateLimit"`
+	TgAutoBanTime     int    `json:"tgAutoBanTime" form:"tgAutoBanTime"`
+	TimeLocation      string `json:"timeLocation" form:"timeLocation"`
+	SecretEnable      bool   `json:"secretEnable" form:"secretEnable"`
+	SubEnable         bool   `json:"subEnable" form:"subEnable"`
+	SubListen         string `json:"subListen" form:"subListen"`
+	SubPort           int    `json:"subPort" form:"subPort"`
+	SubPath           string `json:"subPath" form:"subPath"`
+	SubDomain         string `json:"subDomain" form:"subDomain"`
+	SubCertFile       string `json:"subCertFile" form:"subCertFile"`
+	SubKeyFile        string `json:"subKeyFile" form:"subKeyFile"`
+	SubUpdates        int    `json:"subUpdates" form:"subUpdates"`
+	SubEncrypt        bool   `json:"subEncrypt" form:"subEncrypt"`
+	SubShowInfo       bool   `json:"subShowInfo" form:"subShowInfo"`
+	SubURI            string `json:"subURI" form:"subURI"`
+	SubJsonPath       string `json:"subJsonPath" form:"subJsonPath"`
+	SubJsonURI        string `json:"subJsonURI" form:"subJsonURI"`
+	SubJsonFragment   string `json:"subJsonFragment" form:"subJsonFragment"`
+	SubJsonNoises     string `json:"subJsonNoises" form:"subJsonNoises"`
+	SubJsonMux        string `json:"subJsonMux" form:"subJsonMux"`
+	SubJsonRules      string `json:"subJsonRules" form:"subJsonRules"`
+	Datepicker        string `json:"datepicker" form:"datepicker"`
 }
 
 func (s *AllSetting) CheckValid() error {
@@ -85,6 +106,14 @@ func (s *AllSetting) CheckValid() error {
 		return common.NewError("Sub and Web could not use same ip:port, ", s.SubListen, ":", s.SubPort, " & ", s.WebListen, ":", s.WebPort)
 	}
 
+	if s.CapPolicy != "disable" && s.CapPolicy != "throttle" {
+		return common.NewError("cap policy is not valid:", s.CapPolicy)
+	}
+
+	if s.ThrottleLevel < 0 {
+		return common.NewError("throttle level is not valid:", s.ThrottleLevel)
+	}
+
 	if s.WebCertFile != "" || s.WebKeyFile != "" {
 		_, err := tls.LoadX509KeyPair(s.WebCertFile, s.WebKeyFile)
 		if err != nil {
@@ -124,5 +153,125 @@ func (s *AllSetting) CheckValid() error {
 		return common.NewError("time location not exist:", s.TimeLocation)
 	}
 
+	_, err = ParseReports(s.TgReports)
+	if err != nil {
+		return err
+	}
+
+	_, err = ParseSpeedTiers(s.SpeedTiers)
+	if err != nil {
+		return err
+	}
+
 	return nil
 }
+
+type ReportSection string
+
+const (
+	ReportServer       ReportSection = "server"
+	ReportInbounds     ReportSection = "inbounds"
+	ReportTopConsumers ReportSection = "topConsumers"
+	ReportRevenue      ReportSection = "revenue"
+	ReportExpiring     ReportSection = "expiring"
+	ReportCustomers    ReportSection = "customers"
+	ReportBackup       ReportSection = "backup"
+)
+
+var reportSections = map[ReportSection]bool{
+	ReportServer:       true,
+	ReportInbounds:     true,
+	ReportTopConsumers: true,
+	ReportRevenue:      true,
+	ReportExpiring:     true,
+	ReportCustomers:    true,
+	ReportBackup:       true,
+}
+
+// same fields as the cron of the panel, which runs with seconds
+var reportScheduleParser = cron.NewParser(cron.Second | cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow | cron.Descriptor)
+
+// ReportDefinition is a named Telegram report sent on its own schedule.
+// Without recipients it is sent to the bot admins.
+type ReportDefinition struct {
+	Name       string          `json:"name"`
+	Schedule   string          `json:"schedule"`
+	Sections   []ReportSection `json:"sections"`
+	Recipients []int64         `json:"recipients"`
+}
+
+// ParseReports parses and validates the JSON list of report definitions.
+func ParseReports(setting string) ([]*ReportDefinition, error) {
+	if strings.TrimSpace(setting) == "" {
+		return nil, nil
+	}
+	var reports []*ReportDefinition
+	err := json.Unmarshal([]byte(setting), &reports)
+	if err != nil {
+		return nil, common.NewError("telegram reports invalid:", err)
+	}
+	names := make(map[string]bool)
+	for _, report := range reports {
+		report.Name = strings.TrimSpace(report.Name)
+		if report.Name == "" {
+			return nil, common.NewError("telegram report without name")
+		}
+		if names[report.Name] {
+			return nil, common.NewError("duplicate telegram report:", report.Name)
+		}
+		names[report.Name] = true
+		if _, err := reportScheduleParser.Parse(report.Schedule); err != nil {
+			return nil, common.NewErrorf("telegram report <%v> schedule invalid: %v", report.Name, err)
+		}
+		if len(report.Sections) == 0 {
+			return nil, common.NewErrorf("telegram report <%v> has no sections", report.Name)
+		}
+		for _, section := range report.Sections {
+			if !reportSections[section] {
+				return nil, common.NewErrorf("telegram report <%v> section <%v> unknown", report.Name, section)
+			}
+		}
+	}
+	return reports, nil
+}
+
+// SpeedTier maps the clients of the tier to an xray policy level. Policy
+// holds the settings of the level, such as connIdle or bufferSize, on top of
+// those of level 0.
+type SpeedTier struct {
+	Name   string                 `json:"name"`
+	Level  int                    `json:"level"`
+	Policy map[string]interface{} `json:"policy"`
+}
+
+// ParseSpeedTiers parses and validates the JSON list of speed tiers.
+func ParseSpeedTiers(setting string) ([]*SpeedTier, error) {
+	if strings.TrimSpace(setting) == "" {
+		return nil, nil
+	}
+	var tiers []*SpeedTier
+	err := json.Unmarshal([]byte(setting), &tiers)
+	if err != nil {
+		return nil, common.NewError("speed tiers invalid:", err)
+	}
+	names := make(map[string]bool)
+	levels := make(map[int]bool)
+	for _, tier := range tiers {
+		tier.Name = strings.TrimSpace(tier.Name)
+		if tier.Name == "" || strings.ContainsAny(tier.Name, " \t\n") {
+			return nil, common.NewErrorf("speed tier name <%v> invalid", tier.Name)
+		}
+		if names[tier.Name] {
+			return nil, common.NewError("duplicate speed tier:", tier.Name)
+		}
+		names[tier.Name] = true
+		if tier.Level < 1 {
+			return nil, common.NewErrorf("speed tier <%v> level must be >= 1", tier.Name)
+		}
+		if levels[tier.Level] {
+			return nil, common.NewErrorf("speed tier <%v> level %v is used twice", tier.Name, tier.Level)
+		}
+		levels[tier.Level] = true
+	}
+	return tiers, nil
+}
@@ -0,0 +1,93 @@
+package entity
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseSpeedTiers(t *testing.T) {
+	tests := []struct {
+		name    string
+		setting string
+		want    []*SpeedTier
+		wantErr bool
+	}{
+		{
+			name:    "empty",
+			setting: "",
+		},
+		{
+			name:    "blank",
+			setting: " \n",
+		},
+		{
+			name:    "empty list",
+			setting: "[]",
+			want:    []*SpeedTier{},
+		},
+		{
+			name:    "tiers",
+			setting: `[{"name": "basic", "level": 1}, {"name": " premium ", "level": 2, "policy": {"bufferSize": 512}}]`,
+			want: []*SpeedTier{
+				{Name: "basic", Level: 1},
+				{Name: "premium", Level: 2, Policy: map[string]interface{}{"bufferSize": float64(512)}},
+			},
+		},
+		{
+			name:    "invalid json",
+			setting: `[{"name": "basic", "level": 1}`,
+			wantErr: true,
+		},
+		{
+			name:    "not a list",
+			setting: `{"name": "basic", "level": 1}`,
+			wantErr: true,
+		},
+		{
+			name:    "level not a number",
+			setting: `[{"name": "basic", "level": "1"}]`,
+			wantErr: true,
+		},
+		{
+			name:    "missing name",
+			setting: `[{"level": 1}]`,
+			wantErr: true,
+		},
+		{
+			name:    "name with space",
+			setting: `[{"name": "extra fast", "level": 1}]`,
+			wantErr: true,
+		},
+		{
+			name:    "duplicate name",
+			setting: `[{"name": "basic", "level": 1}, {"name": "basic", "level": 2}]`,
+			wantErr: true,
+		},
+		{
+			name:    "level zero",
+			setting: `[{"name": "basic", "level": 0}]`,
+			wantErr: true,
+		},
+		{
+			name:    "missing level",
+			setting: `[{"name": "basic"}]`,
+			wantErr: true,
+		},
+		{
+			name:    "duplicate level",
+			setting: `[{"name": "basic", "level": 1}, {"name": "premium", "level": 1}]`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseSpeedTiers(tt.setting)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseSpeedTiers() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseSpeedTiers() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -6,6 +6,8 @@ import (
 	"regexp"
 	"sync"
 	"time"
+
+	"x-ui/logger"
 )
 
 type HashEntry struct {
@@ -14,16 +16,28 @@ type HashEntry struct {
 	Timestamp time.Time
 }
 
+// HashStore persists hash entries. LoadHash returns nil for an unknown hash.
+type HashStore interface {
+	SaveHash(entry HashEntry) error
+	LoadHash(hash string) (*HashEntry, error)
+	RemoveHashesBefore(t time.Time) error
+}
+
+// HashStorage keeps callback queries which are too long for Telegram's
+// callback data. Entries are cached in memory and, with a store, persisted so
+// buttons keep working after a restart until they expire.
 type HashStorage struct {
 	sync.RWMutex
 	Data       map[string]HashEntry
 	Expiration time.Duration
+	store      HashStore
 }
 
-func NewHashStorage(expiration time.Duration) *HashStorage {
+func NewHashStorage(expiration time.Duration, store HashStore) *HashStorage {
 	return &HashStorage{
 		Data:       make(map[string]HashEntry),
 		Expiration: expiration,
+		store:      store,
 	}
 }
 
@@ -42,16 +56,44 @@ func (h *HashStorage) SaveHash(query string) string {
 
 	h.Data[md5HashString] = entry
 
+	if h.store != nil {
+		err := h.store.SaveHash(entry)
+		if err != nil {
+			logger.Warning("Unable to save callback hash:", err)
+		}
+	}
+
 	return md5HashString
 }
 
 func (h *HashStorage) GetValue(hash string) (string, bool) {
 	h.RLock()
-	defer h.RUnlock()
-
 	entry, exists := h.Data[hash]
+	h.RUnlock()
+
+	if !exists {
+		if h.store == nil {
+			return "", false
+		}
+		stored, err := h.store.LoadHash(hash)
+		if err != nil {
+			logger.Warning("Unable to load callback hash:", err)
+		}
+		if stored == nil {
+			return "", false
+		}
+		entry = *stored
 
-	return entry.Value, exists
+		h.Lock()
+		h.Data[hash] = entry
+		h.Unlock()
+	}
+
+	if time.Since(entry.Timestamp) > h.Expiration {
+		return "", false
+	}
+
+	return entry.Value, true
 }
 
 func (h *HashStorage) IsMD5(hash string) bool {
@@ -70,11 +112,11 @@ func (h *HashStorage) RemoveExpiredHashes() {
 			delete(h.Data, hash)
 		}
 	}
-}
 
-func (h *HashStorage) Reset() {
-	h.Lock()
-	defer h.Unlock()
-
-	h.Data = make(map[string]HashEntry)
+	if h.store != nil {
+		err := h.store.RemoveHashesBefore(now.Add(-h.Expiration))
+		if err != nil {
+			logger.Warning("Unable to remove expired callback hashes:", err)
+		}
+	}
 }
@@ -320,7 +320,7 @@ func (j *CheckClientIpJob) getInboundByEmail(clientEmail string) (*model.Inbound
 	db := database.GetDB()
 	var inbounds *model.Inbound
 
-	err := db.Model(model.Inbound{}).Where("settings LIKE ?", "%"+clientEmail+"%").Find(&inbounds).Error
+	err := db.Model(model.Inbound{}).Where("id IN (?)", db.Model(model.ClientRecord{}).Select("inbound_id").Where("email = ?", clientEmail)).Find(&inbounds).Error
 	if err != nil {
 		return nil, err
 	}
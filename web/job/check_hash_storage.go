@@ -14,6 +14,13 @@ func NewCheckHashStorageJob() *CheckHashStorageJob {
 
 // Here Run is an interface method of the Job interface
 func (j *CheckHashStorageJob) Run() {
-	// Remove expired hashes from storage
-	j.tgbotService.GetHashStorage().RemoveExpiredHashes()
+	// Remove expired hashes from memory and database
+	hashStorage := j.tgbotService.GetHashStorage()
+	if hashStorage == nil {
+		return
+	}
+	hashStorage.RemoveExpiredHashes()
+
+	// Drop conversations which timed out waiting for input
+	j.tgbotService.RemoveExpiredConversations()
 }
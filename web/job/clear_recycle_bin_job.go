@@ -0,0 +1,32 @@
+package job
+
+import (
+	"x-ui/logger"
+	"x-ui/web/service"
+)
+
+type ClearRecycleBinJob struct {
+	inboundService service.InboundService
+	settingService service.SettingService
+}
+
+func NewClearRecycleBinJob() *ClearRecycleBinJob {
+	return new(ClearRecycleBinJob)
+}
+
+// Here Run is an interface method of the Job interface
+func (j *ClearRecycleBinJob) Run() {
+	days, err := j.settingService.GetRecycleBinDays()
+	if err != nil {
+		logger.Warning("get recycle bin retention failed:", err)
+		return
+	}
+	count, err := j.inboundService.DelExpiredRecycledItems(days)
+	if err != nil {
+		logger.Warning("clear recycle bin failed:", err)
+		return
+	}
+	if count > 0 {
+		logger.Debugf("purged %d items from the recycle bin", count)
+	}
+}
@@ -0,0 +1,37 @@
+package job
+
+import (
+	"x-ui/logger"
+	"x-ui/web/service"
+)
+
+type ClearTrafficRollupsJob struct {
+	inboundService service.InboundService
+	settingService service.SettingService
+}
+
+func NewClearTrafficRollupsJob() *ClearTrafficRollupsJob {
+	return new(ClearTrafficRollupsJob)
+}
+
+// Here Run is an interface method of the Job interface
+func (j *ClearTrafficRollupsJob) Run() {
+	hourlyDays, err := j.settingService.GetTrafficHourlyDays()
+	if err != nil {
+		logger.Warning("get traffic hourly retention failed:", err)
+		return
+	}
+	dailyDays, err := j.settingService.GetTrafficDailyDays()
+	if err != nil {
+		logger.Warning("get traffic daily retention failed:", err)
+		return
+	}
+	count, err := j.inboundService.DelExpiredTrafficRollups(hourlyDays, dailyDays)
+	if err != nil {
+		logger.Warning("clear traffic history failed:", err)
+		return
+	}
+	if count > 0 {
+		logger.Debugf("cleared %d traffic history entries", count)
+	}
+}
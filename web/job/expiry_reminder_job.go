@@ -0,0 +1,21 @@
+package job
+
+import (
+	"x-ui/web/service"
+)
+
+type ExpiryReminderJob struct {
+	tgbotService service.Tgbot
+}
+
+func NewExpiryReminderJob() *ExpiryReminderJob {
+	return new(ExpiryReminderJob)
+}
+
+// Here Run is an interface method of the Job interface
+func (j *ExpiryReminderJob) Run() {
+	if !j.tgbotService.IsRunning() {
+		return
+	}
+	j.tgbotService.SendExpiryReminders()
+}
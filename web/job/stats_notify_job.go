@@ -14,10 +14,11 @@ const (
 type StatsNotifyJob struct {
 	xrayService  service.XrayService
 	tgbotService service.Tgbot
+	report       string
 }
 
-func NewStatsNotifyJob() *StatsNotifyJob {
-	return new(StatsNotifyJob)
+func NewStatsNotifyJob(report string) *StatsNotifyJob {
+	return &StatsNotifyJob{report: report}
 }
 
 // Here run is a interface method of Job interface
@@ -25,5 +26,5 @@ func (j *StatsNotifyJob) Run() {
 	if !j.xrayService.IsXrayRunning() {
 		return
 	}
-	j.tgbotService.SendReport()
+	j.tgbotService.SendReport(j.report)
 }
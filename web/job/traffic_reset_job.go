@@ -0,0 +1,27 @@
+package job
+
+import (
+	"x-ui/logger"
+	"x-ui/web/service"
+)
+
+type TrafficResetJob struct {
+	xrayService    service.XrayService
+	inboundService service.InboundService
+}
+
+func NewTrafficResetJob() *TrafficResetJob {
+	return new(TrafficResetJob)
+}
+
+// Here Run is an interface method of the Job interface
+func (j *TrafficResetJob) Run() {
+	needRestart, err := j.inboundService.ResetScheduledTraffics()
+	if err != nil {
+		logger.Warning("reset scheduled traffics failed:", err)
+		return
+	}
+	if needRestart {
+		j.xrayService.SetToNeedRestart()
+	}
+}
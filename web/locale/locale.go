@@ -76,6 +76,20 @@ func I18n(i18nType I18nType, key string, params ...string) string {
 		return ""
 	}
 
+	return localize(localizer, key, params...)
+}
+
+// I18nLang localizes a bot message into lang instead of the bot language.
+func I18nLang(lang string, key string, params ...string) string {
+	return localize(i18n.NewLocalizer(i18nBundle, lang), key, params...)
+}
+
+// Languages returns the languages of the translation files.
+func Languages() []language.Tag {
+	return i18nBundle.LanguageTags()
+}
+
+func localize(localizer *i18n.Localizer, key string, params ...string) string {
 	templateData := createTemplateData(params)
 
 	msg, err := localizer.Localize(&i18n.LocalizeConfig{
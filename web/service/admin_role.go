@@ -0,0 +1,194 @@
+package service
+
+import (
+	"strconv"
+	"strings"
+
+	"x-ui/logger"
+)
+
+type AdminRole string
+
+const (
+	RoleOwner    AdminRole = "owner"
+	RoleOperator AdminRole = "operator"
+	RoleSupport  AdminRole = "support"
+	RoleReadOnly AdminRole = "read-only"
+)
+
+type Permission string
+
+const (
+	PermViewServer  Permission = "view_server"
+	PermViewClients Permission = "view_clients"
+	PermEditClients Permission = "edit_clients"
+	PermSupport     Permission = "support"
+	PermBackup      Permission = "backup"
+)
+
+var rolePermissions = map[AdminRole][]Permission{
+	RoleOwner:    {PermViewServer, PermViewClients, PermEditClients, PermSupport, PermBackup},
+	RoleOperator: {PermViewServer, PermViewClients, PermEditClients, PermSupport},
+	RoleSupport:  {PermViewClients, PermSupport},
+	RoleReadOnly: {PermViewServer, PermViewClients},
+}
+
+// callbackPermissions maps admin callback actions to the permission they
+// need. Actions which are not listed are available to everyone.
+var callbackPermissions = map[string]Permission{
+	"get_usage":         PermViewServer,
+	"usage_refresh":     PermViewServer,
+	"inbounds":          PermViewServer,
+	"onlines":           PermViewServer,
+	"onlines_refresh":   PermViewServer,
+	"get_backup":        PermBackup,
+	"get_banlogs":       PermBackup,
+	"report_run":        PermViewServer,
+	"get_inbounds":      PermViewClients,
+	"get_clients":       PermViewClients,
+	"deplete_soon":      PermViewClients,
+	"top_today":         PermViewClients,
+	"top_week":          PermViewClients,
+	"top_month":         PermViewClients,
+	"top_all":           PermViewClients,
+	"client_get_usage":  PermViewClients,
+	"client_refresh":    PermViewClients,
+	"client_cancel":     PermViewClients,
+	"ips_refresh":       PermViewClients,
+	"ips_cancel":        PermViewClients,
+	"ip_log":            PermViewClients,
+	"tgid_refresh":      PermViewClients,
+	"tgid_cancel":       PermViewClients,
+	"tg_user":           PermEditClients,
+	"tgid_remove":       PermEditClients,
+	"tgid_remove_c":     PermEditClients,
+	"reset_traffic":     PermEditClients,
+	"reset_traffic_c":   PermEditClients,
+	"limit_traffic":     PermEditClients,
+	"limit_traffic_c":   PermEditClients,
+	"limit_traffic_in":  PermEditClients,
+	"limit_traffic_ask": PermEditClients,
+	"reset_exp":         PermEditClients,
+	"reset_exp_c":       PermEditClients,
+	"reset_exp_in":      PermEditClients,
+	"reset_exp_ask":     PermEditClients,
+	"ip_limit":          PermEditClients,
+	"ip_limit_c":        PermEditClients,
+	"ip_limit_in":       PermEditClients,
+	"ip_limit_ask":      PermEditClients,
+	"clear_ips":         PermEditClients,
+	"clear_ips_c":       PermEditClients,
+	"toggle_enable":     PermEditClients,
+	"toggle_enable_c":   PermEditClients,
+	"speed_tier":        PermEditClients,
+	"speed_tier_c":      PermEditClients,
+	"add_client":        PermEditClients,
+	"add_client_in":     PermEditClients,
+	"del_client":        PermEditClients,
+	"del_client_c":      PermEditClients,
+	"tgid_ban":          PermEditClients,
+	"tgid_ban_c":        PermEditClients,
+	"tgid_unban":        PermEditClients,
+	"tg_unban":          PermEditClients,
+	"customer_get":      PermViewClients,
+	"customer_reset":    PermEditClients,
+	"customer_reset_c":  PermEditClients,
+	"support_reply":     PermSupport,
+	"support_close":     PermSupport,
+}
+
+// customerCallbacks are actions listed in callbackPermissions which customers
+// may use on their own data as well.
+var customerCallbacks = map[string]bool{
+	"support_close": true,
+}
+
+// inboundCallbacks take an inbound id instead of a client email.
+var inboundCallbacks = map[string]bool{
+	"get_clients":   true,
+	"add_client_in": true,
+}
+
+// customerIdCallbacks take the id of a customer.
+var customerIdCallbacks = map[string]bool{
+	"customer_get":     true,
+	"customer_reset":   true,
+	"customer_reset_c": true,
+}
+
+// tgUserCallbacks take a Telegram id of a user who may have no client at all.
+var tgUserCallbacks = map[string]bool{
+	"tg_unban": true,
+}
+
+type AdminAccess struct {
+	Role AdminRole
+	// Inbounds limits operators to these inbound ids, empty means all
+	Inbounds []int
+}
+
+func (a *AdminAccess) Can(permission Permission) bool {
+	if a == nil {
+		return false
+	}
+	for _, p := range rolePermissions[a.Role] {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *AdminAccess) CanAccessInbound(inboundId int) bool {
+	if a == nil {
+		return false
+	}
+	if a.Role != RoleOperator || len(a.Inbounds) == 0 {
+		return true
+	}
+	for _, id := range a.Inbounds {
+		if id == inboundId {
+			return true
+		}
+	}
+	return false
+}
+
+// parseAdminRoles parses entries like "123456:operator:1|4, 654321:support".
+// Admins without an entry are owners.
+func parseAdminRoles(setting string) map[int64]*AdminAccess {
+	roles := make(map[int64]*AdminAccess)
+	for _, entry := range strings.Split(setting, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.Split(entry, ":")
+		if len(parts) < 2 {
+			logger.Warning("Invalid bot admin role:", entry)
+			continue
+		}
+		tgId, err := strconv.ParseInt(strings.TrimSpace(parts[0]), 10, 64)
+		if err != nil {
+			logger.Warning("Invalid bot admin role:", entry)
+			continue
+		}
+		role := AdminRole(strings.ToLower(strings.TrimSpace(parts[1])))
+		if _, exists := rolePermissions[role]; !exists {
+			// never fall back to owner because of a typo
+			logger.Warning("Unknown bot admin role, using read-only:", entry)
+			role = RoleReadOnly
+		}
+		access := &AdminAccess{Role: role}
+		if len(parts) > 2 {
+			for _, id := range strings.Split(parts[2], "|") {
+				inboundId, err := strconv.Atoi(strings.TrimSpace(id))
+				if err == nil {
+					access.Inbounds = append(access.Inbounds, inboundId)
+				}
+			}
+		}
+		roles[tgId] = access
+	}
+	return roles
+}
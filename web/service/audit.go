@@ -0,0 +1,248 @@
+package service
+
+import (
+	"encoding/json"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/logger"
+
+	"gorm.io/gorm"
+)
+
+const (
+	AuditChannelWeb    = "web"
+	AuditChannelApi    = "api"
+	AuditChannelBot    = "bot"
+	AuditChannelSystem = "system"
+)
+
+const (
+	AuditTargetInbound  = "inbound"
+	AuditTargetClient   = "client"
+	AuditTargetSetting  = "setting"
+	AuditTargetTgUser   = "tg_user"
+	AuditTargetCustomer = "customer"
+)
+
+const auditMasked = "***"
+
+// auditMaskedSettings are settings whose values never end up in the audit log.
+var auditMaskedSettings = map[string]bool{
+	"tgBotToken": true,
+	"apiKey":     true,
+	"secret":     true,
+	"warp":       true,
+}
+
+// auditJSONSettings are settings holding JSON documents. They are recorded as
+// objects, so only the changed fields are kept and their secrets are masked.
+var auditJSONSettings = map[string]bool{
+	"xrayTemplateConfig": true,
+}
+
+// auditURLSettings are settings holding URLs which may carry credentials.
+var auditURLSettings = map[string]bool{
+	"tgBotProxy": true,
+}
+
+// auditSecretKeys are JSON fields of clients and inbounds holding credentials
+// or private keys. Their string values are masked, so numeric ids stay.
+var auditSecretKeys = map[string]bool{
+	"id":           true,
+	"password":     true,
+	"subId":        true,
+	"privateKey":   true,
+	"secretKey":    true,
+	"preSharedKey": true,
+	"seed":         true,
+}
+
+// AuditActor is who made a change and through which channel.
+type AuditActor struct {
+	Name    string
+	Channel string
+}
+
+var systemActor = &AuditActor{Name: "system", Channel: AuditChannelSystem}
+
+func NewBotActor(tgId int64) *AuditActor {
+	return &AuditActor{Name: strconv.FormatInt(tgId, 10), Channel: AuditChannelBot}
+}
+
+type AuditService struct{}
+
+func (s *AuditService) Record(actor *AuditActor, action string, targetType string, target string, before interface{}, after interface{}) {
+	s.RecordWithTx(database.GetDB(), actor, action, targetType, target, before, after)
+}
+
+// RecordWithTx stores a change of target within the transaction making it.
+// Only the fields which differ between before and after are kept. Failures
+// are logged and never abort the change itself.
+func (s *AuditService) RecordWithTx(tx *gorm.DB, actor *AuditActor, action string, targetType string, target string, before interface{}, after interface{}) {
+	if actor == nil {
+		actor = systemActor
+	}
+	beforeJson, afterJson := auditDiff(before, after)
+	entry := &model.AuditLog{
+		Actor:      actor.Name,
+		Channel:    actor.Channel,
+		Action:     action,
+		TargetType: targetType,
+		Target:     target,
+		Before:     beforeJson,
+		After:      afterJson,
+		CreatedAt:  time.Now().Unix(),
+	}
+	err := tx.Create(entry).Error
+	if err != nil {
+		logger.Warning("Unable to write audit log:", err)
+	}
+}
+
+// GetLogs returns the latest entries, newest first. Empty filters match everything.
+func (s *AuditService) GetLogs(targetType string, target string, actor string, limit int) ([]*model.AuditLog, error) {
+	db := database.GetDB()
+	var logs []*model.AuditLog
+	query := db.Model(model.AuditLog{})
+	if targetType != "" {
+		query = query.Where("target_type = ?", targetType)
+	}
+	if target != "" {
+		query = query.Where("target = ?", target)
+	}
+	if actor != "" {
+		query = query.Where("actor = ?", actor)
+	}
+	if limit > 0 {
+		query = query.Limit(limit)
+	}
+	err := query.Order("id desc").Find(&logs).Error
+	if err != nil && err != gorm.ErrRecordNotFound {
+		return nil, err
+	}
+	return logs, nil
+}
+
+// auditDiff marshals before and after. When both are JSON objects, fields
+// with equal values are dropped from both sides.
+func auditDiff(before interface{}, after interface{}) (string, string) {
+	beforeMap, beforeIsMap := auditToMap(before)
+	afterMap, afterIsMap := auditToMap(after)
+	if beforeIsMap && afterIsMap {
+		for key, value := range beforeMap {
+			if afterValue, exists := afterMap[key]; exists && reflect.DeepEqual(value, afterValue) {
+				delete(beforeMap, key)
+				delete(afterMap, key)
+			}
+		}
+		return auditMarshal(beforeMap), auditMarshal(afterMap)
+	}
+	return auditMarshal(before), auditMarshal(after)
+}
+
+func auditToMap(value interface{}) (map[string]interface{}, bool) {
+	if value == nil {
+		return nil, false
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, false
+	}
+	var result map[string]interface{}
+	if json.Unmarshal(data, &result) != nil || result == nil {
+		return nil, false
+	}
+	return result, true
+}
+
+func auditMarshal(value interface{}) string {
+	if value == nil {
+		return ""
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return ""
+	}
+	var decoded interface{}
+	if json.Unmarshal(data, &decoded) != nil {
+		return ""
+	}
+	data, err = json.Marshal(auditMaskSecrets(decoded))
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+// auditMaskSecrets replaces the string values of auditSecretKeys in decoded
+// JSON.
+func auditMaskSecrets(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, item := range v {
+			if _, isString := item.(string); isString && auditSecretKeys[key] {
+				v[key] = auditMasked
+			} else {
+				v[key] = auditMaskSecrets(item)
+			}
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = auditMaskSecrets(item)
+		}
+	}
+	return value
+}
+
+// auditMaskJSON masks the secrets of a JSON document kept as a string, like
+// the settings of an inbound.
+func auditMaskJSON(data string) string {
+	if data == "" {
+		return ""
+	}
+	var decoded interface{}
+	if json.Unmarshal([]byte(data), &decoded) != nil {
+		return auditMasked
+	}
+	masked, err := json.Marshal(auditMaskSecrets(decoded))
+	if err != nil {
+		return auditMasked
+	}
+	return string(masked)
+}
+
+// auditJSONValue decodes a JSON document kept as a string, so it is diffed and
+// masked like any other object.
+func auditJSONValue(data string) interface{} {
+	if data == "" {
+		return nil
+	}
+	var decoded interface{}
+	if json.Unmarshal([]byte(data), &decoded) != nil {
+		return auditMasked
+	}
+	return decoded
+}
+
+// auditMaskURL masks the user and password of a URL, like the credentials of
+// a proxy.
+func auditMaskURL(data string) string {
+	if data == "" {
+		return ""
+	}
+	u, err := url.Parse(data)
+	if err != nil {
+		return auditMasked
+	}
+	if u.User == nil {
+		return data
+	}
+	u.User = nil
+	return u.Scheme + "://" + auditMasked + "@" + strings.TrimPrefix(u.String(), u.Scheme+"://")
+}
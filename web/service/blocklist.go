@@ -0,0 +1,125 @@
+package service
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"x-ui/database"
+	"x-ui/database/model"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type BlocklistService struct {
+	actor *AuditActor
+}
+
+// As returns a copy of the service recording its changes as made by actor.
+func (s *BlocklistService) As(actor *AuditActor) *BlocklistService {
+	return &BlocklistService{actor: actor}
+}
+
+// Ban blocks the Telegram user for duration, zero bans for good. Banning a
+// banned user replaces the ban.
+func (s *BlocklistService) Ban(tgId int64, reason string, duration time.Duration) (*model.BlockedUser, error) {
+	db := database.GetDB()
+	now := time.Now()
+	ban := &model.BlockedUser{
+		TgId:      tgId,
+		Reason:    reason,
+		CreatedAt: now.Unix(),
+	}
+	actor := s.actor
+	if actor == nil {
+		actor = systemActor
+	}
+	ban.CreatedBy = actor.Name
+	if duration > 0 {
+		ban.ExpiresAt = now.Add(duration).Unix()
+	}
+	err := db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "tg_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"reason", "created_by", "created_at", "expires_at"}),
+	}).Create(ban).Error
+	if err != nil {
+		return nil, err
+	}
+	auditService := AuditService{}
+	auditService.Record(s.actor, "ban_tg_user", AuditTargetTgUser, strconv.FormatInt(tgId, 10), nil, ban)
+	return ban, nil
+}
+
+func (s *BlocklistService) Unban(tgId int64) (bool, error) {
+	db := database.GetDB()
+	result := db.Where("tg_id = ?", tgId).Delete(model.BlockedUser{})
+	if result.Error != nil {
+		return false, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return false, nil
+	}
+	auditService := AuditService{}
+	auditService.Record(s.actor, "unban_tg_user", AuditTargetTgUser, strconv.FormatInt(tgId, 10), nil, nil)
+	return true, nil
+}
+
+// GetBan returns the ban of the Telegram user, or nil when there is none or
+// it expired.
+func (s *BlocklistService) GetBan(tgId int64) (*model.BlockedUser, error) {
+	db := database.GetDB()
+	ban := &model.BlockedUser{}
+	err := db.Model(model.BlockedUser{}).Where("tg_id = ?", tgId).First(ban).Error
+	if err == gorm.ErrRecordNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if ban.ExpiresAt > 0 && ban.ExpiresAt <= time.Now().Unix() {
+		return nil, db.Delete(ban).Error
+	}
+	return ban, nil
+}
+
+// rateLimiter counts the requests of each Telegram user in a sliding window.
+type rateLimiter struct {
+	mu      sync.Mutex
+	window  time.Duration
+	hits    map[int64][]time.Time
+	cleaned time.Time
+}
+
+func newRateLimiter(window time.Duration) *rateLimiter {
+	return &rateLimiter{
+		window: window,
+		hits:   make(map[int64][]time.Time),
+	}
+}
+
+// hit records a request of the user and returns the number of requests in
+// the window, this one included.
+func (l *rateLimiter) hit(tgId int64) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	since := now.Add(-l.window)
+	if now.Sub(l.cleaned) > l.window {
+		for id, hits := range l.hits {
+			if hits[len(hits)-1].Before(since) {
+				delete(l.hits, id)
+			}
+		}
+		l.cleaned = now
+	}
+
+	hits := l.hits[tgId]
+	for len(hits) > 0 && hits[0].Before(since) {
+		hits = hits[1:]
+	}
+	hits = append(hits, now)
+	l.hits[tgId] = hits
+	return len(hits)
+}
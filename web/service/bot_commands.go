@@ -0,0 +1,87 @@
+package service
+
+import (
+	"x-ui/logger"
+	"x-ui/web/locale"
+
+	"github.com/mymmrac/telego"
+	tu "github.com/mymmrac/telego/telegoutil"
+)
+
+// botCommand is an entry of the command menu of the bot. Admin commands are
+// only shown to the admins having the permission.
+type botCommand struct {
+	command    string
+	customer   bool
+	admin      bool
+	permission Permission
+}
+
+var botCommands = []botCommand{
+	{command: "start", customer: true, admin: true},
+	{command: "help", customer: true, admin: true},
+	{command: "usage", customer: true, admin: true, permission: PermViewClients},
+	{command: "inbound", admin: true, permission: PermViewClients},
+	{command: "top", admin: true, permission: PermViewClients},
+	{command: "customer", admin: true, permission: PermViewClients},
+	{command: "audit", admin: true, permission: PermViewClients},
+	{command: "report", admin: true, permission: PermViewServer},
+	{command: "ban", admin: true, permission: PermEditClients},
+	{command: "unban", admin: true, permission: PermEditClients},
+	{command: "subscribe", customer: true},
+	{command: "remark", customer: true},
+	{command: "support", customer: true, admin: true, permission: PermSupport},
+	{command: "cancel", customer: true, admin: true},
+	{command: "id", customer: true, admin: true},
+	{command: "status", customer: true, admin: true},
+}
+
+// registerCommands sets the command menu of the bot: customer commands for
+// everyone and the admin commands in the chats of the admins, each in the
+// bot language and in every language there is a translation for.
+func (t *Tgbot) registerCommands() {
+	languages := []string{""}
+	for _, tag := range locale.Languages() {
+		base, _ := tag.Base()
+		languages = append(languages, base.String())
+	}
+
+	for _, lang := range languages {
+		t.setCommands(nil, lang, t.botCommandList(nil, lang))
+		for _, adminId := range adminIds {
+			t.setCommands(tu.ScopeChat(tu.ID(adminId)), lang, t.botCommandList(getAdminAccess(adminId), lang))
+		}
+	}
+}
+
+// botCommandList returns the commands of an admin, or of customers when
+// access is nil, described in lang or the bot language when it is empty.
+func (t *Tgbot) botCommandList(access *AdminAccess, lang string) []telego.BotCommand {
+	var commands []telego.BotCommand
+	for _, command := range botCommands {
+		if access == nil && !command.customer {
+			continue
+		}
+		if access != nil && (!command.admin || (command.permission != "" && !access.Can(command.permission))) {
+			continue
+		}
+		key := "tgbot.menu." + command.command
+		description := t.I18nBot(key)
+		if lang != "" {
+			description = locale.I18nLang(lang, key)
+		}
+		commands = append(commands, telego.BotCommand{Command: command.command, Description: description})
+	}
+	return commands
+}
+
+func (t *Tgbot) setCommands(scope telego.BotCommandScope, lang string, commands []telego.BotCommand) {
+	err := bot.SetMyCommands(&telego.SetMyCommandsParams{
+		Commands:     commands,
+		Scope:        scope,
+		LanguageCode: lang,
+	})
+	if err != nil {
+		logger.Warning("Failed to set Telegram bot commands:", err)
+	}
+}
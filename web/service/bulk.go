@@ -0,0 +1,539 @@
+package service
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/logger"
+	"x-ui/util/common"
+	"x-ui/xray"
+
+	"gorm.io/gorm"
+)
+
+// bulkClientLimit caps the clients created by a single template.
+const bulkClientLimit = 1000
+
+// ClientFilter selects the clients of a bulk operation. All given criteria
+// must match and at least one is required.
+type ClientFilter struct {
+	InboundIds []int    `json:"inboundIds" form:"inboundIds"`
+	Emails     []string `json:"emails" form:"emails"`
+	Search     string   `json:"search" form:"search"`
+	TgId       int64    `json:"tgId" form:"tgId"`
+	CustomerId int      `json:"customerId" form:"customerId"`
+	Enable     *bool    `json:"enable" form:"enable"`
+	Depleted   bool     `json:"depleted" form:"depleted"`
+}
+
+func (f *ClientFilter) empty() bool {
+	return len(f.InboundIds) == 0 && len(f.Emails) == 0 && f.Search == "" && f.TgId == 0 &&
+		f.CustomerId == 0 && f.Enable == nil && !f.Depleted
+}
+
+// ClientTemplate describes Count clients named Prefix followed by a number
+// counting from Start, 1 when zero.
+type ClientTemplate struct {
+	InboundId  int    `json:"inboundId" form:"inboundId"`
+	Prefix     string `json:"prefix" form:"prefix"`
+	Count      int    `json:"count" form:"count"`
+	Start      int    `json:"start" form:"start"`
+	TotalGB    int64  `json:"totalGB" form:"totalGB"`
+	ExpiryTime int64  `json:"expiryTime" form:"expiryTime"`
+	LimitIP    int    `json:"limitIp" form:"limitIp"`
+	TgID       int64  `json:"tgId" form:"tgId"`
+	Comment    string `json:"comment" form:"comment"`
+}
+
+// BulkClientUpdate extends the expiry time by AddDays and the traffic limit by
+// AddGB of the filtered clients, and enables or disables them. Unlimited
+// values stay unlimited.
+type BulkClientUpdate struct {
+	Filter  ClientFilter `json:"filter" form:"filter"`
+	AddDays int          `json:"addDays" form:"addDays"`
+	AddGB   int          `json:"addGB" form:"addGB"`
+	Enable  *bool        `json:"enable" form:"enable"`
+}
+
+type BulkClientMove struct {
+	Filter    ClientFilter `json:"filter" form:"filter"`
+	InboundId int          `json:"inboundId" form:"inboundId"`
+}
+
+type BulkClientResult struct {
+	Email     string `json:"email"`
+	InboundId int    `json:"inboundId"`
+	Success   bool   `json:"success"`
+	Msg       string `json:"msg,omitempty"`
+}
+
+type BulkClientReport struct {
+	Succeeded int                 `json:"succeeded"`
+	Failed    int                 `json:"failed"`
+	Results   []*BulkClientResult `json:"results"`
+}
+
+// clientMatch is a client selected by a filter. Active tells whether the
+// traffic and expiry limits left it enabled.
+type clientMatch struct {
+	Email     string
+	InboundId int
+	Enable    bool
+	Active    bool
+}
+
+type bulkInbound struct {
+	inbound  *model.Inbound
+	settings map[string]interface{}
+	clients  []interface{}
+	changed  bool
+}
+
+type xrayUserOp struct {
+	protocol string
+	tag      string
+	email    string
+	user     map[string]interface{}
+}
+
+// xrayUserOps collects the user changes of a transaction, so xray is updated
+// only once it is committed.
+type xrayUserOps struct {
+	removes []xrayUserOp
+	adds    []xrayUserOp
+}
+
+// clientBulk collects the changes of a bulk operation. The inbounds are saved
+// once at the end and xray is updated after the transaction is committed.
+type clientBulk struct {
+	s        *InboundService
+	tx       *gorm.DB
+	inbounds map[int]*bulkInbound
+	report   *BulkClientReport
+	xrayUserOps
+}
+
+// runClientBulk runs the operation in one transaction. Items may fail on
+// their own, any other error rolls back the whole operation. A dry run is
+// always rolled back and only reports what would happen.
+func (s *InboundService) runClientBulk(dryRun bool, run func(b *clientBulk) error) (*BulkClientReport, bool, error) {
+	db := database.GetDB()
+	b := &clientBulk{
+		s:        s,
+		tx:       db.Begin(),
+		inbounds: map[int]*bulkInbound{},
+		report:   &BulkClientReport{Results: []*BulkClientResult{}},
+	}
+	err := run(b)
+	if err == nil {
+		err = b.save()
+	}
+	if err != nil {
+		b.tx.Rollback()
+		return nil, false, err
+	}
+	if dryRun {
+		b.tx.Rollback()
+		return b.report, false, nil
+	}
+	err = b.tx.Commit().Error
+	if err != nil {
+		return nil, false, err
+	}
+	return b.report, b.apply(b.s), nil
+}
+
+func (b *clientBulk) inbound(id int) (*bulkInbound, error) {
+	if in, ok := b.inbounds[id]; ok {
+		return in, nil
+	}
+	inbound := &model.Inbound{}
+	err := b.tx.Model(model.Inbound{}).First(inbound, id).Error
+	if err != nil {
+		return nil, err
+	}
+	switch inbound.Protocol {
+	case model.VMESS, model.VLESS, model.Trojan, model.Shadowsocks:
+	default:
+		return nil, common.NewError("Inbound has no clients:", inbound.Tag)
+	}
+	in := &bulkInbound{inbound: inbound}
+	err = json.Unmarshal([]byte(inbound.Settings), &in.settings)
+	if err != nil {
+		return nil, err
+	}
+	in.clients, _ = in.settings["clients"].([]interface{})
+	b.inbounds[id] = in
+	return in, nil
+}
+
+func (in *bulkInbound) find(email string) (int, map[string]interface{}) {
+	for index, client := range in.clients {
+		c, ok := client.(map[string]interface{})
+		if ok && c["email"] == email {
+			return index, c
+		}
+	}
+	return -1, nil
+}
+
+func (b *clientBulk) ok(email string, inboundId int) {
+	b.report.Succeeded++
+	b.report.Results = append(b.report.Results, &BulkClientResult{Email: email, InboundId: inboundId, Success: true})
+}
+
+func (b *clientBulk) fail(email string, inboundId int, err error) {
+	b.report.Failed++
+	b.report.Results = append(b.report.Results, &BulkClientResult{Email: email, InboundId: inboundId, Msg: err.Error()})
+}
+
+func (b *clientBulk) removeUser(in *bulkInbound, email string) {
+	if !in.inbound.Enable {
+		return
+	}
+	b.removes = append(b.removes, xrayUserOp{tag: in.inbound.Tag, email: email})
+}
+
+func (b *clientBulk) addUser(in *bulkInbound, c map[string]interface{}) {
+	client := clientFromMap(c)
+	if !in.inbound.Enable || !client.Enable {
+		return
+	}
+	b.adds = append(b.adds, xrayUserOf(in.inbound, &client))
+}
+
+func (b *clientBulk) save() error {
+	for _, in := range b.inbounds {
+		if !in.changed {
+			continue
+		}
+		records := make([]model.ClientRecord, 0, len(in.clients))
+		for position, client := range in.clients {
+			c, _ := client.(map[string]interface{})
+			record := clientFromMap(c)
+			records = append(records, model.NewClientRecord(in.inbound.Id, position, &record, clientMethod(c)))
+		}
+		err := in.inbound.SaveClients(b.tx, records)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// apply makes the changes to the running xray in a single API session. A
+// failure asks for a restart instead.
+func (o *xrayUserOps) apply(s *InboundService) bool {
+	if len(o.removes) == 0 && len(o.adds) == 0 {
+		return false
+	}
+	if p == nil || !p.IsRunning() {
+		return true
+	}
+	needRestart := false
+	s.xrayApi.Init(p.GetAPIPort())
+	defer s.xrayApi.Close()
+	for _, op := range o.removes {
+		err := s.xrayApi.RemoveUser(op.tag, op.email)
+		if err != nil {
+			logger.Debug("Error in removing client by api:", err)
+			needRestart = true
+		}
+	}
+	for _, op := range o.adds {
+		err := s.addXrayUser(op.protocol, op.tag, op.user)
+		if err != nil {
+			logger.Debug("Error in adding client by api:", err)
+			needRestart = true
+		}
+	}
+	return needRestart
+}
+
+func clientFromMap(c map[string]interface{}) model.Client {
+	client := model.Client{}
+	data, _ := json.Marshal(c)
+	json.Unmarshal(data, &client)
+	return client
+}
+
+func copyClientMap(c map[string]interface{}) map[string]interface{} {
+	result := make(map[string]interface{}, len(c))
+	for key, value := range c {
+		result[key] = value
+	}
+	return result
+}
+
+func (s *InboundService) matchClients(tx *gorm.DB, filter *ClientFilter) ([]clientMatch, error) {
+	if filter.empty() {
+		return nil, common.NewError("empty client filter")
+	}
+	query := tx.Table("clients").
+		Select("clients.email, clients.inbound_id, clients.enable, COALESCE(client_traffics.enable, 1) AS active").
+		Joins("LEFT JOIN client_traffics ON client_traffics.email = clients.email")
+	if len(filter.InboundIds) > 0 {
+		query = query.Where("clients.inbound_id IN ?", filter.InboundIds)
+	}
+	if len(filter.Emails) > 0 {
+		query = query.Where("clients.email IN ?", filter.Emails)
+	}
+	if filter.Search != "" {
+		query = query.Where("clients.email LIKE ?", "%"+filter.Search+"%")
+	}
+	if filter.TgId != 0 {
+		query = query.Where("clients.tg_id = ?", filter.TgId)
+	}
+	if filter.CustomerId != 0 {
+		query = query.Where("clients.email IN (?)", tx.Model(model.CustomerClient{}).Select("email").Where("customer_id = ?", filter.CustomerId))
+	}
+	if filter.Enable != nil {
+		query = query.Where("clients.enable = ?", *filter.Enable)
+	}
+	if filter.Depleted {
+		query = query.Where("client_traffics.enable = ?", false)
+	}
+	var matches []clientMatch
+	err := query.Order("clients.inbound_id, clients.position").Scan(&matches).Error
+	return matches, err
+}
+
+// AddClientsFromTemplate creates the clients of the template in its inbound.
+// Clients whose email is taken are reported and skipped.
+func (s *InboundService) AddClientsFromTemplate(template *ClientTemplate) (*BulkClientReport, bool, error) {
+	if template.Count <= 0 || template.Count > bulkClientLimit {
+		return nil, false, common.NewErrorf("count must be between 1 and %d", bulkClientLimit)
+	}
+	if template.TotalGB < 0 {
+		return nil, false, common.NewError("totalGB must be >= 0")
+	}
+	start := template.Start
+	if start == 0 {
+		start = 1
+	}
+	allEmails, err := s.getAllEmails()
+	if err != nil {
+		return nil, false, err
+	}
+	taken := make(map[string]bool, len(allEmails))
+	for _, email := range allEmails {
+		taken[email] = true
+	}
+
+	return s.runClientBulk(false, func(b *clientBulk) error {
+		in, err := b.inbound(template.InboundId)
+		if err != nil {
+			return err
+		}
+		for i := 0; i < template.Count; i++ {
+			email := template.Prefix + strconv.Itoa(start+i)
+			if valid, err := validateEmail(email); !valid {
+				b.fail(email, in.inbound.Id, err)
+				continue
+			}
+			if taken[email] {
+				b.fail(email, in.inbound.Id, common.NewError("Duplicate email:", email))
+				continue
+			}
+			taken[email] = true
+
+			client := model.Client{
+				Email:      email,
+				LimitIP:    template.LimitIP,
+				TotalGB:    template.TotalGB,
+				ExpiryTime: template.ExpiryTime,
+				TgID:       template.TgID,
+				Enable:     true,
+			}
+			c := newClientMap(in.inbound, in.settings, client)
+			c["comment"] = template.Comment
+			in.clients = append(in.clients, c)
+			in.changed = true
+			err = s.AddClientStat(b.tx, in.inbound.Id, &client)
+			if err != nil {
+				return err
+			}
+			b.addUser(in, c)
+			s.audit(b.tx, "add_client", AuditTargetClient, email, nil, c)
+			b.ok(email, in.inbound.Id)
+		}
+		return nil
+	})
+}
+
+// UpdateClients applies the update to the filtered clients. Like editing a
+// single client, this enables them again until the next traffic check.
+func (s *InboundService) UpdateClients(update *BulkClientUpdate) (*BulkClientReport, bool, error) {
+	if update.AddDays == 0 && update.AddGB == 0 && update.Enable == nil {
+		return nil, false, common.NewError("nothing to update")
+	}
+	return s.runClientBulk(false, func(b *clientBulk) error {
+		matches, err := s.matchClients(b.tx, &update.Filter)
+		if err != nil {
+			return err
+		}
+		now := time.Now().UnixMilli()
+		for _, match := range matches {
+			in, err := b.inbound(match.InboundId)
+			if err != nil {
+				return err
+			}
+			index, c := in.find(match.Email)
+			if index < 0 {
+				b.fail(match.Email, match.InboundId, common.NewError("Client Not Found For Email:", match.Email))
+				continue
+			}
+			before := copyClientMap(c)
+			client := clientFromMap(c)
+			if update.AddDays != 0 {
+				days := int64(update.AddDays) * 86400000
+				if client.ExpiryTime > 0 {
+					client.ExpiryTime = max(client.ExpiryTime, now) + days
+				} else if client.ExpiryTime < 0 {
+					// not started yet, the duration is stored negative
+					client.ExpiryTime = min(client.ExpiryTime-days, -1)
+				}
+				c["expiryTime"] = client.ExpiryTime
+			}
+			if update.AddGB != 0 && client.TotalGB > 0 {
+				client.TotalGB = max(client.TotalGB+int64(update.AddGB)*1024*1024*1024, 1)
+				c["totalGB"] = client.TotalGB
+			}
+			if update.Enable != nil {
+				c["enable"] = *update.Enable
+			}
+			in.changed = true
+
+			err = b.tx.Model(xray.ClientTraffic{}).
+				Where("email = ?", match.Email).
+				Updates(map[string]interface{}{
+					"enable":      true,
+					"total":       client.TotalGB,
+					"expiry_time": client.ExpiryTime,
+				}).Error
+			if err != nil {
+				return err
+			}
+			if match.Enable && match.Active {
+				b.removeUser(in, match.Email)
+			}
+			b.addUser(in, c)
+			s.audit(b.tx, "update_client", AuditTargetClient, match.Email, before, c)
+			b.ok(match.Email, match.InboundId)
+		}
+		return nil
+	})
+}
+
+// MoveClients moves the filtered clients to another inbound. Clients moving
+// to an inbound of another protocol get new credentials.
+func (s *InboundService) MoveClients(move *BulkClientMove) (*BulkClientReport, bool, error) {
+	return s.runClientBulk(false, func(b *clientBulk) error {
+		target, err := b.inbound(move.InboundId)
+		if err != nil {
+			return err
+		}
+		matches, err := s.matchClients(b.tx, &move.Filter)
+		if err != nil {
+			return err
+		}
+		for _, match := range matches {
+			if match.InboundId == target.inbound.Id {
+				b.fail(match.Email, match.InboundId, common.NewError("client is already in the inbound"))
+				continue
+			}
+			source, err := b.inbound(match.InboundId)
+			if err != nil {
+				return err
+			}
+			index, c := source.find(match.Email)
+			if index < 0 {
+				b.fail(match.Email, match.InboundId, common.NewError("Client Not Found For Email:", match.Email))
+				continue
+			}
+			if len(source.clients) == 1 {
+				b.fail(match.Email, match.InboundId, common.NewError("no client remained in Inbound"))
+				continue
+			}
+
+			moved := copyClientMap(c)
+			if source.inbound.Protocol != target.inbound.Protocol {
+				fresh := newClientMap(target.inbound, target.settings, model.Client{})
+				for _, key := range []string{"id", "password", "method", "security", "flow"} {
+					delete(moved, key)
+					if value, ok := fresh[key]; ok {
+						moved[key] = value
+					}
+				}
+			}
+			source.clients = append(source.clients[:index], source.clients[index+1:]...)
+			target.clients = append(target.clients, moved)
+			source.changed = true
+			target.changed = true
+
+			err = b.tx.Model(xray.ClientTraffic{}).Where("email = ?", match.Email).Update("inbound_id", target.inbound.Id).Error
+			if err != nil {
+				return err
+			}
+			if match.Enable && match.Active {
+				b.removeUser(source, match.Email)
+				b.addUser(target, moved)
+			}
+			s.audit(b.tx, "move_client", AuditTargetClient, match.Email,
+				map[string]interface{}{"inboundId": source.inbound.Id},
+				map[string]interface{}{"inboundId": target.inbound.Id})
+			b.ok(match.Email, target.inbound.Id)
+		}
+		return nil
+	})
+}
+
+// DelClients deletes the filtered clients, keeping the last client of every
+// inbound.
+func (s *InboundService) DelClients(filter *ClientFilter) (*BulkClientReport, bool, error) {
+	return s.runClientBulk(false, func(b *clientBulk) error {
+		matches, err := s.matchClients(b.tx, filter)
+		if err != nil {
+			return err
+		}
+		for _, match := range matches {
+			in, err := b.inbound(match.InboundId)
+			if err != nil {
+				return err
+			}
+			index, c := in.find(match.Email)
+			if index < 0 {
+				b.fail(match.Email, match.InboundId, common.NewError("Client Not Found For Email:", match.Email))
+				continue
+			}
+			if len(in.clients) == 1 {
+				b.fail(match.Email, match.InboundId, common.NewError("no client remained in Inbound"))
+				continue
+			}
+			in.clients = append(in.clients[:index], in.clients[index+1:]...)
+			in.changed = true
+
+			err = s.recycleClient(b.tx, match.InboundId, c)
+			if err != nil {
+				return err
+			}
+			err = s.DelClientStat(b.tx, match.Email)
+			if err != nil {
+				return err
+			}
+			err = s.DelClientIPs(b.tx, match.Email)
+			if err != nil {
+				return err
+			}
+			if match.Enable && match.Active {
+				b.removeUser(in, match.Email)
+			}
+			s.audit(b.tx, "del_client", AuditTargetClient, match.Email, c, nil)
+			b.ok(match.Email, match.InboundId)
+		}
+		return nil
+	})
+}
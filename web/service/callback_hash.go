@@ -0,0 +1,44 @@
+package service
+
+import (
+	"time"
+
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/web/global"
+)
+
+// CallbackHashService persists the callback hashes of the bot, it is the
+// global.HashStore of its HashStorage.
+type CallbackHashService struct{}
+
+func (s CallbackHashService) SaveHash(entry global.HashEntry) error {
+	db := database.GetDB()
+	return db.Save(&model.CallbackHash{
+		Hash:      entry.Hash,
+		Value:     entry.Value,
+		Timestamp: entry.Timestamp.Unix(),
+	}).Error
+}
+
+func (s CallbackHashService) LoadHash(hash string) (*global.HashEntry, error) {
+	db := database.GetDB()
+	stored := &model.CallbackHash{}
+	err := db.Model(model.CallbackHash{}).Where("hash = ?", hash).First(stored).Error
+	if err != nil {
+		if database.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &global.HashEntry{
+		Hash:      stored.Hash,
+		Value:     stored.Value,
+		Timestamp: time.Unix(stored.Timestamp, 0),
+	}, nil
+}
+
+func (s CallbackHashService) RemoveHashesBefore(t time.Time) error {
+	db := database.GetDB()
+	return db.Where("timestamp < ?", t.Unix()).Delete(model.CallbackHash{}).Error
+}
@@ -0,0 +1,61 @@
+package service
+
+import (
+	"encoding/json"
+
+	"x-ui/database/model"
+)
+
+type ClientEventType string
+
+const (
+	ClientDisabledTraffic  ClientEventType = "disabled_traffic"
+	ClientDisabledExpiry   ClientEventType = "disabled_expiry"
+	ClientThrottled        ClientEventType = "throttled"
+	ClientRenewed          ClientEventType = "renewed"
+	ClientDeleted          ClientEventType = "deleted"
+	ClientCreatedByPayment ClientEventType = "created_by_payment"
+	ClientRenewedByPayment ClientEventType = "renewed_by_payment"
+)
+
+// ClientEvent describes a change of a client which was not made by an admin,
+// such as disabling a depleted client or applying a payment.
+type ClientEvent struct {
+	Type       ClientEventType
+	Email      string
+	InboundId  int
+	TgId       int64
+	ExpiryTime int64
+}
+
+type ClientEventHook func(events []ClientEvent)
+
+var clientEventHook ClientEventHook
+
+// SetClientEventHook registers the receiver of client events, nil removes it.
+func SetClientEventHook(hook ClientEventHook) {
+	clientEventHook = hook
+}
+
+// fireClientEvents hands the events to the hook without blocking the caller,
+// which usually just committed a transaction of the traffic job.
+func fireClientEvents(events []ClientEvent) {
+	hook := clientEventHook
+	if hook == nil || len(events) == 0 {
+		return
+	}
+	go hook(events)
+}
+
+// clientTgId reads the Telegram id of a client entry of the inbound settings.
+func clientTgId(c map[string]interface{}) int64 {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return 0
+	}
+	client := model.Client{}
+	if json.Unmarshal(data, &client) != nil {
+		return 0
+	}
+	return client.TgID
+}
@@ -0,0 +1,98 @@
+package service
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/util/common"
+)
+
+const ClientLinkPrefix = "link_"
+
+type ClientLinkService struct {
+	inboundService InboundService
+	settingService SettingService
+}
+
+// CreateToken issues a one-time token which binds the client with the given
+// email to the Telegram account that opens the bot deep link.
+func (s *ClientLinkService) CreateToken(email string) (*model.ClientLinkToken, error) {
+	traffic, err := s.inboundService.GetClientTrafficByEmail(email)
+	if err != nil {
+		return nil, err
+	}
+	if traffic == nil {
+		return nil, common.NewError("Client Not Found For Email:", email)
+	}
+
+	ttl, err := s.settingService.GetTgLinkTokenTTL()
+	if err != nil || ttl <= 0 {
+		ttl = 24
+	}
+
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, err
+	}
+
+	db := database.GetDB()
+	s.removeExpired()
+
+	token := &model.ClientLinkToken{
+		Token:     hex.EncodeToString(buf),
+		Email:     email,
+		ExpiresAt: time.Now().Add(time.Duration(ttl) * time.Hour).Unix(),
+	}
+	err = db.Create(token).Error
+	if err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+// ConsumeToken validates the token, deletes it and sets tgId on the client it
+// was issued for. It returns the email of the linked client.
+func (s *ClientLinkService) ConsumeToken(token string, tgId int64) (string, bool, error) {
+	db := database.GetDB()
+	linkToken := &model.ClientLinkToken{}
+	err := db.Model(model.ClientLinkToken{}).Where("token = ?", token).First(linkToken).Error
+	if err != nil {
+		if database.IsNotFound(err) {
+			return "", false, common.NewError("link token not found")
+		}
+		return "", false, err
+	}
+
+	if linkToken.ExpiresAt < time.Now().Unix() {
+		db.Where("token = ?", token).Delete(model.ClientLinkToken{})
+		return "", false, common.NewError("link token expired")
+	}
+
+	// only the request which deletes the token may use it
+	result := db.Where("token = ?", token).Delete(model.ClientLinkToken{})
+	if result.Error != nil {
+		return "", false, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return "", false, common.NewError("link token already used")
+	}
+
+	traffic, err := s.inboundService.GetClientTrafficByEmail(linkToken.Email)
+	if err != nil {
+		return "", false, err
+	}
+	if traffic == nil {
+		return "", false, common.NewError("Client Not Found For Email:", linkToken.Email)
+	}
+
+	needRestart, err := s.inboundService.As(NewBotActor(tgId)).SetClientTelegramUserID(traffic.Id, tgId)
+	return linkToken.Email, needRestart, err
+}
+
+func (s *ClientLinkService) removeExpired() {
+	db := database.GetDB()
+	db.Where("expires_at < ?", time.Now().Unix()).Delete(model.ClientLinkToken{})
+}
@@ -0,0 +1,315 @@
+package service
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"strconv"
+
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/util/common"
+	"x-ui/xray"
+)
+
+// ClientExport is a client with its traffic as exported and imported. On
+// import the inbound is looked up by InboundId, or by its Inbound tag when the
+// id is zero. Missing credentials are generated.
+type ClientExport struct {
+	InboundId  int    `json:"inboundId"`
+	Inbound    string `json:"inbound"`
+	Protocol   string `json:"protocol"`
+	Email      string `json:"email"`
+	ID         string `json:"id"`
+	Password   string `json:"password"`
+	Security   string `json:"security"`
+	Flow       string `json:"flow"`
+	LimitIP    int    `json:"limitIp"`
+	TotalGB    int64  `json:"totalGB"`
+	ExpiryTime int64  `json:"expiryTime"`
+	Enable     bool   `json:"enable"`
+	TgID       int64  `json:"tgId"`
+	SubID      string `json:"subId"`
+	Reset      int    `json:"reset"`
+	Comment    string `json:"comment"`
+	Up         int64  `json:"up"`
+	Down       int64  `json:"down"`
+}
+
+// clientExportColumns are the CSV columns, named like the JSON fields.
+var clientExportColumns = []string{
+	"inboundId", "inbound", "protocol", "email", "id", "password", "security", "flow", "limitIp",
+	"totalGB", "expiryTime", "enable", "tgId", "subId", "reset", "comment", "up", "down",
+}
+
+func (s *InboundService) ExportClients() ([]*ClientExport, error) {
+	db := database.GetDB()
+	clients := []*ClientExport{}
+	err := db.Table("clients").
+		Select("clients.inbound_id, inbounds.tag AS inbound, inbounds.protocol, clients.email, clients.uuid AS id, " +
+			"clients.password, clients.security, clients.flow, clients.limit_ip, clients.total_gb, clients.expiry_time, " +
+			"clients.enable, clients.tg_id, clients.sub_id, clients.reset, clients.comment, " +
+			"COALESCE(client_traffics.up, 0) AS up, COALESCE(client_traffics.down, 0) AS down").
+		Joins("JOIN inbounds ON inbounds.id = clients.inbound_id").
+		Joins("LEFT JOIN client_traffics ON client_traffics.email = clients.email").
+		Order("clients.inbound_id, clients.position").
+		Scan(&clients).Error
+	if err != nil {
+		return nil, err
+	}
+	return clients, nil
+}
+
+func WriteClientsCSV(w io.Writer, clients []*ClientExport) error {
+	writer := csv.NewWriter(w)
+	err := writer.Write(clientExportColumns)
+	if err != nil {
+		return err
+	}
+	for _, client := range clients {
+		err = writer.Write([]string{
+			strconv.Itoa(client.InboundId),
+			client.Inbound,
+			client.Protocol,
+			client.Email,
+			client.ID,
+			client.Password,
+			client.Security,
+			client.Flow,
+			strconv.Itoa(client.LimitIP),
+			strconv.FormatInt(client.TotalGB, 10),
+			strconv.FormatInt(client.ExpiryTime, 10),
+			strconv.FormatBool(client.Enable),
+			strconv.FormatInt(client.TgID, 10),
+			client.SubID,
+			strconv.Itoa(client.Reset),
+			client.Comment,
+			strconv.FormatInt(client.Up, 10),
+			strconv.FormatInt(client.Down, 10),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// ParseClients reads clients exported as a JSON array or as CSV with a header
+// row. CSV columns may be left out or come in any order, a missing enable
+// column enables the clients.
+func ParseClients(data []byte) ([]*ClientExport, error) {
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] == '[' {
+		var clients []*ClientExport
+		err := json.Unmarshal(data, &clients)
+		return clients, err
+	}
+
+	reader := csv.NewReader(bytes.NewReader(data))
+	reader.FieldsPerRecord = -1
+	rows, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, common.NewError("no clients to import")
+	}
+	header := rows[0]
+	clients := make([]*ClientExport, 0, len(rows)-1)
+	for line, row := range rows[1:] {
+		client := &ClientExport{Enable: true}
+		for i, value := range row {
+			if i >= len(header) {
+				break
+			}
+			err = client.setField(header[i], value)
+			if err != nil {
+				return nil, common.NewErrorf("line %d, column %s: %v", line+2, header[i], err)
+			}
+		}
+		clients = append(clients, client)
+	}
+	return clients, nil
+}
+
+func (c *ClientExport) setField(column string, value string) error {
+	var err error
+	switch column {
+	case "inboundId":
+		c.InboundId, err = atoiOrZero(value)
+	case "inbound":
+		c.Inbound = value
+	case "protocol":
+		c.Protocol = value
+	case "email":
+		c.Email = value
+	case "id":
+		c.ID = value
+	case "password":
+		c.Password = value
+	case "security":
+		c.Security = value
+	case "flow":
+		c.Flow = value
+	case "limitIp":
+		c.LimitIP, err = atoiOrZero(value)
+	case "totalGB":
+		c.TotalGB, err = parseInt64OrZero(value)
+	case "expiryTime":
+		c.ExpiryTime, err = parseInt64OrZero(value)
+	case "enable":
+		if value != "" {
+			c.Enable, err = strconv.ParseBool(value)
+		}
+	case "tgId":
+		c.TgID, err = parseInt64OrZero(value)
+	case "subId":
+		c.SubID = value
+	case "reset":
+		c.Reset, err = atoiOrZero(value)
+	case "comment":
+		c.Comment = value
+	case "up":
+		c.Up, err = parseInt64OrZero(value)
+	case "down":
+		c.Down, err = parseInt64OrZero(value)
+	}
+	return err
+}
+
+func atoiOrZero(value string) (int, error) {
+	if value == "" {
+		return 0, nil
+	}
+	return strconv.Atoi(value)
+}
+
+func parseInt64OrZero(value string) (int64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	return strconv.ParseInt(value, 10, 64)
+}
+
+// ImportClients creates the clients in their inbounds together with their
+// traffic. Clients with an invalid or taken email or an unknown inbound are
+// reported and skipped.
+func (s *InboundService) ImportClients(clients []*ClientExport, dryRun bool) (*BulkClientReport, bool, error) {
+	if len(clients) == 0 {
+		return nil, false, common.NewError("no clients to import")
+	}
+
+	db := database.GetDB()
+	var inbounds []*model.Inbound
+	err := db.Model(model.Inbound{}).Select("id", "tag").Find(&inbounds).Error
+	if err != nil {
+		return nil, false, err
+	}
+	inboundIds := make(map[int]bool, len(inbounds))
+	tags := make(map[string]int, len(inbounds))
+	for _, inbound := range inbounds {
+		inboundIds[inbound.Id] = true
+		tags[inbound.Tag] = inbound.Id
+	}
+
+	// validate before the transaction, checkEmailsExistForClients reads
+	// outside of it
+	failures := make([]error, len(clients))
+	seen := make(map[string]bool, len(clients))
+	for i, client := range clients {
+		if client.InboundId == 0 {
+			client.InboundId = tags[client.Inbound]
+		}
+		if !inboundIds[client.InboundId] {
+			inbound := client.Inbound
+			if inbound == "" {
+				inbound = strconv.Itoa(client.InboundId)
+			}
+			failures[i] = common.NewError("Inbound Not Found:", inbound)
+			continue
+		}
+		if valid, err := validateEmail(client.Email); !valid {
+			failures[i] = err
+			continue
+		}
+		existEmail, err := s.checkEmailsExistForClients([]model.Client{{Email: client.Email}})
+		if err != nil {
+			return nil, false, err
+		}
+		if existEmail != "" || seen[client.Email] {
+			failures[i] = common.NewError("Duplicate email:", client.Email)
+			continue
+		}
+		if client.TotalGB < 0 {
+			failures[i] = common.NewError("totalGB must be >= 0")
+			continue
+		}
+		seen[client.Email] = true
+	}
+
+	return s.runClientBulk(dryRun, func(b *clientBulk) error {
+		for i, client := range clients {
+			if failures[i] != nil {
+				b.fail(client.Email, client.InboundId, failures[i])
+				continue
+			}
+			in, err := b.inbound(client.InboundId)
+			if err != nil {
+				b.fail(client.Email, client.InboundId, err)
+				continue
+			}
+
+			c := newClientMap(in.inbound, in.settings, model.Client{
+				Email:      client.Email,
+				LimitIP:    client.LimitIP,
+				TotalGB:    client.TotalGB,
+				ExpiryTime: client.ExpiryTime,
+				TgID:       client.TgID,
+			})
+			switch in.inbound.Protocol {
+			case model.Trojan, model.Shadowsocks:
+				if client.Password != "" {
+					c["password"] = client.Password
+				}
+			default:
+				if client.ID != "" {
+					c["id"] = client.ID
+				}
+				if client.Security != "" && in.inbound.Protocol == model.VMESS {
+					c["security"] = client.Security
+				}
+				if in.inbound.Protocol == model.VLESS && client.Protocol == string(model.VLESS) {
+					c["flow"] = client.Flow
+				}
+			}
+			if client.SubID != "" {
+				c["subId"] = client.SubID
+			}
+			c["enable"] = client.Enable
+			c["reset"] = client.Reset
+			c["comment"] = client.Comment
+			in.clients = append(in.clients, c)
+			in.changed = true
+
+			stat := clientFromMap(c)
+			err = s.AddClientStat(b.tx, in.inbound.Id, &stat)
+			if err != nil {
+				return err
+			}
+			if client.Up != 0 || client.Down != 0 {
+				err = b.tx.Model(xray.ClientTraffic{}).
+					Where("email = ?", client.Email).
+					Updates(map[string]interface{}{"up": client.Up, "down": client.Down}).Error
+				if err != nil {
+					return err
+				}
+			}
+			b.addUser(in, c)
+			s.audit(b.tx, "import_client", AuditTargetClient, client.Email, nil, c)
+			b.ok(client.Email, in.inbound.Id)
+		}
+		return nil
+	})
+}
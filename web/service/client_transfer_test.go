@@ -0,0 +1,129 @@
+package service
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseClients(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		want    []*ClientExport
+		wantErr bool
+	}{
+		{
+			name: "json",
+			data: `[{"inboundId": 1, "email": "a", "id": "uuid-a", "totalGB": 10, "enable": false}]`,
+			want: []*ClientExport{{InboundId: 1, Email: "a", ID: "uuid-a", TotalGB: 10}},
+		},
+		{
+			name: "json with surrounding space",
+			data: "\n  [{\"inbound\": \"in-1\", \"email\": \"a\"}]\n",
+			want: []*ClientExport{{Inbound: "in-1", Email: "a"}},
+		},
+		{
+			name: "csv in export order",
+			data: "inboundId,inbound,protocol,email,id,password,security,flow,limitIp,totalGB,expiryTime,enable,tgId,subId,reset,comment,up,down\n" +
+				"1,in-1,vless,a,uuid-a,,auto,xtls-rprx-vision,2,1073741824,1700000000000,false,42,sub-a,30,vip,5,6\n",
+			want: []*ClientExport{{
+				InboundId: 1, Inbound: "in-1", Protocol: "vless", Email: "a", ID: "uuid-a", Security: "auto",
+				Flow: "xtls-rprx-vision", LimitIP: 2, TotalGB: 1073741824, ExpiryTime: 1700000000000, TgID: 42,
+				SubID: "sub-a", Reset: 30, Comment: "vip", Up: 5, Down: 6,
+			}},
+		},
+		{
+			name: "csv columns in any order, missing enable enables",
+			data: "email,inbound\na,in-1\nb,in-2\n",
+			want: []*ClientExport{
+				{Email: "a", Inbound: "in-1", Enable: true},
+				{Email: "b", Inbound: "in-2", Enable: true},
+			},
+		},
+		{
+			name: "csv empty numbers and enable",
+			data: "email,totalGB,limitIp,enable\na,,,\n",
+			want: []*ClientExport{{Email: "a", Enable: true}},
+		},
+		{
+			name: "csv unknown columns and extra values are ignored",
+			data: "email,color\na,red,extra\n",
+			want: []*ClientExport{{Email: "a", Enable: true}},
+		},
+		{
+			name: "csv short row",
+			data: "email,comment,totalGB\na\n",
+			want: []*ClientExport{{Email: "a", Enable: true}},
+		},
+		{
+			name:    "csv invalid number",
+			data:    "email,totalGB\na,ten\n",
+			wantErr: true,
+		},
+		{
+			name:    "csv invalid enable",
+			data:    "email,enable\na,maybe\n",
+			wantErr: true,
+		},
+		{
+			name:    "empty",
+			data:    "",
+			wantErr: true,
+		},
+		{
+			name:    "invalid json",
+			data:    `[{"email": 1}]`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseClients([]byte(tt.data))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseClients() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseClients() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClientExportSetField(t *testing.T) {
+	tests := []struct {
+		column  string
+		value   string
+		want    ClientExport
+		wantErr bool
+	}{
+		{column: "inboundId", value: "3", want: ClientExport{InboundId: 3}},
+		{column: "inboundId", value: "", want: ClientExport{}},
+		{column: "inboundId", value: "x", wantErr: true},
+		{column: "limitIp", value: "-1", want: ClientExport{LimitIP: -1}},
+		{column: "totalGB", value: "9223372036854775807", want: ClientExport{TotalGB: 9223372036854775807}},
+		{column: "totalGB", value: "9223372036854775808", wantErr: true},
+		{column: "expiryTime", value: "-86400000", want: ClientExport{ExpiryTime: -86400000}},
+		{column: "tgId", value: "1.5", wantErr: true},
+		{column: "enable", value: "true", want: ClientExport{Enable: true}},
+		{column: "enable", value: "0", want: ClientExport{}},
+		{column: "enable", value: "", want: ClientExport{}},
+		{column: "enable", value: "yes", wantErr: true},
+		{column: "comment", value: "a, \"b\"", want: ClientExport{Comment: "a, \"b\""}},
+		{column: "unknown", value: "x", want: ClientExport{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.column+"="+tt.value, func(t *testing.T) {
+			got := ClientExport{}
+			err := got.setField(tt.column, tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("setField() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Errorf("setField() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
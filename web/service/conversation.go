@@ -0,0 +1,103 @@
+package service
+
+import (
+	"maps"
+	"sync"
+	"time"
+)
+
+const conversationTimeout = 10 * time.Minute
+
+// Conversation is the state of a multi-step bot flow waiting for free-text
+// input from a chat.
+type Conversation struct {
+	Flow      string
+	Fields    map[string]string
+	ExpiresAt time.Time
+}
+
+type ConversationStore struct {
+	sync.Mutex
+	data    map[int64]*Conversation
+	timeout time.Duration
+}
+
+func NewConversationStore(timeout time.Duration) *ConversationStore {
+	return &ConversationStore{
+		data:    make(map[int64]*Conversation),
+		timeout: timeout,
+	}
+}
+
+// Start replaces any running conversation of the chat with a new flow.
+func (c *ConversationStore) Start(chatId int64, flow string, fields map[string]string) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.data[chatId] = &Conversation{
+		Flow:      flow,
+		Fields:    maps.Clone(fields),
+		ExpiresAt: time.Now().Add(c.timeout),
+	}
+	if c.data[chatId].Fields == nil {
+		c.data[chatId].Fields = make(map[string]string)
+	}
+}
+
+// Get returns a copy of the running conversation of the chat, or nil if there
+// is none or it has timed out. The copy is safe to read while handlers of
+// other messages of the chat change the conversation.
+func (c *ConversationStore) Get(chatId int64) *Conversation {
+	c.Lock()
+	defer c.Unlock()
+
+	conversation, exists := c.data[chatId]
+	if !exists {
+		return nil
+	}
+	if time.Now().After(conversation.ExpiresAt) {
+		delete(c.data, chatId)
+		return nil
+	}
+	return &Conversation{
+		Flow:      conversation.Flow,
+		Fields:    maps.Clone(conversation.Fields),
+		ExpiresAt: conversation.ExpiresAt,
+	}
+}
+
+// Set stores a collected field and moves the conversation to the next step.
+func (c *ConversationStore) Set(chatId int64, flow string, key string, value string) {
+	c.Lock()
+	defer c.Unlock()
+
+	conversation, exists := c.data[chatId]
+	if !exists {
+		return
+	}
+	conversation.Flow = flow
+	conversation.Fields[key] = value
+	conversation.ExpiresAt = time.Now().Add(c.timeout)
+}
+
+// End removes the conversation of the chat and reports whether there was one.
+func (c *ConversationStore) End(chatId int64) bool {
+	c.Lock()
+	defer c.Unlock()
+
+	_, exists := c.data[chatId]
+	delete(c.data, chatId)
+	return exists
+}
+
+func (c *ConversationStore) RemoveExpired() {
+	c.Lock()
+	defer c.Unlock()
+
+	now := time.Now()
+	for chatId, conversation := range c.data {
+		if now.After(conversation.ExpiresAt) {
+			delete(c.data, chatId)
+		}
+	}
+}
@@ -0,0 +1,445 @@
+package service
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/logger"
+	"x-ui/util/common"
+	"x-ui/xray"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type CustomerService struct {
+	inboundService InboundService
+	actor          *AuditActor
+}
+
+// As returns a copy of the service recording its changes as made by actor.
+func (s *CustomerService) As(actor *AuditActor) *CustomerService {
+	return &CustomerService{inboundService: *s.inboundService.As(actor), actor: actor}
+}
+
+func (s *CustomerService) audit(tx *gorm.DB, action string, target int, before interface{}, after interface{}) {
+	auditService := AuditService{}
+	auditService.RecordWithTx(tx, s.actor, action, AuditTargetCustomer, strconv.Itoa(target), before, after)
+}
+
+// auditCustomer strips the client traffics, which change on their own.
+func auditCustomer(customer *model.Customer) model.Customer {
+	result := *customer
+	result.Clients = nil
+	return result
+}
+
+func (s *CustomerService) GetCustomers() ([]*model.Customer, error) {
+	db := database.GetDB()
+	var customers []*model.Customer
+	err := db.Model(model.Customer{}).Order("id").Find(&customers).Error
+	if err != nil {
+		return nil, err
+	}
+	return customers, s.loadClients(db, customers)
+}
+
+func (s *CustomerService) GetCustomer(id int) (*model.Customer, error) {
+	return s.getCustomer(database.GetDB(), id)
+}
+
+func (s *CustomerService) getCustomer(tx *gorm.DB, id int) (*model.Customer, error) {
+	customer := &model.Customer{}
+	err := tx.Model(model.Customer{}).First(customer, id).Error
+	if err != nil {
+		return nil, err
+	}
+	return customer, s.loadClients(tx, []*model.Customer{customer})
+}
+
+// SearchCustomers returns the customers whose id or Telegram ID equals query,
+// or whose name, contact or tags contain it.
+func (s *CustomerService) SearchCustomers(query string, limit int) ([]*model.Customer, error) {
+	db := database.GetDB()
+	var customers []*model.Customer
+	tx := db.Model(model.Customer{})
+	if id, err := strconv.ParseInt(query, 10, 64); err == nil {
+		tx = tx.Where("id = ? OR tg_id = ?", id, id)
+	} else {
+		like := "%" + query + "%"
+		tx = tx.Where("name LIKE ? OR contact LIKE ? OR tags LIKE ?", like, like, like)
+	}
+	err := tx.Order("id").Limit(limit).Find(&customers).Error
+	if err != nil {
+		return nil, err
+	}
+	return customers, s.loadClients(db, customers)
+}
+
+// GetCustomerByEmail returns the customer owning the client, nil when the
+// client has none.
+func (s *CustomerService) GetCustomerByEmail(email string) (*model.Customer, error) {
+	db := database.GetDB()
+	var customerId int
+	err := db.Model(model.CustomerClient{}).Select("customer_id").Where("email = ?", email).Scan(&customerId).Error
+	if err != nil {
+		return nil, err
+	}
+	if customerId == 0 {
+		return nil, nil
+	}
+	return s.GetCustomer(customerId)
+}
+
+func (s *CustomerService) loadClients(db *gorm.DB, customers []*model.Customer) error {
+	if len(customers) == 0 {
+		return nil
+	}
+	byId := make(map[int]*model.Customer, len(customers))
+	ids := make([]int, 0, len(customers))
+	for _, customer := range customers {
+		customer.Clients = []xray.ClientTraffic{}
+		byId[customer.Id] = customer
+		ids = append(ids, customer.Id)
+	}
+	var rows []struct {
+		CustomerId int
+		xray.ClientTraffic
+	}
+	err := db.Table("customer_clients").
+		Select("customer_clients.customer_id, client_traffics.*").
+		Joins("JOIN client_traffics ON client_traffics.email = customer_clients.email").
+		Where("customer_clients.customer_id IN ?", ids).
+		Order("client_traffics.id").
+		Scan(&rows).Error
+	if err != nil {
+		return err
+	}
+	for _, row := range rows {
+		customer := byId[row.CustomerId]
+		customer.Clients = append(customer.Clients, row.ClientTraffic)
+	}
+	return nil
+}
+
+// CustomerTraffic returns the traffic used by all clients of the customer.
+func CustomerTraffic(customer *model.Customer) (up int64, down int64) {
+	for _, client := range customer.Clients {
+		up += client.Up
+		down += client.Down
+	}
+	return up, down
+}
+
+func (s *CustomerService) checkCustomer(customer *model.Customer) error {
+	customer.Name = strings.TrimSpace(customer.Name)
+	if customer.Name == "" {
+		return common.NewError("customer name is empty")
+	}
+	if customer.TotalGB < 0 || customer.ExpiryTime < 0 {
+		return common.NewError("customer quota and expiry time must be >= 0")
+	}
+	return checkSpeedTier(customer.SpeedTier)
+}
+
+func (s *CustomerService) AddCustomer(customer *model.Customer) error {
+	err := s.checkCustomer(customer)
+	if err != nil {
+		return err
+	}
+	db := database.GetDB()
+	customer.Id = 0
+	customer.CreatedAt = time.Now().Unix()
+	err = db.Omit("Clients").Create(customer).Error
+	if err != nil {
+		return err
+	}
+	s.audit(db, "add_customer", customer.Id, nil, auditCustomer(customer))
+	return nil
+}
+
+// UpdateCustomer stores the customer. A new expiry time is applied to all its
+// clients, which like a changed quota also enables them again.
+func (s *CustomerService) UpdateCustomer(customer *model.Customer) (bool, error) {
+	err := s.checkCustomer(customer)
+	if err != nil {
+		return false, err
+	}
+	needRestart := false
+	err = database.GetDB().Transaction(func(tx *gorm.DB) error {
+		old, err := s.getCustomer(tx, customer.Id)
+		if err != nil {
+			return err
+		}
+		err = tx.Model(&model.Customer{Id: customer.Id}).
+			Select("name", "contact", "tg_id", "notes", "tags", "total_gb", "expiry_time", "speed_tier").
+			Updates(customer).Error
+		if err != nil {
+			return err
+		}
+		s.audit(tx, "update_customer", customer.Id, auditCustomer(old), auditCustomer(customer))
+
+		// the speed tier is part of the xray config of the clients
+		needRestart = old.SpeedTier != customer.SpeedTier && len(old.Clients) > 0
+		newExpiry := customer.ExpiryTime != old.ExpiryTime && customer.ExpiryTime != 0
+		if newExpiry {
+			err = s.setClientsExpiryTime(tx, old.Clients, customer.ExpiryTime)
+			if err != nil {
+				return err
+			}
+		}
+		if !newExpiry && old.TotalGB == customer.TotalGB {
+			return nil
+		}
+		enabled, err := s.enableClients(tx, old.Clients)
+		needRestart = needRestart || enabled
+		return err
+	})
+	return needRestart, err
+}
+
+// DelCustomer deletes the customer. Its clients stay and lose the owner.
+func (s *CustomerService) DelCustomer(id int) (bool, error) {
+	old, err := s.GetCustomer(id)
+	if err != nil {
+		return false, err
+	}
+	db := database.GetDB()
+	err = db.Where("customer_id = ?", id).Delete(model.CustomerClient{}).Error
+	if err != nil {
+		return false, err
+	}
+	err = db.Delete(model.Customer{}, id).Error
+	if err != nil {
+		return false, err
+	}
+	s.audit(db, "del_customer", id, auditCustomer(old), nil)
+	return old.SpeedTier != "" && len(old.Clients) > 0, nil
+}
+
+// AddCustomerClients assigns the clients to the customer, taking them from
+// their former owner. The expiry time of the customer, if any, is applied to
+// them.
+func (s *CustomerService) AddCustomerClients(id int, emails []string) (bool, error) {
+	customer, err := s.GetCustomer(id)
+	if err != nil {
+		return false, err
+	}
+	db := database.GetDB()
+	var clients []xray.ClientTraffic
+	for _, email := range emails {
+		traffic, err := s.inboundService.GetClientTrafficByEmail(email)
+		if err != nil {
+			return false, err
+		}
+		if traffic == nil {
+			return false, common.NewError("Client Not Found For Email:", email)
+		}
+		clients = append(clients, *traffic)
+	}
+
+	needRestart := customer.SpeedTier != ""
+	err = db.Transaction(func(tx *gorm.DB) error {
+		for _, client := range clients {
+			err := tx.Clauses(clause.OnConflict{
+				Columns:   []clause.Column{{Name: "email"}},
+				DoUpdates: clause.AssignmentColumns([]string{"customer_id"}),
+			}).Create(&model.CustomerClient{CustomerId: id, Email: client.Email}).Error
+			if err != nil {
+				return err
+			}
+		}
+		s.audit(tx, "add_customer_clients", id, nil, emails)
+		if customer.ExpiryTime == 0 {
+			return nil
+		}
+		err := s.setClientsExpiryTime(tx, clients, customer.ExpiryTime)
+		if err != nil {
+			return err
+		}
+		enabled, err := s.enableClients(tx, clients)
+		needRestart = needRestart || enabled
+		return err
+	})
+	return needRestart, err
+}
+
+func (s *CustomerService) DelCustomerClient(id int, email string) (bool, error) {
+	var customer model.Customer
+	db := database.GetDB()
+	err := db.Model(model.Customer{}).Where("id = ?", id).First(&customer).Error
+	if err != nil {
+		return false, err
+	}
+	result := db.Where("customer_id = ? AND email = ?", id, email).Delete(model.CustomerClient{})
+	if result.Error != nil {
+		return false, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return false, common.NewError("Client Not Found For Email:", email)
+	}
+	s.audit(db, "del_customer_client", id, email, nil)
+	return customer.SpeedTier != "", nil
+}
+
+// ResetCustomerTraffic resets the traffic of all clients of the customer,
+// which enables the ones disabled by the shared quota again.
+func (s *CustomerService) ResetCustomerTraffic(id int) (bool, error) {
+	customer, err := s.GetCustomer(id)
+	if err != nil {
+		return false, err
+	}
+	needRestart := false
+	for _, client := range customer.Clients {
+		needRestart0, err := s.inboundService.ResetClientTraffic(client.InboundId, client.Email)
+		if err != nil {
+			return needRestart, err
+		}
+		needRestart = needRestart || needRestart0
+	}
+	return needRestart, nil
+}
+
+// customerSpeedTiers maps the emails of clients owned by a customer with a
+// speed tier to that tier.
+func customerSpeedTiers() (map[string]string, error) {
+	var rows []struct {
+		Email     string
+		SpeedTier string
+	}
+	db := database.GetDB()
+	err := db.Table("customer_clients").
+		Select("customer_clients.email, customers.speed_tier").
+		Joins("JOIN customers ON customers.id = customer_clients.customer_id").
+		Where("customers.speed_tier != ''").
+		Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	tiers := make(map[string]string, len(rows))
+	for _, row := range rows {
+		tiers[row.Email] = row.SpeedTier
+	}
+	return tiers, nil
+}
+
+// checkSpeedTier fails for names of speed tiers which are not configured, an
+// empty name means none.
+func checkSpeedTier(name string) error {
+	if name == "" {
+		return nil
+	}
+	settingService := SettingService{}
+	tier, err := settingService.GetSpeedTier(name)
+	if err != nil {
+		return err
+	}
+	if tier == nil {
+		return common.NewError("Speed tier not found:", name)
+	}
+	return nil
+}
+
+// setClientsExpiryTime sets the expiry time of the client records and the
+// traffics of the clients.
+func (s *CustomerService) setClientsExpiryTime(tx *gorm.DB, clients []xray.ClientTraffic, expiryTime int64) error {
+	list := make([]string, 0, len(clients))
+	for _, client := range clients {
+		list = append(list, client.Email)
+	}
+	var records []*model.ClientRecord
+	err := tx.Where("email IN ?", list).Find(&records).Error
+	if err != nil {
+		return err
+	}
+	inboundIds := make([]int, 0, len(records))
+	for _, record := range records {
+		s.inboundService.audit(tx, "update_client", AuditTargetClient, record.Email,
+			map[string]interface{}{"expiryTime": record.ExpiryTime}, map[string]interface{}{"expiryTime": expiryTime})
+		inboundIds = append(inboundIds, record.InboundId)
+	}
+	err = tx.Model(model.ClientRecord{}).Where("email IN ?", list).Update("expiry_time", expiryTime).Error
+	if err != nil {
+		return err
+	}
+	err = model.TouchInbounds(tx, inboundIds)
+	if err != nil {
+		return err
+	}
+	return tx.Model(xray.ClientTraffic{}).Where("email IN ?", list).Update("expiry_time", expiryTime).Error
+}
+
+// enableClients enables the clients disabled for their traffic or expiry
+// again. The traffic job disables those still over a limit on its next run.
+func (s *CustomerService) enableClients(tx *gorm.DB, clients []xray.ClientTraffic) (bool, error) {
+	emails := make([]string, 0, len(clients))
+	for _, client := range clients {
+		emails = append(emails, client.Email)
+	}
+	result := tx.Model(xray.ClientTraffic{}).Where("email IN ? AND enable = ?", emails, false).Update("enable", true)
+	return result.RowsAffected > 0, result.Error
+}
+
+// disableOverQuotaCustomers disables the clients of every customer whose
+// clients together used up the shared quota.
+func (s *InboundService) disableOverQuotaCustomers(tx *gorm.DB) (bool, []ClientEvent, error) {
+	overQuota := tx.Table("customer_clients").
+		Select("customer_clients.customer_id").
+		Joins("JOIN client_traffics ON client_traffics.email = customer_clients.email").
+		Joins("JOIN customers ON customers.id = customer_clients.customer_id").
+		Where("customers.total_gb > 0").
+		Group("customer_clients.customer_id, customers.total_gb").
+		Having("SUM(client_traffics.up + client_traffics.down) >= customers.total_gb")
+
+	var results []struct {
+		Tag string
+		xray.ClientTraffic
+	}
+	err := tx.Table("client_traffics").
+		Select("inbounds.tag, client_traffics.*").
+		Joins("JOIN inbounds ON inbounds.id = client_traffics.inbound_id").
+		Joins("JOIN customer_clients ON customer_clients.email = client_traffics.email").
+		Where("customer_clients.customer_id IN (?) AND client_traffics.enable = ?", overQuota, true).
+		Scan(&results).Error
+	if err != nil {
+		return false, nil, err
+	}
+	if len(results) == 0 {
+		return false, nil, nil
+	}
+
+	needRestart := false
+	if p != nil {
+		s.xrayApi.Init(p.GetAPIPort())
+		for _, result := range results {
+			err1 := s.xrayApi.RemoveUser(result.Tag, result.Email)
+			if err1 == nil {
+				logger.Debug("Client of customer over quota disabled by api:", result.Email)
+			} else {
+				logger.Debug("Error in disabling client by api:", err1)
+				needRestart = true
+			}
+		}
+		s.xrayApi.Close()
+	}
+
+	emails := make([]string, 0, len(results))
+	events := make([]ClientEvent, 0, len(results))
+	for _, result := range results {
+		emails = append(emails, result.Email)
+		events = append(events, ClientEvent{
+			Type:       ClientDisabledTraffic,
+			Email:      result.Email,
+			InboundId:  result.InboundId,
+			ExpiryTime: result.ExpiryTime,
+		})
+	}
+	err = tx.Model(xray.ClientTraffic{}).Where("email IN ?", emails).Update("enable", false).Error
+	if err != nil {
+		return needRestart, nil, err
+	}
+	return needRestart, events, nil
+}
@@ -1,6 +1,8 @@
 package service
 
 import (
+	"crypto/rand"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -13,8 +15,10 @@ import (
 	"x-ui/database/model"
 	"x-ui/logger"
 	"x-ui/util/common"
+	"x-ui/util/random"
 	"x-ui/xray"
 
+	"github.com/google/uuid"
 	"gorm.io/gorm"
 )
 
@@ -37,6 +41,38 @@ type InboundSettings struct {
 
 type InboundService struct {
 	xrayApi xray.XrayAPI
+	actor   *AuditActor
+}
+
+// As returns a copy of the service which records its changes in the audit
+// log under the given actor.
+func (s *InboundService) As(actor *AuditActor) *InboundService {
+	inboundService := *s
+	inboundService.actor = actor
+	return &inboundService
+}
+
+func (s *InboundService) audit(tx *gorm.DB, action string, targetType string, target string, before interface{}, after interface{}) {
+	auditService := AuditService{}
+	auditService.RecordWithTx(tx, s.actor, action, targetType, target, before, after)
+}
+
+// auditInbound strips the client stats, which change on their own and would
+// only bloat the audit log, and masks the credentials and keys in the settings.
+func auditInbound(inbound *model.Inbound) model.Inbound {
+	result := *inbound
+	result.ClientStats = nil
+	result.Settings = auditMaskJSON(result.Settings)
+	result.StreamSettings = auditMaskJSON(result.StreamSettings)
+	return result
+}
+
+func auditTraffic(traffic *xray.ClientTraffic) map[string]interface{} {
+	return map[string]interface{}{
+		"up":     traffic.Up,
+		"down":   traffic.Down,
+		"enable": traffic.Enable,
+	}
 }
 
 func (s *InboundService) GetInbounds(userId int) ([]*model.Inbound, error) {
@@ -59,6 +95,20 @@ func (s *InboundService) GetAllInbounds() ([]*model.Inbound, error) {
 	return inbounds, nil
 }
 
+// GetXrayInbounds returns the inbounds with their client stats and client
+// records, in the order of the settings.
+func (s *InboundService) GetXrayInbounds() ([]*model.Inbound, error) {
+	db := database.GetDB()
+	var inbounds []*model.Inbound
+	err := db.Model(model.Inbound{}).Preload("ClientStats").Preload("Clients", func(db *gorm.DB) *gorm.DB {
+		return db.Order("position")
+	}).Find(&inbounds).Error
+	if err != nil && err != gorm.ErrRecordNotFound {
+		return nil, err
+	}
+	return inbounds, nil
+}
+
 func (s *InboundService) checkPortExist(listen string, port int, ignoreId int) (bool, error) {
 	db := database.GetDB()
 	if listen == "" || listen == "0.0.0.0" || listen == "::" || listen == "::0" {
@@ -106,11 +156,7 @@ func (s *InboundService) GetClients(inbound *model.Inbound) ([]model.Client, err
 func (s *InboundService) getAllEmails() ([]string, error) {
 	db := database.GetDB()
 	var emails []string
-	err := db.Raw(`
-		SELECT JSON_EXTRACT(client.value, '$.email')
-		FROM inbounds,
-			JSON_EACH(JSON_EXTRACT(inbounds.settings, '$.clients')) AS client
-		`).Scan(&emails).Error
+	err := db.Model(model.ClientRecord{}).Pluck("email", &emails).Error
 	if err != nil {
 		return nil, err
 	}
@@ -171,127 +217,168 @@ func (s *InboundService) checkEmailExistForInbound(inbound *model.Inbound) (stri
 }
 
 func (s *InboundService) AddInbound(inbound *model.Inbound) (*model.Inbound, bool, error) {
-	exist, err := s.checkPortExist(inbound.Listen, inbound.Port, 0)
+	db := database.GetDB()
+	err := db.Transaction(func(tx *gorm.DB) error {
+		return s.addInbound(tx, inbound)
+	})
 	if err != nil {
 		return inbound, false, err
 	}
+	return inbound, s.addXrayInbound(inbound), nil
+}
+
+// addInbound checks and saves a new inbound with the traffic rows of its
+// clients, leaving xray to the caller once the transaction is committed.
+func (s *InboundService) addInbound(tx *gorm.DB, inbound *model.Inbound) error {
+	exist, err := s.checkPortExist(inbound.Listen, inbound.Port, 0)
+	if err != nil {
+		return err
+	}
 	if exist {
-		return inbound, false, common.NewError("Port already exists:", inbound.Port)
+		return common.NewError("Port already exists:", inbound.Port)
 	}
 
 	existEmail, err := s.checkEmailExistForInbound(inbound)
 	if err != nil {
-		return inbound, false, err
+		return err
 	}
 	if existEmail != "" {
-		return inbound, false, common.NewError("Duplicate email:", existEmail)
+		return common.NewError("Duplicate email:", existEmail)
 	}
 
 	clients, err := s.GetClients(inbound)
 	if err != nil {
-		return inbound, false, err
+		return err
+	}
+
+	err = ValidateTrafficReset(inbound.TrafficReset)
+	if err != nil {
+		return err
 	}
 
 	// Secure client ID
 	for _, client := range clients {
+		err = ValidateTrafficReset(client.TrafficReset)
+		if err != nil {
+			return err
+		}
+		err = checkSpeedTier(client.SpeedTier)
+		if err != nil {
+			return err
+		}
 		if inbound.Protocol == "trojan" {
 			if client.Password == "" {
-				return inbound, false, common.NewError("empty client ID")
+				return common.NewError("empty client ID")
 			}
 		} else if inbound.Protocol == "shadowsocks" {
 			if client.Email == "" {
-				return inbound, false, common.NewError("empty client ID")
+				return common.NewError("empty client ID")
 			}
 		} else {
 			if client.ID == "" {
-				return inbound, false, common.NewError("empty client ID")
+				return common.NewError("empty client ID")
 			}
 		}
 	}
 
-	db := database.GetDB()
-	tx := db.Begin()
-	defer func() {
-		if err == nil {
-			tx.Commit()
-		} else {
-			tx.Rollback()
-		}
-	}()
-
 	err = tx.Save(inbound).Error
-	if err == nil {
-		if len(inbound.ClientStats) == 0 {
-			for _, client := range clients {
-				s.AddClientStat(tx, inbound.Id, &client)
-			}
+	if err != nil {
+		return err
+	}
+	if len(inbound.ClientStats) == 0 {
+		for _, client := range clients {
+			s.AddClientStat(tx, inbound.Id, &client)
 		}
-	} else {
-		return inbound, false, err
 	}
 
-	needRestart := false
-	if inbound.Enable {
-		s.xrayApi.Init(p.GetAPIPort())
-		inboundJson, err1 := json.MarshalIndent(inbound.GenXrayInboundConfig(), "", "  ")
-		if err1 != nil {
-			logger.Debug("Unable to marshal inbound config:", err1)
-		}
+	s.audit(tx, "add_inbound", AuditTargetInbound, strconv.Itoa(inbound.Id), nil, auditInbound(inbound))
+	return nil
+}
 
-		err1 = s.xrayApi.AddInbound(inboundJson)
-		if err1 == nil {
-			logger.Debug("New inbound added by api:", inbound.Tag)
-		} else {
-			logger.Debug("Unable to add inbound by api:", err1)
-			needRestart = true
-		}
-		s.xrayApi.Close()
+// addXrayInbound adds an enabled inbound to the running xray, reporting
+// whether xray needs a restart instead.
+func (s *InboundService) addXrayInbound(inbound *model.Inbound) bool {
+	if !inbound.Enable {
+		return false
+	}
+	needRestart := false
+	s.xrayApi.Init(p.GetAPIPort())
+	inboundJson, err1 := json.MarshalIndent(inbound.GenXrayInboundConfig(), "", "  ")
+	if err1 != nil {
+		logger.Debug("Unable to marshal inbound config:", err1)
 	}
 
-	return inbound, needRestart, err
+	err1 = s.xrayApi.AddInbound(inboundJson)
+	if err1 == nil {
+		logger.Debug("New inbound added by api:", inbound.Tag)
+	} else {
+		logger.Debug("Unable to add inbound by api:", err1)
+		needRestart = true
+	}
+	s.xrayApi.Close()
+	return needRestart
 }
 
+// DelInbound moves the inbound to the recycle bin and deletes it with the
+// traffic, IP history and records of its clients in one transaction, then
+// removes it from xray.
 func (s *InboundService) DelInbound(id int) (bool, error) {
 	db := database.GetDB()
+	inbound := &model.Inbound{}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(model.Inbound{}).First(inbound, id).Error
+		if err != nil {
+			return err
+		}
+		err = s.recycleInbound(tx, inbound)
+		if err != nil {
+			return err
+		}
+
+		// Delete client traffics of inbounds
+		err = tx.Where("inbound_id = ?", id).Delete(xray.ClientTraffic{}).Error
+		if err != nil {
+			return err
+		}
+		clients, err := s.GetClients(inbound)
+		if err != nil {
+			return err
+		}
+		for _, client := range clients {
+			err := s.DelClientIPs(tx, client.Email)
+			if err != nil {
+				return err
+			}
+		}
+		err = tx.Where("inbound_id = ?", id).Delete(model.ClientRecord{}).Error
+		if err != nil {
+			return err
+		}
+
+		err = tx.Delete(model.Inbound{}, id).Error
+		if err != nil {
+			return err
+		}
+		s.audit(tx, "del_inbound", AuditTargetInbound, strconv.Itoa(id), auditInbound(inbound), nil)
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
 
-	var tag string
 	needRestart := false
-	result := db.Model(model.Inbound{}).Select("tag").Where("id = ? and enable = ?", id, true).First(&tag)
-	if result.Error == nil {
+	if inbound.Enable {
 		s.xrayApi.Init(p.GetAPIPort())
-		err1 := s.xrayApi.DelInbound(tag)
+		err1 := s.xrayApi.DelInbound(inbound.Tag)
 		if err1 == nil {
-			logger.Debug("Inbound deleted by api:", tag)
+			logger.Debug("Inbound deleted by api:", inbound.Tag)
 		} else {
 			logger.Debug("Unable to delete inbound by api:", err1)
 			needRestart = true
 		}
 		s.xrayApi.Close()
-	} else {
-		logger.Debug("No enabled inbound founded to removing by api", tag)
-	}
-
-	// Delete client traffics of inbounds
-	err := db.Where("inbound_id = ?", id).Delete(xray.ClientTraffic{}).Error
-	if err != nil {
-		return false, err
 	}
-	inbound, err := s.GetInbound(id)
-	if err != nil {
-		return false, err
-	}
-	clients, err := s.GetClients(inbound)
-	if err != nil {
-		return false, err
-	}
-	for _, client := range clients {
-		err := s.DelClientIPs(db, client.Email)
-		if err != nil {
-			return false, err
-		}
-	}
-
-	return needRestart, db.Delete(model.Inbound{}, id).Error
+	return needRestart, nil
 }
 
 func (s *InboundService) GetInbound(id int) (*model.Inbound, error) {
@@ -312,13 +399,23 @@ func (s *InboundService) UpdateInbound(inbound *model.Inbound) (*model.Inbound,
 	if exist {
 		return inbound, false, common.NewError("Port already exists:", inbound.Port)
 	}
+	err = ValidateTrafficReset(inbound.TrafficReset)
+	if err != nil {
+		return inbound, false, err
+	}
 
 	oldInbound, err := s.GetInbound(inbound.Id)
 	if err != nil {
 		return inbound, false, err
 	}
+	// the form carries all the clients, an edit of an older version would
+	// drop the changes made since
+	if inbound.Version != 0 && inbound.Version != oldInbound.Version {
+		return inbound, false, model.ErrInboundConflict
+	}
 
 	tag := oldInbound.Tag
+	before := auditInbound(oldInbound)
 
 	db := database.GetDB()
 	tx := db.Begin()
@@ -341,7 +438,11 @@ func (s *InboundService) UpdateInbound(inbound *model.Inbound) (*model.Inbound,
 	oldInbound.Total = inbound.Total
 	oldInbound.Remark = inbound.Remark
 	oldInbound.Enable = inbound.Enable
+	if inbound.Enable {
+		oldInbound.AutoDisabled = false
+	}
 	oldInbound.ExpiryTime = inbound.ExpiryTime
+	oldInbound.TrafficReset = inbound.TrafficReset
 	oldInbound.Listen = inbound.Listen
 	oldInbound.Port = inbound.Port
 	oldInbound.Protocol = inbound.Protocol
@@ -354,6 +455,10 @@ func (s *InboundService) UpdateInbound(inbound *model.Inbound) (*model.Inbound,
 	} else {
 		oldInbound.Tag = fmt.Sprintf("inbound-%v:%v", inbound.Listen, inbound.Port)
 	}
+	err = renameTrafficRollups(tx, RollupInbound, tag, oldInbound.Tag)
+	if err != nil {
+		return inbound, false, err
+	}
 
 	needRestart := false
 	s.xrayApi.Init(p.GetAPIPort())
@@ -377,7 +482,12 @@ func (s *InboundService) UpdateInbound(inbound *model.Inbound) (*model.Inbound,
 	}
 	s.xrayApi.Close()
 
-	return inbound, needRestart, tx.Save(oldInbound).Error
+	err = tx.Save(oldInbound).Error
+	if err != nil {
+		return inbound, needRestart, err
+	}
+	s.audit(tx, "update_inbound", AuditTargetInbound, strconv.Itoa(oldInbound.Id), before, auditInbound(oldInbound))
+	return inbound, needRestart, nil
 }
 
 func (s *InboundService) updateClientTraffics(tx *gorm.DB, oldInbound *model.Inbound, newInbound *model.Inbound) error {
@@ -474,18 +584,6 @@ func (s *InboundService) AddInboundClientWithTx(tx *gorm.DB, data *model.Inbound
 		return false, err
 	}
 
-	oldClients := oldSettings["clients"].([]interface{})
-	oldClients = append(oldClients, interfaceClients...)
-
-	oldSettings["clients"] = oldClients
-
-	newSettings, err := json.MarshalIndent(oldSettings, "", "  ")
-	if err != nil {
-		return false, err
-	}
-
-	oldInbound.Settings = string(newSettings)
-
 	needRestart := false
 	s.xrayApi.Init(p.GetAPIPort())
 	for _, client := range clients {
@@ -496,13 +594,14 @@ func (s *InboundService) AddInboundClientWithTx(tx *gorm.DB, data *model.Inbound
 				if oldInbound.Protocol == "shadowsocks" {
 					cipher = oldSettings["method"].(string)
 				}
-				err1 := s.xrayApi.AddUser(string(oldInbound.Protocol), oldInbound.Tag, map[string]interface{}{
-					"email":    client.Email,
-					"id":       client.ID,
-					"security": client.Security,
-					"flow":     client.Flow,
-					"password": client.Password,
-					"cipher":   cipher,
+				err1 := s.addXrayUser(string(oldInbound.Protocol), oldInbound.Tag, map[string]interface{}{
+					"email":     client.Email,
+					"id":        client.ID,
+					"security":  client.Security,
+					"flow":      client.Flow,
+					"password":  client.Password,
+					"cipher":    cipher,
+					"speedTier": client.SpeedTier,
 				})
 				if err1 == nil {
 					logger.Debug("Client added by api:", client.Email)
@@ -517,10 +616,86 @@ func (s *InboundService) AddInboundClientWithTx(tx *gorm.DB, data *model.Inbound
 	}
 	s.xrayApi.Close()
 
-	return needRestart, tx.Save(oldInbound).Error
+	err = s.insertClients(tx, oldInbound, clients, interfaceClients)
+	if err != nil {
+		return needRestart, err
+	}
+	for _, client := range clients {
+		s.audit(tx, "add_client", AuditTargetClient, client.Email, nil, client)
+	}
+	return needRestart, nil
+}
+
+// insertClients adds the clients after the clients of the inbound, with
+// interfaceClients their entries in the settings.
+func (s *InboundService) insertClients(tx *gorm.DB, inbound *model.Inbound, clients []model.Client, interfaceClients []interface{}) error {
+	err := inbound.BumpVersion(tx)
+	if err != nil {
+		return err
+	}
+	position := -1
+	err = tx.Model(model.ClientRecord{}).Where("inbound_id = ?", inbound.Id).
+		Select("COALESCE(MAX(position), -1)").Scan(&position).Error
+	if err != nil {
+		return err
+	}
+	for index := range clients {
+		position++
+		record := model.NewClientRecord(inbound.Id, position, &clients[index], clientMethod(interfaceClients[index]))
+		err = tx.Create(&record).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// findClientRecord returns the record of the client of the inbound with the
+// given client id, see GetClientId.
+func (s *InboundService) findClientRecord(tx *gorm.DB, inbound *model.Inbound, clientId string) (*model.ClientRecord, error) {
+	var records []*model.ClientRecord
+	err := tx.Where("inbound_id = ?", inbound.Id).Order("position, id").Find(&records).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, record := range records {
+		if GetClientId(inbound.Protocol, *record.Client()) == clientId {
+			return record, nil
+		}
+	}
+	return nil, nil
+}
+
+// clientMethod returns the method of an entry of the clients of the settings.
+func clientMethod(client interface{}) string {
+	c, _ := client.(map[string]interface{})
+	method, _ := c["method"].(string)
+	return method
+}
+
+// inboundConflictRetries is how often a client change is tried when the
+// inbound keeps being saved by others, e.g. the traffic job, meanwhile.
+const inboundConflictRetries = 3
+
+// retryOnConflict runs a read-modify-write of an inbound again, from a fresh
+// read, when the save found a newer version of the inbound.
+func retryOnConflict(change func() (bool, error)) (needRestart bool, err error) {
+	for range inboundConflictRetries {
+		needRestart, err = change()
+		if !errors.Is(err, model.ErrInboundConflict) {
+			break
+		}
+	}
+	return needRestart, err
 }
 
 func (s *InboundService) AddInboundClient(data *model.Inbound) (bool, error) {
+	return retryOnConflict(func() (bool, error) {
+		return s.addInboundClient(data)
+	})
+}
+
+func (s *InboundService) addInboundClient(data *model.Inbound) (bool, error) {
 	clients, err := s.GetClients(data)
 	if err != nil {
 		return false, err
@@ -554,6 +729,14 @@ func (s *InboundService) AddInboundClient(data *model.Inbound) (bool, error) {
 
 	// Secure client ID
 	for _, client := range clients {
+		err = ValidateTrafficReset(client.TrafficReset)
+		if err != nil {
+			return false, err
+		}
+		err = checkSpeedTier(client.SpeedTier)
+		if err != nil {
+			return false, err
+		}
 		if oldInbound.Protocol == "trojan" {
 			if client.Password == "" {
 				return false, common.NewError("empty client ID")
@@ -569,70 +752,46 @@ func (s *InboundService) AddInboundClient(data *model.Inbound) (bool, error) {
 		}
 	}
 
-	var oldSettings map[string]interface{}
-	err = json.Unmarshal([]byte(oldInbound.Settings), &oldSettings)
-	if err != nil {
-		return false, err
-	}
-
-	oldClients := oldSettings["clients"].([]interface{})
-	oldClients = append(oldClients, interfaceClients...)
-
-	oldSettings["clients"] = oldClients
-
-	newSettings, err := json.MarshalIndent(oldSettings, "", "  ")
-	if err != nil {
-		return false, err
+	// the clients join xray only once they are committed
+	needRestart := false
+	ops := xrayUserOps{}
+	for _, client := range clients {
+		if len(client.Email) == 0 {
+			needRestart = true
+		} else if client.Enable {
+			ops.adds = append(ops.adds, xrayUserOf(oldInbound, &client))
+		}
 	}
 
-	oldInbound.Settings = string(newSettings)
-
 	db := database.GetDB()
-	tx := db.Begin()
-
-	defer func() {
+	err = db.Transaction(func(tx *gorm.DB) error {
+		for _, client := range clients {
+			if len(client.Email) > 0 {
+				s.AddClientStat(tx, data.Id, &client)
+			}
+		}
+		err := s.insertClients(tx, oldInbound, clients, interfaceClients)
 		if err != nil {
-			tx.Rollback()
-		} else {
-			tx.Commit()
+			return err
 		}
-	}()
-
-	needRestart := false
-	s.xrayApi.Init(p.GetAPIPort())
-	for _, client := range clients {
-		if len(client.Email) > 0 {
-			s.AddClientStat(tx, data.Id, &client)
-			if client.Enable {
-				cipher := ""
-				if oldInbound.Protocol == "shadowsocks" {
-					cipher = oldSettings["method"].(string)
-				}
-				err1 := s.xrayApi.AddUser(string(oldInbound.Protocol), oldInbound.Tag, map[string]interface{}{
-					"email":    client.Email,
-					"id":       client.ID,
-					"security": client.Security,
-					"flow":     client.Flow,
-					"password": client.Password,
-					"cipher":   cipher,
-				})
-				if err1 == nil {
-					logger.Debug("Client added by api:", client.Email)
-				} else {
-					logger.Debug("Error in adding client by api:", err1)
-					needRestart = true
-				}
-			}
-		} else {
-			needRestart = true
+		for _, client := range clients {
+			s.audit(tx, "add_client", AuditTargetClient, client.Email, nil, client)
 		}
+		return nil
+	})
+	if err != nil {
+		return false, err
 	}
-	s.xrayApi.Close()
-
-	return needRestart, tx.Save(oldInbound).Error
+	return ops.apply(s) || needRestart, nil
 }
 
 func (s *InboundService) DelInboundClient(inboundId int, clientId string) (bool, error) {
+	return retryOnConflict(func() (bool, error) {
+		return s.delInboundClient(inboundId, clientId)
+	})
+}
+
+func (s *InboundService) delInboundClient(inboundId int, clientId string) (bool, error) {
 	oldInbound, err := s.GetInbound(inboundId)
 	if err != nil {
 		logger.Error("Load Old Data Error")
@@ -655,11 +814,13 @@ func (s *InboundService) DelInboundClient(inboundId int, clientId string) (bool,
 
 	interfaceClients := settings["clients"].([]interface{})
 	var newClients []interface{}
+	var deletedClient map[string]interface{}
 	needApiDel := false
 	for _, client := range interfaceClients {
 		c := client.(map[string]interface{})
 		c_id := c[client_key].(string)
 		if c_id == clientId {
+			deletedClient = c
 			email, _ = c["email"].(string)
 			needApiDel, _ = c["enable"].(bool)
 		} else {
@@ -671,52 +832,78 @@ func (s *InboundService) DelInboundClient(inboundId int, clientId string) (bool,
 		return false, common.NewError("no client remained in Inbound")
 	}
 
-	settings["clients"] = newClients
-	newSettings, err := json.MarshalIndent(settings, "", "  ")
-	if err != nil {
-		return false, err
-	}
-
-	oldInbound.Settings = string(newSettings)
-
+	// the client leaves xray only once its removal is committed
+	needApiDel = needApiDel && len(email) > 0
 	db := database.GetDB()
-
-	err = s.DelClientIPs(db, email)
-	if err != nil {
-		logger.Error("Error in delete client IPs")
-		return false, err
-	}
-	needRestart := false
-
-	if len(email) > 0 {
-		notDepleted := true
-		err = db.Model(xray.ClientTraffic{}).Select("enable").Where("email = ?", email).First(&notDepleted).Error
-		if err != nil {
-			logger.Error("Get stats error")
-			return false, err
-		}
-		err = s.DelClientStat(db, email)
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if deletedClient != nil {
+			err := s.recycleClient(tx, oldInbound.Id, deletedClient)
+			if err != nil {
+				return err
+			}
+		}
+		err := s.DelClientIPs(tx, email)
 		if err != nil {
-			logger.Error("Delete stats Data Error")
-			return false, err
+			logger.Error("Error in delete client IPs")
+			return err
 		}
-		if needApiDel && notDepleted {
-			s.xrayApi.Init(p.GetAPIPort())
-			err1 := s.xrayApi.RemoveUser(oldInbound.Tag, email)
-			if err1 == nil {
-				logger.Debug("Client deleted by api:", email)
-				needRestart = false
-			} else {
-				logger.Debug("Unable to del client by api:", err1)
-				needRestart = true
+		if len(email) > 0 {
+			notDepleted := true
+			err = tx.Model(xray.ClientTraffic{}).Select("enable").Where("email = ?", email).First(&notDepleted).Error
+			if err != nil {
+				logger.Error("Get stats error")
+				return err
+			}
+			needApiDel = needApiDel && notDepleted
+			err = s.DelClientStat(tx, email)
+			if err != nil {
+				logger.Error("Delete stats Data Error")
+				return err
 			}
-			s.xrayApi.Close()
 		}
+		err = oldInbound.BumpVersion(tx)
+		if err != nil {
+			return err
+		}
+		record, err := s.findClientRecord(tx, oldInbound, clientId)
+		if err != nil {
+			return err
+		}
+		if record != nil {
+			err = tx.Delete(record).Error
+			if err != nil {
+				return err
+			}
+		}
+		s.audit(tx, "del_client", AuditTargetClient, email, deletedClient, nil)
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+
+	needRestart := false
+	if needApiDel {
+		s.xrayApi.Init(p.GetAPIPort())
+		err1 := s.xrayApi.RemoveUser(oldInbound.Tag, email)
+		if err1 == nil {
+			logger.Debug("Client deleted by api:", email)
+		} else {
+			logger.Debug("Unable to del client by api:", err1)
+			needRestart = true
+		}
+		s.xrayApi.Close()
 	}
-	return needRestart, db.Save(oldInbound).Error
+	return needRestart, nil
 }
 
 func (s *InboundService) UpdateInboundClient(data *model.Inbound, clientId string) (bool, error) {
+	return retryOnConflict(func() (bool, error) {
+		return s.updateInboundClient(data, clientId)
+	})
+}
+
+func (s *InboundService) updateInboundClient(data *model.Inbound, clientId string) (bool, error) {
 	clients, err := s.GetClients(data)
 	if err != nil {
 		return false, err
@@ -727,6 +914,14 @@ func (s *InboundService) UpdateInboundClient(data *model.Inbound, clientId strin
 	if !valid {
 		return false, err
 	}
+	err = ValidateTrafficReset(clients[0].TrafficReset)
+	if err != nil {
+		return false, err
+	}
+	err = checkSpeedTier(clients[0].SpeedTier)
+	if err != nil {
+		return false, err
+	}
 
 	var settings map[string]interface{}
 	err = json.Unmarshal([]byte(data.Settings), &settings)
@@ -783,97 +978,84 @@ func (s *InboundService) UpdateInboundClient(data *model.Inbound, clientId strin
 		}
 	}
 
-	var oldSettings map[string]interface{}
-	err = json.Unmarshal([]byte(oldInbound.Settings), &oldSettings)
-	if err != nil {
-		return false, err
-	}
-	settingsClients := oldSettings["clients"].([]interface{})
-	settingsClients[clientIndex] = interfaceClients[0]
-	oldSettings["clients"] = settingsClients
-
-	newSettings, err := json.MarshalIndent(oldSettings, "", "  ")
-	if err != nil {
-		return false, err
+	// the old user leaves and the new one joins xray only once the change is
+	// committed
+	needRestart := false
+	ops := xrayUserOps{}
+	if len(oldEmail) > 0 {
+		if oldClients[clientIndex].Enable {
+			ops.removes = append(ops.removes, xrayUserOp{tag: oldInbound.Tag, email: oldEmail})
+		}
+		if clients[0].Enable {
+			ops.adds = append(ops.adds, xrayUserOf(oldInbound, &clients[0]))
+		}
+	} else {
+		logger.Debug("Client old email not found")
+		needRestart = true
 	}
 
-	oldInbound.Settings = string(newSettings)
 	db := database.GetDB()
-	tx := db.Begin()
-
-	defer func() {
-		if err != nil {
-			tx.Rollback()
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if len(clients[0].Email) > 0 {
+			if len(oldEmail) > 0 {
+				err := s.UpdateClientStat(tx, oldEmail, &clients[0])
+				if err != nil {
+					return err
+				}
+				err = s.UpdateClientIPs(tx, oldEmail, clients[0].Email)
+				if err != nil {
+					return err
+				}
+				err = renameTrafficRollups(tx, RollupClient, oldEmail, clients[0].Email)
+				if err != nil {
+					return err
+				}
+				err = tx.Model(model.CustomerClient{}).Where("email = ?", oldEmail).Update("email", clients[0].Email).Error
+				if err != nil {
+					return err
+				}
+			} else {
+				s.AddClientStat(tx, data.Id, &clients[0])
+			}
 		} else {
-			tx.Commit()
-		}
-	}()
-
-	if len(clients[0].Email) > 0 {
-		if len(oldEmail) > 0 {
-			err = s.UpdateClientStat(tx, oldEmail, &clients[0])
+			err := s.DelClientStat(tx, oldEmail)
 			if err != nil {
-				return false, err
+				return err
 			}
-			err = s.UpdateClientIPs(tx, oldEmail, clients[0].Email)
+			err = s.DelClientIPs(tx, oldEmail)
 			if err != nil {
-				return false, err
+				return err
 			}
-		} else {
-			s.AddClientStat(tx, data.Id, &clients[0])
 		}
-	} else {
-		err = s.DelClientStat(tx, oldEmail)
+		err := oldInbound.BumpVersion(tx)
 		if err != nil {
-			return false, err
+			return err
 		}
-		err = s.DelClientIPs(tx, oldEmail)
+		oldRecord, err := s.findClientRecord(tx, oldInbound, clientId)
 		if err != nil {
-			return false, err
+			return err
 		}
-	}
-	needRestart := false
-	if len(oldEmail) > 0 {
-		s.xrayApi.Init(p.GetAPIPort())
-		if oldClients[clientIndex].Enable {
-			err1 := s.xrayApi.RemoveUser(oldInbound.Tag, oldEmail)
-			if err1 == nil {
-				logger.Debug("Old client deleted by api:", clients[0].Email)
-			} else {
-				logger.Debug("Error in deleting client by api:", err1)
-				needRestart = true
-			}
+		if oldRecord == nil {
+			return common.NewError("Client Not Found:", oldEmail)
 		}
-		if clients[0].Enable {
-			cipher := ""
-			if oldInbound.Protocol == "shadowsocks" {
-				cipher = oldSettings["method"].(string)
-			}
-			err1 := s.xrayApi.AddUser(string(oldInbound.Protocol), oldInbound.Tag, map[string]interface{}{
-				"email":    clients[0].Email,
-				"id":       clients[0].ID,
-				"security": clients[0].Security,
-				"flow":     clients[0].Flow,
-				"password": clients[0].Password,
-				"cipher":   cipher,
-			})
-			if err1 == nil {
-				logger.Debug("Client edited by api:", clients[0].Email)
-			} else {
-				logger.Debug("Error in adding client by api:", err1)
-				needRestart = true
-			}
+		record := model.NewClientRecord(oldInbound.Id, oldRecord.Position, &clients[0], clientMethod(interfaceClients[0]))
+		record.Id = oldRecord.Id
+		err = tx.Save(&record).Error
+		if err != nil {
+			return err
 		}
-		s.xrayApi.Close()
-	} else {
-		logger.Debug("Client old email not found")
-		needRestart = true
+		s.audit(tx, "update_client", AuditTargetClient, clients[0].Email, oldClients[clientIndex], clients[0])
+		return nil
+	})
+	if err != nil {
+		return false, err
 	}
-	return needRestart, tx.Save(oldInbound).Error
+	return ops.apply(s) || needRestart, nil
 }
 
 func (s *InboundService) AddTraffic(inboundTraffics []*xray.Traffic, clientTraffics []*xray.ClientTraffic) (error, bool) {
 	var err error
+	var events []ClientEvent
 	db := database.GetDB()
 	tx := db.Begin()
 
@@ -882,6 +1064,7 @@ func (s *InboundService) AddTraffic(inboundTraffics []*xray.Traffic, clientTraff
 			tx.Rollback()
 		} else {
 			tx.Commit()
+			fireClientEvents(events)
 		}
 	}()
 	err = s.addInboundTraffic(tx, inboundTraffics)
@@ -893,18 +1076,41 @@ func (s *InboundService) AddTraffic(inboundTraffics []*xray.Traffic, clientTraff
 		return err, false
 	}
 
-	needRestart0, count, err := s.autoRenewClients(tx)
+	needRestart0, renewed, err := s.autoRenewClients(tx)
 	if err != nil {
 		logger.Warning("Error in renew clients:", err)
-	} else if count > 0 {
-		logger.Debugf("%v clients renewed", count)
+	} else if len(renewed) > 0 {
+		logger.Debugf("%v clients renewed", len(renewed))
+		events = append(events, renewed...)
 	}
 
-	needRestart1, count, err := s.disableInvalidClients(tx)
+	needRestart4, err := s.restoreThrottledClients(tx)
+	if err != nil {
+		logger.Warning("Error in restoring throttled clients:", err)
+	}
+
+	needRestart5, throttled, err := s.throttleCappedClients(tx)
+	if err != nil {
+		logger.Warning("Error in throttling clients:", err)
+	} else if len(throttled) > 0 {
+		logger.Debugf("%v clients throttled", len(throttled))
+		events = append(events, throttled...)
+	}
+
+	needRestart1, disabled, err := s.disableInvalidClients(tx)
 	if err != nil {
 		logger.Warning("Error in disabling invalid clients:", err)
-	} else if count > 0 {
-		logger.Debugf("%v clients disabled", count)
+	} else if len(disabled) > 0 {
+		logger.Debugf("%v clients disabled", len(disabled))
+		events = append(events, disabled...)
+	}
+
+	needRestart3, overQuota, err := s.disableOverQuotaCustomers(tx)
+	if err != nil {
+		logger.Warning("Error in disabling clients of customers over quota:", err)
+	} else if len(overQuota) > 0 {
+		logger.Debugf("%v clients of customers over quota disabled", len(overQuota))
+		events = append(events, overQuota...)
 	}
 
 	needRestart2, count, err := s.disableInvalidInbounds(tx)
@@ -913,7 +1119,7 @@ func (s *InboundService) AddTraffic(inboundTraffics []*xray.Traffic, clientTraff
 	} else if count > 0 {
 		logger.Debugf("%v inbounds disabled", count)
 	}
-	return nil, (needRestart0 || needRestart1 || needRestart2)
+	return nil, (needRestart0 || needRestart1 || needRestart2 || needRestart3 || needRestart4 || needRestart5)
 }
 
 func (s *InboundService) addInboundTraffic(tx *gorm.DB, traffics []*xray.Traffic) error {
@@ -922,6 +1128,7 @@ func (s *InboundService) addInboundTraffic(tx *gorm.DB, traffics []*xray.Traffic
 	}
 
 	var err error
+	var inboundTraffics []*xray.Traffic
 
 	for _, traffic := range traffics {
 		if traffic.IsInbound {
@@ -933,8 +1140,14 @@ func (s *InboundService) addInboundTraffic(tx *gorm.DB, traffics []*xray.Traffic
 			if err != nil {
 				return err
 			}
+			inboundTraffics = append(inboundTraffics, traffic)
 		}
 	}
+
+	err = addTrafficRollups(tx, RollupInbound, inboundTraffics)
+	if err != nil {
+		logger.Warning("AddInboundTraffic update rollups ", err)
+	}
 	return nil
 }
 
@@ -992,155 +1205,137 @@ func (s *InboundService) addClientTraffic(tx *gorm.DB, traffics []*xray.ClientTr
 		logger.Warning("AddClientTraffic update data ", err)
 	}
 
+	err = addClientRollups(tx, traffics)
+	if err != nil {
+		logger.Warning("AddClientTraffic update rollups ", err)
+	}
+
 	return nil
 }
 
 func (s *InboundService) adjustTraffics(tx *gorm.DB, dbClientTraffics []*xray.ClientTraffic) ([]*xray.ClientTraffic, error) {
-	inboundIds := make([]int, 0, len(dbClientTraffics))
+	emails := make([]string, 0, len(dbClientTraffics))
 	for _, dbClientTraffic := range dbClientTraffics {
 		if dbClientTraffic.ExpiryTime < 0 {
-			inboundIds = append(inboundIds, dbClientTraffic.InboundId)
+			emails = append(emails, dbClientTraffic.Email)
 		}
 	}
 
-	if len(inboundIds) > 0 {
-		var inbounds []*model.Inbound
-		err := tx.Model(model.Inbound{}).Where("id IN (?)", inboundIds).Find(&inbounds).Error
+	if len(emails) > 0 {
+		var records []*model.ClientRecord
+		err := tx.Where("email IN ? AND expiry_time < 0", emails).Find(&records).Error
 		if err != nil {
 			return nil, err
 		}
-		for inbound_index := range inbounds {
-			settings := map[string]interface{}{}
-			json.Unmarshal([]byte(inbounds[inbound_index].Settings), &settings)
-			clients, ok := settings["clients"].([]interface{})
-			if ok {
-				var newClients []interface{}
-				for client_index := range clients {
-					c := clients[client_index].(map[string]interface{})
-					for traffic_index := range dbClientTraffics {
-						if dbClientTraffics[traffic_index].ExpiryTime < 0 && c["email"] == dbClientTraffics[traffic_index].Email {
-							oldExpiryTime := c["expiryTime"].(float64)
-							newExpiryTime := (time.Now().Unix() * 1000) - int64(oldExpiryTime)
-							c["expiryTime"] = newExpiryTime
-							dbClientTraffics[traffic_index].ExpiryTime = newExpiryTime
-							break
-						}
-					}
-					newClients = append(newClients, interface{}(c))
-				}
-				settings["clients"] = newClients
-				modifiedSettings, err := json.MarshalIndent(settings, "", "  ")
-				if err != nil {
-					return nil, err
+		inboundIds := make([]int, 0, len(records))
+		for _, record := range records {
+			newExpiryTime := (time.Now().Unix() * 1000) - record.ExpiryTime
+			err = tx.Model(record).Update("expiry_time", newExpiryTime).Error
+			if err != nil {
+				return nil, err
+			}
+			inboundIds = append(inboundIds, record.InboundId)
+			for traffic_index := range dbClientTraffics {
+				if dbClientTraffics[traffic_index].Email == record.Email {
+					dbClientTraffics[traffic_index].ExpiryTime = newExpiryTime
+					break
 				}
-
-				inbounds[inbound_index].Settings = string(modifiedSettings)
 			}
 		}
-		err = tx.Save(inbounds).Error
+		err = model.TouchInbounds(tx, inboundIds)
 		if err != nil {
 			logger.Warning("AddClientTraffic update inbounds ", err)
-			logger.Error(inbounds)
 		}
 	}
 
 	return dbClientTraffics, nil
 }
 
-func (s *InboundService) autoRenewClients(tx *gorm.DB) (bool, int64, error) {
+func (s *InboundService) autoRenewClients(tx *gorm.DB) (bool, []ClientEvent, error) {
 	// check for time expired
 	var traffics []*xray.ClientTraffic
 	now := time.Now().Unix() * 1000
-	var err, err1 error
+	var err error
 
 	err = tx.Model(xray.ClientTraffic{}).Where("reset > 0 and expiry_time > 0 and expiry_time <= ?", now).Find(&traffics).Error
 	if err != nil {
-		return false, 0, err
+		return false, nil, err
 	}
 	// return if there is no client to renew
 	if len(traffics) == 0 {
-		return false, 0, nil
+		return false, nil, nil
 	}
 
+	var emails []string
 	var inbound_ids []int
-	var inbounds []*model.Inbound
-	needRestart := false
-	var clientsToAdd []struct {
-		protocol string
-		tag      string
-		client   map[string]interface{}
-	}
-
 	for _, traffic := range traffics {
+		emails = append(emails, traffic.Email)
 		inbound_ids = append(inbound_ids, traffic.InboundId)
 	}
+	var records []*model.ClientRecord
+	err = tx.Where("email IN ?", emails).Find(&records).Error
+	if err != nil {
+		return false, nil, err
+	}
+	var inbounds []*model.Inbound
 	err = tx.Model(model.Inbound{}).Where("id IN ?", inbound_ids).Find(&inbounds).Error
 	if err != nil {
-		return false, 0, err
+		return false, nil, err
 	}
-	for inbound_index := range inbounds {
-		settings := map[string]interface{}{}
-		json.Unmarshal([]byte(inbounds[inbound_index].Settings), &settings)
-		clients := settings["clients"].([]interface{})
-		for client_index := range clients {
-			c := clients[client_index].(map[string]interface{})
-			for traffic_index, traffic := range traffics {
-				if traffic.Email == c["email"].(string) {
-					newExpiryTime := traffic.ExpiryTime
-					for newExpiryTime < now {
-						newExpiryTime += (int64(traffic.Reset) * 86400000)
-					}
-					c["expiryTime"] = newExpiryTime
-					traffics[traffic_index].ExpiryTime = newExpiryTime
-					traffics[traffic_index].Down = 0
-					traffics[traffic_index].Up = 0
-					if !traffic.Enable {
-						traffics[traffic_index].Enable = true
-						clientsToAdd = append(clientsToAdd,
-							struct {
-								protocol string
-								tag      string
-								client   map[string]interface{}
-							}{
-								protocol: string(inbounds[inbound_index].Protocol),
-								tag:      inbounds[inbound_index].Tag,
-								client:   c,
-							})
-					}
-					clients[client_index] = interface{}(c)
-					break
+	inboundsById := make(map[int]*model.Inbound, len(inbounds))
+	for _, inbound := range inbounds {
+		inboundsById[inbound.Id] = inbound
+	}
+
+	var events []ClientEvent
+	ops := xrayUserOps{}
+	renewedIds := make([]int, 0, len(records))
+	for _, record := range records {
+		for traffic_index, traffic := range traffics {
+			if traffic.Email != record.Email {
+				continue
+			}
+			newExpiryTime := traffic.ExpiryTime
+			for newExpiryTime < now {
+				newExpiryTime += (int64(traffic.Reset) * 86400000)
+			}
+			err = tx.Model(record).Update("expiry_time", newExpiryTime).Error
+			if err != nil {
+				return false, nil, err
+			}
+			renewedIds = append(renewedIds, record.InboundId)
+			traffics[traffic_index].ExpiryTime = newExpiryTime
+			traffics[traffic_index].Down = 0
+			traffics[traffic_index].Up = 0
+			events = append(events, ClientEvent{
+				Type:       ClientRenewed,
+				Email:      traffic.Email,
+				InboundId:  record.InboundId,
+				TgId:       record.TgID,
+				ExpiryTime: newExpiryTime,
+			})
+			if !traffic.Enable {
+				traffics[traffic_index].Enable = true
+				if inbound, ok := inboundsById[record.InboundId]; ok && record.Enable {
+					ops.adds = append(ops.adds, xrayUserOf(inbound, record.Client()))
 				}
 			}
+			break
 		}
-		settings["clients"] = clients
-		newSettings, err := json.MarshalIndent(settings, "", "  ")
-		if err != nil {
-			return false, 0, err
-		}
-		inbounds[inbound_index].Settings = string(newSettings)
 	}
-	err = tx.Save(inbounds).Error
+	err = model.TouchInbounds(tx, renewedIds)
 	if err != nil {
-		return false, 0, err
+		return false, nil, err
 	}
 	err = tx.Save(traffics).Error
 	if err != nil {
-		return false, 0, err
+		return false, nil, err
 	}
+	needRestart := false
 	if p != nil {
-		err1 = s.xrayApi.Init(p.GetAPIPort())
-		if err1 != nil {
-			return true, int64(len(traffics)), nil
-		}
-		for _, clientToAdd := range clientsToAdd {
-			err1 = s.xrayApi.AddUser(clientToAdd.protocol, clientToAdd.tag, clientToAdd.client)
-			if err1 != nil {
-				needRestart = true
-			}
-		}
-		s.xrayApi.Close()
+		needRestart = ops.apply(s)
 	}
-	return needRestart, int64(len(traffics)), nil
+	return needRestart, events, nil
 }
 
 func (s *InboundService) disableInvalidInbounds(tx *gorm.DB) (bool, int64, error) {
@@ -1169,18 +1364,29 @@ func (s *InboundService) disableInvalidInbounds(tx *gorm.DB) (bool, int64, error
 		s.xrayApi.Close()
 	}
 
-	result := tx.Model(model.Inbound{}).
+	result := tx.Model(&model.Inbound{}).
 		Where("((total > 0 and up + down >= total) or (expiry_time > 0 and expiry_time <= ?)) and enable = ?", now, true).
-		Update("enable", false)
+		Updates(map[string]interface{}{"enable": false, "auto_disabled": true})
 	err := result.Error
 	count := result.RowsAffected
 	return needRestart, count, err
 }
 
-func (s *InboundService) disableInvalidClients(tx *gorm.DB) (bool, int64, error) {
+func (s *InboundService) disableInvalidClients(tx *gorm.DB) (bool, []ClientEvent, error) {
 	now := time.Now().Unix() * 1000
 	needRestart := false
 
+	var disabled []*xray.ClientTraffic
+	err := tx.Model(xray.ClientTraffic{}).
+		Where("((total > 0 and up + down >= total and throttled = ?) or (expiry_time > 0 and expiry_time <= ?)) and enable = ?", false, now, true).
+		Find(&disabled).Error
+	if err != nil {
+		return false, nil, err
+	}
+	if len(disabled) == 0 {
+		return false, nil, nil
+	}
+
 	if p != nil {
 		var results []struct {
 			Tag   string
@@ -1190,10 +1396,10 @@ func (s *InboundService) disableInvalidClients(tx *gorm.DB) (bool, int64, error)
 		err := tx.Table("inbounds").
 			Select("inbounds.tag, client_traffics.email").
 			Joins("JOIN client_traffics ON inbounds.id = client_traffics.inbound_id").
-			Where("((client_traffics.total > 0 AND client_traffics.up + client_traffics.down >= client_traffics.total) OR (client_traffics.expiry_time > 0 AND client_traffics.expiry_time <= ?)) AND client_traffics.enable = ?", now, true).
+			Where("((client_traffics.total > 0 AND client_traffics.up + client_traffics.down >= client_traffics.total AND client_traffics.throttled = ?) OR (client_traffics.expiry_time > 0 AND client_traffics.expiry_time <= ?)) AND client_traffics.enable = ?", false, now, true).
 			Scan(&results).Error
 		if err != nil {
-			return false, 0, err
+			return false, nil, err
 		}
 		s.xrayApi.Init(p.GetAPIPort())
 		for _, result := range results {
@@ -1208,11 +1414,133 @@ func (s *InboundService) disableInvalidClients(tx *gorm.DB) (bool, int64, error)
 		s.xrayApi.Close()
 	}
 	result := tx.Model(xray.ClientTraffic{}).
-		Where("((total > 0 and up + down >= total) or (expiry_time > 0 and expiry_time <= ?)) and enable = ?", now, true).
+		Where("((total > 0 and up + down >= total and throttled = ?) or (expiry_time > 0 and expiry_time <= ?)) and enable = ?", false, now, true).
 		Update("enable", false)
-	err := result.Error
-	count := result.RowsAffected
-	return needRestart, count, err
+	err = result.Error
+	if err != nil {
+		return needRestart, nil, err
+	}
+
+	events := make([]ClientEvent, 0, len(disabled))
+	for _, traffic := range disabled {
+		eventType := ClientDisabledExpiry
+		if traffic.Total > 0 && traffic.Up+traffic.Down >= traffic.Total && !traffic.Throttled {
+			eventType = ClientDisabledTraffic
+		}
+		events = append(events, ClientEvent{
+			Type:       eventType,
+			Email:      traffic.Email,
+			InboundId:  traffic.InboundId,
+			ExpiryTime: traffic.ExpiryTime,
+		})
+	}
+	return needRestart, events, nil
+}
+
+// throttleSettings returns the default cap policy and whether throttling is
+// configured at all. Without a throttle outbound or level, clients following
+// the throttle policy are disabled like the others.
+func (s *InboundService) throttleSettings() (string, bool, error) {
+	settingService := SettingService{}
+	policy, err := settingService.GetCapPolicy()
+	if err != nil {
+		return "", false, err
+	}
+	outbound, err := settingService.GetThrottleOutbound()
+	if err != nil {
+		return "", false, err
+	}
+	level, err := settingService.GetThrottleLevel()
+	if err != nil {
+		return "", false, err
+	}
+	return policy, outbound != "" || level > 0, nil
+}
+
+// throttleCappedClients marks the clients which used up their traffic and
+// follow the throttle policy as throttled. They stay in xray at a lower speed
+// instead of being disabled.
+func (s *InboundService) throttleCappedClients(tx *gorm.DB) (bool, []ClientEvent, error) {
+	policy, enabled, err := s.throttleSettings()
+	if err != nil || !enabled {
+		return false, nil, err
+	}
+
+	var throttled []*xray.ClientTraffic
+	err = tx.Model(xray.ClientTraffic{}).
+		Select("client_traffics.*").
+		Joins("JOIN clients ON clients.email = client_traffics.email").
+		Where("client_traffics.total > 0 AND client_traffics.up + client_traffics.down >= client_traffics.total AND client_traffics.enable = ? AND client_traffics.throttled = ?", true, false).
+		Where("clients.cap_policy = ? OR (clients.cap_policy = '' AND ? = ?)", "throttle", policy, "throttle").
+		Find(&throttled).Error
+	if err != nil {
+		return false, nil, err
+	}
+	if len(throttled) == 0 {
+		return false, nil, nil
+	}
+
+	emails := make([]string, 0, len(throttled))
+	events := make([]ClientEvent, 0, len(throttled))
+	for _, traffic := range throttled {
+		emails = append(emails, traffic.Email)
+		events = append(events, ClientEvent{
+			Type:       ClientThrottled,
+			Email:      traffic.Email,
+			InboundId:  traffic.InboundId,
+			ExpiryTime: traffic.ExpiryTime,
+		})
+	}
+	err = tx.Model(xray.ClientTraffic{}).Where("email IN ?", emails).Update("throttled", true).Error
+	if err != nil {
+		return false, nil, err
+	}
+	// the throttle routing rule and policy level only change with a restart
+	return true, events, nil
+}
+
+// restoreThrottledClients gives full speed back to throttled clients whose
+// traffic was reset or raised, or which no longer follow the throttle policy.
+func (s *InboundService) restoreThrottledClients(tx *gorm.DB) (bool, error) {
+	policy, enabled, err := s.throttleSettings()
+	if err != nil {
+		return false, err
+	}
+
+	var results []struct {
+		Email     string
+		Total     int64
+		Up        int64
+		Down      int64
+		CapPolicy string
+	}
+	err = tx.Table("client_traffics").
+		Select("client_traffics.email, client_traffics.total, client_traffics.up, client_traffics.down, clients.cap_policy").
+		Joins("LEFT JOIN clients ON clients.email = client_traffics.email").
+		Where("client_traffics.throttled = ?", true).
+		Scan(&results).Error
+	if err != nil {
+		return false, err
+	}
+
+	var emails []string
+	for _, result := range results {
+		clientPolicy := result.CapPolicy
+		if clientPolicy == "" {
+			clientPolicy = policy
+		}
+		if !enabled || clientPolicy != "throttle" || result.Total == 0 || result.Up+result.Down < result.Total {
+			emails = append(emails, result.Email)
+		}
+	}
+	if len(emails) == 0 {
+		return false, nil
+	}
+	err = tx.Model(xray.ClientTraffic{}).Where("email IN ?", emails).Update("throttled", false).Error
+	if err != nil {
+		return false, err
+	}
+	return true, nil
 }
 
 func (s *InboundService) GetInboundTags() (string, error) {
@@ -1231,9 +1559,13 @@ func (s *InboundService) MigrationRemoveOrphanedTraffics() {
 	db.Exec(`
 		DELETE FROM client_traffics
 		WHERE email NOT IN (
-			SELECT JSON_EXTRACT(client.value, '$.email')
-			FROM inbounds,
-				JSON_EACH(JSON_EXTRACT(inbounds.settings, '$.clients')) AS client
+			SELECT email FROM clients
+		)
+	`)
+	db.Exec(`
+		DELETE FROM customer_clients
+		WHERE email NOT IN (
+			SELECT email FROM clients
 		)
 	`)
 }
@@ -1272,6 +1604,10 @@ func (s *InboundService) UpdateClientIPs(tx *gorm.DB, oldEmail string, newEmail
 }
 
 func (s *InboundService) DelClientStat(tx *gorm.DB, email string) error {
+	err := tx.Where("email = ?", email).Delete(model.CustomerClient{}).Error
+	if err != nil {
+		return err
+	}
 	return tx.Where("email = ?", email).Delete(xray.ClientTraffic{}).Error
 }
 
@@ -1333,362 +1669,395 @@ func (s *InboundService) GetClientByEmailIfExists(clientEmail string) (*xray.Cli
 }
 
 func (s *InboundService) GetClientByEmail(clientEmail string) (*xray.ClientTraffic, *model.Client, error) {
-	traffic, inbound, err := s.GetClientInboundByEmail(clientEmail)
+	traffic, err := s.GetClientTrafficByEmail(clientEmail)
 	if err != nil {
 		return nil, nil, err
 	}
-	if inbound == nil {
+	if traffic == nil {
 		return nil, nil, common.NewError("Inbound Not Found For Email:", clientEmail)
 	}
 
-	clients, err := s.GetClients(inbound)
+	record, err := s.getClientRecord(clientEmail)
 	if err != nil {
 		return nil, nil, err
 	}
-
-	for _, client := range clients {
-		if client.Email == clientEmail {
-			return traffic, &client, nil
-		}
+	if record == nil {
+		return nil, nil, common.NewError("Client Not Found In Inbound For Email:", clientEmail)
 	}
 
-	return nil, nil, common.NewError("Client Not Found In Inbound For Email:", clientEmail)
+	return traffic, record.Client(), nil
 }
 
 func (s *InboundService) SetClientTelegramUserID(trafficId int, tgId int64) (bool, error) {
-	traffic, inbound, err := s.GetClientInboundByTrafficID(trafficId)
-	if err != nil {
-		return false, err
-	}
-	if inbound == nil {
-		return false, common.NewError("Inbound Not Found For Traffic ID:", trafficId)
-	}
-
-	clientEmail := traffic.Email
-
-	oldClients, err := s.GetClients(inbound)
+	traffic, _, err := s.GetClientInboundByTrafficID(trafficId)
 	if err != nil {
 		return false, err
 	}
-
-	clientId := ""
-
-	for _, oldClient := range oldClients {
-		if oldClient.Email == clientEmail {
-			if inbound.Protocol == "trojan" {
-				clientId = oldClient.Password
-			} else if inbound.Protocol == "shadowsocks" {
-				clientId = oldClient.Email
-			} else {
-				clientId = oldClient.ID
-			}
-			break
-		}
-	}
-
-	if len(clientId) == 0 {
-		return false, common.NewError("Client Not Found For Email:", clientEmail)
+	if traffic == nil {
+		return false, common.NewError("Client Not Found For Traffic ID:", trafficId)
 	}
-
-	var settings map[string]interface{}
-	err = json.Unmarshal([]byte(inbound.Settings), &settings)
-	if err != nil {
-		return false, err
-	}
-	clients := settings["clients"].([]interface{})
-	var newClients []interface{}
-	for client_index := range clients {
-		c := clients[client_index].(map[string]interface{})
-		if c["email"] == clientEmail {
-			c["tgId"] = tgId
-			newClients = append(newClients, interface{}(c))
-		}
-	}
-	settings["clients"] = newClients
-	modifiedSettings, err := json.MarshalIndent(settings, "", "  ")
-	if err != nil {
-		return false, err
-	}
-	inbound.Settings = string(modifiedSettings)
-	needRestart, err := s.UpdateInboundClient(inbound, clientId)
-	return needRestart, err
+	return s.updateClientByEmail(traffic.Email, func(inbound *model.Inbound, c map[string]interface{}) {
+		c["tgId"] = tgId
+	})
 }
 
 func (s *InboundService) checkIsEnabledByEmail(clientEmail string) (bool, error) {
-	_, inbound, err := s.GetClientInboundByEmail(clientEmail)
+	record, err := s.getClientRecord(clientEmail)
 	if err != nil {
 		return false, err
 	}
-	if inbound == nil {
+	if record == nil {
 		return false, common.NewError("Inbound Not Found For Email:", clientEmail)
 	}
+	return record.Enable, nil
+}
 
-	clients, err := s.GetClients(inbound)
+// getClientRecord returns the client record with the email, nil when there
+// is none.
+func (s *InboundService) getClientRecord(email string) (*model.ClientRecord, error) {
+	db := database.GetDB()
+	var records []*model.ClientRecord
+	err := db.Model(model.ClientRecord{}).Where("email = ?", email).Limit(1).Find(&records).Error
 	if err != nil {
-		return false, err
+		return nil, err
 	}
-
-	isEnable := false
-
-	for _, client := range clients {
-		if client.Email == clientEmail {
-			isEnable = client.Enable
-			break
-		}
+	if len(records) == 0 {
+		return nil, nil
 	}
-
-	return isEnable, err
+	return records[0], nil
 }
 
-func (s *InboundService) ToggleClientEnableByEmail(clientEmail string) (bool, bool, error) {
-	_, inbound, err := s.GetClientInboundByEmail(clientEmail)
+func (s *InboundService) ToggleClientEnableByEmail(clientEmail string) (enabled bool, needRestart bool, err error) {
+	needRestart, err = s.updateClientByEmail(clientEmail, func(inbound *model.Inbound, c map[string]interface{}) {
+		enabled, _ = c["enable"].(bool)
+		enabled = !enabled
+		c["enable"] = enabled
+	})
 	if err != nil {
-		return false, false, err
-	}
-	if inbound == nil {
-		return false, false, common.NewError("Inbound Not Found For Email:", clientEmail)
+		return false, needRestart, err
 	}
+	return enabled, needRestart, nil
+}
 
-	oldClients, err := s.GetClients(inbound)
-	if err != nil {
-		return false, false, err
-	}
+func (s *InboundService) ResetClientIpLimitByEmail(clientEmail string, count int) (bool, error) {
+	return s.updateClientByEmail(clientEmail, func(inbound *model.Inbound, c map[string]interface{}) {
+		c["limitIp"] = count
+	})
+}
 
-	clientId := ""
-	clientOldEnabled := false
+func (s *InboundService) ResetClientExpiryTimeByEmail(clientEmail string, expiry_time int64) (bool, error) {
+	return s.updateClientByEmail(clientEmail, func(inbound *model.Inbound, c map[string]interface{}) {
+		c["expiryTime"] = expiry_time
+	})
+}
 
-	for _, oldClient := range oldClients {
-		if oldClient.Email == clientEmail {
-			if inbound.Protocol == "trojan" {
-				clientId = oldClient.Password
-			} else if inbound.Protocol == "shadowsocks" {
-				clientId = oldClient.Email
-			} else {
-				clientId = oldClient.ID
-			}
-			clientOldEnabled = oldClient.Enable
-			break
-		}
+func (s *InboundService) ResetClientTrafficLimitByEmail(clientEmail string, totalGB int) (bool, error) {
+	if totalGB < 0 {
+		return false, common.NewError("totalGB must be >= 0")
 	}
+	return s.updateClientByEmail(clientEmail, func(inbound *model.Inbound, c map[string]interface{}) {
+		c["totalGB"] = totalGB * 1024 * 1024 * 1024
+	})
+}
 
-	if len(clientId) == 0 {
-		return false, false, common.NewError("Client Not Found For Email:", clientEmail)
-	}
+// updateClientByEmail applies update to the client record with the given
+// email, as an entry of the settings, and stores it through
+// UpdateInboundClient, so the xray user is removed and re-added with the new
+// values.
+func (s *InboundService) updateClientByEmail(clientEmail string, update func(inbound *model.Inbound, c map[string]interface{})) (bool, error) {
+	return retryOnConflict(func() (bool, error) {
+		return s.updateClientByEmailOnce(clientEmail, update)
+	})
+}
 
-	var settings map[string]interface{}
-	err = json.Unmarshal([]byte(inbound.Settings), &settings)
+func (s *InboundService) updateClientByEmailOnce(clientEmail string, update func(inbound *model.Inbound, c map[string]interface{})) (bool, error) {
+	record, err := s.getClientRecord(clientEmail)
 	if err != nil {
-		return false, false, err
+		return false, err
 	}
-	clients := settings["clients"].([]interface{})
-	var newClients []interface{}
-	for client_index := range clients {
-		c := clients[client_index].(map[string]interface{})
-		if c["email"] == clientEmail {
-			c["enable"] = !clientOldEnabled
-			newClients = append(newClients, interface{}(c))
-		}
+	if record == nil {
+		return false, common.NewError("Client Not Found For Email:", clientEmail)
 	}
-	settings["clients"] = newClients
-	modifiedSettings, err := json.MarshalIndent(settings, "", "  ")
+	inbound, err := s.GetInbound(record.InboundId)
 	if err != nil {
-		return false, false, err
+		return false, err
 	}
-	inbound.Settings = string(modifiedSettings)
 
-	needRestart, err := s.UpdateInboundClient(inbound, clientId)
+	c := map[string]interface{}{}
+	data, err := json.Marshal(record.Client())
 	if err != nil {
-		return false, needRestart, err
+		return false, err
 	}
-
-	return !clientOldEnabled, needRestart, nil
-}
-
-func (s *InboundService) ResetClientIpLimitByEmail(clientEmail string, count int) (bool, error) {
-	_, inbound, err := s.GetClientInboundByEmail(clientEmail)
+	err = json.Unmarshal(data, &c)
 	if err != nil {
 		return false, err
 	}
-	if inbound == nil {
-		return false, common.NewError("Inbound Not Found For Email:", clientEmail)
+	if record.Method != "" {
+		c["method"] = record.Method
 	}
-
-	oldClients, err := s.GetClients(inbound)
+	update(inbound, c)
+	settings, err := json.Marshal(map[string]interface{}{"clients": []interface{}{c}})
 	if err != nil {
 		return false, err
 	}
+	changed := &model.Inbound{Id: inbound.Id, Settings: string(settings)}
+	return s.updateInboundClient(changed, GetClientId(inbound.Protocol, *record.Client()))
+}
 
-	clientId := ""
-
-	for _, oldClient := range oldClients {
-		if oldClient.Email == clientEmail {
-			if inbound.Protocol == "trojan" {
-				clientId = oldClient.Password
-			} else if inbound.Protocol == "shadowsocks" {
-				clientId = oldClient.Email
-			} else {
-				clientId = oldClient.ID
-			}
-			break
-		}
-	}
+// RegenerateClientCredentialByEmail issues a new UUID (or password for trojan
+// and shadowsocks) for the client, invalidating the old one in xray.
+func (s *InboundService) RegenerateClientCredentialByEmail(clientEmail string) (bool, error) {
+	return s.updateClientByEmail(clientEmail, func(inbound *model.Inbound, c map[string]interface{}) {
+		switch inbound.Protocol {
+		case model.Trojan:
+			c["password"] = random.Seq(10)
+		case model.Shadowsocks:
+			var settings map[string]interface{}
+			json.Unmarshal([]byte(inbound.Settings), &settings)
+			method, _ := settings["method"].(string)
+			c["password"] = genShadowsocksPassword(method)
+		default:
+			c["id"] = uuid.NewString()
+		}
+	})
+}
 
-	if len(clientId) == 0 {
-		return false, common.NewError("Client Not Found For Email:", clientEmail)
-	}
+func (s *InboundService) SetClientCommentByEmail(clientEmail string, comment string) (bool, error) {
+	return s.updateClientByEmail(clientEmail, func(_ *model.Inbound, c map[string]interface{}) {
+		c["comment"] = comment
+	})
+}
 
-	var settings map[string]interface{}
-	err = json.Unmarshal([]byte(inbound.Settings), &settings)
-	if err != nil {
-		return false, err
+// SetClientCapPolicyByEmail sets what happens when the client uses up its
+// traffic: "disable", "throttle" or "" for the panel default.
+func (s *InboundService) SetClientCapPolicyByEmail(clientEmail string, capPolicy string) (bool, error) {
+	if capPolicy != "" && capPolicy != "disable" && capPolicy != "throttle" {
+		return false, common.NewError("invalid cap policy:", capPolicy)
 	}
-	clients := settings["clients"].([]interface{})
-	var newClients []interface{}
-	for client_index := range clients {
-		c := clients[client_index].(map[string]interface{})
-		if c["email"] == clientEmail {
-			c["limitIp"] = count
-			newClients = append(newClients, interface{}(c))
+	return s.updateClientByEmail(clientEmail, func(_ *model.Inbound, c map[string]interface{}) {
+		if capPolicy == "" {
+			delete(c, "capPolicy")
+		} else {
+			c["capPolicy"] = capPolicy
 		}
-	}
-	settings["clients"] = newClients
-	modifiedSettings, err := json.MarshalIndent(settings, "", "  ")
-	if err != nil {
-		return false, err
-	}
-	inbound.Settings = string(modifiedSettings)
-	needRestart, err := s.UpdateInboundClient(inbound, clientId)
-	return needRestart, err
+	})
 }
 
-func (s *InboundService) ResetClientExpiryTimeByEmail(clientEmail string, expiry_time int64) (bool, error) {
-	_, inbound, err := s.GetClientInboundByEmail(clientEmail)
-	if err != nil {
-		return false, err
-	}
-	if inbound == nil {
-		return false, common.NewError("Inbound Not Found For Email:", clientEmail)
-	}
-
-	oldClients, err := s.GetClients(inbound)
+// SetClientTrafficResetByEmail sets the traffic reset schedule of the client,
+// "" falls back to the schedule of its inbound.
+func (s *InboundService) SetClientTrafficResetByEmail(clientEmail string, schedule string) (bool, error) {
+	err := ValidateTrafficReset(schedule)
 	if err != nil {
 		return false, err
 	}
-
-	clientId := ""
-
-	for _, oldClient := range oldClients {
-		if oldClient.Email == clientEmail {
-			if inbound.Protocol == "trojan" {
-				clientId = oldClient.Password
-			} else if inbound.Protocol == "shadowsocks" {
-				clientId = oldClient.Email
-			} else {
-				clientId = oldClient.ID
-			}
-			break
+	return s.updateClientByEmail(clientEmail, func(_ *model.Inbound, c map[string]interface{}) {
+		if schedule == "" {
+			delete(c, "trafficReset")
+		} else {
+			c["trafficReset"] = schedule
 		}
-	}
-
-	if len(clientId) == 0 {
-		return false, common.NewError("Client Not Found For Email:", clientEmail)
-	}
+	})
+}
 
-	var settings map[string]interface{}
-	err = json.Unmarshal([]byte(inbound.Settings), &settings)
+// SetClientSpeedTierByEmail sets the speed tier of the client, "" falls back
+// to the speed tier of its customer. The tier is part of the xray config, so
+// xray always needs a restart.
+func (s *InboundService) SetClientSpeedTierByEmail(clientEmail string, speedTier string) (bool, error) {
+	err := checkSpeedTier(speedTier)
 	if err != nil {
 		return false, err
 	}
-	clients := settings["clients"].([]interface{})
-	var newClients []interface{}
-	for client_index := range clients {
-		c := clients[client_index].(map[string]interface{})
-		if c["email"] == clientEmail {
-			c["expiryTime"] = expiry_time
-			newClients = append(newClients, interface{}(c))
+	_, err = s.updateClientByEmail(clientEmail, func(_ *model.Inbound, c map[string]interface{}) {
+		if speedTier == "" {
+			delete(c, "speedTier")
+		} else {
+			c["speedTier"] = speedTier
 		}
-	}
-	settings["clients"] = newClients
-	modifiedSettings, err := json.MarshalIndent(settings, "", "  ")
+	})
 	if err != nil {
 		return false, err
 	}
-	inbound.Settings = string(modifiedSettings)
-	needRestart, err := s.UpdateInboundClient(inbound, clientId)
-	return needRestart, err
+	return true, nil
 }
 
-func (s *InboundService) ResetClientTrafficLimitByEmail(clientEmail string, totalGB int) (bool, error) {
-	if totalGB < 0 {
-		return false, common.NewError("totalGB must be >= 0")
-	}
-	_, inbound, err := s.GetClientInboundByEmail(clientEmail)
+// ErrNoRenewPeriod is returned when turning on the auto-renewal of a client
+// which has no renewal period to go back to.
+var ErrNoRenewPeriod = errors.New("the client has no auto-renew period")
+
+// ToggleClientAutoRenewByEmail turns the auto-renewal of the client off,
+// keeping its period in renewDays, or on again with the kept period.
+func (s *InboundService) ToggleClientAutoRenewByEmail(clientEmail string) (bool, bool, error) {
+	// decided on the client as read by each try, not on a stale copy
+	autoRenew := false
+	hasPeriod := true
+	needRestart, err := s.updateClientByEmail(clientEmail, func(_ *model.Inbound, c map[string]interface{}) {
+		reset, _ := c["reset"].(float64)
+		renewDays, _ := c["renewDays"].(float64)
+		switch {
+		case reset > 0:
+			c["reset"] = 0
+			c["renewDays"] = reset
+		case renewDays > 0:
+			c["reset"] = renewDays
+			delete(c, "renewDays")
+			autoRenew = true
+		default:
+			hasPeriod = false
+		}
+	})
 	if err != nil {
-		return false, err
+		return false, needRestart, err
 	}
-	if inbound == nil {
-		return false, common.NewError("Inbound Not Found For Email:", clientEmail)
+	if !hasPeriod {
+		return false, needRestart, ErrNoRenewPeriod
 	}
+	return autoRenew, needRestart, nil
+}
 
-	oldClients, err := s.GetClients(inbound)
-	if err != nil {
-		return false, err
+// xrayUserOf returns the operation adding the client to the inbound in xray.
+func xrayUserOf(inbound *model.Inbound, client *model.Client) xrayUserOp {
+	cipher := ""
+	if inbound.Protocol == model.Shadowsocks {
+		settings := map[string]interface{}{}
+		json.Unmarshal([]byte(inbound.Settings), &settings)
+		cipher, _ = settings["method"].(string)
+	}
+	return xrayUserOp{
+		protocol: string(inbound.Protocol),
+		tag:      inbound.Tag,
+		email:    client.Email,
+		user: map[string]interface{}{
+			"email":     client.Email,
+			"id":        client.ID,
+			"security":  client.Security,
+			"flow":      client.Flow,
+			"password":  client.Password,
+			"cipher":    cipher,
+			"speedTier": client.SpeedTier,
+		},
 	}
+}
 
-	clientId := ""
+// addXrayUser adds the user to the inbound in xray at the policy level
+// GetXrayConfig would give it.
+func (s *InboundService) addXrayUser(protocol string, tag string, user map[string]interface{}) error {
+	email, _ := user["email"].(string)
+	speedTier, _ := user["speedTier"].(string)
+	level := clientLevel(email, speedTier)
+	if level > 0 {
+		leveled := make(map[string]interface{}, len(user)+1)
+		for key, value := range user {
+			leveled[key] = value
+		}
+		leveled["level"] = level
+		user = leveled
+	}
+	return s.xrayApi.AddUser(protocol, tag, user)
+}
 
-	for _, oldClient := range oldClients {
-		if oldClient.Email == clientEmail {
-			if inbound.Protocol == "trojan" {
-				clientId = oldClient.Password
-			} else if inbound.Protocol == "shadowsocks" {
-				clientId = oldClient.Email
-			} else {
-				clientId = oldClient.ID
-			}
-			break
-		}
+// GetClientId returns the value identifying the client within an inbound of
+// the given protocol, as expected by UpdateInboundClient and DelInboundClient.
+func GetClientId(protocol model.Protocol, client model.Client) string {
+	switch protocol {
+	case model.Trojan:
+		return client.Password
+	case model.Shadowsocks:
+		return client.Email
+	default:
+		return client.ID
 	}
+}
 
-	if len(clientId) == 0 {
-		return false, common.NewError("Client Not Found For Email:", clientEmail)
+// NewClientSettings returns the settings of an inbound holding a single new
+// client with generated credentials, ready for AddInboundClient.
+func (s *InboundService) NewClientSettings(inbound *model.Inbound, client model.Client) (string, error) {
+	var settings map[string]interface{}
+	err := json.Unmarshal([]byte(inbound.Settings), &settings)
+	if err != nil {
+		return "", err
 	}
 
-	var settings map[string]interface{}
-	err = json.Unmarshal([]byte(inbound.Settings), &settings)
+	newSettings, err := json.Marshal(map[string]interface{}{
+		"clients": []interface{}{newClientMap(inbound, settings, client)},
+	})
 	if err != nil {
-		return false, err
+		return "", err
 	}
-	clients := settings["clients"].([]interface{})
-	var newClients []interface{}
-	for client_index := range clients {
-		c := clients[client_index].(map[string]interface{})
-		if c["email"] == clientEmail {
-			c["totalGB"] = totalGB * 1024 * 1024 * 1024
-			newClients = append(newClients, interface{}(c))
+	return string(newSettings), nil
+}
+
+// newClientMap returns the settings entry of a new enabled client of the
+// inbound with generated credentials.
+func newClientMap(inbound *model.Inbound, settings map[string]interface{}, client model.Client) map[string]interface{} {
+	newClient := map[string]interface{}{
+		"email":      client.Email,
+		"limitIp":    client.LimitIP,
+		"totalGB":    client.TotalGB,
+		"expiryTime": client.ExpiryTime,
+		"enable":     true,
+		"tgId":       client.TgID,
+		"subId":      random.Seq(16),
+		"reset":      0,
+	}
+
+	switch inbound.Protocol {
+	case model.Trojan:
+		newClient["password"] = random.Seq(10)
+	case model.Shadowsocks:
+		method, _ := settings["method"].(string)
+		newClient["method"] = ""
+		newClient["password"] = genShadowsocksPassword(method)
+	default:
+		newClient["id"] = uuid.NewString()
+		if inbound.Protocol == model.VMESS {
+			newClient["security"] = "auto"
+		}
+		// reuse the flow of existing clients, e.g. xtls-rprx-vision
+		if clients, ok := settings["clients"].([]interface{}); ok && len(clients) > 0 {
+			if first, ok := clients[0].(map[string]interface{}); ok {
+				if flow, ok := first["flow"].(string); ok {
+					newClient["flow"] = flow
+				}
+			}
 		}
 	}
-	settings["clients"] = newClients
-	modifiedSettings, err := json.MarshalIndent(settings, "", "  ")
-	if err != nil {
-		return false, err
+	return newClient
+}
+
+func genShadowsocksPassword(method string) string {
+	keyLen := 32
+	if method == "2022-blake3-aes-128-gcm" {
+		keyLen = 16
 	}
-	inbound.Settings = string(modifiedSettings)
-	needRestart, err := s.UpdateInboundClient(inbound, clientId)
-	return needRestart, err
+	if strings.HasPrefix(method, "2022") {
+		key := make([]byte, keyLen)
+		rand.Read(key)
+		return base64.StdEncoding.EncodeToString(key)
+	}
+	return random.Seq(keyLen)
 }
 
 func (s *InboundService) ResetClientTrafficByEmail(clientEmail string) error {
 	db := database.GetDB()
 
+	traffic, err := s.GetClientTrafficByEmail(clientEmail)
+	if err != nil {
+		return err
+	}
+
 	result := db.Model(xray.ClientTraffic{}).
 		Where("email = ?", clientEmail).
 		Updates(map[string]interface{}{"enable": true, "up": 0, "down": 0})
 
-	err := result.Error
+	err = result.Error
 	if err != nil {
 		return err
 	}
+	if traffic != nil {
+		before := auditTraffic(traffic)
+		traffic.Up, traffic.Down, traffic.Enable = 0, 0, true
+		s.audit(db, "reset_traffic", AuditTargetClient, clientEmail, before, auditTraffic(traffic))
+	}
 	return nil
 }
 
@@ -1721,13 +2090,14 @@ func (s *InboundService) ResetClientTraffic(id int, clientEmail string) (bool, e
 					}
 					cipher = oldSettings["method"].(string)
 				}
-				err1 := s.xrayApi.AddUser(string(inbound.Protocol), inbound.Tag, map[string]interface{}{
-					"email":    client.Email,
-					"id":       client.ID,
-					"security": client.Security,
-					"flow":     client.Flow,
-					"password": client.Password,
-					"cipher":   cipher,
+				err1 := s.addXrayUser(string(inbound.Protocol), inbound.Tag, map[string]interface{}{
+					"email":     client.Email,
+					"id":        client.ID,
+					"security":  client.Security,
+					"flow":      client.Flow,
+					"password":  client.Password,
+					"cipher":    cipher,
+					"speedTier": client.SpeedTier,
 				})
 				if err1 == nil {
 					logger.Debug("Client enabled due to reset traffic:", clientEmail)
@@ -1741,6 +2111,7 @@ func (s *InboundService) ResetClientTraffic(id int, clientEmail string) (bool, e
 		}
 	}
 
+	before := auditTraffic(traffic)
 	traffic.Up = 0
 	traffic.Down = 0
 	traffic.Enable = true
@@ -1750,6 +2121,7 @@ func (s *InboundService) ResetClientTraffic(id int, clientEmail string) (bool, e
 	if err != nil {
 		return false, err
 	}
+	s.audit(db, "reset_traffic", AuditTargetClient, clientEmail, before, auditTraffic(traffic))
 
 	return needRestart, nil
 }
@@ -1769,26 +2141,40 @@ func (s *InboundService) ResetAllClientTraffics(id int) error {
 		Updates(map[string]interface{}{"enable": true, "up": 0, "down": 0})
 
 	err := result.Error
-	return err
+	if err != nil {
+		return err
+	}
+	target := strconv.Itoa(id)
+	if id == -1 {
+		target = "all"
+	}
+	s.audit(db, "reset_all_client_traffics", AuditTargetInbound, target, nil, nil)
+	return nil
 }
 
 func (s *InboundService) ResetAllTraffics() error {
 	db := database.GetDB()
 
-	result := db.Model(model.Inbound{}).
+	result := db.Model(&model.Inbound{}).
 		Where("user_id > ?", 0).
 		Updates(map[string]interface{}{"up": 0, "down": 0})
 
 	err := result.Error
-	return err
+	if err != nil {
+		return err
+	}
+	s.audit(db, "reset_all_traffics", AuditTargetInbound, "all", nil, nil)
+	return nil
 }
 
 func (s *InboundService) DelDepletedClients(id int) (err error) {
+	var events []ClientEvent
 	db := database.GetDB()
 	tx := db.Begin()
 	defer func() {
 		if err == nil {
 			tx.Commit()
+			fireClientEvents(events)
 		} else {
 			tx.Rollback()
 		}
@@ -1821,6 +2207,7 @@ func (s *InboundService) DelDepletedClients(id int) (err error) {
 
 		oldClients := oldSettings["clients"].([]interface{})
 		var newClients []interface{}
+		var deleted []map[string]interface{}
 		for _, client := range oldClients {
 			deplete := false
 			c := client.(map[string]interface{})
@@ -1830,23 +2217,33 @@ func (s *InboundService) DelDepletedClients(id int) (err error) {
 					break
 				}
 			}
-			if !deplete {
+			if deplete {
+				deleted = append(deleted, c)
+				events = append(events, ClientEvent{
+					Type:      ClientDeleted,
+					Email:     c["email"].(string),
+					InboundId: depletedClient.InboundId,
+					TgId:      clientTgId(c),
+				})
+			} else {
 				newClients = append(newClients, client)
 			}
 		}
 		if len(newClients) > 0 {
-			oldSettings["clients"] = newClients
-
-			newSettings, err := json.MarshalIndent(oldSettings, "", "  ")
+			err = oldInbound.BumpVersion(tx)
 			if err != nil {
 				return err
 			}
-
-			oldInbound.Settings = string(newSettings)
-			err = tx.Save(oldInbound).Error
+			err = tx.Where("inbound_id = ? AND email IN ?", oldInbound.Id, emails).Delete(&model.ClientRecord{}).Error
 			if err != nil {
 				return err
 			}
+			for _, c := range deleted {
+				err = s.recycleClient(tx, depletedClient.InboundId, c)
+				if err != nil {
+					return err
+				}
+			}
 		} else {
 			// Delete inbound if no client remains
 			s.DelInbound(depletedClient.InboundId)
@@ -1858,34 +2255,24 @@ func (s *InboundService) DelDepletedClients(id int) (err error) {
 		return err
 	}
 
+	for _, depletedClient := range depletedClients {
+		for _, email := range strings.Split(depletedClient.Email, ",") {
+			s.audit(tx, "del_depleted_client", AuditTargetClient, email, map[string]interface{}{"inboundId": depletedClient.InboundId}, nil)
+		}
+	}
 	return nil
 }
 
 func (s *InboundService) GetClientTrafficTgBot(tgId int64) ([]*xray.ClientTraffic, error) {
 	db := database.GetDB()
-	var inbounds []*model.Inbound
+	var emails []string
 
-	// Retrieve inbounds where settings contain the given tgId
-	err := db.Model(model.Inbound{}).Where("settings LIKE ?", fmt.Sprintf(`%%"tgId": %d%%`, tgId)).Find(&inbounds).Error
-	if err != nil && err != gorm.ErrRecordNotFound {
-		logger.Errorf("Error retrieving inbounds with tgId %d: %v", tgId, err)
+	err := db.Model(model.ClientRecord{}).Where("tg_id = ?", tgId).Pluck("email", &emails).Error
+	if err != nil {
+		logger.Errorf("Error retrieving clients with tgId %d: %v", tgId, err)
 		return nil, err
 	}
 
-	var emails []string
-	for _, inbound := range inbounds {
-		clients, err := s.GetClients(inbound)
-		if err != nil {
-			logger.Errorf("Error retrieving clients for inbound %d: %v", inbound.Id, err)
-			continue
-		}
-		for _, client := range clients {
-			if client.TgID == tgId {
-				emails = append(emails, client.Email)
-			}
-		}
-	}
-
 	var traffics []*xray.ClientTraffic
 	err = db.Model(xray.ClientTraffic{}).Where("email IN ?", emails).Find(&traffics).Error
 	if err != nil {
@@ -1920,13 +2307,9 @@ func (s *InboundService) GetClientTrafficByID(id string) ([]xray.ClientTraffic,
 	db := database.GetDB()
 	var traffics []xray.ClientTraffic
 
-	err := db.Model(xray.ClientTraffic{}).Where(`email IN(
-		SELECT JSON_EXTRACT(client.value, '$.email') as email
-		FROM inbounds,
-	  	JSON_EACH(JSON_EXTRACT(inbounds.settings, '$.clients')) AS client
-		WHERE
-	  	JSON_EXTRACT(client.value, '$.id') in (?)
-		)`, id).Find(&traffics).Error
+	err := db.Model(xray.ClientTraffic{}).Where("email IN (?)",
+		db.Model(model.ClientRecord{}).Select("email").Where("uuid = ?", id),
+	).Find(&traffics).Error
 	if err != nil {
 		logger.Debug(err)
 		return nil, err
@@ -1936,56 +2319,76 @@ func (s *InboundService) GetClientTrafficByID(id string) ([]xray.ClientTraffic,
 
 func (s *InboundService) SearchClientTraffic(query string) (traffic *xray.ClientTraffic, err error) {
 	db := database.GetDB()
-	inbound := &model.Inbound{}
 	traffic = &xray.ClientTraffic{}
 
-	// Search for inbound settings that contain the query
-	err = db.Model(model.Inbound{}).Where("settings LIKE ?", "%\""+query+"\"%").First(inbound).Error
+	// Search for the client whose UUID or password is the query
+	record := &model.ClientRecord{}
+	err = db.Model(model.ClientRecord{}).Where("(uuid = ? OR password = ?) AND email != ''", query, query).First(record).Error
 	if err != nil {
 		if err == gorm.ErrRecordNotFound {
-			logger.Warningf("Inbound settings containing query %s not found: %v", query, err)
+			logger.Warningf("Client with query %s not found: %v", query, err)
 			return nil, err
 		}
-		logger.Errorf("Error searching for inbound settings with query %s: %v", query, err)
+		logger.Errorf("Error searching for client with query %s: %v", query, err)
 		return nil, err
 	}
 
-	traffic.InboundId = inbound.Id
-
-	// Unmarshal settings to get clients
-	settings := map[string][]model.Client{}
-	if err := json.Unmarshal([]byte(inbound.Settings), &settings); err != nil {
-		logger.Errorf("Error unmarshalling inbound settings for inbound ID %d: %v", inbound.Id, err)
-		return nil, err
-	}
-
-	clients := settings["clients"]
-	for _, client := range clients {
-		if (client.ID == query || client.Password == query) && client.Email != "" {
-			traffic.Email = client.Email
-			break
-		}
-	}
-
-	if traffic.Email == "" {
-		logger.Warningf("No client found with query %s in inbound ID %d", query, inbound.Id)
-		return nil, gorm.ErrRecordNotFound
-	}
-
 	// Retrieve ClientTraffic based on the found email
-	err = db.Model(xray.ClientTraffic{}).Where("email = ?", traffic.Email).First(traffic).Error
+	err = db.Model(xray.ClientTraffic{}).Where("email = ?", record.Email).First(traffic).Error
 	if err != nil {
 		if err == gorm.ErrRecordNotFound {
-			logger.Warningf("ClientTraffic for email %s not found: %v", traffic.Email, err)
+			logger.Warningf("ClientTraffic for email %s not found: %v", record.Email, err)
 			return nil, err
 		}
-		logger.Errorf("Error retrieving ClientTraffic for email %s: %v", traffic.Email, err)
+		logger.Errorf("Error retrieving ClientTraffic for email %s: %v", record.Email, err)
 		return nil, err
 	}
 
 	return traffic, nil
 }
 
+// SearchClientTraffics finds up to limit clients whose email or sub ID
+// contains the query, or whose UUID, password or Telegram ID starts with it.
+func (s *InboundService) SearchClientTraffics(query string, limit int) ([]*xray.ClientTraffic, error) {
+	query = strings.ToLower(strings.TrimSpace(query))
+
+	inbounds, err := s.GetAllInbounds()
+	if err != nil {
+		return nil, err
+	}
+
+	var traffics []*xray.ClientTraffic
+	for _, inbound := range inbounds {
+		clients, err := s.GetClients(inbound)
+		if err != nil {
+			continue
+		}
+		for _, client := range clients {
+			if client.Email == "" {
+				continue
+			}
+			if query != "" &&
+				!strings.Contains(strings.ToLower(client.Email), query) &&
+				!strings.Contains(strings.ToLower(client.SubID), query) &&
+				!(client.ID != "" && strings.HasPrefix(strings.ToLower(client.ID), query)) &&
+				!(client.Password != "" && strings.HasPrefix(strings.ToLower(client.Password), query)) &&
+				!(client.TgID != 0 && strings.HasPrefix(strconv.FormatInt(client.TgID, 10), query)) {
+				continue
+			}
+			for i := range inbound.ClientStats {
+				if inbound.ClientStats[i].Email == client.Email {
+					traffics = append(traffics, &inbound.ClientStats[i])
+					break
+				}
+			}
+			if len(traffics) >= limit {
+				return traffics, nil
+			}
+		}
+	}
+	return traffics, nil
+}
+
 func (s *InboundService) GetInboundClientIps(clientEmail string) (string, error) {
 	db := database.GetDB()
 	InboundClientIps := &model.InboundClientIps{}
@@ -1999,6 +2402,8 @@ func (s *InboundService) GetInboundClientIps(clientEmail string) (string, error)
 func (s *InboundService) ClearClientIps(clientEmail string) error {
 	db := database.GetDB()
 
+	ips, _ := s.GetInboundClientIps(clientEmail)
+
 	result := db.Model(model.InboundClientIps{}).
 		Where("client_email = ?", clientEmail).
 		Update("ips", "")
@@ -2006,6 +2411,7 @@ func (s *InboundService) ClearClientIps(clientEmail string) error {
 	if err != nil {
 		return err
 	}
+	s.audit(db, "clear_ips", AuditTargetClient, clientEmail, map[string]interface{}{"ips": ips}, map[string]interface{}{"ips": ""})
 	return nil
 }
 
@@ -2137,7 +2543,7 @@ func (s *InboundService) MigrationRequirements() {
 		}
 		stream["externalProxy"] = reverses
 		newStream, _ := json.MarshalIndent(stream, " ", "  ")
-		tx.Model(model.Inbound{}).Where("id = ?", ep.Id).Update("stream_settings", newStream)
+		tx.Model(&model.Inbound{}).Where("id = ?", ep.Id).Update("stream_settings", newStream)
 	}
 
 	err = tx.Raw(`UPDATE inbounds
@@ -38,9 +38,11 @@ func (s *OutboundService) addOutboundTraffic(tx *gorm.DB, traffics []*xray.Traff
 	}
 
 	var err error
+	var outboundTraffics []*xray.Traffic
 
 	for _, traffic := range traffics {
 		if traffic.IsOutbound {
+			outboundTraffics = append(outboundTraffics, traffic)
 
 			var outbound model.OutboundTraffics
 
@@ -61,6 +63,11 @@ func (s *OutboundService) addOutboundTraffic(tx *gorm.DB, traffics []*xray.Traff
 			}
 		}
 	}
+
+	err = addTrafficRollups(tx, RollupOutbound, outboundTraffics)
+	if err != nil {
+		logger.Warning("AddOutboundTraffic update rollups ", err)
+	}
 	return nil
 }
 
@@ -0,0 +1,32 @@
+package service
+
+import (
+	"time"
+
+	"x-ui/database"
+	"x-ui/database/model"
+)
+
+type PaymentService struct{}
+
+// GetRevenue sums the succeeded payments since the given time per currency.
+func (s *PaymentService) GetRevenue(since time.Time) (map[string]float64, error) {
+	db := database.GetDB()
+	var rows []struct {
+		Currency string
+		Amount   float64
+	}
+	err := db.Model(model.Payment{}).
+		Select("currency, SUM(amount) as amount").
+		Where("status = ? AND created_at >= ?", model.Succeeded, since).
+		Group("currency").
+		Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	revenue := make(map[string]float64)
+	for _, row := range rows {
+		revenue[row.Currency] = row.Amount
+	}
+	return revenue, nil
+}
@@ -0,0 +1,300 @@
+package service
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/util/common"
+	"x-ui/xray"
+
+	"gorm.io/gorm"
+)
+
+// recycleClient keeps a client deleted from the inbound in the recycle bin
+// with its traffic, IP history and customer. It has to run before those are
+// removed.
+func (s *InboundService) recycleClient(tx *gorm.DB, inboundId int, client map[string]interface{}) error {
+	email, _ := client["email"].(string)
+	data, err := json.Marshal(client)
+	if err != nil {
+		return err
+	}
+	item := &model.RecycledItem{
+		Kind:      RollupClient,
+		Name:      email,
+		InboundId: inboundId,
+		Data:      string(data),
+	}
+	err = s.recycleClientData(tx, item, []string{email})
+	if err != nil {
+		return err
+	}
+	return tx.Create(item).Error
+}
+
+// recycleInbound keeps a deleted inbound in the recycle bin with the traffic,
+// IP history and customers of its clients. It has to run before those are
+// removed.
+func (s *InboundService) recycleInbound(tx *gorm.DB, inbound *model.Inbound) error {
+	data, err := json.Marshal(inbound)
+	if err != nil {
+		return err
+	}
+	var emails []string
+	err = tx.Model(xray.ClientTraffic{}).Where("inbound_id = ?", inbound.Id).Pluck("email", &emails).Error
+	if err != nil {
+		return err
+	}
+	item := &model.RecycledItem{
+		Kind:      RollupInbound,
+		Name:      inbound.Tag,
+		InboundId: inbound.Id,
+		Data:      string(data),
+	}
+	err = s.recycleClientData(tx, item, emails)
+	if err != nil {
+		return err
+	}
+	return tx.Create(item).Error
+}
+
+func (s *InboundService) recycleClientData(tx *gorm.DB, item *model.RecycledItem, emails []string) error {
+	var traffics []xray.ClientTraffic
+	err := tx.Where("email IN ?", emails).Find(&traffics).Error
+	if err != nil {
+		return err
+	}
+	var ips []model.InboundClientIps
+	err = tx.Where("client_email IN ?", emails).Find(&ips).Error
+	if err != nil {
+		return err
+	}
+	var customers []model.CustomerClient
+	err = tx.Where("email IN ?", emails).Find(&customers).Error
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(traffics)
+	if err != nil {
+		return err
+	}
+	item.Traffics = string(data)
+	data, err = json.Marshal(ips)
+	if err != nil {
+		return err
+	}
+	item.Ips = string(data)
+	data, err = json.Marshal(customers)
+	if err != nil {
+		return err
+	}
+	item.Customers = string(data)
+	item.RecycledAt = time.Now().Unix()
+	return nil
+}
+
+// GetRecycledItems returns the recycle bin, newest first, optionally of one
+// kind only.
+func (s *InboundService) GetRecycledItems(kind string) ([]model.RecycledItem, error) {
+	db := database.GetDB()
+	query := db.Model(model.RecycledItem{})
+	if kind != "" {
+		query = query.Where("kind = ?", kind)
+	}
+	var items []model.RecycledItem
+	err := query.Order("id DESC").Find(&items).Error
+	if err != nil && err != gorm.ErrRecordNotFound {
+		return nil, err
+	}
+	return items, nil
+}
+
+// RestoreRecycledItem adds a deleted client or inbound again, to xray through
+// the API as usual, and gives it back its traffic, IP history and customers
+// in the same transaction. A client can only go back to an inbound which
+// still exists.
+func (s *InboundService) RestoreRecycledItem(id int) (bool, error) {
+	needRestart := false
+	var restored *model.Inbound
+	db := database.GetDB()
+	err := db.Transaction(func(tx *gorm.DB) error {
+		item := &model.RecycledItem{}
+		err := tx.First(item, id).Error
+		if err != nil {
+			return err
+		}
+
+		inboundId := item.InboundId
+		target := item.Name
+		switch item.Kind {
+		case RollupInbound:
+			inbound := &model.Inbound{}
+			err = json.Unmarshal([]byte(item.Data), inbound)
+			if err != nil {
+				return err
+			}
+			// the old id may have been taken by a newer inbound
+			inbound.Id = 0
+			inbound.Version = 0
+			inbound.ClientStats = nil
+			err = s.addInbound(tx, inbound)
+			if err != nil {
+				return err
+			}
+			restored = inbound
+			inboundId = inbound.Id
+			target = strconv.Itoa(inboundId)
+			// clients deleted from the inbound earlier go back to its new id
+			err = tx.Model(model.RecycledItem{}).Where("kind = ? AND inbound_id = ?", RollupClient, item.InboundId).
+				Update("inbound_id", inboundId).Error
+			if err != nil {
+				return err
+			}
+		case RollupClient:
+			var exists int64
+			err = tx.Model(model.Inbound{}).Where("id = ?", item.InboundId).Count(&exists).Error
+			if err != nil {
+				return err
+			}
+			if exists == 0 {
+				return common.NewError("The inbound of the client is deleted, restore it first:", item.InboundId)
+			}
+			var client map[string]interface{}
+			err = json.Unmarshal([]byte(item.Data), &client)
+			if err != nil {
+				return err
+			}
+			settings, err := json.Marshal(map[string]interface{}{"clients": []interface{}{client}})
+			if err != nil {
+				return err
+			}
+			needRestart, err = s.AddInboundClientWithTx(tx, &model.Inbound{Id: item.InboundId, Settings: string(settings)})
+			if err != nil {
+				return err
+			}
+		default:
+			return common.NewError("Unknown recycled item kind:", item.Kind)
+		}
+
+		needRestart0, err := s.restoreClientData(tx, item)
+		if err != nil {
+			return err
+		}
+		needRestart = needRestart || needRestart0
+		err = tx.Delete(item).Error
+		if err != nil {
+			return err
+		}
+		// the kinds of the recycle bin match the audit target types
+		s.audit(tx, "restore_"+item.Kind, item.Kind, target, nil, map[string]interface{}{"inboundId": inboundId})
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	if restored != nil && s.addXrayInbound(restored) {
+		needRestart = true
+	}
+	return needRestart, nil
+}
+
+// restoreClientData puts back the usage, IP history and customers of restored
+// clients, whose traffic rows adding them created anew. A customer deleted in
+// the meantime is left out.
+func (s *InboundService) restoreClientData(tx *gorm.DB, item *model.RecycledItem) (bool, error) {
+	var traffics []xray.ClientTraffic
+	err := json.Unmarshal([]byte(item.Traffics), &traffics)
+	if err != nil {
+		return false, err
+	}
+	for _, traffic := range traffics {
+		err = tx.Model(xray.ClientTraffic{}).Where("email = ?", traffic.Email).
+			Updates(map[string]interface{}{
+				"up":                 traffic.Up,
+				"down":               traffic.Down,
+				"last_traffic_reset": traffic.LastTrafficReset,
+			}).Error
+		if err != nil {
+			return false, err
+		}
+	}
+
+	var ips []model.InboundClientIps
+	err = json.Unmarshal([]byte(item.Ips), &ips)
+	if err != nil {
+		return false, err
+	}
+	for _, ip := range ips {
+		err = s.DelClientIPs(tx, ip.ClientEmail)
+		if err != nil {
+			return false, err
+		}
+		ip.Id = 0
+		err = tx.Create(&ip).Error
+		if err != nil {
+			return false, err
+		}
+	}
+
+	var customers []model.CustomerClient
+	err = json.Unmarshal([]byte(item.Customers), &customers)
+	if err != nil {
+		return false, err
+	}
+	needRestart := false
+	for _, link := range customers {
+		customer := &model.Customer{}
+		err = tx.Model(model.Customer{}).Where("id = ?", link.CustomerId).Find(customer).Error
+		if err != nil {
+			return false, err
+		}
+		if customer.Id == 0 {
+			continue
+		}
+		err = tx.Where("email = ?", link.Email).Delete(model.CustomerClient{}).Error
+		if err != nil {
+			return false, err
+		}
+		link.Id = 0
+		err = tx.Create(&link).Error
+		if err != nil {
+			return false, err
+		}
+		// the xray user was added before its customer's speed tier applied
+		if customer.SpeedTier != "" {
+			needRestart = true
+		}
+	}
+	return needRestart, nil
+}
+
+// DelRecycledItem deletes an item from the recycle bin for good.
+func (s *InboundService) DelRecycledItem(id int) error {
+	db := database.GetDB()
+	item := &model.RecycledItem{}
+	err := db.First(item, id).Error
+	if err != nil {
+		return err
+	}
+	err = db.Delete(item).Error
+	if err != nil {
+		return err
+	}
+	s.audit(db, "purge_"+item.Kind, item.Kind, item.Name, map[string]interface{}{"recycledAt": item.RecycledAt}, nil)
+	return nil
+}
+
+// DelExpiredRecycledItems drops the recycle bin items older than the
+// retention in days, zero keeps them for good.
+func (s *InboundService) DelExpiredRecycledItems(days int) (int64, error) {
+	if days <= 0 {
+		return 0, nil
+	}
+	db := database.GetDB()
+	result := db.Where("recycled_at < ?", time.Now().AddDate(0, 0, -days).Unix()).Delete(model.RecycledItem{})
+	return result.RowsAffected, result.Error
+}
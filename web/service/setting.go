@@ -36,17 +36,35 @@ var defaultValueMap = map[string]string{
 	"pageSize":           "50",
 	"expireDiff":         "0",
 	"trafficDiff":        "0",
+	"trafficHourlyDays":  "7",
+	"trafficDailyDays":   "365",
+	"recycleBinDays":     "30",
+	"capPolicy":          "disable",
+	"throttleOutbound":   "",
+	"throttleLevel":      "0",
+	"speedTiers":         "",
 	"remarkModel":        "-ieo",
 	"timeLocation":       "Asia/Tehran",
 	"tgBotEnable":        "false",
 	"tgBotToken":         "",
 	"tgBotProxy":         "",
 	"tgBotChatId":        "",
+	"tgBotRoles":         "",
 	"tgRunTime":          "@daily",
 	"tgBotBackup":        "false",
 	"tgBotLoginNotify":   "true",
 	"tgCpu":              "80",
 	"tgLang":             "en-US",
+	"tgLinkTokenTTL":     "24",
+	"tgCallbackTTL":      "72",
+	"tgExpiryReminders":  "7,3,1,0",
+	"tgReports":          "",
+	"tgNotifyDisabled":   "true",
+	"tgNotifyRenewed":    "true",
+	"tgNotifyDeleted":    "true",
+	"tgNotifyPayment":    "true",
+	"tgRateLimit":        "20",
+	"tgAutoBanTime":      "60",
 	"secretEnable":       "false",
 	"subEnable":          "false",
 	"subListen":          "",
@@ -69,7 +87,37 @@ var defaultValueMap = map[string]string{
 	"warp":               "",
 }
 
-type SettingService struct{}
+type SettingService struct {
+	actor *AuditActor
+}
+
+// As returns a copy of the service which records its changes in the audit
+// log under the given actor.
+func (s *SettingService) As(actor *AuditActor) *SettingService {
+	settingService := *s
+	settingService.actor = actor
+	return &settingService
+}
+
+func (s *SettingService) audit(action string, key string, before string, after string) {
+	auditService := AuditService{}
+	if auditJSONSettings[key] {
+		auditService.Record(s.actor, action, AuditTargetSetting, key, auditJSONValue(before), auditJSONValue(after))
+		return
+	}
+	if auditMaskedSettings[key] {
+		if before != "" {
+			before = auditMasked
+		}
+		if after != "" {
+			after = auditMasked
+		}
+	} else if auditURLSettings[key] {
+		before = auditMaskURL(before)
+		after = auditMaskURL(after)
+	}
+	auditService.Record(s.actor, action, AuditTargetSetting, key, before, after)
+}
 
 func (s *SettingService) GetDefaultJsonConfig() (interface{}, error) {
 	var jsonData interface{}
@@ -161,9 +209,14 @@ func (s *SettingService) ResetSettings() error {
 	if err != nil {
 		return err
 	}
-	return db.Model(model.User{}).
+	err = db.Model(model.User{}).
 		Where("1 = 1").
 		Update("login_secret", "").Error
+	if err != nil {
+		return err
+	}
+	s.audit("reset_settings", "all", "", "")
+	return nil
 }
 
 func (s *SettingService) getSetting(key string) (*model.Setting, error) {
@@ -180,16 +233,25 @@ func (s *SettingService) saveSetting(key string, value string) error {
 	setting, err := s.getSetting(key)
 	db := database.GetDB()
 	if database.IsNotFound(err) {
-		return db.Create(&model.Setting{
+		err = db.Create(&model.Setting{
 			Key:   key,
 			Value: value,
 		}).Error
+		if err == nil && value != defaultValueMap[key] {
+			s.audit("update_setting", key, defaultValueMap[key], value)
+		}
+		return err
 	} else if err != nil {
 		return err
 	}
+	before := setting.Value
 	setting.Key = key
 	setting.Value = value
-	return db.Save(setting).Error
+	err = db.Save(setting).Error
+	if err == nil && before != value {
+		s.audit("update_setting", key, before, value)
+	}
+	return err
 }
 
 func (s *SettingService) getString(key string) (string, error) {
@@ -262,6 +324,10 @@ func (s *SettingService) SetTgBotProxy(token string) error {
 	return s.setString("tgBotProxy", token)
 }
 
+func (s *SettingService) GetTgBotRoles() (string, error) {
+	return s.getString("tgBotRoles")
+}
+
 func (s *SettingService) GetTgBotChatId() (string, error) {
 	return s.getString("tgBotChatId")
 }
@@ -302,6 +368,77 @@ func (s *SettingService) GetTgLang() (string, error) {
 	return s.getString("tgLang")
 }
 
+func (s *SettingService) GetTgLinkTokenTTL() (int, error) {
+	return s.getInt("tgLinkTokenTTL")
+}
+
+func (s *SettingService) GetTgCallbackTTL() (int, error) {
+	return s.getInt("tgCallbackTTL")
+}
+
+func (s *SettingService) GetTgRateLimit() (int, error) {
+	return s.getInt("tgRateLimit")
+}
+
+func (s *SettingService) GetTgAutoBanTime() (int, error) {
+	return s.getInt("tgAutoBanTime")
+}
+
+func (s *SettingService) GetTgExpiryReminders() (string, error) {
+	return s.getString("tgExpiryReminders")
+}
+
+func (s *SettingService) GetTgReports() (string, error) {
+	return s.getString("tgReports")
+}
+
+// GetReports returns the configured Telegram reports. Without any, the
+// report of tgRunTime is the only one.
+func (s *SettingService) GetReports() ([]*entity.ReportDefinition, error) {
+	setting, err := s.GetTgReports()
+	if err != nil {
+		return nil, err
+	}
+	reports, err := entity.ParseReports(setting)
+	if err != nil {
+		return nil, err
+	}
+	if len(reports) > 0 {
+		return reports, nil
+	}
+
+	runTime, err := s.GetTgbotRuntime()
+	if err != nil || runTime == "" {
+		runTime = "@daily"
+	}
+	report := &entity.ReportDefinition{
+		Name:     "default",
+		Schedule: runTime,
+		Sections: []entity.ReportSection{entity.ReportServer, entity.ReportExpiring, entity.ReportCustomers},
+	}
+	backupEnable, err := s.GetTgBotBackup()
+	if err == nil && backupEnable {
+		report.Sections = append(report.Sections, entity.ReportBackup)
+	}
+	return []*entity.ReportDefinition{report}, nil
+}
+
+func (s *SettingService) GetTgNotifyDisabled() (bool, error) {
+	return s.getBool("tgNotifyDisabled")
+}
+
+func (s *SettingService) GetTgNotifyRenewed() (bool, error) {
+	return s.getBool("tgNotifyRenewed")
+}
+
+func (s *SettingService) GetTgNotifyDeleted() (bool, error) {
+	return s.getBool("tgNotifyDeleted")
+}
+
+func (s *SettingService) GetTgNotifyPayment() (bool, error) {
+	return s.getBool("tgNotifyPayment")
+}
+
 func (s *SettingService) GetPort() (int, error) {
 	return s.getInt("webPort")
 }
@@ -358,6 +495,67 @@ func (s *SettingService) GetTrafficDiff() (int, error) {
 	return s.getInt("trafficDiff")
 }
 
+func (s *SettingService) GetTrafficHourlyDays() (int, error) {
+	return s.getInt("trafficHourlyDays")
+}
+
+func (s *SettingService) GetTrafficDailyDays() (int, error) {
+	return s.getInt("trafficDailyDays")
+}
+
+func (s *SettingService) GetRecycleBinDays() (int, error) {
+	return s.getInt("recycleBinDays")
+}
+
+func (s *SettingService) GetCapPolicy() (string, error) {
+	return s.getString("capPolicy")
+}
+
+func (s *SettingService) GetThrottleOutbound() (string, error) {
+	return s.getString("throttleOutbound")
+}
+
+func (s *SettingService) GetThrottleLevel() (int, error) {
+	return s.getInt("throttleLevel")
+}
+
+func (s *SettingService) GetSpeedTiers() ([]*entity.SpeedTier, error) {
+	setting, err := s.getString("speedTiers")
+	if err != nil {
+		return nil, err
+	}
+	return entity.ParseSpeedTiers(setting)
+}
+
+// GetSpeedTierNames returns the names of the speed tiers for the panel, none
+// while the setting is invalid.
+func (s *SettingService) GetSpeedTierNames() ([]string, error) {
+	tiers, err := s.GetSpeedTiers()
+	if err != nil {
+		logger.Warning("Invalid speed tiers:", err)
+	}
+	names := make([]string, 0, len(tiers))
+	for _, tier := range tiers {
+		names = append(names, tier.Name)
+	}
+	return names, nil
+}
+
+// GetSpeedTier returns the speed tier with the given name, nil if there is
+// none.
+func (s *SettingService) GetSpeedTier(name string) (*entity.SpeedTier, error) {
+	tiers, err := s.GetSpeedTiers()
+	if err != nil {
+		return nil, err
+	}
+	for _, tier := range tiers {
+		if tier.Name == name {
+			return tier, nil
+		}
+	}
+	return nil, nil
+}
+
 func (s *SettingService) GetSessionMaxAge() (int, error) {
 	return s.getInt("sessionMaxAge")
 }
@@ -568,6 +766,7 @@ func (s *SettingService) GetDefaultSettings(host string) (interface{}, error) {
 		"remarkModel":   func() (interface{}, error) { return s.GetRemarkModel() },
 		"datepicker":    func() (interface{}, error) { return s.GetDatepicker() },
 		"ipLimitEnable": func() (interface{}, error) { return s.GetIpLimitEnable() },
+		"speedTiers":    func() (interface{}, error) { return s.GetSpeedTierNames() },
 		"shopId":        func() (interface{}, error) { return s.GetYookassaShopId() },
 		"apiKey":        func() (interface{}, error) { return s.GetYookassaApiKey() },
 	}
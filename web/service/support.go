@@ -0,0 +1,140 @@
+package service
+
+import (
+	"time"
+
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/util/common"
+
+	"gorm.io/gorm"
+)
+
+type SupportService struct{}
+
+// OpenTicket returns the open ticket of the Telegram user or creates a new one.
+func (s *SupportService) OpenTicket(tgId int64, username string) (*model.SupportTicket, error) {
+	ticket, err := s.GetOpenTicket(tgId)
+	if err != nil {
+		return nil, err
+	}
+	if ticket != nil {
+		return ticket, nil
+	}
+
+	now := time.Now().Unix()
+	ticket = &model.SupportTicket{
+		TgId:      tgId,
+		Username:  username,
+		Status:    model.TicketOpen,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	db := database.GetDB()
+	err = db.Create(ticket).Error
+	if err != nil {
+		return nil, err
+	}
+	return ticket, nil
+}
+
+// GetOpenTicket returns the open ticket of the Telegram user, or nil if there is none.
+func (s *SupportService) GetOpenTicket(tgId int64) (*model.SupportTicket, error) {
+	db := database.GetDB()
+	ticket := &model.SupportTicket{}
+	err := db.Model(model.SupportTicket{}).
+		Where("tg_id = ? AND status = ?", tgId, model.TicketOpen).
+		Order("id desc").
+		First(ticket).Error
+	if err != nil {
+		if database.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return ticket, nil
+}
+
+func (s *SupportService) GetTicket(id int) (*model.SupportTicket, error) {
+	db := database.GetDB()
+	ticket := &model.SupportTicket{}
+	err := db.Model(model.SupportTicket{}).
+		Preload("Messages", func(db *gorm.DB) *gorm.DB {
+			return db.Order("id asc")
+		}).
+		Where("id = ?", id).
+		First(ticket).Error
+	if err != nil {
+		return nil, err
+	}
+	return ticket, nil
+}
+
+// GetTickets lists tickets without their messages. An empty status returns all of them.
+func (s *SupportService) GetTickets(status string) ([]*model.SupportTicket, error) {
+	db := database.GetDB()
+	var tickets []*model.SupportTicket
+	query := db.Model(model.SupportTicket{})
+	if status != "" {
+		query = query.Where("status = ?", status)
+	}
+	err := query.Order("updated_at desc").Find(&tickets).Error
+	if err != nil && err != gorm.ErrRecordNotFound {
+		return nil, err
+	}
+	return tickets, nil
+}
+
+func (s *SupportService) AddMessage(ticketId int, senderId int64, fromAdmin bool, text string) error {
+	db := database.GetDB()
+	now := time.Now().Unix()
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		ticket := &model.SupportTicket{}
+		err := tx.Model(model.SupportTicket{}).Where("id = ?", ticketId).First(ticket).Error
+		if err != nil {
+			return err
+		}
+		if ticket.Status != model.TicketOpen {
+			return common.NewError("support ticket is closed:", ticketId)
+		}
+
+		message := &model.SupportMessage{
+			TicketId:  ticketId,
+			SenderId:  senderId,
+			FromAdmin: fromAdmin,
+			Text:      text,
+			CreatedAt: now,
+		}
+		err = tx.Create(message).Error
+		if err != nil {
+			return err
+		}
+		return tx.Model(model.SupportTicket{}).Where("id = ?", ticketId).Update("updated_at", now).Error
+	})
+}
+
+// CloseTicket marks the ticket as closed and returns it. Closing an already
+// closed ticket is not an error.
+func (s *SupportService) CloseTicket(id int) (*model.SupportTicket, error) {
+	db := database.GetDB()
+	ticket := &model.SupportTicket{}
+	err := db.Model(model.SupportTicket{}).Where("id = ?", id).First(ticket).Error
+	if err != nil {
+		return nil, err
+	}
+	if ticket.Status == model.TicketClosed {
+		return ticket, nil
+	}
+
+	ticket.Status = model.TicketClosed
+	ticket.UpdatedAt = time.Now().Unix()
+	err = db.Model(model.SupportTicket{}).Where("id = ?", id).Updates(map[string]interface{}{
+		"status":     ticket.Status,
+		"updated_at": ticket.UpdatedAt,
+	}).Error
+	if err != nil {
+		return nil, err
+	}
+	return ticket, nil
+}
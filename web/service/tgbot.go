@@ -6,10 +6,12 @@ import (
 	"errors"
 	"encoding/json"
 	"fmt"
+	"html"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -20,6 +22,7 @@ import (
 	"x-ui/logger"
 	"x-ui/util/common"
 	"x-ui/util/random"
+	"x-ui/web/entity"
 	"x-ui/web/global"
 	"x-ui/web/locale"
 	"x-ui/xray"
@@ -37,13 +40,40 @@ var (
 	bot         *telego.Bot
 	botHandler  *th.BotHandler
 	adminIds    []int64
+	adminRoles  map[int64]*AdminAccess
 	isRunning   bool
 	hostname    string
 	hashStorage *global.HashStorage
+
+	rateLimit      int
+	autoBanTime    int
+	requestLimiter = newRateLimiter(rateLimitWindow)
+
+	conversations = NewConversationStore(conversationTimeout)
 )
 
 type LoginStatus byte
 
+const (
+	// deep link argument opening the admin controls of a client
+	clientCardPrefix = "client_"
+	inlineQueryLimit = 20
+	auditLogLimit    = 10
+	auditValueLength = 200
+	topConsumerLimit = 10
+	rateLimitWindow  = time.Minute
+	// users sending this many times the rate limit are banned for a while
+	autoBanFactor = 3
+)
+
+// topConsumerPeriods maps the ranking periods to their labels.
+var topConsumerPeriods = map[string]string{
+	RankingToday: "tgbot.periodToday",
+	RankingWeek:  "tgbot.periodThisWeek",
+	RankingMonth: "tgbot.periodThisMonth",
+	RankingAll:   "tgbot.periodAllTime",
+}
+
 const (
 	LoginSuccess        LoginStatus = 1
 	LoginFail           LoginStatus = 0
@@ -51,11 +81,17 @@ const (
 )
 
 type Tgbot struct {
-	inboundService InboundService
-	settingService SettingService
-	serverService  ServerService
-	xrayService    XrayService
-	lastStatus     *Status
+	inboundService    InboundService
+	settingService    SettingService
+	serverService     ServerService
+	xrayService       XrayService
+	clientLinkService ClientLinkService
+	supportService    SupportService
+	auditService      AuditService
+	paymentService    PaymentService
+	blocklistService  BlocklistService
+	customerService   CustomerService
+	lastStatus        *Status
 }
 
 func (t *Tgbot) NewTgbot() *Tgbot {
@@ -71,6 +107,23 @@ func (t *Tgbot) GetMyLink() (string, error) {
 	return fmt.Sprintf("https://t.me/%s", tgBot.Username), nil
 }
 
+// GetClientLinkURL returns a one-time deep link which binds the client to the
+// Telegram account that opens it.
+func (t *Tgbot) GetClientLinkURL(email string) (string, error) {
+	if !isRunning {
+		return "", common.NewError("telegram bot is not running")
+	}
+	token, err := t.clientLinkService.CreateToken(email)
+	if err != nil {
+		return "", err
+	}
+	link, err := t.GetMyLink()
+	if err != nil {
+		return "", err
+	}
+	return link + "?start=" + ClientLinkPrefix + token.Token, nil
+}
+
 func (t *Tgbot) I18nBot(name string, params ...string) string {
 	return locale.I18n(locale.Bot, name, params...)
 }
@@ -87,7 +140,11 @@ func (t *Tgbot) Start(i18nFS embed.FS) error {
 	}
 
 	// Initialize hash storage to store callback queries
-	hashStorage = global.NewHashStorage(20 * time.Minute)
+	callbackTTL, err := t.settingService.GetTgCallbackTTL()
+	if err != nil || callbackTTL <= 0 {
+		callbackTTL = 72
+	}
+	hashStorage = global.NewHashStorage(time.Duration(callbackTTL)*time.Hour, CallbackHashService{})
 
 	t.SetHostname()
 
@@ -117,6 +174,23 @@ func (t *Tgbot) Start(i18nFS embed.FS) error {
 		}
 	}
 
+	// Roles of admins, the ones without a role are owners
+	tgBotRoles, err := t.settingService.GetTgBotRoles()
+	if err != nil {
+		logger.Warning("Failed to get Telegram bot admin roles:", err)
+	}
+	adminRoles = parseAdminRoles(tgBotRoles)
+
+	// Limit the requests of users, admins are never limited
+	rateLimit, err = t.settingService.GetTgRateLimit()
+	if err != nil {
+		logger.Warning("Failed to get Telegram bot rate limit:", err)
+	}
+	autoBanTime, err = t.settingService.GetTgAutoBanTime()
+	if err != nil {
+		logger.Warning("Failed to get Telegram bot automatic ban time:", err)
+	}
+
 	// Get Telegram bot proxy URL
 	tgBotProxy, err := t.settingService.GetTgBotProxy()
 	if err != nil {
@@ -130,6 +204,9 @@ func (t *Tgbot) Start(i18nFS embed.FS) error {
 		return err
 	}
 
+	// Show the commands in the menu of the chats
+	go t.registerCommands()
+
 	// Start receiving Telegram bot messages
 	if !isRunning {
 		logger.Info("Telegram bot receiver started")
@@ -137,6 +214,8 @@ func (t *Tgbot) Start(i18nFS embed.FS) error {
 		isRunning = true
 	}
 
+	SetClientEventHook(t.NotifyClientEvents)
+
 	return nil
 }
 
@@ -182,6 +261,8 @@ func (t *Tgbot) Stop() {
 	logger.Info("Stop Telegram receiver ...")
 	isRunning = false
 	adminIds = nil
+	adminRoles = nil
+	SetClientEventHook(nil)
 }
 
 func (t *Tgbot) encodeQuery(query string) string {
@@ -206,6 +287,15 @@ func (t *Tgbot) decodeQuery(query string) (string, error) {
 	return decoded, nil
 }
 
+// answerExpiredQuery tells the user that the pressed button is no longer
+// valid and sends a fresh menu to continue from.
+func (t *Tgbot) answerExpiredQuery(callbackQuery *telego.CallbackQuery, isAdmin bool) {
+	chatId := callbackQuery.Message.GetChat().ID
+	t.sendCallbackAnswerTgBot(callbackQuery.ID, t.I18nBot("tgbot.buttonExpired"))
+	t.editMessageCallbackTgBot(chatId, callbackQuery.Message.GetMessageID(), tu.InlineKeyboard())
+	t.SendAnswer(chatId, t.I18nBot("tgbot.buttonExpired")+"\r\n\r\n"+t.I18nBot("tgbot.commands.pleaseChoose"), isAdmin)
+}
+
 func (t *Tgbot) OnReceive() {
 	params := telego.GetUpdatesParams{
 		Timeout: 10,
@@ -215,6 +305,12 @@ func (t *Tgbot) OnReceive() {
 
 	botHandler, _ = th.NewBotHandler(bot, updates)
 
+	botHandler.Use(func(bot *telego.Bot, update telego.Update, next th.Handler) {
+		if t.allowUpdate(update) {
+			next(bot, update)
+		}
+	})
+
 	botHandler.HandleMessage(func(_ *telego.Bot, message telego.Message) {
 		t.SendMsgToTgbot(message.Chat.ID, t.I18nBot("tgbot.keyboardClosed"), tu.ReplyKeyboardRemove())
 	}, th.TextEqual(t.I18nBot("tgbot.buttons.closeKeyboard")))
@@ -227,12 +323,16 @@ func (t *Tgbot) OnReceive() {
 		t.answerCallback(&query, checkAdmin(query.From.ID))
 	}, th.AnyCallbackQueryWithMessage())
 
+	botHandler.HandleInlineQuery(func(_ *telego.Bot, query telego.InlineQuery) {
+		t.answerInlineQuery(&query)
+	}, th.AnyInlineQuery())
+
 	botHandler.HandleMessage(func(_ *telego.Bot, message telego.Message) {
 		if message.UsersShared != nil {
-			if checkAdmin(message.From.ID) {
+			if t.canAccessTrafficId(message.From.ID, int(message.UsersShared.RequestID)) {
 				for _, sharedUser := range message.UsersShared.Users {
 					userID := sharedUser.UserID
-					needRestart, err := t.inboundService.SetClientTelegramUserID(message.UsersShared.RequestID, userID)
+					needRestart, err := t.inboundService.As(NewBotActor(message.From.ID)).SetClientTelegramUserID(message.UsersShared.RequestID, userID)
 					if needRestart {
 						t.xrayService.SetToNeedRestart()
 					}
@@ -247,12 +347,140 @@ func (t *Tgbot) OnReceive() {
 			} else {
 				t.SendMsgToTgbot(message.Chat.ID, t.I18nBot("tgbot.noResult"), tu.ReplyKeyboardRemove())
 			}
+		} else if message.Text != "" {
+			if !t.answerConversation(&message) {
+				t.supportMessage(&message)
+			}
 		}
 	}, th.AnyMessage())
 
 	botHandler.Start()
 }
 
+// allowUpdate drops the updates of banned users and of users sending more
+// than the rate limit, the ones far above it are banned for a while.
+func (t *Tgbot) allowUpdate(update telego.Update) bool {
+	var from *telego.User
+	switch {
+	case update.Message != nil:
+		from = update.Message.From
+	case update.CallbackQuery != nil:
+		from = &update.CallbackQuery.From
+	case update.InlineQuery != nil:
+		from = &update.InlineQuery.From
+	}
+	if from == nil || checkAdmin(from.ID) {
+		return true
+	}
+
+	ban, err := t.blocklistService.GetBan(from.ID)
+	if err != nil {
+		logger.Warning("Failed to check Telegram user ban:", err)
+	} else if ban != nil {
+		return false
+	}
+
+	if rateLimit <= 0 {
+		return true
+	}
+	hits := requestLimiter.hit(from.ID)
+	switch {
+	case hits <= rateLimit:
+		return true
+	case hits == rateLimit+1:
+		t.SendMsgToTgbot(from.ID, t.I18nBot("tgbot.answers.rateLimited"))
+	case hits == rateLimit*autoBanFactor+1 && autoBanTime > 0:
+		t.autoBan(from)
+	}
+	return false
+}
+
+func (t *Tgbot) autoBan(user *telego.User) {
+	ban, err := t.blocklistService.Ban(user.ID, t.I18nBot("tgbot.messages.banReasonFlood"), time.Duration(autoBanTime)*time.Minute)
+	if err != nil {
+		logger.Warning("Failed to ban Telegram user:", err)
+		return
+	}
+	until := time.Unix(ban.ExpiresAt, 0).Format("2006-01-02 15:04:05")
+	t.SendMsgToTgbot(user.ID, t.I18nBot("tgbot.answers.youAreBanned", "Time=="+until))
+
+	name := user.FirstName
+	if user.Username != "" {
+		name = "@" + user.Username
+	}
+	tgId := strconv.FormatInt(user.ID, 10)
+	inlineKeyboard := tu.InlineKeyboard(
+		tu.InlineKeyboardRow(
+			tu.InlineKeyboardButton(t.I18nBot("tgbot.buttons.unbanTGUser")).WithCallbackData(t.encodeQuery("tg_unban " + tgId)),
+		),
+	)
+	t.sendMsgToAdminsWith(PermEditClients, t.I18nBot("tgbot.messages.userAutoBanned",
+		"User=="+html.EscapeString(name),
+		"TelegramID=="+tgId,
+		"Time=="+until), inlineKeyboard)
+}
+
+// banCommand bans (/ban [ID] [Minutes] [Reason]) or unbans (/unban [ID]) a
+// Telegram user, without minutes the ban lasts for good.
+func (t *Tgbot) banCommand(tgUserID int64, command string, args []string) string {
+	if len(args) == 0 {
+		return t.I18nBot("tgbot.commands.ban")
+	}
+	tgId, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil || checkAdmin(tgId) {
+		return t.I18nBot("tgbot.commands.ban")
+	}
+	blocklistService := t.blocklistService.As(NewBotActor(tgUserID))
+
+	if command == "unban" {
+		unbanned, err := blocklistService.Unban(tgId)
+		if err != nil {
+			logger.Warning(err)
+			return t.I18nBot("tgbot.answers.errorOperation")
+		}
+		if !unbanned {
+			return t.I18nBot("tgbot.noResult")
+		}
+		return t.I18nBot("tgbot.answers.unbannedTGUser", "TelegramID=="+args[0])
+	}
+
+	minutes := 0
+	reason := t.I18nBot("tgbot.messages.banReasonAdmin")
+	if len(args) > 1 {
+		minutes, err = strconv.Atoi(args[1])
+		if err != nil || minutes < 0 {
+			return t.I18nBot("tgbot.commands.ban")
+		}
+	}
+	if len(args) > 2 {
+		reason = strings.Join(args[2:], " ")
+	}
+	_, err = blocklistService.Ban(tgId, reason, time.Duration(minutes)*time.Minute)
+	if err != nil {
+		logger.Warning(err)
+		return t.I18nBot("tgbot.answers.errorOperation")
+	}
+	msg, _ := t.banStatusMsg(tgId)
+	return t.I18nBot("tgbot.answers.bannedTGUser", "TelegramID=="+args[0]) + msg
+}
+
+// banStatusMsg describes the ban of the Telegram user, if any.
+func (t *Tgbot) banStatusMsg(tgId int64) (string, bool) {
+	ban, err := t.blocklistService.GetBan(tgId)
+	if err != nil {
+		logger.Warning(err)
+		return "", false
+	}
+	if ban == nil {
+		return "", false
+	}
+	until := t.I18nBot("tgbot.banForever")
+	if ban.ExpiresAt > 0 {
+		until = time.Unix(ban.ExpiresAt, 0).Format("2006-01-02 15:04:05")
+	}
+	return t.I18nBot("tgbot.messages.tgUserBanned", "Reason=="+html.EscapeString(ban.Reason), "Time=="+until), true
+}
+
 func (t *Tgbot) answerCommand(message *telego.Message, chatId int64, isAdmin bool) {
 	msg, onlyMessage := "", false
 
@@ -265,10 +493,21 @@ func (t *Tgbot) answerCommand(message *telego.Message, chatId int64, isAdmin boo
 			msg += t.I18nBot("tgbot.commands.helpAdmin")
 		} else {
 			msg += t.I18nBot("tgbot.commands.help")
+			msg += t.I18nBot("tgbot.commands.support")
 		}
 
 		msg += t.I18nBot("tgbot.commands.pleaseChoose")
 	case "start":
+		if len(commandArgs) > 0 && strings.HasPrefix(commandArgs[0], ClientLinkPrefix) {
+			onlyMessage = true
+			msg += t.linkClient(message.From.ID, strings.TrimPrefix(commandArgs[0], ClientLinkPrefix))
+			break
+		}
+		if isAdmin && len(commandArgs) > 0 && strings.HasPrefix(commandArgs[0], clientCardPrefix) {
+			onlyMessage = true
+			t.openClientCard(chatId, message.From.ID, strings.TrimPrefix(commandArgs[0], clientCardPrefix))
+			break
+		}
 		msg += t.I18nBot("tgbot.commands.start", "Firstname=="+message.From.FirstName)
 		if isAdmin {
 			msg += t.I18nBot("tgbot.commands.welcome", "Hostname=="+hostname)
@@ -284,6 +523,10 @@ func (t *Tgbot) answerCommand(message *telego.Message, chatId int64, isAdmin boo
 		onlyMessage = true
 		if len(commandArgs) > 0 {
 			if isAdmin {
+				if !t.canAccessClient(message.From.ID, commandArgs[0]) {
+					msg += t.I18nBot("tgbot.answers.noPermission")
+					break
+				}
 				t.searchClient(chatId, commandArgs[0])
 			} else {
 				// Convert message.From.ID to int64
@@ -296,35 +539,134 @@ func (t *Tgbot) answerCommand(message *telego.Message, chatId int64, isAdmin boo
 	case "inbound":
 		onlyMessage = true
 		if isAdmin && len(commandArgs) > 0 {
-			t.searchInbound(chatId, commandArgs[0])
+			if !getAdminAccess(message.From.ID).Can(PermViewClients) {
+				msg += t.I18nBot("tgbot.answers.noPermission")
+				break
+			}
+			t.searchInbound(chatId, message.From.ID, commandArgs[0])
 		} else {
 			msg += t.I18nBot("tgbot.commands.unknown")
 		}
-	case "subscribe":
+	case "remark":
 		onlyMessage = true
-		if len(commandArgs) > 0 {
-			emails, err := t.inboundService.getAllEmails()
+		if len(commandArgs) > 1 {
+			email := commandArgs[0]
+			if !t.isClientOwner(message.From.ID, email) {
+				msg += t.I18nBot("tgbot.noResult")
+				break
+			}
+			needRestart, err := t.inboundService.As(NewBotActor(message.From.ID)).SetClientCommentByEmail(email, strings.Join(commandArgs[1:], " "))
+			if needRestart {
+				t.xrayService.SetToNeedRestart()
+			}
 			if err != nil {
+				logger.Warning(err)
 				msg += t.I18nBot("tgbot.answers.errorOperation")
 				break
 			}
-
-			userEmail := commandArgs[0]
-			for _, email := range emails {
-				if email == userEmail {
-					msg += t.I18nBot("tgbot.answers.emailNotAvailable")
-					break
-				}
-			}
-
-			if msg != "" {
+			msg += t.I18nBot("tgbot.answers.remarkSaved", "Email=="+email)
+		} else {
+			msg += t.I18nBot("tgbot.commands.remark")
+		}
+	case "subscribe":
+		onlyMessage = true
+		if len(commandArgs) > 0 {
+			msg += t.subscribe(chatId, message.From.ID, commandArgs[0])
+		} else {
+			t.startConversation(chatId, "subscribe", t.I18nBot("tgbot.commands.needEmail"), nil)
+		}
+	case "cancel":
+		onlyMessage = true
+		if conversations.End(chatId) {
+			msg += t.I18nBot("tgbot.answers.conversationCanceled")
+		} else {
+			msg += t.I18nBot("tgbot.answers.nothingToCancel")
+		}
+	case "report":
+		onlyMessage = true
+		if !isAdmin {
+			msg += t.I18nBot("tgbot.commands.unknown")
+			break
+		}
+		if !getAdminAccess(message.From.ID).Can(PermViewServer) {
+			msg += t.I18nBot("tgbot.answers.noPermission")
+			break
+		}
+		if len(commandArgs) > 0 {
+			t.runReport(chatId, strings.Join(commandArgs, " "))
+		} else {
+			t.sendReportList(chatId)
+		}
+	case "top":
+		onlyMessage = true
+		if !isAdmin {
+			msg += t.I18nBot("tgbot.commands.unknown")
+			break
+		}
+		if !getAdminAccess(message.From.ID).Can(PermViewClients) {
+			msg += t.I18nBot("tgbot.answers.noPermission")
+			break
+		}
+		period := RankingToday
+		if len(commandArgs) > 0 {
+			period = commandArgs[0]
+		}
+		if _, exists := topConsumerPeriods[period]; !exists {
+			msg += t.I18nBot("tgbot.commands.top")
+			break
+		}
+		t.sendTopConsumers(chatId, message.From.ID, period)
+	case "ban", "unban":
+		onlyMessage = true
+		if !isAdmin {
+			msg += t.I18nBot("tgbot.commands.unknown")
+			break
+		}
+		if !getAdminAccess(message.From.ID).Can(PermEditClients) {
+			msg += t.I18nBot("tgbot.answers.noPermission")
+			break
+		}
+		msg += t.banCommand(message.From.ID, command, commandArgs)
+	case "customer":
+		onlyMessage = true
+		if !isAdmin {
+			msg += t.I18nBot("tgbot.commands.unknown")
+			break
+		}
+		if !getAdminAccess(message.From.ID).Can(PermViewClients) {
+			msg += t.I18nBot("tgbot.answers.noPermission")
+			break
+		}
+		if len(commandArgs) == 0 {
+			msg += t.I18nBot("tgbot.commands.customer")
+			break
+		}
+		t.searchCustomers(chatId, message.From.ID, strings.Join(commandArgs, " "))
+	case "audit":
+		onlyMessage = true
+		if !isAdmin {
+			msg += t.I18nBot("tgbot.commands.unknown")
+			break
+		}
+		if len(commandArgs) == 0 {
+			msg += t.I18nBot("tgbot.commands.audit")
+			break
+		}
+		if !getAdminAccess(message.From.ID).Can(PermViewClients) || !t.canAccessClient(message.From.ID, commandArgs[0]) {
+			msg += t.I18nBot("tgbot.answers.noPermission")
+			break
+		}
+		msg += t.auditLogMsg(commandArgs[0])
+	case "support":
+		onlyMessage = true
+		if isAdmin {
+			if !getAdminAccess(message.From.ID).Can(PermSupport) {
+				msg += t.I18nBot("tgbot.answers.noPermission")
 				break
 			}
-
-			fromID := int64(message.From.ID)
-			msg += t.getPaymentLink(chatId, fromID, userEmail)
+			t.sendOpenTickets(chatId)
 		} else {
-			msg += t.I18nBot("tgbot.commands.needEmail")
+			t.openTicket(message, strings.Join(commandArgs, " "))
 		}
 
 	default:
@@ -344,21 +686,31 @@ func (t *Tgbot) answerCommand(message *telego.Message, chatId int64, isAdmin boo
 func (t *Tgbot) answerCallback(callbackQuery *telego.CallbackQuery, isAdmin bool) {
 	chatId := callbackQuery.Message.GetChat().ID
 
+	if decodedQuery, err := t.decodeQuery(callbackQuery.Data); err == nil && !t.checkPermission(callbackQuery.From.ID, decodedQuery) {
+		t.sendCallbackAnswerTgBot(callbackQuery.ID, t.I18nBot("tgbot.answers.noPermission"))
+		return
+	}
+
 	if isAdmin {
 		// get query from hash storage
 		decodedQuery, err := t.decodeQuery(callbackQuery.Data)
 		if err != nil {
-			t.SendMsgToTgbot(chatId, t.I18nBot("tgbot.noQuery"))
+			t.answerExpiredQuery(callbackQuery, isAdmin)
 			return
 		}
 		dataArray := strings.Split(decodedQuery, " ")
 
 		if len(dataArray) >= 2 && len(dataArray[1]) > 0 {
 			email := dataArray[1]
+			handled := true
 			switch dataArray[0] {
 			case "client_get_usage":
 				t.sendCallbackAnswerTgBot(callbackQuery.ID, t.I18nBot("tgbot.messages.email", "Email=="+email))
 				t.searchClient(chatId, email)
+			case "report_run":
+				name := strings.Join(dataArray[1:], " ")
+				t.sendCallbackAnswerTgBot(callbackQuery.ID, name)
+				t.runReport(chatId, name)
 			case "client_refresh":
 				t.sendCallbackAnswerTgBot(callbackQuery.ID, t.I18nBot("tgbot.answers.clientRefreshSuccess", "Email=="+email))
 				t.searchClient(chatId, email, callbackQuery.Message.GetMessageID())
@@ -388,7 +740,7 @@ func (t *Tgbot) answerCallback(callbackQuery *telego.CallbackQuery, isAdmin bool
 				)
 				t.editMessageCallbackTgBot(chatId, callbackQuery.Message.GetMessageID(), inlineKeyboard)
 			case "reset_traffic_c":
-				err := t.inboundService.ResetClientTrafficByEmail(email)
+				err := t.inboundService.As(NewBotActor(callbackQuery.From.ID)).ResetClientTrafficByEmail(email)
 				if err == nil {
 					t.sendCallbackAnswerTgBot(callbackQuery.ID, t.I18nBot("tgbot.answers.resetTrafficSuccess", "Email=="+email))
 					t.searchClient(chatId, email, callbackQuery.Message.GetMessageID())
@@ -430,7 +782,7 @@ func (t *Tgbot) answerCallback(callbackQuery *telego.CallbackQuery, isAdmin bool
 				if len(dataArray) == 3 {
 					limitTraffic, err := strconv.Atoi(dataArray[2])
 					if err == nil {
-						needRestart, err := t.inboundService.ResetClientTrafficLimitByEmail(email, limitTraffic)
+						needRestart, err := t.inboundService.As(NewBotActor(callbackQuery.From.ID)).ResetClientTrafficLimitByEmail(email, limitTraffic)
 						if needRestart {
 							t.xrayService.SetToNeedRestart()
 						}
@@ -477,6 +829,9 @@ func (t *Tgbot) answerCallback(callbackQuery *telego.CallbackQuery, isAdmin bool
 							tu.InlineKeyboardRow(
 								tu.InlineKeyboardButton(t.I18nBot("tgbot.buttons.confirmNumberAdd", "Num=="+strconv.Itoa(inputNumber))).WithCallbackData(t.encodeQuery("limit_traffic_c "+email+" "+strconv.Itoa(inputNumber))),
 							),
+							tu.InlineKeyboardRow(
+								tu.InlineKeyboardButton(t.I18nBot("tgbot.buttons.typeValue")).WithCallbackData(t.encodeQuery("limit_traffic_ask "+email)),
+							),
 							tu.InlineKeyboardRow(
 								tu.InlineKeyboardButton("1").WithCallbackData(t.encodeQuery("limit_traffic_in "+email+" "+strconv.Itoa(inputNumber)+" 1")),
 								tu.InlineKeyboardButton("2").WithCallbackData(t.encodeQuery("limit_traffic_in "+email+" "+strconv.Itoa(inputNumber)+" 2")),
@@ -535,33 +890,13 @@ func (t *Tgbot) answerCallback(callbackQuery *telego.CallbackQuery, isAdmin bool
 				if len(dataArray) == 3 {
 					days, err := strconv.Atoi(dataArray[2])
 					if err == nil {
-						var date int64 = 0
-						if days > 0 {
-							traffic, err := t.inboundService.GetClientTrafficByEmail(email)
-							if err != nil {
-								logger.Warning(err)
-								msg := t.I18nBot("tgbot.wentWrong")
-								t.SendMsgToTgbot(chatId, msg)
-								return
-							}
-							if traffic == nil {
-								msg := t.I18nBot("tgbot.noResult")
-								t.SendMsgToTgbot(chatId, msg)
-								return
-							}
-
-							if traffic.ExpiryTime > 0 {
-								if traffic.ExpiryTime-time.Now().Unix()*1000 < 0 {
-									date = -int64(days * 24 * 60 * 60000)
-								} else {
-									date = traffic.ExpiryTime + int64(days*24*60*60000)
-								}
-							} else {
-								date = traffic.ExpiryTime - int64(days*24*60*60000)
-							}
-
+						date, err := t.expiryAfterDays(email, days)
+						if err != nil {
+							logger.Warning(err)
+							t.SendMsgToTgbot(chatId, t.I18nBot("tgbot.wentWrong"))
+							return
 						}
-						needRestart, err := t.inboundService.ResetClientExpiryTimeByEmail(email, date)
+						needRestart, err := t.inboundService.As(NewBotActor(callbackQuery.From.ID)).ResetClientExpiryTimeByEmail(email, date)
 						if needRestart {
 							t.xrayService.SetToNeedRestart()
 						}
@@ -608,6 +943,9 @@ func (t *Tgbot) answerCallback(callbackQuery *telego.CallbackQuery, isAdmin bool
 							tu.InlineKeyboardRow(
 								tu.InlineKeyboardButton(t.I18nBot("tgbot.buttons.confirmNumber", "Num=="+strconv.Itoa(inputNumber))).WithCallbackData(t.encodeQuery("reset_exp_c "+email+" "+strconv.Itoa(inputNumber))),
 							),
+							tu.InlineKeyboardRow(
+								tu.InlineKeyboardButton(t.I18nBot("tgbot.buttons.typeValue")).WithCallbackData(t.encodeQuery("reset_exp_ask "+email)),
+							),
 							tu.InlineKeyboardRow(
 								tu.InlineKeyboardButton("1").WithCallbackData(t.encodeQuery("reset_exp_in "+email+" "+strconv.Itoa(inputNumber)+" 1")),
 								tu.InlineKeyboardButton("2").WithCallbackData(t.encodeQuery("reset_exp_in "+email+" "+strconv.Itoa(inputNumber)+" 2")),
@@ -668,7 +1006,7 @@ func (t *Tgbot) answerCallback(callbackQuery *telego.CallbackQuery, isAdmin bool
 				if len(dataArray) == 3 {
 					count, err := strconv.Atoi(dataArray[2])
 					if err == nil {
-						needRestart, err := t.inboundService.ResetClientIpLimitByEmail(email, count)
+						needRestart, err := t.inboundService.As(NewBotActor(callbackQuery.From.ID)).ResetClientIpLimitByEmail(email, count)
 						if needRestart {
 							t.xrayService.SetToNeedRestart()
 						}
@@ -715,6 +1053,9 @@ func (t *Tgbot) answerCallback(callbackQuery *telego.CallbackQuery, isAdmin bool
 							tu.InlineKeyboardRow(
 								tu.InlineKeyboardButton(t.I18nBot("tgbot.buttons.confirmNumber", "Num=="+strconv.Itoa(inputNumber))).WithCallbackData(t.encodeQuery("ip_limit_c "+email+" "+strconv.Itoa(inputNumber))),
 							),
+							tu.InlineKeyboardRow(
+								tu.InlineKeyboardButton(t.I18nBot("tgbot.buttons.typeValue")).WithCallbackData(t.encodeQuery("ip_limit_ask "+email)),
+							),
 							tu.InlineKeyboardRow(
 								tu.InlineKeyboardButton("1").WithCallbackData(t.encodeQuery("ip_limit_in "+email+" "+strconv.Itoa(inputNumber)+" 1")),
 								tu.InlineKeyboardButton("2").WithCallbackData(t.encodeQuery("ip_limit_in "+email+" "+strconv.Itoa(inputNumber)+" 2")),
@@ -742,6 +1083,15 @@ func (t *Tgbot) answerCallback(callbackQuery *telego.CallbackQuery, isAdmin bool
 				}
 				t.sendCallbackAnswerTgBot(callbackQuery.ID, t.I18nBot("tgbot.answers.errorOperation"))
 				t.searchClient(chatId, email, callbackQuery.Message.GetMessageID())
+			case "limit_traffic_ask":
+				t.sendCallbackAnswerTgBot(callbackQuery.ID, t.I18nBot("tgbot.buttons.typeValue"))
+				t.startConversation(chatId, "limit_traffic", t.I18nBot("tgbot.messages.askTrafficLimit", "Email=="+email), map[string]string{"email": email})
+			case "reset_exp_ask":
+				t.sendCallbackAnswerTgBot(callbackQuery.ID, t.I18nBot("tgbot.buttons.typeValue"))
+				t.startConversation(chatId, "reset_exp", t.I18nBot("tgbot.messages.askExpiryDays", "Email=="+email), map[string]string{"email": email})
+			case "ip_limit_ask":
+				t.sendCallbackAnswerTgBot(callbackQuery.ID, t.I18nBot("tgbot.buttons.typeValue"))
+				t.startConversation(chatId, "ip_limit", t.I18nBot("tgbot.messages.askIpLimit", "Email=="+email), map[string]string{"email": email})
 			case "clear_ips":
 				inlineKeyboard := tu.InlineKeyboard(
 					tu.InlineKeyboardRow(
@@ -753,7 +1103,7 @@ func (t *Tgbot) answerCallback(callbackQuery *telego.CallbackQuery, isAdmin bool
 				)
 				t.editMessageCallbackTgBot(chatId, callbackQuery.Message.GetMessageID(), inlineKeyboard)
 			case "clear_ips_c":
-				err := t.inboundService.ClearClientIps(email)
+				err := t.inboundService.As(NewBotActor(callbackQuery.From.ID)).ClearClientIps(email)
 				if err == nil {
 					t.sendCallbackAnswerTgBot(callbackQuery.ID, t.I18nBot("tgbot.answers.clearIpSuccess", "Email=="+email))
 					t.searchClientIps(chatId, email, callbackQuery.Message.GetMessageID())
@@ -782,7 +1132,7 @@ func (t *Tgbot) answerCallback(callbackQuery *telego.CallbackQuery, isAdmin bool
 					t.sendCallbackAnswerTgBot(callbackQuery.ID, t.I18nBot("tgbot.answers.errorOperation"))
 					return
 				}
-				needRestart, err := t.inboundService.SetClientTelegramUserID(traffic.Id, EmptyTelegramUserID)
+				needRestart, err := t.inboundService.As(NewBotActor(callbackQuery.From.ID)).SetClientTelegramUserID(traffic.Id, EmptyTelegramUserID)
 				if needRestart {
 					t.xrayService.SetToNeedRestart()
 				}
@@ -792,6 +1142,83 @@ func (t *Tgbot) answerCallback(callbackQuery *telego.CallbackQuery, isAdmin bool
 				} else {
 					t.sendCallbackAnswerTgBot(callbackQuery.ID, t.I18nBot("tgbot.answers.errorOperation"))
 				}
+			case "tgid_ban":
+				inlineKeyboard := tu.InlineKeyboard(
+					tu.InlineKeyboardRow(
+						tu.InlineKeyboardButton(t.I18nBot("tgbot.buttons.cancel")).WithCallbackData(t.encodeQuery("tgid_cancel "+email)),
+					),
+					tu.InlineKeyboardRow(
+						tu.InlineKeyboardButton(t.I18nBot("tgbot.buttons.confirmBanTGUser")).WithCallbackData(t.encodeQuery("tgid_ban_c "+email)),
+					),
+				)
+				t.editMessageCallbackTgBot(chatId, callbackQuery.Message.GetMessageID(), inlineKeyboard)
+			case "tgid_ban_c", "tgid_unban":
+				_, client, err := t.inboundService.GetClientByEmail(email)
+				if err != nil || client == nil || client.TgID == 0 || checkAdmin(client.TgID) {
+					t.sendCallbackAnswerTgBot(callbackQuery.ID, t.I18nBot("tgbot.answers.errorOperation"))
+					return
+				}
+				blocklistService := t.blocklistService.As(NewBotActor(callbackQuery.From.ID))
+				if dataArray[0] == "tgid_ban_c" {
+					_, err = blocklistService.Ban(client.TgID, t.I18nBot("tgbot.messages.banReasonAdmin"), 0)
+				} else {
+					_, err = blocklistService.Unban(client.TgID)
+				}
+				if err != nil {
+					logger.Warning(err)
+					t.sendCallbackAnswerTgBot(callbackQuery.ID, t.I18nBot("tgbot.answers.errorOperation"))
+					return
+				}
+				t.sendCallbackAnswerTgBot(callbackQuery.ID, t.I18nBot("tgbot.answers.successfulOperation"))
+				t.clientTelegramUserInfo(chatId, email, callbackQuery.Message.GetMessageID())
+			case "customer_get":
+				id, err := strconv.Atoi(dataArray[1])
+				if err != nil {
+					t.sendCallbackAnswerTgBot(callbackQuery.ID, t.I18nBot("tgbot.answers.errorOperation"))
+					return
+				}
+				t.sendCallbackAnswerTgBot(callbackQuery.ID, t.I18nBot("tgbot.answers.successfulOperation"))
+				t.sendCustomer(chatId, callbackQuery.From.ID, id, callbackQuery.Message.GetMessageID())
+			case "customer_reset":
+				inlineKeyboard := tu.InlineKeyboard(
+					tu.InlineKeyboardRow(
+						tu.InlineKeyboardButton(t.I18nBot("tgbot.buttons.cancel")).WithCallbackData(t.encodeQuery("customer_get "+dataArray[1])),
+					),
+					tu.InlineKeyboardRow(
+						tu.InlineKeyboardButton(t.I18nBot("tgbot.buttons.confirmResetTraffic")).WithCallbackData(t.encodeQuery("customer_reset_c "+dataArray[1])),
+					),
+				)
+				t.editMessageCallbackTgBot(chatId, callbackQuery.Message.GetMessageID(), inlineKeyboard)
+			case "customer_reset_c":
+				id, err := strconv.Atoi(dataArray[1])
+				if err != nil {
+					t.sendCallbackAnswerTgBot(callbackQuery.ID, t.I18nBot("tgbot.answers.errorOperation"))
+					return
+				}
+				needRestart, err := t.customerService.As(NewBotActor(callbackQuery.From.ID)).ResetCustomerTraffic(id)
+				if needRestart {
+					t.xrayService.SetToNeedRestart()
+				}
+				if err != nil {
+					logger.Warning(err)
+					t.sendCallbackAnswerTgBot(callbackQuery.ID, t.I18nBot("tgbot.answers.errorOperation"))
+					return
+				}
+				t.sendCallbackAnswerTgBot(callbackQuery.ID, t.I18nBot("tgbot.answers.successfulOperation"))
+				t.sendCustomer(chatId, callbackQuery.From.ID, id, callbackQuery.Message.GetMessageID())
+			case "tg_unban":
+				tgId, err := strconv.ParseInt(dataArray[1], 10, 64)
+				if err != nil {
+					t.sendCallbackAnswerTgBot(callbackQuery.ID, t.I18nBot("tgbot.answers.errorOperation"))
+					return
+				}
+				_, err = t.blocklistService.As(NewBotActor(callbackQuery.From.ID)).Unban(tgId)
+				if err != nil {
+					logger.Warning(err)
+					t.sendCallbackAnswerTgBot(callbackQuery.ID, t.I18nBot("tgbot.answers.errorOperation"))
+					return
+				}
+				t.sendCallbackAnswerTgBot(callbackQuery.ID, t.I18nBot("tgbot.answers.unbannedTGUser", "TelegramID=="+dataArray[1]))
 			case "toggle_enable":
 				inlineKeyboard := tu.InlineKeyboard(
 					tu.InlineKeyboardRow(
@@ -803,7 +1230,7 @@ func (t *Tgbot) answerCallback(callbackQuery *telego.CallbackQuery, isAdmin bool
 				)
 				t.editMessageCallbackTgBot(chatId, callbackQuery.Message.GetMessageID(), inlineKeyboard)
 			case "toggle_enable_c":
-				enabled, needRestart, err := t.inboundService.ToggleClientEnableByEmail(email)
+				enabled, needRestart, err := t.inboundService.As(NewBotActor(callbackQuery.From.ID)).ToggleClientEnableByEmail(email)
 				if needRestart {
 					t.xrayService.SetToNeedRestart()
 				}
@@ -817,6 +1244,79 @@ func (t *Tgbot) answerCallback(callbackQuery *telego.CallbackQuery, isAdmin bool
 				} else {
 					t.sendCallbackAnswerTgBot(callbackQuery.ID, t.I18nBot("tgbot.answers.errorOperation"))
 				}
+			case "speed_tier":
+				tiers, err := t.settingService.GetSpeedTiers()
+				if err != nil || len(tiers) == 0 {
+					t.sendCallbackAnswerTgBot(callbackQuery.ID, t.I18nBot("tgbot.answers.noSpeedTiers"))
+					return
+				}
+				rows := [][]telego.InlineKeyboardButton{
+					tu.InlineKeyboardRow(
+						tu.InlineKeyboardButton(t.I18nBot("tgbot.buttons.cancel")).WithCallbackData(t.encodeQuery("client_cancel " + email)),
+					),
+					tu.InlineKeyboardRow(
+						tu.InlineKeyboardButton(t.I18nBot("tgbot.buttons.defaultSpeedTier")).WithCallbackData(t.encodeQuery("speed_tier_c " + email)),
+					),
+				}
+				for _, tier := range tiers {
+					rows = append(rows, tu.InlineKeyboardRow(
+						tu.InlineKeyboardButton(tier.Name).WithCallbackData(t.encodeQuery("speed_tier_c "+email+" "+tier.Name)),
+					))
+				}
+				t.editMessageCallbackTgBot(chatId, callbackQuery.Message.GetMessageID(), tu.InlineKeyboard(rows...))
+			case "speed_tier_c":
+				speedTier := ""
+				if len(dataArray) == 3 {
+					speedTier = dataArray[2]
+				}
+				needRestart, err := t.inboundService.As(NewBotActor(callbackQuery.From.ID)).SetClientSpeedTierByEmail(email, speedTier)
+				if needRestart {
+					t.xrayService.SetToNeedRestart()
+				}
+				if err == nil {
+					t.sendCallbackAnswerTgBot(callbackQuery.ID, t.I18nBot("tgbot.answers.speedTierSuccess", "Email=="+email))
+				} else {
+					logger.Warning(err)
+					t.sendCallbackAnswerTgBot(callbackQuery.ID, t.I18nBot("tgbot.answers.errorOperation"))
+				}
+				t.searchClient(chatId, email, callbackQuery.Message.GetMessageID())
+			case "add_client_in":
+				inboundId, err := strconv.Atoi(dataArray[1])
+				if err != nil {
+					t.sendCallbackAnswerTgBot(callbackQuery.ID, err.Error())
+					return
+				}
+				inbound, err := t.inboundService.GetInbound(inboundId)
+				if err != nil {
+					t.sendCallbackAnswerTgBot(callbackQuery.ID, err.Error())
+					return
+				}
+				t.sendCallbackAnswerTgBot(callbackQuery.ID, t.I18nBot("tgbot.buttons.addClient"))
+				t.startConversation(chatId, "add_client_email", t.I18nBot("tgbot.messages.askNewEmail", "Inbound=="+inbound.Remark), map[string]string{
+					"inbound": dataArray[1],
+				})
+			case "del_client":
+				inlineKeyboard := tu.InlineKeyboard(
+					tu.InlineKeyboardRow(
+						tu.InlineKeyboardButton(t.I18nBot("tgbot.buttons.cancel")).WithCallbackData(t.encodeQuery("client_cancel "+email)),
+					),
+					tu.InlineKeyboardRow(
+						tu.InlineKeyboardButton(t.I18nBot("tgbot.buttons.confirmDeleteClient")).WithCallbackData(t.encodeQuery("del_client_c "+email)),
+					),
+				)
+				t.editMessageCallbackTgBot(chatId, callbackQuery.Message.GetMessageID(), inlineKeyboard)
+			case "del_client_c":
+				needRestart, err := t.deleteClient(callbackQuery.From.ID, email)
+				if needRestart {
+					t.xrayService.SetToNeedRestart()
+				}
+				if err != nil {
+					logger.Warning(err)
+					t.sendCallbackAnswerTgBot(callbackQuery.ID, t.I18nBot("tgbot.answers.errorOperation"))
+					return
+				}
+				t.sendCallbackAnswerTgBot(callbackQuery.ID, t.I18nBot("tgbot.answers.clientDeleted", "Email=="+email))
+				t.editMessageTgBot(chatId, callbackQuery.Message.GetMessageID(), t.I18nBot("tgbot.answers.clientDeleted", "Email=="+email))
 			case "get_clients":
 				inboundId := dataArray[1]
 				inboundIdInt, err := strconv.Atoi(inboundId)
@@ -835,21 +1335,58 @@ func (t *Tgbot) answerCallback(callbackQuery *telego.CallbackQuery, isAdmin bool
 					return
 				}
 				t.SendMsgToTgbot(chatId, t.I18nBot("tgbot.answers.chooseClient", "Inbound=="+inbound.Remark), clients)
-
-			}
-			return
-		} else {
-			switch callbackQuery.Data {
-			case "get_inbounds":
-				inbounds, err := t.getInbounds()
+			case "support_reply":
+				ticketId, err := strconv.Atoi(dataArray[1])
 				if err != nil {
 					t.sendCallbackAnswerTgBot(callbackQuery.ID, err.Error())
 					return
-
 				}
-				t.sendCallbackAnswerTgBot(callbackQuery.ID, t.I18nBot("tgbot.buttons.allClients"))
-				t.SendMsgToTgbot(chatId, t.I18nBot("tgbot.answers.chooseInbound"), inbounds)
-			}
+				t.sendCallbackAnswerTgBot(callbackQuery.ID, t.I18nBot("tgbot.buttons.reply"))
+				t.startConversation(chatId, "support_reply", t.I18nBot("tgbot.answers.supportReplyPrompt", "Id=="+strconv.Itoa(ticketId)), map[string]string{
+					"ticket": strconv.Itoa(ticketId),
+				})
+			case "support_close":
+				ticketId, err := strconv.Atoi(dataArray[1])
+				if err != nil {
+					t.sendCallbackAnswerTgBot(callbackQuery.ID, err.Error())
+					return
+				}
+				ticket, err := t.supportService.CloseTicket(ticketId)
+				if err != nil {
+					logger.Warning(err)
+					t.sendCallbackAnswerTgBot(callbackQuery.ID, t.I18nBot("tgbot.answers.errorOperation"))
+					return
+				}
+				t.sendCallbackAnswerTgBot(callbackQuery.ID, t.I18nBot("tgbot.answers.supportClosed", "Id=="+dataArray[1]))
+				t.editMessageCallbackTgBot(chatId, callbackQuery.Message.GetMessageID(), tu.InlineKeyboard())
+				t.SendMsgToTgbot(ticket.TgId, t.I18nBot("tgbot.answers.supportClosed", "Id=="+dataArray[1]))
+			default:
+				// admins manage the clients they own like customers do
+				handled = false
+			}
+			if handled {
+				return
+			}
+		} else {
+			switch callbackQuery.Data {
+			case "get_inbounds":
+				inbounds, err := t.getInbounds(callbackQuery.From.ID, "get_clients")
+				if err != nil {
+					t.sendCallbackAnswerTgBot(callbackQuery.ID, err.Error())
+					return
+
+				}
+				t.sendCallbackAnswerTgBot(callbackQuery.ID, t.I18nBot("tgbot.buttons.allClients"))
+				t.SendMsgToTgbot(chatId, t.I18nBot("tgbot.answers.chooseInbound"), inbounds)
+			case "add_client":
+				inbounds, err := t.getInbounds(callbackQuery.From.ID, "add_client_in")
+				if err != nil {
+					t.sendCallbackAnswerTgBot(callbackQuery.ID, err.Error())
+					return
+				}
+				t.sendCallbackAnswerTgBot(callbackQuery.ID, t.I18nBot("tgbot.buttons.addClient"))
+				t.SendMsgToTgbot(chatId, t.I18nBot("tgbot.answers.chooseInbound"), inbounds)
+			}
 
 		}
 	}
@@ -859,7 +1396,7 @@ func (t *Tgbot) answerCallback(callbackQuery *telego.CallbackQuery, isAdmin bool
 		// get query from hash storage
 		decodedQuery, err := t.decodeQuery(callbackQuery.Data)
 		if err != nil {
-			t.SendMsgToTgbot(chatId, t.I18nBot("tgbot.noQuery"))
+			t.answerExpiredQuery(callbackQuery, isAdmin)
 			return
 		}
 		dataArray = strings.Split(decodedQuery, " ")
@@ -873,6 +1410,10 @@ func (t *Tgbot) answerCallback(callbackQuery *telego.CallbackQuery, isAdmin bool
 		case "usage_refresh":
 			t.sendCallbackAnswerTgBot(callbackQuery.ID, t.I18nBot("tgbot.answers.successfulOperation"))
 			t.getServerUsage(chatId, callbackQuery.Message.GetMessageID())
+		case "top_today", "top_week", "top_month", "top_all":
+			period := strings.TrimPrefix(dataArray[0], "top_")
+			t.sendCallbackAnswerTgBot(callbackQuery.ID, t.I18nBot(topConsumerPeriods[period]))
+			t.sendTopConsumers(chatId, callbackQuery.From.ID, period, callbackQuery.Message.GetMessageID())
 		case "inbounds":
 			t.sendCallbackAnswerTgBot(callbackQuery.ID, t.I18nBot("tgbot.buttons.getInbounds"))
 			t.SendMsgToTgbot(chatId, t.getInboundUsages())
@@ -899,7 +1440,7 @@ func (t *Tgbot) answerCallback(callbackQuery *telego.CallbackQuery, isAdmin bool
 			t.onlineClients(chatId, callbackQuery.Message.GetMessageID())
 		case "commands":
 			t.sendCallbackAnswerTgBot(callbackQuery.ID, t.I18nBot("tgbot.buttons.commands"))
-			t.SendMsgToTgbot(chatId, t.I18nBot("tgbot.commands.helpAdminCommands"))
+			t.SendMsgToTgbot(chatId, t.I18nBot("tgbot.commands.helpAdminCommands")+t.I18nBot("tgbot.commands.inlineSearch")+t.I18nBot("tgbot.commands.audit")+t.I18nBot("tgbot.commands.report")+t.I18nBot("tgbot.commands.top")+t.I18nBot("tgbot.commands.customer")+t.I18nBot("tgbot.commands.ban"))
 		case "subInfo":
 			t.sendCallbackAnswerTgBot(callbackQuery.ID, t.I18nBot("tgbot.buttons.subscription"))
 			t.SendMsgToTgbot(chatId, t.I18nBot("tgbot.commands.helpAdminCommands"))
@@ -909,7 +1450,92 @@ func (t *Tgbot) answerCallback(callbackQuery *telego.CallbackQuery, isAdmin bool
 			t.sendSubscriptions(chatId, tgUserID)
 		}
 	} else if len(dataArray) == 2 {
+		if strings.HasPrefix(dataArray[0], "my_") && !t.isClientOwner(callbackQuery.From.ID, dataArray[1]) {
+			t.sendCallbackAnswerTgBot(callbackQuery.ID, t.I18nBot("tgbot.noResult"))
+			return
+		}
 		switch dataArray[0] {
+		case "my_client":
+			t.sendCallbackAnswerTgBot(callbackQuery.ID, t.I18nBot("tgbot.answers.clientRefreshSuccess", "Email=="+dataArray[1]))
+			t.customerClient(chatId, dataArray[1], callbackQuery.Message.GetMessageID())
+		case "my_regen":
+			inlineKeyboard := tu.InlineKeyboard(
+				tu.InlineKeyboardRow(
+					tu.InlineKeyboardButton(t.I18nBot("tgbot.buttons.cancel")).WithCallbackData(t.encodeQuery("my_client "+dataArray[1])),
+				),
+				tu.InlineKeyboardRow(
+					tu.InlineKeyboardButton(t.I18nBot("tgbot.buttons.confirmRegenerate")).WithCallbackData(t.encodeQuery("my_regen_c "+dataArray[1])),
+				),
+			)
+			t.editMessageCallbackTgBot(chatId, callbackQuery.Message.GetMessageID(), inlineKeyboard)
+		case "my_regen_c":
+			needRestart, err := t.inboundService.As(NewBotActor(callbackQuery.From.ID)).RegenerateClientCredentialByEmail(dataArray[1])
+			if needRestart {
+				t.xrayService.SetToNeedRestart()
+			}
+			if err == nil {
+				t.sendCallbackAnswerTgBot(callbackQuery.ID, t.I18nBot("tgbot.answers.regenerateSuccess", "Email=="+dataArray[1]))
+				t.customerClient(chatId, dataArray[1], callbackQuery.Message.GetMessageID())
+			} else {
+				logger.Warning(err)
+				t.sendCallbackAnswerTgBot(callbackQuery.ID, t.I18nBot("tgbot.answers.errorOperation"))
+			}
+		case "my_clear_ips":
+			inlineKeyboard := tu.InlineKeyboard(
+				tu.InlineKeyboardRow(
+					tu.InlineKeyboardButton(t.I18nBot("tgbot.buttons.cancel")).WithCallbackData(t.encodeQuery("my_client "+dataArray[1])),
+				),
+				tu.InlineKeyboardRow(
+					tu.InlineKeyboardButton(t.I18nBot("tgbot.buttons.confirmResetDevices")).WithCallbackData(t.encodeQuery("my_clear_ips_c "+dataArray[1])),
+				),
+			)
+			t.editMessageCallbackTgBot(chatId, callbackQuery.Message.GetMessageID(), inlineKeyboard)
+		case "my_clear_ips_c":
+			err := t.inboundService.As(NewBotActor(callbackQuery.From.ID)).ClearClientIps(dataArray[1])
+			if err == nil {
+				t.sendCallbackAnswerTgBot(callbackQuery.ID, t.I18nBot("tgbot.answers.clearIpSuccess", "Email=="+dataArray[1]))
+				t.customerClient(chatId, dataArray[1], callbackQuery.Message.GetMessageID())
+			} else {
+				t.sendCallbackAnswerTgBot(callbackQuery.ID, t.I18nBot("tgbot.answers.errorOperation"))
+			}
+		case "my_autopay":
+			autoRenew, needRestart, err := t.inboundService.As(NewBotActor(callbackQuery.From.ID)).ToggleClientAutoRenewByEmail(dataArray[1])
+			if needRestart {
+				t.xrayService.SetToNeedRestart()
+			}
+			if errors.Is(err, ErrNoRenewPeriod) {
+				t.sendCallbackAnswerTgBot(callbackQuery.ID, t.I18nBot("tgbot.answers.autoRenewUnavailable", "Email=="+dataArray[1]))
+			} else if err == nil {
+				if autoRenew {
+					t.sendCallbackAnswerTgBot(callbackQuery.ID, t.I18nBot("tgbot.answers.autoRenewEnabled", "Email=="+dataArray[1]))
+				} else {
+					t.sendCallbackAnswerTgBot(callbackQuery.ID, t.I18nBot("tgbot.answers.autoRenewDisabled", "Email=="+dataArray[1]))
+				}
+				t.customerClient(chatId, dataArray[1], callbackQuery.Message.GetMessageID())
+			} else {
+				logger.Warning(err)
+				t.sendCallbackAnswerTgBot(callbackQuery.ID, t.I18nBot("tgbot.answers.errorOperation"))
+			}
+		case "support_close":
+			ticketId, err := strconv.Atoi(dataArray[1])
+			if err != nil {
+				t.sendCallbackAnswerTgBot(callbackQuery.ID, t.I18nBot("tgbot.noResult"))
+				return
+			}
+			ticket, err := t.supportService.GetTicket(ticketId)
+			if err != nil || ticket.TgId != callbackQuery.From.ID {
+				t.sendCallbackAnswerTgBot(callbackQuery.ID, t.I18nBot("tgbot.noResult"))
+				return
+			}
+			_, err = t.supportService.CloseTicket(ticketId)
+			if err != nil {
+				logger.Warning(err)
+				t.sendCallbackAnswerTgBot(callbackQuery.ID, t.I18nBot("tgbot.answers.errorOperation"))
+				return
+			}
+			t.sendCallbackAnswerTgBot(callbackQuery.ID, t.I18nBot("tgbot.answers.supportClosed", "Id=="+dataArray[1]))
+			t.editMessageCallbackTgBot(chatId, callbackQuery.Message.GetMessageID(), tu.InlineKeyboard())
+			t.sendMsgToAdminsWith(PermSupport, t.I18nBot("tgbot.answers.supportClosed", "Id=="+dataArray[1]))
 		case "resubscribe":
 			tgUserID := callbackQuery.From.ID
 			email := dataArray[1]
@@ -920,6 +1546,681 @@ func (t *Tgbot) answerCallback(callbackQuery *telego.CallbackQuery, isAdmin bool
 	}
 }
 
+// openTicket opens a support ticket for the customer, or reuses the open one,
+// and forwards text given along with the command to the admins.
+func (t *Tgbot) openTicket(message *telego.Message, text string) {
+	chatId := message.Chat.ID
+	ticket, err := t.supportService.OpenTicket(message.From.ID, supportUsername(message.From))
+	if err != nil {
+		logger.Warning(err)
+		t.SendMsgToTgbot(chatId, t.I18nBot("tgbot.answers.errorOperation"))
+		return
+	}
+
+	inlineKeyboard := tu.InlineKeyboard(
+		tu.InlineKeyboardRow(
+			tu.InlineKeyboardButton(t.I18nBot("tgbot.buttons.closeTicket")).WithCallbackData(t.encodeQuery("support_close " + strconv.Itoa(ticket.Id))),
+		),
+	)
+	t.SendMsgToTgbot(chatId, t.I18nBot("tgbot.answers.supportOpened", "Id=="+strconv.Itoa(ticket.Id)), inlineKeyboard)
+
+	if text != "" {
+		t.forwardToAdmins(ticket, message.From.ID, text)
+	}
+}
+
+// supportMessage forwards plain text messages of customers with an open
+// ticket to the admins.
+func (t *Tgbot) supportMessage(message *telego.Message) {
+	if checkAdmin(message.From.ID) {
+		return
+	}
+
+	ticket, err := t.supportService.GetOpenTicket(message.From.ID)
+	if err != nil {
+		logger.Warning(err)
+		return
+	}
+	if ticket == nil {
+		return
+	}
+	t.forwardToAdmins(ticket, message.From.ID, message.Text)
+}
+
+// replyTicket relays the admin's reply to the customer who opened the ticket.
+func (t *Tgbot) replyTicket(message *telego.Message, ticketId int) {
+	chatId := message.Chat.ID
+	err := t.supportService.AddMessage(ticketId, message.From.ID, true, message.Text)
+	if err != nil {
+		logger.Warning(err)
+		t.SendMsgToTgbot(chatId, t.I18nBot("tgbot.answers.errorOperation"))
+		return
+	}
+	ticket, err := t.supportService.GetTicket(ticketId)
+	if err != nil {
+		logger.Warning(err)
+		t.SendMsgToTgbot(chatId, t.I18nBot("tgbot.answers.errorOperation"))
+		return
+	}
+
+	id := strconv.Itoa(ticket.Id)
+	inlineKeyboard := tu.InlineKeyboard(
+		tu.InlineKeyboardRow(
+			tu.InlineKeyboardButton(t.I18nBot("tgbot.buttons.closeTicket")).WithCallbackData(t.encodeQuery("support_close " + id)),
+		),
+	)
+	output := t.I18nBot("tgbot.messages.supportReply", "Id=="+id)
+	output += html.EscapeString(message.Text)
+	t.SendMsgToTgbot(ticket.TgId, output, inlineKeyboard)
+	t.SendMsgToTgbot(chatId, t.I18nBot("tgbot.answers.supportReplySent", "Id=="+id))
+}
+
+func (t *Tgbot) forwardToAdmins(ticket *model.SupportTicket, senderId int64, text string) {
+	err := t.supportService.AddMessage(ticket.Id, senderId, false, text)
+	if err != nil {
+		logger.Warning(err)
+		t.SendMsgToTgbot(ticket.TgId, t.I18nBot("tgbot.answers.errorOperation"))
+		return
+	}
+
+	id := strconv.Itoa(ticket.Id)
+	output := t.I18nBot("tgbot.messages.supportTicket",
+		"Id=="+id,
+		"User=="+html.EscapeString(ticket.Username),
+		"TelegramID=="+strconv.FormatInt(ticket.TgId, 10))
+	output += html.EscapeString(text)
+	t.sendMsgToAdminsWith(PermSupport, output, t.ticketKeyboard(ticket.Id))
+	t.SendMsgToTgbot(ticket.TgId, t.I18nBot("tgbot.answers.supportDelivered", "Id=="+id))
+}
+
+func (t *Tgbot) sendOpenTickets(chatId int64) {
+	tickets, err := t.supportService.GetTickets(string(model.TicketOpen))
+	if err != nil {
+		logger.Warning(err)
+		t.SendMsgToTgbot(chatId, t.I18nBot("tgbot.wentWrong"))
+		return
+	}
+	if len(tickets) == 0 {
+		t.SendMsgToTgbot(chatId, t.I18nBot("tgbot.answers.supportNoTickets"))
+		return
+	}
+
+	for _, ticket := range tickets {
+		output := t.I18nBot("tgbot.messages.supportTicket",
+			"Id=="+strconv.Itoa(ticket.Id),
+			"User=="+html.EscapeString(ticket.Username),
+			"TelegramID=="+strconv.FormatInt(ticket.TgId, 10))
+		output += t.I18nBot("tgbot.messages.supportUpdated", "Time=="+time.Unix(ticket.UpdatedAt, 0).Format("2006-01-02 15:04:05"))
+		t.SendMsgToTgbot(chatId, output, t.ticketKeyboard(ticket.Id))
+	}
+}
+
+// auditLogMsg lists the latest audit entries of the client.
+func (t *Tgbot) auditLogMsg(email string) string {
+	logs, err := t.auditService.GetLogs(AuditTargetClient, email, "", auditLogLimit)
+	if err != nil {
+		logger.Warning(err)
+		return t.I18nBot("tgbot.wentWrong")
+	}
+	if len(logs) == 0 {
+		return t.I18nBot("tgbot.noResult")
+	}
+
+	output := t.I18nBot("tgbot.messages.auditTitle", "Email=="+html.EscapeString(email))
+	for _, entry := range logs {
+		output += t.I18nBot("tgbot.messages.auditEntry",
+			"Time=="+time.Unix(entry.CreatedAt, 0).Format("2006-01-02 15:04:05"),
+			"Action=="+entry.Action,
+			"Actor=="+html.EscapeString(entry.Actor),
+			"Channel=="+entry.Channel)
+		if entry.Before != "" || entry.After != "" {
+			output += t.I18nBot("tgbot.messages.auditChange",
+				"Before=="+html.EscapeString(auditShorten(entry.Before)),
+				"After=="+html.EscapeString(auditShorten(entry.After)))
+		}
+		output += "\r\n"
+	}
+	return output
+}
+
+// auditShorten keeps audit values short enough for a Telegram message.
+func auditShorten(value string) string {
+	if value == "" {
+		return "-"
+	}
+	runes := []rune(value)
+	if len(runes) > auditValueLength {
+		return string(runes[:auditValueLength]) + "…"
+	}
+	return value
+}
+
+func (t *Tgbot) ticketKeyboard(ticketId int) *telego.InlineKeyboardMarkup {
+	id := strconv.Itoa(ticketId)
+	return tu.InlineKeyboard(
+		tu.InlineKeyboardRow(
+			tu.InlineKeyboardButton(t.I18nBot("tgbot.buttons.reply")).WithCallbackData(t.encodeQuery("support_reply "+id)),
+			tu.InlineKeyboardButton(t.I18nBot("tgbot.buttons.closeTicket")).WithCallbackData(t.encodeQuery("support_close "+id)),
+		),
+	)
+}
+
+func supportUsername(user *telego.User) string {
+	if user.Username != "" {
+		return "@" + user.Username
+	}
+	return strings.TrimSpace(user.FirstName + " " + user.LastName)
+}
+
+// startConversation makes the bot wait for free-text input of the chat for
+// the given flow, replacing any running one.
+func (t *Tgbot) startConversation(chatId int64, flow string, prompt string, fields map[string]string) {
+	conversations.Start(chatId, flow, fields)
+	t.SendMsgToTgbot(chatId, prompt+t.I18nBot("tgbot.messages.cancelHint"))
+}
+
+// RemoveExpiredConversations drops conversations nobody answered in time.
+func (t *Tgbot) RemoveExpiredConversations() {
+	conversations.RemoveExpired()
+}
+
+// answerConversation handles a text message as the input of the running
+// conversation of the chat and reports whether there was one.
+func (t *Tgbot) answerConversation(message *telego.Message) bool {
+	chatId := message.Chat.ID
+	conversation := conversations.Get(chatId)
+	if conversation == nil {
+		return false
+	}
+
+	// the role of an admin may have changed since the flow started
+	if query := conversationQuery(conversation); query != "" {
+		if !checkAdmin(message.From.ID) {
+			conversations.End(chatId)
+			return false
+		}
+		if !t.checkPermission(message.From.ID, query) {
+			conversations.End(chatId)
+			t.SendMsgToTgbot(chatId, t.I18nBot("tgbot.answers.noPermission"))
+			return true
+		}
+	}
+
+	text := strings.TrimSpace(message.Text)
+	email := conversation.Fields["email"]
+
+	switch conversation.Flow {
+	case "limit_traffic", "reset_exp", "ip_limit":
+		number, err := strconv.Atoi(text)
+		if err != nil || number < 0 || number >= 999999 {
+			t.SendMsgToTgbot(chatId, t.I18nBot("tgbot.messages.invalidNumber"))
+			return true
+		}
+		conversations.End(chatId)
+
+		var needRestart bool
+		var output string
+		switch conversation.Flow {
+		case "limit_traffic":
+			needRestart, err = t.inboundService.As(NewBotActor(message.From.ID)).ResetClientTrafficLimitByEmail(email, number)
+			output = t.I18nBot("tgbot.answers.setTrafficLimitSuccess", "Email=="+email)
+		case "reset_exp":
+			var date int64
+			date, err = t.expiryAfterDays(email, number)
+			if err == nil {
+				needRestart, err = t.inboundService.As(NewBotActor(message.From.ID)).ResetClientExpiryTimeByEmail(email, date)
+			}
+			output = t.I18nBot("tgbot.answers.expireResetSuccess", "Email=="+email)
+		case "ip_limit":
+			needRestart, err = t.inboundService.As(NewBotActor(message.From.ID)).ResetClientIpLimitByEmail(email, number)
+			output = t.I18nBot("tgbot.answers.resetIpSuccess", "Email=="+email, "Count=="+strconv.Itoa(number))
+		}
+		if needRestart {
+			t.xrayService.SetToNeedRestart()
+		}
+		if err != nil {
+			logger.Warning(err)
+			t.SendMsgToTgbot(chatId, t.I18nBot("tgbot.answers.errorOperation"))
+			return true
+		}
+		t.SendMsgToTgbot(chatId, output)
+		t.searchClient(chatId, email)
+	case "add_client_email":
+		valid, err := validateEmail(text)
+		if !valid {
+			t.SendMsgToTgbot(chatId, t.I18nBot("tgbot.messages.invalidEmail", "Error=="+html.EscapeString(err.Error())))
+			return true
+		}
+		traffic, err := t.inboundService.GetClientTrafficByEmail(text)
+		if err != nil || traffic != nil {
+			t.SendMsgToTgbot(chatId, t.I18nBot("tgbot.answers.emailNotAvailable"))
+			return true
+		}
+		conversations.Set(chatId, "add_client_traffic", "email", text)
+		t.SendMsgToTgbot(chatId, t.I18nBot("tgbot.messages.askTrafficLimit", "Email=="+text)+t.I18nBot("tgbot.messages.cancelHint"))
+	case "add_client_traffic", "add_client_expiry", "add_client_limitip", "add_client_tgid":
+		number, err := strconv.ParseInt(text, 10, 64)
+		if err != nil || number < 0 {
+			t.SendMsgToTgbot(chatId, t.I18nBot("tgbot.messages.invalidNumber"))
+			return true
+		}
+		switch conversation.Flow {
+		case "add_client_traffic":
+			conversations.Set(chatId, "add_client_expiry", "traffic", text)
+			t.SendMsgToTgbot(chatId, t.I18nBot("tgbot.messages.askNewExpiryDays", "Email=="+email)+t.I18nBot("tgbot.messages.cancelHint"))
+		case "add_client_expiry":
+			conversations.Set(chatId, "add_client_limitip", "expiry", text)
+			t.SendMsgToTgbot(chatId, t.I18nBot("tgbot.messages.askIpLimit", "Email=="+email)+t.I18nBot("tgbot.messages.cancelHint"))
+		case "add_client_limitip":
+			conversations.Set(chatId, "add_client_tgid", "limitIp", text)
+			t.SendMsgToTgbot(chatId, t.I18nBot("tgbot.messages.askTgId", "Email=="+email)+t.I18nBot("tgbot.messages.cancelHint"))
+		case "add_client_tgid":
+			conversations.End(chatId)
+			conversation.Fields["tgId"] = text
+			t.createClient(chatId, message.From.ID, conversation.Fields)
+		}
+	case "support_reply":
+		conversations.End(chatId)
+		ticketId, err := strconv.Atoi(conversation.Fields["ticket"])
+		if err != nil {
+			t.SendMsgToTgbot(chatId, t.I18nBot("tgbot.answers.errorOperation"))
+			return true
+		}
+		t.replyTicket(message, ticketId)
+	case "subscribe":
+		conversations.End(chatId)
+		t.SendMsgToTgbot(chatId, t.subscribe(chatId, message.From.ID, text))
+	default:
+		conversations.End(chatId)
+		return false
+	}
+	return true
+}
+
+// conversationQuery is the callback query an admin flow acts like, whose
+// permission is checked again on every step, empty for customer flows.
+func conversationQuery(conversation *Conversation) string {
+	switch conversation.Flow {
+	case "limit_traffic", "reset_exp", "ip_limit":
+		return conversation.Flow + " " + conversation.Fields["email"]
+	case "add_client_email", "add_client_traffic", "add_client_expiry", "add_client_limitip", "add_client_tgid":
+		return "add_client_in " + conversation.Fields["inbound"]
+	case "support_reply":
+		return "support_reply " + conversation.Fields["ticket"]
+	}
+	return ""
+}
+
+// createClient adds the client collected by the add_client conversation and
+// replies with its share links and subscription URL.
+func (t *Tgbot) createClient(chatId int64, tgUserID int64, fields map[string]string) {
+	email := fields["email"]
+	inboundId, err := strconv.Atoi(fields["inbound"])
+	if err != nil {
+		t.SendMsgToTgbot(chatId, t.I18nBot("tgbot.answers.errorOperation"))
+		return
+	}
+	totalGB, _ := strconv.ParseInt(fields["traffic"], 10, 64)
+	days, _ := strconv.ParseInt(fields["expiry"], 10, 64)
+	limitIp, _ := strconv.Atoi(fields["limitIp"])
+	tgId, _ := strconv.ParseInt(fields["tgId"], 10, 64)
+
+	inbound, err := t.inboundService.GetInbound(inboundId)
+	if err != nil {
+		logger.Warning(err)
+		t.SendMsgToTgbot(chatId, t.I18nBot("tgbot.answers.errorOperation"))
+		return
+	}
+
+	var expiryTime int64 = 0
+	if days > 0 {
+		expiryTime = time.Now().Add(time.Duration(days) * 24 * time.Hour).UnixMilli()
+	}
+	settings, err := t.inboundService.NewClientSettings(inbound, model.Client{
+		Email:      email,
+		TotalGB:    totalGB * 1024 * 1024 * 1024,
+		ExpiryTime: expiryTime,
+		LimitIP:    limitIp,
+		TgID:       tgId,
+	})
+	if err != nil {
+		logger.Warning(err)
+		t.SendMsgToTgbot(chatId, t.I18nBot("tgbot.answers.errorOperation"))
+		return
+	}
+
+	needRestart, err := t.inboundService.As(NewBotActor(tgUserID)).AddInboundClient(&model.Inbound{
+		Id:       inboundId,
+		Settings: settings,
+	})
+	if needRestart {
+		t.xrayService.SetToNeedRestart()
+	}
+	if err != nil {
+		logger.Warning(err)
+		t.SendMsgToTgbot(chatId, t.I18nBot("tgbot.answers.errorOperation"))
+		return
+	}
+
+	output := t.I18nBot("tgbot.answers.clientCreated", "Email=="+email)
+	output += t.clientLinksMsg(email)
+	t.SendMsgToTgbot(chatId, output)
+	t.searchClient(chatId, email)
+}
+
+// clientLinksMsg lists the share links and the subscription URL of the client.
+func (t *Tgbot) clientLinksMsg(email string) string {
+	_, inbound, err := t.inboundService.GetClientInboundByEmail(email)
+	if err != nil || inbound == nil {
+		return ""
+	}
+	_, client, err := t.inboundService.GetClientByEmail(email)
+	if err != nil || client == nil {
+		return ""
+	}
+
+	host := t.subHost()
+	output := ""
+	showInfo, err := t.settingService.GetSubShowInfo()
+	if err != nil {
+		showInfo = false
+	}
+	remarkModel, err := t.settingService.GetRemarkModel()
+	if err != nil || remarkModel == "" {
+		remarkModel = "-ieo"
+	}
+	link := NewShareLinkService(showInfo, remarkModel).GetLink(inbound, email, host)
+	if link != "" {
+		output += t.I18nBot("tgbot.messages.shareLink", "Link=="+html.EscapeString(link))
+	}
+
+	if client.SubID != "" {
+		settings, err := t.settingService.GetDefaultSettings(host)
+		if err == nil {
+			defaults := settings.(map[string]interface{})
+			if defaults["subEnable"].(bool) {
+				subURL := defaults["subURI"].(string) + client.SubID
+				output += t.I18nBot("tgbot.messages.subscriptionURL", "Url=="+html.EscapeString(subURL))
+			}
+		}
+	}
+	return output
+}
+
+// subHost returns the address clients use to reach this server.
+func (t *Tgbot) subHost() string {
+	subDomain, err := t.settingService.GetSubDomain()
+	if err == nil && subDomain != "" {
+		return subDomain
+	}
+	webDomain, err := t.settingService.GetWebDomain()
+	if err == nil && webDomain != "" {
+		return webDomain
+	}
+	return hostname
+}
+
+// deleteClient removes the client with the given email from its inbound.
+func (t *Tgbot) deleteClient(tgUserID int64, email string) (bool, error) {
+	_, inbound, err := t.inboundService.GetClientInboundByEmail(email)
+	if err != nil {
+		return false, err
+	}
+	if inbound == nil {
+		return false, common.NewError("Inbound Not Found For Email:", email)
+	}
+	_, client, err := t.inboundService.GetClientByEmail(email)
+	if err != nil {
+		return false, err
+	}
+	if client == nil {
+		return false, common.NewError("Client Not Found For Email:", email)
+	}
+	return t.inboundService.As(NewBotActor(tgUserID)).DelInboundClient(inbound.Id, GetClientId(inbound.Protocol, *client))
+}
+
+// subscribe checks that the nickname is free and returns the payment link
+// message for a new subscription.
+func (t *Tgbot) subscribe(chatId int64, tgUserID int64, userEmail string) string {
+	emails, err := t.inboundService.getAllEmails()
+	if err != nil {
+		return t.I18nBot("tgbot.answers.errorOperation")
+	}
+
+	for _, email := range emails {
+		if email == userEmail {
+			return t.I18nBot("tgbot.answers.emailNotAvailable")
+		}
+	}
+
+	return t.getPaymentLink(chatId, tgUserID, userEmail)
+}
+
+// expiryAfterDays returns the expiry time of the client extended by the given
+// days, in the format expected by ResetClientExpiryTimeByEmail. Zero days
+// means unlimited.
+func (t *Tgbot) expiryAfterDays(email string, days int) (int64, error) {
+	var date int64 = 0
+	if days > 0 {
+		traffic, err := t.inboundService.GetClientTrafficByEmail(email)
+		if err != nil {
+			return 0, err
+		}
+		if traffic == nil {
+			return 0, common.NewError("Client Not Found For Email:", email)
+		}
+
+		if traffic.ExpiryTime > 0 {
+			if traffic.ExpiryTime-time.Now().Unix()*1000 < 0 {
+				date = -int64(days * 24 * 60 * 60000)
+			} else {
+				date = traffic.ExpiryTime + int64(days*24*60*60000)
+			}
+		} else {
+			date = traffic.ExpiryTime - int64(days*24*60*60000)
+		}
+	}
+	return date, nil
+}
+
+// answerInlineQuery lets admins search clients with "@bot query" from any
+// chat. Each result links back to the bot with the client's controls.
+func (t *Tgbot) answerInlineQuery(query *telego.InlineQuery) {
+	params := tu.InlineQuery(query.ID).WithCacheTime(0).WithIsPersonal()
+	params.Results = []telego.InlineQueryResult{}
+	access := getAdminAccess(query.From.ID)
+	if access == nil || !access.Can(PermViewClients) {
+		bot.AnswerInlineQuery(params)
+		return
+	}
+
+	traffics, err := t.inboundService.SearchClientTraffics(query.Query, inlineQueryLimit)
+	if err != nil {
+		logger.Warning(err)
+	}
+	myLink, err := t.GetMyLink()
+	if err != nil {
+		logger.Warning(err)
+	}
+
+	for _, traffic := range traffics {
+		if !access.CanAccessInbound(traffic.InboundId) {
+			continue
+		}
+		status := "🟢"
+		if !traffic.Enable {
+			status = "🔴"
+		}
+		total := t.I18nBot("tgbot.unlimited")
+		if traffic.Total > 0 {
+			total = common.FormatTraffic(traffic.Total)
+		}
+		description := fmt.Sprintf("%s %s / %s", status, common.FormatTraffic(traffic.Up+traffic.Down), total)
+
+		content := tu.TextMessage(t.clientInfoMsg(traffic, true, false, false, true, true, true)).WithParseMode(telego.ModeHTML)
+		result := tu.ResultArticle(strconv.Itoa(traffic.Id), traffic.Email, content).WithDescription(description)
+		if myLink != "" {
+			result = result.WithReplyMarkup(tu.InlineKeyboard(
+				tu.InlineKeyboardRow(
+					tu.InlineKeyboardButton(t.I18nBot("tgbot.buttons.manageClient", "Email=="+traffic.Email)).WithURL(myLink + "?start=" + clientCardPrefix + strconv.Itoa(traffic.Id)),
+				),
+			))
+		}
+		params.Results = append(params.Results, result)
+	}
+
+	err = bot.AnswerInlineQuery(params)
+	if err != nil {
+		logger.Warning("Error answering inline query:", err)
+	}
+}
+
+// openClientCard shows the admin controls of the client with the given
+// traffic id, as opened from an inline query result.
+func (t *Tgbot) openClientCard(chatId int64, tgUserID int64, trafficId string) {
+	id, err := strconv.Atoi(trafficId)
+	if err != nil {
+		t.SendMsgToTgbot(chatId, t.I18nBot("tgbot.noResult"))
+		return
+	}
+	traffic, err := t.getTrafficById(id)
+	if err != nil {
+		t.SendMsgToTgbot(chatId, t.I18nBot("tgbot.noResult"))
+		return
+	}
+	if !t.canAccessClient(tgUserID, traffic.Email) {
+		t.SendMsgToTgbot(chatId, t.I18nBot("tgbot.answers.noPermission"))
+		return
+	}
+	t.searchClient(chatId, traffic.Email)
+}
+
+func (t *Tgbot) getTrafficById(id int) (*xray.ClientTraffic, error) {
+	traffic := &xray.ClientTraffic{}
+	err := database.GetDB().Model(xray.ClientTraffic{}).Where("id = ?", id).First(traffic).Error
+	if err != nil {
+		return nil, err
+	}
+	return traffic, nil
+}
+
+func (t *Tgbot) linkClient(tgUserID int64, token string) string {
+	email, needRestart, err := t.clientLinkService.ConsumeToken(token, tgUserID)
+	if needRestart {
+		t.xrayService.SetToNeedRestart()
+	}
+	if err != nil {
+		logger.Warning("Unable to link client:", err)
+		return t.I18nBot("tgbot.answers.linkInvalid")
+	}
+	return t.I18nBot("tgbot.answers.linkSuccess", "Email=="+email)
+}
+
+// isClientOwner reports whether the client with the given email is linked
+// to the Telegram user, so customers can only manage their own clients.
+func (t *Tgbot) isClientOwner(tgUserID int64, email string) bool {
+	_, client, err := t.inboundService.GetClientByEmailIfExists(email)
+	if err != nil || client == nil {
+		return false
+	}
+	return client.TgID == tgUserID
+}
+
+// getAdminAccess returns the role of the admin, or nil if tgId is not an admin.
+func getAdminAccess(tgId int64) *AdminAccess {
+	if !checkAdmin(tgId) {
+		return nil
+	}
+	if access, exists := adminRoles[tgId]; exists {
+		return access
+	}
+	return &AdminAccess{Role: RoleOwner}
+}
+
+// checkPermission reports whether the user may run the callback query.
+func (t *Tgbot) checkPermission(tgUserID int64, query string) bool {
+	dataArray := strings.Split(query, " ")
+	action := dataArray[0]
+	permission, exists := callbackPermissions[action]
+	if !exists {
+		return true
+	}
+
+	access := getAdminAccess(tgUserID)
+	if access == nil {
+		return customerCallbacks[action]
+	}
+	if !access.Can(permission) {
+		return false
+	}
+	// only client actions are limited to the inbounds of operators
+	if len(dataArray) < 2 || permission == PermSupport || permission == PermViewServer || tgUserCallbacks[action] {
+		return true
+	}
+	if inboundCallbacks[action] {
+		inboundId, err := strconv.Atoi(dataArray[1])
+		return err == nil && access.CanAccessInbound(inboundId)
+	}
+	if customerIdCallbacks[action] {
+		id, err := strconv.Atoi(dataArray[1])
+		if err != nil {
+			return false
+		}
+		customer, err := t.customerService.GetCustomer(id)
+		return err == nil && t.canAccessCustomer(tgUserID, customer)
+	}
+	return t.canAccessClient(tgUserID, dataArray[1])
+}
+
+// canAccessClient reports whether the admin may see the client, operators are
+// limited to the inbounds of their scope.
+func (t *Tgbot) canAccessClient(tgUserID int64, email string) bool {
+	access := getAdminAccess(tgUserID)
+	if access == nil || !access.Can(PermViewClients) {
+		return false
+	}
+	if len(access.Inbounds) == 0 || access.Role != RoleOperator {
+		return true
+	}
+	traffic, err := t.inboundService.GetClientTrafficByEmail(email)
+	if err != nil || traffic == nil {
+		return false
+	}
+	return access.CanAccessInbound(traffic.InboundId)
+}
+
+// canAccessCustomer reports whether the admin may see the customer, operators
+// need access to every client of it.
+func (t *Tgbot) canAccessCustomer(tgUserID int64, customer *model.Customer) bool {
+	access := getAdminAccess(tgUserID)
+	if access == nil || !access.Can(PermViewClients) {
+		return false
+	}
+	if len(access.Inbounds) == 0 || access.Role != RoleOperator {
+		return true
+	}
+	for _, client := range customer.Clients {
+		if !access.CanAccessInbound(client.InboundId) {
+			return false
+		}
+	}
+	return true
+}
+
+// canAccessTrafficId reports whether the admin may edit the client with the
+// given traffic id.
+func (t *Tgbot) canAccessTrafficId(tgUserID int64, id int) bool {
+	access := getAdminAccess(tgUserID)
+	if access == nil || !access.Can(PermEditClients) {
+		return false
+	}
+	traffic, err := t.getTrafficById(id)
+	if err != nil {
+		return false
+	}
+	return access.CanAccessInbound(traffic.InboundId)
+}
+
 func checkAdmin(tgId int64) bool {
 	for _, adminId := range adminIds {
 		if adminId == tgId {
@@ -949,6 +2250,7 @@ func (t *Tgbot) SendAnswer(chatId int64, msg string, isAdmin bool) {
 		),
 		tu.InlineKeyboardRow(
 			tu.InlineKeyboardButton(t.I18nBot("tgbot.buttons.subscriptions")).WithCallbackData(t.encodeQuery("subscriptions")),
+			tu.InlineKeyboardButton(t.I18nBot("tgbot.buttons.addClient")).WithCallbackData(t.encodeQuery("add_client")),
 		),
 	)
 	numericKeyboardClient := tu.InlineKeyboard(
@@ -959,113 +2261,397 @@ func (t *Tgbot) SendAnswer(chatId int64, msg string, isAdmin bool) {
 		),
 	)
 
-	var ReplyMarkup telego.ReplyMarkup
-	if isAdmin {
-		ReplyMarkup = numericKeyboard
+	var ReplyMarkup telego.ReplyMarkup
+	if isAdmin {
+		ReplyMarkup = numericKeyboard
+	} else {
+		ReplyMarkup = numericKeyboardClient
+	}
+	t.SendMsgToTgbot(chatId, msg, ReplyMarkup)
+}
+
+func (t *Tgbot) SendMsgToTgbot(chatId int64, msg string, replyMarkup ...telego.ReplyMarkup) {
+	if !isRunning {
+		return
+	}
+
+	if msg == "" {
+		logger.Info("[tgbot] message is empty!")
+		return
+	}
+
+	var allMessages []string
+	limit := 2000
+
+	// paging message if it is big
+	if len(msg) > limit {
+		messages := strings.Split(msg, "\r\n\r\n")
+		lastIndex := -1
+
+		for _, message := range messages {
+			if (len(allMessages) == 0) || (len(allMessages[lastIndex])+len(message) > limit) {
+				allMessages = append(allMessages, message)
+				lastIndex++
+			} else {
+				allMessages[lastIndex] += "\r\n\r\n" + message
+			}
+		}
+		if strings.TrimSpace(allMessages[len(allMessages)-1]) == "" {
+			allMessages = allMessages[:len(allMessages)-1]
+		}
+	} else {
+		allMessages = append(allMessages, msg)
+	}
+	for n, message := range allMessages {
+		params := telego.SendMessageParams{
+			ChatID:    tu.ID(chatId),
+			Text:      message,
+			ParseMode: "HTML",
+		}
+		// only add replyMarkup to last message
+		if len(replyMarkup) > 0 && n == (len(allMessages)-1) {
+			params.ReplyMarkup = replyMarkup[0]
+		}
+		_, err := bot.SendMessage(&params)
+		if err != nil {
+			logger.Warning("Error sending telegram message :", err)
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+}
+
+func (t *Tgbot) SendMsgToTgbotAdmins(msg string, replyMarkup ...telego.ReplyMarkup) {
+	if len(replyMarkup) > 0 {
+		for _, adminId := range adminIds {
+			t.SendMsgToTgbot(adminId, msg, replyMarkup[0])
+		}
+	} else {
+		for _, adminId := range adminIds {
+			t.SendMsgToTgbot(adminId, msg)
+		}
+	}
+}
+
+// sendMsgToAdminsWith sends the message to the admins whose role has the permission.
+func (t *Tgbot) sendMsgToAdminsWith(permission Permission, msg string, replyMarkup ...telego.ReplyMarkup) {
+	for _, adminId := range adminIds {
+		if getAdminAccess(adminId).Can(permission) {
+			t.SendMsgToTgbot(adminId, msg, replyMarkup...)
+		}
+	}
+}
+
+// SendReport sends the named report to its recipients, or to the admins if
+// it has none.
+func (t *Tgbot) SendReport(name string) {
+	report := t.getReport(name)
+	if report == nil {
+		logger.Warning("Telegram report not found:", name)
+		return
+	}
+
+	if len(report.Recipients) > 0 {
+		for _, chatId := range report.Recipients {
+			t.sendReport(chatId, report, true)
+		}
+	} else {
+		for _, adminId := range adminIds {
+			t.sendReport(adminId, report, false)
+		}
+	}
+
+	for _, section := range report.Sections {
+		if section == entity.ReportCustomers {
+			t.notifyExhausted()
+		}
+	}
+}
+
+func (t *Tgbot) getReport(name string) *entity.ReportDefinition {
+	reports, err := t.settingService.GetReports()
+	if err != nil {
+		logger.Warning("Unable to load Telegram reports:", err)
+		return nil
+	}
+	for _, report := range reports {
+		if report.Name == name {
+			return report
+		}
+	}
+	return nil
+}
+
+// sendReport sends the sections of the report to the chat. Admins only get
+// the sections their role allows, unless they are listed as recipients.
+// Customer notifications are left to SendReport.
+func (t *Tgbot) sendReport(chatId int64, report *entity.ReportDefinition, recipient bool) {
+	access := getAdminAccess(chatId)
+	allowed := func(permission Permission) bool {
+		return recipient || access.Can(permission)
+	}
+
+	msg := t.I18nBot("tgbot.messages.reportName", "Name=="+html.EscapeString(report.Name))
+	msg += t.I18nBot("tgbot.messages.report", "RunTime=="+report.Schedule)
+	msg += t.I18nBot("tgbot.messages.datetime", "DateTime=="+time.Now().Format("2006-01-02 15:04:05"))
+	t.SendMsgToTgbot(chatId, msg)
+
+	for _, section := range report.Sections {
+		switch section {
+		case entity.ReportServer:
+			if allowed(PermViewServer) {
+				t.SendMsgToTgbot(chatId, t.prepareServerUsageInfo())
+			}
+		case entity.ReportInbounds:
+			if allowed(PermViewServer) {
+				t.SendMsgToTgbot(chatId, t.getInboundUsages())
+			}
+		case entity.ReportTopConsumers:
+			if allowed(PermViewClients) {
+				msg, _ := t.topConsumersMsg(access, recipient, RankingToday)
+				t.SendMsgToTgbot(chatId, msg)
+			}
+		case entity.ReportRevenue:
+			if allowed(PermViewServer) {
+				t.SendMsgToTgbot(chatId, t.revenueMsg())
+			}
+		case entity.ReportExpiring:
+			if allowed(PermViewClients) {
+				t.getExhausted(chatId)
+			}
+		case entity.ReportBackup:
+			// the database never leaves the admins allowed to back it up
+			if access.Can(PermBackup) {
+				t.sendBackup(chatId)
+			}
+		}
+	}
+}
+
+// topConsumersMsg lists the clients with the most traffic in the period and
+// returns the listed ones, admins only see the clients of their inbounds.
+func (t *Tgbot) topConsumersMsg(access *AdminAccess, recipient bool, period string) (string, []*ClientTrafficRank) {
+	// fetch more than needed since operators may not see all of them
+	ranks, err := t.inboundService.GetClientTrafficRanking(period, topConsumerLimit*5)
+	if err != nil {
+		logger.Warning(err)
+		return t.I18nBot("tgbot.wentWrong"), nil
+	}
+	output := t.I18nBot("tgbot.messages.topConsumers", "Period=="+t.I18nBot(topConsumerPeriods[period]))
+	var listed []*ClientTrafficRank
+	for _, rank := range ranks {
+		if len(listed) >= topConsumerLimit {
+			break
+		}
+		if !recipient && !access.CanAccessInbound(rank.InboundId) {
+			continue
+		}
+		listed = append(listed, rank)
+		output += t.I18nBot("tgbot.messages.topConsumer",
+			"Rank=="+strconv.Itoa(len(listed)),
+			"Email=="+html.EscapeString(rank.Email),
+			"Traffic=="+common.FormatTraffic(rank.Up+rank.Down))
+	}
+	if len(listed) == 0 {
+		output += t.I18nBot("tgbot.noResult")
+	}
+	return output, listed
+}
+
+// sendTopConsumers sends the ranking of the period with buttons opening the
+// listed clients and switching to the other periods.
+func (t *Tgbot) sendTopConsumers(chatId int64, tgUserID int64, period string, messageID ...int) {
+	msg, ranks := t.topConsumersMsg(getAdminAccess(tgUserID), false, period)
+
+	var clientButtons []telego.InlineKeyboardButton
+	for _, rank := range ranks {
+		clientButtons = append(clientButtons, tu.InlineKeyboardButton(rank.Email).WithCallbackData(t.encodeQuery("client_get_usage "+rank.Email)))
+	}
+	var periodButtons []telego.InlineKeyboardButton
+	for _, key := range []string{RankingToday, RankingWeek, RankingMonth, RankingAll} {
+		periodButtons = append(periodButtons, tu.InlineKeyboardButton(t.I18nBot(topConsumerPeriods[key])).WithCallbackData(t.encodeQuery("top_"+key)))
+	}
+	keyboard := tu.InlineKeyboardGrid(append(tu.InlineKeyboardCols(2, clientButtons...), periodButtons))
+
+	if len(messageID) > 0 {
+		t.editMessageTgBot(chatId, messageID[0], msg, keyboard)
 	} else {
-		ReplyMarkup = numericKeyboardClient
+		t.SendMsgToTgbot(chatId, msg, keyboard)
 	}
-	t.SendMsgToTgbot(chatId, msg, ReplyMarkup)
 }
 
-func (t *Tgbot) SendMsgToTgbot(chatId int64, msg string, replyMarkup ...telego.ReplyMarkup) {
-	if !isRunning {
+// searchCustomers sends the customer matching query, or a list to pick one
+// when there are several.
+func (t *Tgbot) searchCustomers(chatId int64, tgUserID int64, query string) {
+	customers, err := t.customerService.SearchCustomers(query, 20)
+	if err != nil {
+		logger.Warning(err)
+		t.SendMsgToTgbot(chatId, t.I18nBot("tgbot.wentWrong"))
 		return
 	}
+	var buttons []telego.InlineKeyboardButton
+	var found *model.Customer
+	for _, customer := range customers {
+		if !t.canAccessCustomer(tgUserID, customer) {
+			continue
+		}
+		found = customer
+		buttons = append(buttons, tu.InlineKeyboardButton(customer.Name).WithCallbackData(t.encodeQuery("customer_get "+strconv.Itoa(customer.Id))))
+	}
+	switch len(buttons) {
+	case 0:
+		t.SendMsgToTgbot(chatId, t.I18nBot("tgbot.noResult"))
+	case 1:
+		t.sendCustomerMsg(chatId, tgUserID, found)
+	default:
+		t.SendMsgToTgbot(chatId, t.I18nBot("tgbot.answers.chooseCustomer"), tu.InlineKeyboardGrid(tu.InlineKeyboardCols(2, buttons...)))
+	}
+}
 
-	if msg == "" {
-		logger.Info("[tgbot] message is empty!")
+func (t *Tgbot) sendCustomer(chatId int64, tgUserID int64, id int, messageID ...int) {
+	customer, err := t.customerService.GetCustomer(id)
+	if err != nil {
+		logger.Warning(err)
+		t.SendMsgToTgbot(chatId, t.I18nBot("tgbot.noResult"))
 		return
 	}
+	t.sendCustomerMsg(chatId, tgUserID, customer, messageID...)
+}
 
-	var allMessages []string
-	limit := 2000
-
-	// paging message if it is big
-	if len(msg) > limit {
-		messages := strings.Split(msg, "\r\n\r\n")
-		lastIndex := -1
+// sendCustomerMsg sends the customer with its clients, which open the client
+// when pressed.
+func (t *Tgbot) sendCustomerMsg(chatId int64, tgUserID int64, customer *model.Customer, messageID ...int) {
+	id := strconv.Itoa(customer.Id)
+	var clientButtons []telego.InlineKeyboardButton
+	for _, client := range customer.Clients {
+		clientButtons = append(clientButtons, tu.InlineKeyboardButton(client.Email).WithCallbackData(t.encodeQuery("client_get_usage "+client.Email)))
+	}
+	actions := []telego.InlineKeyboardButton{
+		tu.InlineKeyboardButton(t.I18nBot("tgbot.buttons.refresh")).WithCallbackData(t.encodeQuery("customer_get " + id)),
+	}
+	if getAdminAccess(tgUserID).Can(PermEditClients) {
+		actions = append(actions, tu.InlineKeyboardButton(t.I18nBot("tgbot.buttons.resetTraffic")).WithCallbackData(t.encodeQuery("customer_reset "+id)))
+	}
+	keyboard := tu.InlineKeyboardGrid(append(tu.InlineKeyboardCols(2, clientButtons...), actions))
 
-		for _, message := range messages {
-			if (len(allMessages) == 0) || (len(allMessages[lastIndex])+len(message) > limit) {
-				allMessages = append(allMessages, message)
-				lastIndex++
-			} else {
-				allMessages[lastIndex] += "\r\n\r\n" + message
-			}
-		}
-		if strings.TrimSpace(allMessages[len(allMessages)-1]) == "" {
-			allMessages = allMessages[:len(allMessages)-1]
-		}
+	msg := t.customerMsg(customer)
+	if len(messageID) > 0 {
+		t.editMessageTgBot(chatId, messageID[0], msg, keyboard)
 	} else {
-		allMessages = append(allMessages, msg)
-	}
-	for n, message := range allMessages {
-		params := telego.SendMessageParams{
-			ChatID:    tu.ID(chatId),
-			Text:      message,
-			ParseMode: "HTML",
-		}
-		// only add replyMarkup to last message
-		if len(replyMarkup) > 0 && n == (len(allMessages)-1) {
-			params.ReplyMarkup = replyMarkup[0]
-		}
-		_, err := bot.SendMessage(&params)
-		if err != nil {
-			logger.Warning("Error sending telegram message :", err)
-		}
-		time.Sleep(500 * time.Millisecond)
+		t.SendMsgToTgbot(chatId, msg, keyboard)
 	}
 }
 
-func (t *Tgbot) SendMsgToTgbotAdmins(msg string, replyMarkup ...telego.ReplyMarkup) {
-	if len(replyMarkup) > 0 {
-		for _, adminId := range adminIds {
-			t.SendMsgToTgbot(adminId, msg, replyMarkup[0])
-		}
-	} else {
-		for _, adminId := range adminIds {
-			t.SendMsgToTgbot(adminId, msg)
+func (t *Tgbot) customerMsg(customer *model.Customer) string {
+	output := t.I18nBot("tgbot.messages.customer", "Name=="+html.EscapeString(customer.Name))
+	if customer.Contact != "" {
+		output += t.I18nBot("tgbot.messages.contact", "Contact=="+html.EscapeString(customer.Contact))
+	}
+	if customer.TgId != 0 {
+		output += t.I18nBot("tgbot.messages.TGUser", "TelegramID=="+strconv.FormatInt(customer.TgId, 10))
+	}
+	if customer.Tags != "" {
+		output += t.I18nBot("tgbot.messages.tags", "Tags=="+html.EscapeString(customer.Tags))
+	}
+	if customer.Notes != "" {
+		output += t.I18nBot("tgbot.messages.notes", "Notes=="+html.EscapeString(customer.Notes))
+	}
+
+	expiryTime := t.I18nBot("tgbot.unlimited")
+	if customer.ExpiryTime > 0 {
+		expiryTime = time.UnixMilli(customer.ExpiryTime).Format("2006-01-02 15:04:05")
+	}
+	output += t.I18nBot("tgbot.messages.expire", "Time=="+expiryTime)
+	total := t.I18nBot("tgbot.unlimited")
+	if customer.TotalGB > 0 {
+		total = common.FormatTraffic(customer.TotalGB)
+	}
+	up, down := CustomerTraffic(customer)
+	output += t.I18nBot("tgbot.messages.total", "UpDown=="+common.FormatTraffic(up+down), "Total=="+total)
+
+	output += t.I18nBot("tgbot.messages.customerClients", "Count=="+strconv.Itoa(len(customer.Clients)))
+	for _, client := range customer.Clients {
+		status := "✅"
+		if !client.Enable {
+			status = "⛔"
 		}
+		output += t.I18nBot("tgbot.messages.customerClient",
+			"Status=="+status,
+			"Email=="+html.EscapeString(client.Email),
+			"Traffic=="+common.FormatTraffic(client.Up+client.Down))
 	}
+	return output
 }
 
-func (t *Tgbot) SendReport() {
-	runTime, err := t.settingService.GetTgbotRuntime()
-	if err == nil && len(runTime) > 0 {
-		msg := ""
-		msg += t.I18nBot("tgbot.messages.report", "RunTime=="+runTime)
-		msg += t.I18nBot("tgbot.messages.datetime", "DateTime=="+time.Now().Format("2006-01-02 15:04:05"))
-		t.SendMsgToTgbotAdmins(msg)
+func (t *Tgbot) revenueMsg() string {
+	now := time.Now()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	periods := []struct {
+		key   string
+		since time.Time
+	}{
+		{"tgbot.periodToday", today},
+		{"tgbot.periodWeek", today.AddDate(0, 0, -6)},
+		{"tgbot.periodMonth", today.AddDate(0, 0, -29)},
 	}
 
-	info := t.sendServerUsage()
-	t.SendMsgToTgbotAdmins(info)
-
-	t.sendExhaustedToAdmins()
-	t.notifyExhausted()
+	output := t.I18nBot("tgbot.messages.revenue")
+	for _, period := range periods {
+		revenue, err := t.paymentService.GetRevenue(period.since)
+		if err != nil {
+			logger.Warning(err)
+			return t.I18nBot("tgbot.wentWrong")
+		}
+		currencies := make([]string, 0, len(revenue))
+		for currency := range revenue {
+			currencies = append(currencies, currency)
+		}
+		sort.Strings(currencies)
+		amounts := make([]string, 0, len(currencies))
+		for _, currency := range currencies {
+			amounts = append(amounts, strconv.FormatFloat(revenue[currency], 'f', 2, 64)+" "+currency)
+		}
+		if len(amounts) == 0 {
+			amounts = append(amounts, "0")
+		}
+		output += t.I18nBot("tgbot.messages.revenuePeriod", "Period=="+t.I18nBot(period.key), "Amount=="+strings.Join(amounts, ", "))
+	}
+	return output
+}
 
-	backupEnable, err := t.settingService.GetTgBotBackup()
-	if err == nil && backupEnable {
-		t.SendBackupToAdmins()
+// runReport sends the named report to the chat only.
+func (t *Tgbot) runReport(chatId int64, name string) {
+	report := t.getReport(name)
+	if report == nil {
+		t.SendMsgToTgbot(chatId, t.I18nBot("tgbot.noResult"))
+		return
 	}
+	t.sendReport(chatId, report, false)
 }
 
-func (t *Tgbot) SendBackupToAdmins() {
-	if !t.IsRunning() {
+// sendReportList lets the admin run any report on demand.
+func (t *Tgbot) sendReportList(chatId int64) {
+	reports, err := t.settingService.GetReports()
+	if err != nil {
+		logger.Warning(err)
+		t.SendMsgToTgbot(chatId, t.I18nBot("tgbot.wentWrong"))
 		return
 	}
-	for _, adminId := range adminIds {
-		t.sendBackup(int64(adminId))
+	var buttons []telego.InlineKeyboardButton
+	for _, report := range reports {
+		buttons = append(buttons, tu.InlineKeyboardButton(report.Name).WithCallbackData(t.encodeQuery("report_run "+report.Name)))
 	}
+	keyboard := tu.InlineKeyboardGrid(tu.InlineKeyboardCols(1, buttons...))
+	t.SendMsgToTgbot(chatId, t.I18nBot("tgbot.answers.chooseReport"), keyboard)
 }
 
-func (t *Tgbot) sendExhaustedToAdmins() {
+func (t *Tgbot) SendBackupToAdmins() {
 	if !t.IsRunning() {
 		return
 	}
 	for _, adminId := range adminIds {
-		t.getExhausted(int64(adminId))
+		if getAdminAccess(adminId).Can(PermBackup) {
+			t.sendBackup(int64(adminId))
+		}
 	}
 }
 
@@ -1084,12 +2670,6 @@ func (t *Tgbot) getServerUsage(chatId int64, messageID ...int) string {
 	return info
 }
 
-// Send server usage without an inline keyboard
-func (t *Tgbot) sendServerUsage() string {
-	info := t.prepareServerUsageInfo()
-	return info
-}
-
 func (t *Tgbot) prepareServerUsageInfo() string {
 	info, ipv4, ipv6 := "", "", ""
 
@@ -1195,7 +2775,9 @@ func (t *Tgbot) getInboundUsages() string {
 	return info
 }
 
-func (t *Tgbot) getInbounds() (*telego.InlineKeyboardMarkup, error) {
+// getInbounds returns a keyboard of the inbounds the admin may access whose
+// buttons run the callback action with the inbound id.
+func (t *Tgbot) getInbounds(tgUserID int64, action string) (*telego.InlineKeyboardMarkup, error) {
 	inbounds, err := t.inboundService.GetAllInbounds()
 	var buttons []telego.InlineKeyboardButton
 
@@ -1204,12 +2786,16 @@ func (t *Tgbot) getInbounds() (*telego.InlineKeyboardMarkup, error) {
 		return nil, errors.New(t.I18nBot("tgbot.answers.getInboundsFailed"))
 	} else {
 		if len(inbounds) > 0 {
+			access := getAdminAccess(tgUserID)
 			for _, inbound := range inbounds {
+				if !access.CanAccessInbound(inbound.Id) {
+					continue
+				}
 				status := "❌"
 				if inbound.Enable {
 					status = "✅"
 				}
-				buttons = append(buttons, tu.InlineKeyboardButton(fmt.Sprintf("%v - %v", inbound.Remark, status)).WithCallbackData(t.encodeQuery("get_clients "+strconv.Itoa(inbound.Id))))
+				buttons = append(buttons, tu.InlineKeyboardButton(fmt.Sprintf("%v - %v", inbound.Remark, status)).WithCallbackData(t.encodeQuery(action+" "+strconv.Itoa(inbound.Id))))
 			}
 		} else {
 			logger.Warning("GetAllInbounds run failed:", err)
@@ -1332,6 +2918,15 @@ func (t *Tgbot) clientInfoMsg(
 	if printActive {
 		output += t.I18nBot("tgbot.messages.active", "Enable=="+active)
 	}
+	if traffic.Throttled {
+		output += t.I18nBot("tgbot.messages.throttled")
+	}
+	if printEnabled {
+		_, client, err := t.inboundService.GetClientByEmail(traffic.Email)
+		if err == nil && client != nil && client.SpeedTier != "" {
+			output += t.I18nBot("tgbot.messages.speedTier", "SpeedTier=="+html.EscapeString(client.SpeedTier))
+		}
+	}
 	if printDate {
 		if flag {
 			output += t.I18nBot("tgbot.messages.expireIn", "Time=="+expiryTime)
@@ -1343,6 +2938,7 @@ func (t *Tgbot) clientInfoMsg(
 		output += t.I18nBot("tgbot.messages.upload", "Upload=="+common.FormatTraffic(traffic.Up))
 		output += t.I18nBot("tgbot.messages.download", "Download=="+common.FormatTraffic(traffic.Down))
 		output += t.I18nBot("tgbot.messages.total", "UpDown=="+common.FormatTraffic((traffic.Up+traffic.Down)), "Total=="+total)
+		output += t.clientPeriodUsageMsg(traffic.Email)
 	}
 	if printRefreshed {
 		output += t.I18nBot("tgbot.messages.refreshedOn", "Time=="+time.Now().Format("2006-01-02 15:04:05"))
@@ -1351,6 +2947,29 @@ func (t *Tgbot) clientInfoMsg(
 	return output
 }
 
+// clientPeriodUsageMsg shows the traffic of the client today and in the last
+// 7 and 30 days.
+func (t *Tgbot) clientPeriodUsageMsg(email string) string {
+	today := periodStart(RankingToday, time.Now())
+	params := []string{}
+	for _, period := range []struct {
+		param string
+		since time.Time
+	}{
+		{"Today", today},
+		{"Week", today.AddDate(0, 0, -6)},
+		{"Month", today.AddDate(0, 0, -29)},
+	} {
+		up, down, err := t.inboundService.GetTrafficSince(RollupClient, email, period.since)
+		if err != nil {
+			logger.Warning(err)
+			return ""
+		}
+		params = append(params, period.param+"=="+common.FormatTraffic(up+down))
+	}
+	return t.I18nBot("tgbot.messages.periodUsage", params...)
+}
+
 func (t *Tgbot) getClientUsage(chatId int64, tgUserID int64, email ...string) {
 	traffics, err := t.inboundService.GetClientTrafficTgBot(tgUserID)
 	if err != nil {
@@ -1371,8 +2990,7 @@ func (t *Tgbot) getClientUsage(chatId int64, tgUserID int64, email ...string) {
 		if len(email) > 0 {
 			for _, traffic := range traffics {
 				if traffic.Email == email[0] {
-					output := t.clientInfoMsg(traffic, true, true, true, true, true, true)
-					t.SendMsgToTgbot(chatId, output)
+					t.customerClient(chatId, traffic.Email)
 					return
 				}
 			}
@@ -1393,6 +3011,52 @@ func (t *Tgbot) getClientUsage(chatId int64, tgUserID int64, email ...string) {
 	t.SendAnswer(chatId, output, false)
 }
 
+// customerClient shows a client card with the self-service actions that are
+// available to the Telegram user owning the client.
+func (t *Tgbot) customerClient(chatId int64, email string, messageID ...int) {
+	traffic, client, err := t.inboundService.GetClientByEmailIfExists(email)
+	if err != nil {
+		logger.Warning(err)
+		t.SendMsgToTgbot(chatId, t.I18nBot("tgbot.wentWrong"))
+		return
+	}
+	if traffic == nil || client == nil {
+		t.SendMsgToTgbot(chatId, t.I18nBot("tgbot.noResult"))
+		return
+	}
+
+	output := t.clientInfoMsg(traffic, true, true, true, true, true, false)
+	if client.Comment != "" {
+		output += t.I18nBot("tgbot.messages.remark", "Remark=="+client.Comment)
+	}
+	autoRenew := t.I18nBot("tgbot.messages.no")
+	if client.Reset > 0 {
+		autoRenew = t.I18nBot("tgbot.messages.yes")
+	}
+	output += t.I18nBot("tgbot.messages.autoRenew", "Enable=="+autoRenew)
+	output += t.I18nBot("tgbot.messages.refreshedOn", "Time=="+time.Now().Format("2006-01-02 15:04:05"))
+	output += t.I18nBot("tgbot.commands.remark")
+
+	inlineKeyboard := tu.InlineKeyboard(
+		tu.InlineKeyboardRow(
+			tu.InlineKeyboardButton(t.I18nBot("tgbot.buttons.refresh")).WithCallbackData(t.encodeQuery("my_client "+email)),
+		),
+		tu.InlineKeyboardRow(
+			tu.InlineKeyboardButton(t.I18nBot("tgbot.buttons.regenerate")).WithCallbackData(t.encodeQuery("my_regen "+email)),
+			tu.InlineKeyboardButton(t.I18nBot("tgbot.buttons.resetDevices")).WithCallbackData(t.encodeQuery("my_clear_ips "+email)),
+		),
+		tu.InlineKeyboardRow(
+			tu.InlineKeyboardButton(t.I18nBot("tgbot.buttons.toggleAutoRenew")).WithCallbackData(t.encodeQuery("my_autopay "+email)),
+		),
+	)
+
+	if len(messageID) > 0 {
+		t.editMessageTgBot(chatId, messageID[0], output, inlineKeyboard)
+	} else {
+		t.SendMsgToTgbot(chatId, output, inlineKeyboard)
+	}
+}
+
 func (t *Tgbot) searchClientIps(chatId int64, email string, messageID ...int) {
 	ips, err := t.inboundService.GetInboundClientIps(email)
 	if err != nil || len(ips) == 0 {
@@ -1441,6 +3105,12 @@ func (t *Tgbot) clientTelegramUserInfo(chatId int64, email string, messageID ...
 	output := ""
 	output += t.I18nBot("tgbot.messages.email", "Email=="+email)
 	output += t.I18nBot("tgbot.messages.TGUser", "TelegramID=="+tgId)
+	banned := false
+	if client.TgID != 0 {
+		var banMsg string
+		banMsg, banned = t.banStatusMsg(client.TgID)
+		output += banMsg
+	}
 	output += t.I18nBot("tgbot.messages.refreshedOn", "Time=="+time.Now().Format("2006-01-02 15:04:05"))
 
 	inlineKeyboard := tu.InlineKeyboard(
@@ -1451,6 +3121,17 @@ func (t *Tgbot) clientTelegramUserInfo(chatId int64, email string, messageID ...
 			tu.InlineKeyboardButton(t.I18nBot("tgbot.buttons.removeTGUser")).WithCallbackData(t.encodeQuery("tgid_remove "+email)),
 		),
 	)
+	if client.TgID != 0 && !checkAdmin(client.TgID) {
+		if banned {
+			inlineKeyboard.InlineKeyboard = append(inlineKeyboard.InlineKeyboard, tu.InlineKeyboardRow(
+				tu.InlineKeyboardButton(t.I18nBot("tgbot.buttons.unbanTGUser")).WithCallbackData(t.encodeQuery("tgid_unban "+email)),
+			))
+		} else {
+			inlineKeyboard.InlineKeyboard = append(inlineKeyboard.InlineKeyboard, tu.InlineKeyboardRow(
+				tu.InlineKeyboardButton(t.I18nBot("tgbot.buttons.banTGUser")).WithCallbackData(t.encodeQuery("tgid_ban "+email)),
+			))
+		}
+	}
 
 	if len(messageID) > 0 {
 		t.editMessageTgBot(chatId, messageID[0], output, inlineKeyboard)
@@ -1506,9 +3187,15 @@ func (t *Tgbot) searchClient(chatId int64, email string, messageID ...int) {
 		tu.InlineKeyboardRow(
 			tu.InlineKeyboardButton(t.I18nBot("tgbot.buttons.setTGUser")).WithCallbackData(t.encodeQuery("tg_user "+email)),
 		),
+		tu.InlineKeyboardRow(
+			tu.InlineKeyboardButton(t.I18nBot("tgbot.buttons.speedTier")).WithCallbackData(t.encodeQuery("speed_tier "+email)),
+		),
 		tu.InlineKeyboardRow(
 			tu.InlineKeyboardButton(t.I18nBot("tgbot.buttons.toggle")).WithCallbackData(t.encodeQuery("toggle_enable "+email)),
 		),
+		tu.InlineKeyboardRow(
+			tu.InlineKeyboardButton(t.I18nBot("tgbot.buttons.deleteClient")).WithCallbackData(t.encodeQuery("del_client "+email)),
+		),
 	)
 	if len(messageID) > 0 {
 		t.editMessageTgBot(chatId, messageID[0], output, inlineKeyboard)
@@ -1517,7 +3204,7 @@ func (t *Tgbot) searchClient(chatId int64, email string, messageID ...int) {
 	}
 }
 
-func (t *Tgbot) searchInbound(chatId int64, remark string) {
+func (t *Tgbot) searchInbound(chatId int64, tgUserID int64, remark string) {
 	inbounds, err := t.inboundService.SearchInbounds(remark)
 	if err != nil {
 		logger.Warning(err)
@@ -1531,7 +3218,11 @@ func (t *Tgbot) searchInbound(chatId int64, remark string) {
 		return
 	}
 
+	access := getAdminAccess(tgUserID)
 	for _, inbound := range inbounds {
+		if !access.CanAccessInbound(inbound.Id) {
+			continue
+		}
 		info := ""
 		info += t.I18nBot("tgbot.messages.inbound", "Remark=="+inbound.Remark)
 		info += t.I18nBot("tgbot.messages.port", "Port=="+strconv.Itoa(inbound.Port))
@@ -1721,6 +3412,239 @@ func (t *Tgbot) notifyExhausted() {
 	}
 }
 
+// SendExpiryReminders reminds customers about clients which expire within
+// one of the configured offsets (in days, 0 means on expiry). Each offset is
+// sent once per client and expiry date.
+func (t *Tgbot) SendExpiryReminders() {
+	offsets := t.getExpiryReminderOffsets()
+	if len(offsets) == 0 {
+		return
+	}
+
+	inbounds, err := t.inboundService.GetAllInbounds()
+	if err != nil {
+		logger.Warning("Unable to load Inbounds", err)
+		return
+	}
+
+	db := database.GetDB()
+	now := time.Now().UnixMilli()
+	dayMs := int64(24 * 60 * 60 * 1000)
+
+	for _, inbound := range inbounds {
+		if !inbound.Enable {
+			continue
+		}
+		clients, err := t.inboundService.GetClients(inbound)
+		if err != nil {
+			continue
+		}
+		for _, client := range clients {
+			if client.TgID == 0 || checkAdmin(client.TgID) {
+				continue
+			}
+			var traffic *xray.ClientTraffic
+			for i := range inbound.ClientStats {
+				if inbound.ClientStats[i].Email == client.Email {
+					traffic = &inbound.ClientStats[i]
+					break
+				}
+			}
+			// negative expiry starts counting on first use
+			if traffic == nil || traffic.ExpiryTime <= 0 {
+				continue
+			}
+
+			// the most urgent offset which is due, long expired clients
+			// were already reminded
+			remaining := traffic.ExpiryTime - now
+			if remaining < -dayMs {
+				continue
+			}
+			offset := -1
+			for _, o := range offsets {
+				if remaining <= int64(o)*dayMs {
+					offset = o
+				}
+			}
+			if offset < 0 {
+				continue
+			}
+
+			var count int64
+			db.Model(model.ExpiryReminder{}).
+				Where("email = ? AND expiry_time = ? AND days_before <= ?", client.Email, traffic.ExpiryTime, offset).
+				Count(&count)
+			if count > 0 {
+				continue
+			}
+
+			t.sendExpiryReminder(client.TgID, traffic, remaining, dayMs)
+
+			err = db.Create(&model.ExpiryReminder{
+				Email:      client.Email,
+				ExpiryTime: traffic.ExpiryTime,
+				DaysBefore: offset,
+				SentAt:     time.Now().Unix(),
+			}).Error
+			if err != nil {
+				logger.Warning("Unable to save expiry reminder:", err)
+			}
+		}
+	}
+
+	// reminders of old expiry dates are not needed anymore
+	db.Where("expiry_time < ?", now-30*dayMs).Delete(model.ExpiryReminder{})
+}
+
+func (t *Tgbot) sendExpiryReminder(chatId int64, traffic *xray.ClientTraffic, remaining int64, dayMs int64) {
+	expiry := time.UnixMilli(traffic.ExpiryTime).Format("2006-01-02 15:04:05")
+	output := ""
+	if remaining <= 0 {
+		output += t.I18nBot("tgbot.messages.expiredReminder", "Email=="+traffic.Email, "Time=="+expiry)
+	} else {
+		days := (remaining + dayMs - 1) / dayMs
+		output += t.I18nBot("tgbot.messages.expiryReminder", "Email=="+traffic.Email, "Days=="+strconv.FormatInt(days, 10), "Time=="+expiry)
+	}
+
+	inlineKeyboard := tu.InlineKeyboard(
+		tu.InlineKeyboardRow(
+			tu.InlineKeyboardButton(t.I18nBot("tgbot.buttons.renew")).WithCallbackData(t.encodeQuery("resubscribe " + traffic.Email)),
+		),
+	)
+	t.SendMsgToTgbot(chatId, output, inlineKeyboard)
+}
+
+// getExpiryReminderOffsets parses the comma-separated reminder offsets in days.
+func (t *Tgbot) getExpiryReminderOffsets() []int {
+	setting, err := t.settingService.GetTgExpiryReminders()
+	if err != nil {
+		return nil
+	}
+	var offsets []int
+	for _, part := range strings.Split(setting, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		offset, err := strconv.Atoi(part)
+		if err != nil || offset < 0 {
+			logger.Warning("Invalid expiry reminder offset:", part)
+			continue
+		}
+		offsets = append(offsets, offset)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(offsets)))
+	return offsets
+}
+
+// clientEventKeys are the suffixes of the message keys of each client event.
+var clientEventKeys = map[ClientEventType]string{
+	ClientDisabledTraffic:  "DisabledTraffic",
+	ClientDisabledExpiry:   "DisabledExpiry",
+	ClientThrottled:        "Throttled",
+	ClientRenewed:          "Renewed",
+	ClientDeleted:          "Deleted",
+	ClientCreatedByPayment: "CreatedByPayment",
+	ClientRenewedByPayment: "RenewedByPayment",
+}
+
+// NotifyClientEvents tells the admins and the affected customers about
+// automatic changes of clients. Admins get one message per batch, limited to
+// the inbounds they may see.
+func (t *Tgbot) NotifyClientEvents(events []ClientEvent) {
+	if !isRunning {
+		return
+	}
+	enabled := t.getClientEventSettings()
+	var notified []ClientEvent
+	for _, event := range events {
+		if enabled[event.Type] {
+			notified = append(notified, event)
+		}
+	}
+	if len(notified) == 0 {
+		return
+	}
+
+	for _, adminId := range adminIds {
+		access := getAdminAccess(adminId)
+		if !access.Can(PermViewClients) {
+			continue
+		}
+		output := ""
+		for _, event := range notified {
+			if access.CanAccessInbound(event.InboundId) {
+				output += t.clientEventMsg("tgbot.messages.clientEvent", event) + "\r\n"
+			}
+		}
+		if output != "" {
+			t.SendMsgToTgbot(adminId, output)
+		}
+	}
+
+	for _, event := range notified {
+		tgId := event.TgId
+		if tgId == 0 {
+			_, client, err := t.inboundService.GetClientByEmail(event.Email)
+			if err == nil && client != nil {
+				tgId = client.TgID
+			}
+		}
+		if tgId == 0 || checkAdmin(tgId) {
+			continue
+		}
+		output := t.clientEventMsg("tgbot.messages.customerEvent", event)
+		if event.Type == ClientDisabledTraffic || event.Type == ClientDisabledExpiry || event.Type == ClientThrottled {
+			inlineKeyboard := tu.InlineKeyboard(
+				tu.InlineKeyboardRow(
+					tu.InlineKeyboardButton(t.I18nBot("tgbot.buttons.renew")).WithCallbackData(t.encodeQuery("resubscribe " + event.Email)),
+				),
+			)
+			t.SendMsgToTgbot(tgId, output, inlineKeyboard)
+		} else {
+			t.SendMsgToTgbot(tgId, output)
+		}
+	}
+}
+
+func (t *Tgbot) clientEventMsg(prefix string, event ClientEvent) string {
+	expiry := ""
+	if event.ExpiryTime > 0 {
+		expiry = time.UnixMilli(event.ExpiryTime).Format("2006-01-02 15:04:05")
+	}
+	return t.I18nBot(prefix+clientEventKeys[event.Type], "Email=="+html.EscapeString(event.Email), "Time=="+expiry)
+}
+
+// getClientEventSettings returns which client events should be notified.
+func (t *Tgbot) getClientEventSettings() map[ClientEventType]bool {
+	disabled, err := t.settingService.GetTgNotifyDisabled()
+	if err != nil {
+		logger.Warning("Unable to load client event setting:", err)
+	}
+	renewed, err := t.settingService.GetTgNotifyRenewed()
+	if err != nil {
+		logger.Warning("Unable to load client event setting:", err)
+	}
+	deleted, err := t.settingService.GetTgNotifyDeleted()
+	if err != nil {
+		logger.Warning("Unable to load client event setting:", err)
+	}
+	payment, err := t.settingService.GetTgNotifyPayment()
+	if err != nil {
+		logger.Warning("Unable to load client event setting:", err)
+	}
+	return map[ClientEventType]bool{
+		ClientDisabledTraffic:  disabled,
+		ClientDisabledExpiry:   disabled,
+		ClientThrottled:        disabled,
+		ClientRenewed:          renewed,
+		ClientDeleted:          deleted,
+		ClientCreatedByPayment: payment,
+		ClientRenewedByPayment: payment,
+	}
+}
+
 func int64Contains(slice []int64, item int64) bool {
 	for _, s := range slice {
 		if s == item {
@@ -1786,6 +3710,9 @@ func (t *Tgbot) sendSubscriptions(chatId int64, tgUserId int64) {
 
 	for _, traffic := range traffics {
 		msg += t.clientInfoMsg(traffic, true, true, true, true, true, true)
+		keyboard.InlineKeyboard = append(keyboard.InlineKeyboard, tu.InlineKeyboardRow(
+			tu.InlineKeyboardButton(t.I18nBot("tgbot.buttons.manageClient", "Email=="+traffic.Email)).WithCallbackData(t.encodeQuery("my_client "+traffic.Email)),
+		))
 		// unlimited
 		if traffic.ExpiryTime == 0 {
 			continue
@@ -1797,7 +3724,7 @@ func (t *Tgbot) sendSubscriptions(chatId int64, tgUserId int64) {
 			// expired
 			buttons = append(buttons, tu.InlineKeyboardButton(t.I18nBot("tgbot.buttons.subInfo", "Email=="+traffic.Email, "Remaining=="+"expired")).WithCallbackData(t.encodeQuery("resubscribe "+traffic.Email)))
 		} else {
-			buttons = append(buttons, tu.InlineKeyboardButton(t.I18nBot("tgbot.buttons.subInfo", "Email=="+traffic.Email, "Remaining=="+string(remainingSeconds))).WithCallbackData(t.encodeQuery("subInfo "+traffic.Email)))
+			buttons = append(buttons, tu.InlineKeyboardButton(t.I18nBot("tgbot.buttons.subInfo", "Email=="+traffic.Email, "Remaining=="+fmt.Sprintf("%d %s", remainingSeconds/86400, t.I18nBot("tgbot.days")))).WithCallbackData(t.encodeQuery("subInfo "+traffic.Email)))
 		}
 	}
 
@@ -2090,12 +4017,14 @@ func (t *Tgbot) handleCanceledPayment(chatId int64, reason string) {
 	t.SendMsgToTgbot(chatId, t.I18nBot("tgbot.answers.errorOperation")+reason)
 }
 
-func (t *Tgbot) handleSucceededPayment(tx *gorm.DB, payment *model.Payment) (applied bool, error error) {
-	_, client, err := t.inboundService.GetClientByEmailIfExists(payment.Email)
+// handleSucceededPayment renews or creates the client paid for within the
+// transaction of the payment. The events are for after the commit.
+func (t *Tgbot) handleSucceededPayment(tx *gorm.DB, payment *model.Payment) (applied bool, events []ClientEvent, error error) {
+	traffic, client, err := t.inboundService.GetClientByEmailIfExists(payment.Email)
 	if err != nil {
 		logger.Errorf("Error getting client inbound by email=%s %s", payment.Email, err.Error())
 		t.SendMsgToTgbot(payment.ChatId, t.I18nBot("tgbot.answers.errorOperation"))
-		return false, err
+		return false, nil, err
 	}
 	logger.Debug("get client by email: ok")
 
@@ -2103,27 +4032,39 @@ func (t *Tgbot) handleSucceededPayment(tx *gorm.DB, payment *model.Payment) (app
 
 	if client != nil {
 		logger.Debug("client is not nil: ok")
+		before := map[string]interface{}{"expiryTime": client.ExpiryTime}
 		client.ExpiryTime = expiryTime.Unix()
 		err := t.inboundService.UpdateClientStat(tx, payment.Email, client)
 		if err != nil {
 			logger.Errorf("Error updating client inbound with email=%s %v", payment.Email, err.Error())
 			t.SendMsgToTgbot(payment.ChatId, t.I18nBot("tgbot.answers.errorOperation"))
-			return false, err
+			return false, nil, err
+		}
+		t.auditService.RecordWithTx(tx, NewBotActor(payment.TgID), "renew_client", AuditTargetClient, payment.Email, before, map[string]interface{}{"expiryTime": client.ExpiryTime})
+		inboundId := 0
+		if traffic != nil {
+			inboundId = traffic.InboundId
 		}
 		logger.Debug("update client stat: ok")
-		return true, nil
+		return true, []ClientEvent{{
+			Type:       ClientRenewedByPayment,
+			Email:      payment.Email,
+			InboundId:  inboundId,
+			TgId:       payment.TgID,
+			ExpiryTime: expiryTime.UnixMilli(),
+		}}, nil
 	} else {
 		logger.Debug("client is nil: ok")
 		allInbounds, err := t.inboundService.GetAllInbounds()
 		if err != nil {
-			return false, err
+			return false, nil, err
 		}
 
 		inbound := allInbounds[0]
 		var defaultSetting InboundSettings
 		err = json.Unmarshal([]byte(inbound.Settings), &defaultSetting)
 		if err != nil {
-			return false, err
+			return false, nil, err
 		}
 
 		clientSettings := InboundClientSetting{
@@ -2142,7 +4083,7 @@ func (t *Tgbot) handleSucceededPayment(tx *gorm.DB, payment *model.Payment) (app
 
 		settingJson, err := json.Marshal(inboundSettings)
 		if err != nil {
-			return false, err
+			return false, nil, err
 		}
 
 		newInboundSettings := model.Inbound{
@@ -2154,19 +4095,24 @@ func (t *Tgbot) handleSucceededPayment(tx *gorm.DB, payment *model.Payment) (app
 		logger.Debugf("prepare client inbound: ok %s", settingsIndent)
 		needRestart := true
 
-		needRestart, err = t.inboundService.AddInboundClientWithTx(tx, &newInboundSettings)
+		needRestart, err = t.inboundService.As(NewBotActor(payment.TgID)).AddInboundClientWithTx(tx, &newInboundSettings)
 		if err != nil {
 			logger.Errorf("Error adding client inbound with email=%s %v", payment.Email, err.Error())
 			t.SendMsgToTgbot(payment.ChatId, t.I18nBot("tgbot.answers.errorOperation"))
-			return false, err
+			return false, nil, err
 		}
 		logger.Debug("create inbound client: ok")
 		if needRestart {
 			t.xrayService.SetToNeedRestart()
 		}
+		return true, []ClientEvent{{
+			Type:       ClientCreatedByPayment,
+			Email:      payment.Email,
+			InboundId:  inbound.Id,
+			TgId:       payment.TgID,
+			ExpiryTime: expiryTime.UnixMilli(),
+		}}, nil
 	}
-
-	return true, nil
 }
 
 func (t *Tgbot) sendSubscription(chatId int64, email string) {
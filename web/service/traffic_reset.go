@@ -0,0 +1,346 @@
+package service
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/logger"
+	"x-ui/util/common"
+	"x-ui/xray"
+
+	"github.com/robfig/cron/v3"
+	"gorm.io/gorm"
+)
+
+// monthlySchedule fires at midnight on a day of the month, on the last day of
+// shorter months.
+type monthlySchedule struct {
+	day int
+}
+
+func (m monthlySchedule) Next(t time.Time) time.Time {
+	for month := 0; ; month++ {
+		first := time.Date(t.Year(), t.Month()+time.Month(month), 1, 0, 0, 0, 0, t.Location())
+		lastDay := first.AddDate(0, 1, -1).Day()
+		next := first.AddDate(0, 0, min(m.day, lastDay)-1)
+		if next.After(t) {
+			return next
+		}
+	}
+}
+
+// parseTrafficReset parses a traffic reset schedule: "daily", "weekly"
+// (Mondays), "monthly" (the 1st), "monthly:<day>" or a standard cron spec.
+func parseTrafficReset(schedule string) (cron.Schedule, error) {
+	switch schedule {
+	case "daily":
+		return cron.ParseStandard("0 0 * * *")
+	case "weekly":
+		return cron.ParseStandard("0 0 * * 1")
+	case "monthly":
+		return monthlySchedule{day: 1}, nil
+	}
+	if day, found := strings.CutPrefix(schedule, "monthly:"); found {
+		d, err := strconv.Atoi(day)
+		if err != nil || d < 1 || d > 31 {
+			return nil, common.NewError("invalid day of month:", day)
+		}
+		return monthlySchedule{day: d}, nil
+	}
+	return cron.ParseStandard(schedule)
+}
+
+// ValidateTrafficReset checks a traffic reset schedule, empty means none.
+func ValidateTrafficReset(schedule string) error {
+	if schedule == "" {
+		return nil
+	}
+	_, err := parseTrafficReset(schedule)
+	if err != nil {
+		return common.NewErrorf("invalid traffic reset schedule %q: %v", schedule, err)
+	}
+	return nil
+}
+
+// trafficResetDue reports whether a boundary of the schedule passed since the
+// last reset, both in milliseconds.
+func trafficResetDue(schedule cron.Schedule, lastReset int64, now time.Time) bool {
+	return !schedule.Next(time.UnixMilli(lastReset).In(now.Location())).After(now)
+}
+
+// ResetScheduledTraffics zeroes the traffic of the clients and inbounds whose
+// reset schedule passed a boundary, keeping the usage before the reset in the
+// traffic reset log. Inbounds and clients which were only disabled for their
+// traffic are enabled again. Schedules seen for the first time only start
+// counting.
+func (s *InboundService) ResetScheduledTraffics() (bool, error) {
+	settingService := SettingService{}
+	now := time.Now()
+	location, err := settingService.GetTimeLocation()
+	if err == nil {
+		now = now.In(location)
+	}
+	nowMs := now.UnixMilli()
+
+	db := database.GetDB()
+	hasSchedules, err := s.hasTrafficResets(db)
+	if err != nil || !hasSchedules {
+		return false, err
+	}
+
+	needRestart := false
+	var clientsToAdd []struct {
+		protocol string
+		tag      string
+		client   map[string]interface{}
+	}
+	var dueInbounds, dueTraffics int
+	err = db.Transaction(func(tx *gorm.DB) error {
+		var inbounds []*model.Inbound
+		err := tx.Model(model.Inbound{}).Find(&inbounds).Error
+		if err != nil {
+			return err
+		}
+		var records []struct {
+			Email        string
+			InboundId    int
+			Enable       bool
+			TrafficReset string
+		}
+		err = tx.Model(model.ClientRecord{}).Select("email, inbound_id, enable, traffic_reset").Scan(&records).Error
+		if err != nil {
+			return err
+		}
+		var traffics []*xray.ClientTraffic
+		err = tx.Model(xray.ClientTraffic{}).Find(&traffics).Error
+		if err != nil {
+			return err
+		}
+
+		schedules := map[string]cron.Schedule{}
+		scheduleOf := func(spec string) cron.Schedule {
+			schedule, ok := schedules[spec]
+			if !ok {
+				var err error
+				schedule, err = parseTrafficReset(spec)
+				if err != nil {
+					logger.Warning("Invalid traffic reset schedule", spec, ":", err)
+				}
+				schedules[spec] = schedule
+			}
+			return schedule
+		}
+
+		for _, inbound := range inbounds {
+			if inbound.TrafficReset == "" {
+				continue
+			}
+			schedule := scheduleOf(inbound.TrafficReset)
+			if schedule == nil {
+				continue
+			}
+			if inbound.LastTrafficReset == 0 {
+				err = tx.Model(&model.Inbound{}).Where("id = ?", inbound.Id).Update("last_traffic_reset", nowMs).Error
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			if !trafficResetDue(schedule, inbound.LastTrafficReset, now) {
+				continue
+			}
+			dueInbounds++
+			err = tx.Create(&model.TrafficResetLog{
+				Kind:    RollupInbound,
+				Name:    inbound.Tag,
+				Up:      inbound.Up,
+				Down:    inbound.Down,
+				Total:   inbound.Total,
+				ResetAt: nowMs,
+			}).Error
+			if err != nil {
+				return err
+			}
+			// inbounds disabled by an admin or by their expiry stay disabled
+			enable := inbound.Enable || (inbound.AutoDisabled && (inbound.ExpiryTime <= 0 || inbound.ExpiryTime > nowMs))
+			err = tx.Model(&model.Inbound{}).Where("id = ?", inbound.Id).
+				Updates(map[string]interface{}{
+					"up":                 0,
+					"down":               0,
+					"enable":             enable,
+					"auto_disabled":      inbound.AutoDisabled && !enable,
+					"last_traffic_reset": nowMs,
+				}).Error
+			if err != nil {
+				return err
+			}
+			if enable && !inbound.Enable {
+				needRestart = true
+			}
+			s.audit(tx, "scheduled_reset_traffic", AuditTargetInbound, inbound.Tag,
+				map[string]interface{}{"up": inbound.Up, "down": inbound.Down, "enable": inbound.Enable},
+				map[string]interface{}{"up": 0, "down": 0, "enable": enable})
+		}
+
+		inboundsById := make(map[int]*model.Inbound, len(inbounds))
+		for _, inbound := range inbounds {
+			inboundsById[inbound.Id] = inbound
+		}
+		clientSchedules := make(map[string]string, len(records))
+		clientEnabled := make(map[string]bool, len(records))
+		for _, record := range records {
+			spec := record.TrafficReset
+			if spec == "" {
+				if inbound, ok := inboundsById[record.InboundId]; ok {
+					spec = inbound.TrafficReset
+				}
+			}
+			clientSchedules[record.Email] = spec
+			clientEnabled[record.Email] = record.Enable
+		}
+		var startEmails []string
+		for _, traffic := range traffics {
+			spec := clientSchedules[traffic.Email]
+			if spec == "" {
+				continue
+			}
+			schedule := scheduleOf(spec)
+			if schedule == nil {
+				continue
+			}
+			if traffic.LastTrafficReset == 0 {
+				startEmails = append(startEmails, traffic.Email)
+				continue
+			}
+			if !trafficResetDue(schedule, traffic.LastTrafficReset, now) {
+				continue
+			}
+			dueTraffics++
+			err = tx.Create(&model.TrafficResetLog{
+				Kind:    RollupClient,
+				Name:    traffic.Email,
+				Up:      traffic.Up,
+				Down:    traffic.Down,
+				Total:   traffic.Total,
+				ResetAt: nowMs,
+			}).Error
+			if err != nil {
+				return err
+			}
+			before := auditTraffic(traffic)
+			// clients disabled by an admin or by their expiry stay disabled
+			enable := traffic.Enable || (clientEnabled[traffic.Email] && (traffic.ExpiryTime <= 0 || traffic.ExpiryTime > nowMs))
+			err = tx.Model(xray.ClientTraffic{}).Where("email = ?", traffic.Email).
+				Updates(map[string]interface{}{
+					"up":                 0,
+					"down":               0,
+					"enable":             enable,
+					"throttled":          false,
+					"last_traffic_reset": nowMs,
+				}).Error
+			if err != nil {
+				return err
+			}
+			if traffic.Throttled {
+				needRestart = true
+			}
+			if enable && !traffic.Enable {
+				inbound := inboundsById[traffic.InboundId]
+				if inbound != nil {
+					settings := map[string]interface{}{}
+					json.Unmarshal([]byte(inbound.Settings), &settings)
+					clients, _ := settings["clients"].([]interface{})
+					for _, client := range clients {
+						c, ok := client.(map[string]interface{})
+						if ok && c["email"] == traffic.Email {
+							clientsToAdd = append(clientsToAdd, struct {
+								protocol string
+								tag      string
+								client   map[string]interface{}
+							}{
+								protocol: string(inbound.Protocol),
+								tag:      inbound.Tag,
+								client:   c,
+							})
+							break
+						}
+					}
+				}
+			}
+			traffic.Up = 0
+			traffic.Down = 0
+			traffic.Enable = enable
+			s.audit(tx, "scheduled_reset_traffic", AuditTargetClient, traffic.Email, before, auditTraffic(traffic))
+		}
+		if len(startEmails) > 0 {
+			return tx.Model(xray.ClientTraffic{}).Where("email IN ?", startEmails).Update("last_traffic_reset", nowMs).Error
+		}
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+
+	if len(clientsToAdd) > 0 {
+		if p != nil {
+			err1 := s.xrayApi.Init(p.GetAPIPort())
+			if err1 != nil {
+				return true, nil
+			}
+			for _, clientToAdd := range clientsToAdd {
+				err1 = s.addXrayUser(clientToAdd.protocol, clientToAdd.tag, clientToAdd.client)
+				if err1 == nil {
+					logger.Debug("Client enabled due to scheduled traffic reset:", clientToAdd.client["email"])
+				} else {
+					logger.Debug("Error in enabling client by api:", err1)
+					needRestart = true
+				}
+			}
+			s.xrayApi.Close()
+		} else {
+			needRestart = true
+		}
+	}
+	if dueInbounds > 0 || dueTraffics > 0 {
+		logger.Infof("traffic reset by schedule for %d inbounds and %d clients", dueInbounds, dueTraffics)
+	}
+	return needRestart, nil
+}
+
+// hasTrafficResets reports whether any inbound or client has a traffic reset
+// schedule, sparing the job from loading all traffics every minute otherwise.
+func (s *InboundService) hasTrafficResets(db *gorm.DB) (bool, error) {
+	var count int64
+	err := db.Model(model.Inbound{}).Where("traffic_reset != ?", "").Count(&count).Error
+	if err != nil || count > 0 {
+		return count > 0, err
+	}
+	err = db.Model(model.ClientRecord{}).Where("traffic_reset != ?", "").Count(&count).Error
+	return count > 0, err
+}
+
+// GetTrafficResetLogs returns the latest scheduled resets, optionally of one
+// client or inbound only.
+func (s *InboundService) GetTrafficResetLogs(kind string, name string, limit int) ([]model.TrafficResetLog, error) {
+	db := database.GetDB()
+	query := db.Model(model.TrafficResetLog{})
+	if kind != "" {
+		query = query.Where("kind = ?", kind)
+	}
+	if name != "" {
+		query = query.Where("name = ?", name)
+	}
+	if limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+	var logs []model.TrafficResetLog
+	err := query.Order("id DESC").Limit(limit).Find(&logs).Error
+	if err != nil && err != gorm.ErrRecordNotFound {
+		return nil, err
+	}
+	return logs, nil
+}
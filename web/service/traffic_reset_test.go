@@ -0,0 +1,172 @@
+package service
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseTrafficReset(t *testing.T) {
+	tests := []struct {
+		schedule string
+		wantErr  bool
+	}{
+		{schedule: "daily"},
+		{schedule: "weekly"},
+		{schedule: "monthly"},
+		{schedule: "monthly:1"},
+		{schedule: "monthly:31"},
+		{schedule: "0 4 * * *"},
+		{schedule: "@every 1h"},
+		{schedule: "monthly:0", wantErr: true},
+		{schedule: "monthly:32", wantErr: true},
+		{schedule: "monthly:x", wantErr: true},
+		{schedule: "monthly:", wantErr: true},
+		{schedule: "yearly", wantErr: true},
+		{schedule: "0 0 * *", wantErr: true},
+		{schedule: "61 0 * * *", wantErr: true},
+		{schedule: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.schedule, func(t *testing.T) {
+			schedule, err := parseTrafficReset(tt.schedule)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseTrafficReset(%q) error = %v, wantErr %v", tt.schedule, err, tt.wantErr)
+			}
+			if !tt.wantErr && schedule == nil {
+				t.Errorf("parseTrafficReset(%q) returned no schedule", tt.schedule)
+			}
+		})
+	}
+}
+
+func TestParseTrafficResetNext(t *testing.T) {
+	from := time.Date(2024, time.March, 13, 10, 30, 0, 0, time.UTC) // a Wednesday
+	tests := []struct {
+		schedule string
+		want     time.Time
+	}{
+		{schedule: "daily", want: time.Date(2024, time.March, 14, 0, 0, 0, 0, time.UTC)},
+		{schedule: "weekly", want: time.Date(2024, time.March, 18, 0, 0, 0, 0, time.UTC)},
+		{schedule: "monthly", want: time.Date(2024, time.April, 1, 0, 0, 0, 0, time.UTC)},
+		{schedule: "monthly:20", want: time.Date(2024, time.March, 20, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.schedule, func(t *testing.T) {
+			schedule, err := parseTrafficReset(tt.schedule)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := schedule.Next(from); !got.Equal(tt.want) {
+				t.Errorf("Next() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMonthlyScheduleNext(t *testing.T) {
+	tests := []struct {
+		name string
+		day  int
+		from time.Time
+		want time.Time
+	}{
+		{
+			name: "later this month",
+			day:  15,
+			from: time.Date(2023, time.January, 10, 12, 0, 0, 0, time.UTC),
+			want: time.Date(2023, time.January, 15, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name: "next month",
+			day:  5,
+			from: time.Date(2023, time.January, 10, 12, 0, 0, 0, time.UTC),
+			want: time.Date(2023, time.February, 5, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name: "day 31 in february",
+			day:  31,
+			from: time.Date(2023, time.February, 1, 0, 0, 0, 0, time.UTC),
+			want: time.Date(2023, time.February, 28, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name: "day 31 in a leap february",
+			day:  31,
+			from: time.Date(2024, time.February, 1, 0, 0, 0, 0, time.UTC),
+			want: time.Date(2024, time.February, 29, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name: "day 30 in a leap february",
+			day:  30,
+			from: time.Date(2024, time.February, 28, 23, 59, 59, 0, time.UTC),
+			want: time.Date(2024, time.February, 29, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name: "day 31 in april",
+			day:  31,
+			from: time.Date(2023, time.April, 2, 0, 0, 0, 0, time.UTC),
+			want: time.Date(2023, time.April, 30, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name: "after the clamped day",
+			day:  31,
+			from: time.Date(2023, time.April, 30, 0, 0, 1, 0, time.UTC),
+			want: time.Date(2023, time.May, 31, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name: "exactly at the boundary",
+			day:  31,
+			from: time.Date(2023, time.February, 28, 0, 0, 0, 0, time.UTC),
+			want: time.Date(2023, time.March, 31, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name: "just before the boundary",
+			day:  1,
+			from: time.Date(2023, time.February, 28, 23, 59, 59, 999, time.UTC),
+			want: time.Date(2023, time.March, 1, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name: "across the year",
+			day:  31,
+			from: time.Date(2023, time.December, 31, 0, 0, 0, 0, time.UTC),
+			want: time.Date(2024, time.January, 31, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name: "keeps the location",
+			day:  1,
+			from: time.Date(2023, time.March, 31, 23, 0, 0, 0, time.FixedZone("UTC+3", 3*3600)),
+			want: time.Date(2023, time.April, 1, 0, 0, 0, 0, time.FixedZone("UTC+3", 3*3600)),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := monthlySchedule{day: tt.day}.Next(tt.from)
+			if !got.Equal(tt.want) {
+				t.Errorf("Next(%v) = %v, want %v", tt.from, got, tt.want)
+			}
+			if got.Location() != tt.from.Location() {
+				t.Errorf("Next(%v) location = %v, want %v", tt.from, got.Location(), tt.from.Location())
+			}
+		})
+	}
+}
+
+func TestTrafficResetDue(t *testing.T) {
+	schedule := monthlySchedule{day: 1}
+	lastReset := time.Date(2023, time.March, 1, 0, 0, 0, 0, time.UTC).UnixMilli()
+	tests := []struct {
+		name string
+		now  time.Time
+		want bool
+	}{
+		{name: "same month", now: time.Date(2023, time.March, 31, 23, 59, 59, 0, time.UTC), want: false},
+		{name: "at the boundary", now: time.Date(2023, time.April, 1, 0, 0, 0, 0, time.UTC), want: true},
+		{name: "boundaries missed", now: time.Date(2023, time.June, 15, 0, 0, 0, 0, time.UTC), want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := trafficResetDue(schedule, lastReset, tt.now); got != tt.want {
+				t.Errorf("trafficResetDue() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,212 @@
+package service
+
+import (
+	"time"
+
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/xray"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	RollupClient   = "client"
+	RollupInbound  = "inbound"
+	RollupOutbound = "outbound"
+)
+
+const (
+	RollupHour = "hour"
+	RollupDay  = "day"
+)
+
+const (
+	RankingToday = "today"
+	RankingWeek  = "week"
+	RankingMonth = "month"
+	RankingAll   = "all"
+)
+
+type ClientTrafficRank struct {
+	Email     string `json:"email"`
+	TrafficId int    `json:"trafficId"`
+	InboundId int    `json:"inboundId"`
+	Up        int64  `json:"up"`
+	Down      int64  `json:"down"`
+}
+
+// TrafficPoint is the traffic of a bucket of a series, Start is in unix seconds.
+type TrafficPoint struct {
+	Start int64 `json:"start"`
+	Up    int64 `json:"up"`
+	Down  int64 `json:"down"`
+}
+
+// addClientRollups adds the traffic deltas of the clients to their rollups
+// of the current hour and day.
+func addClientRollups(tx *gorm.DB, traffics []*xray.ClientTraffic) error {
+	deltas := make([]*xray.Traffic, 0, len(traffics))
+	for _, traffic := range traffics {
+		deltas = append(deltas, &xray.Traffic{Tag: traffic.Email, Up: traffic.Up, Down: traffic.Down})
+	}
+	return addTrafficRollups(tx, RollupClient, deltas)
+}
+
+// addTrafficRollups adds the traffic deltas, named by their tag, to the
+// rollups of kind for the current hour and day.
+func addTrafficRollups(tx *gorm.DB, kind string, traffics []*xray.Traffic) error {
+	now := time.Now()
+	hour := periodStart(RollupHour, now).Unix()
+	day := periodStart(RankingToday, now).Unix()
+	rollups := make([]*model.TrafficRollup, 0, len(traffics)*2)
+	for _, traffic := range traffics {
+		if traffic.Up+traffic.Down == 0 {
+			continue
+		}
+		for period, start := range map[string]int64{RollupHour: hour, RollupDay: day} {
+			rollups = append(rollups, &model.TrafficRollup{
+				Kind:   kind,
+				Name:   traffic.Tag,
+				Period: period,
+				Start:  start,
+				Up:     traffic.Up,
+				Down:   traffic.Down,
+			})
+		}
+	}
+	if len(rollups) == 0 {
+		return nil
+	}
+	return tx.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "kind"}, {Name: "name"}, {Name: "period"}, {Name: "start"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{
+			"up":   gorm.Expr("traffic_rollups.up + excluded.up"),
+			"down": gorm.Expr("traffic_rollups.down + excluded.down"),
+		}),
+	}).Create(&rollups).Error
+}
+
+// renameTrafficRollups moves the history and the traffic reset log of a
+// renamed client or inbound to its new name, dropping any stale history left
+// under the new name.
+func renameTrafficRollups(tx *gorm.DB, kind string, oldName string, newName string) error {
+	if oldName == newName {
+		return nil
+	}
+	err := tx.Where("kind = ? AND name = ?", kind, newName).Delete(model.TrafficRollup{}).Error
+	if err != nil {
+		return err
+	}
+	err = tx.Model(model.TrafficRollup{}).
+		Where("kind = ? AND name = ?", kind, oldName).
+		Update("name", newName).Error
+	if err != nil {
+		return err
+	}
+	return tx.Model(model.TrafficResetLog{}).
+		Where("kind = ? AND name = ?", kind, oldName).
+		Update("name", newName).Error
+}
+
+// periodStart returns the start of the hour, calendar day, week (from
+// Monday) or month containing now, in the time location of the panel.
+func periodStart(period string, now time.Time) time.Time {
+	settingService := SettingService{}
+	location, err := settingService.GetTimeLocation()
+	if err == nil {
+		now = now.In(location)
+	}
+	if period == RollupHour {
+		return time.Date(now.Year(), now.Month(), now.Day(), now.Hour(), 0, 0, 0, now.Location())
+	}
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	switch period {
+	case RankingWeek:
+		return day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+	case RankingMonth:
+		return day.AddDate(0, 0, 1-day.Day())
+	default:
+		return day
+	}
+}
+
+// GetClientTrafficRanking returns the clients with the most traffic in the
+// period, all-time figures come from the client traffics themselves.
+func (s *InboundService) GetClientTrafficRanking(period string, limit int) ([]*ClientTrafficRank, error) {
+	db := database.GetDB()
+	var ranks []*ClientTrafficRank
+	var err error
+	if period == RankingAll {
+		err = db.Model(xray.ClientTraffic{}).
+			Select("email, id as traffic_id, inbound_id, up, down").
+			Where("up + down > 0").
+			Order("up + down desc").
+			Limit(limit).
+			Scan(&ranks).Error
+	} else {
+		err = db.Table("traffic_rollups").
+			Select("traffic_rollups.name as email, client_traffics.id as traffic_id, client_traffics.inbound_id, SUM(traffic_rollups.up) as up, SUM(traffic_rollups.down) as down").
+			Joins("JOIN client_traffics ON client_traffics.email = traffic_rollups.name").
+			Where("traffic_rollups.kind = ? AND traffic_rollups.period = ? AND traffic_rollups.start >= ?", RollupClient, RollupDay, periodStart(period, time.Now()).Unix()).
+			Group("traffic_rollups.name").
+			Order("SUM(traffic_rollups.up + traffic_rollups.down) desc").
+			Limit(limit).
+			Scan(&ranks).Error
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ranks, nil
+}
+
+// GetTrafficSeries returns the hourly or daily traffic of the client,
+// inbound or outbound named name, for the buckets starting in [from, to).
+func (s *InboundService) GetTrafficSeries(kind string, name string, period string, from int64, to int64) ([]*TrafficPoint, error) {
+	db := database.GetDB()
+	var points []*TrafficPoint
+	err := db.Model(model.TrafficRollup{}).
+		Select("start, up, down").
+		Where("kind = ? AND name = ? AND period = ? AND start >= ? AND start < ?", kind, name, period, from, to).
+		Order("start").
+		Scan(&points).Error
+	if err != nil {
+		return nil, err
+	}
+	return points, nil
+}
+
+// GetTrafficSince sums the daily traffic of the client, inbound or outbound
+// named name from the day starting at since.
+func (s *InboundService) GetTrafficSince(kind string, name string, since time.Time) (int64, int64, error) {
+	db := database.GetDB()
+	var total TrafficPoint
+	err := db.Model(model.TrafficRollup{}).
+		Select("COALESCE(SUM(up), 0) as up, COALESCE(SUM(down), 0) as down").
+		Where("kind = ? AND name = ? AND period = ? AND start >= ?", kind, name, RollupDay, since.Unix()).
+		Scan(&total).Error
+	if err != nil {
+		return 0, 0, err
+	}
+	return total.Up, total.Down, nil
+}
+
+// DelExpiredTrafficRollups drops the hourly and daily rollups older than
+// their retention in days, zero keeps them for good.
+func (s *InboundService) DelExpiredTrafficRollups(hourlyDays int, dailyDays int) (int64, error) {
+	db := database.GetDB()
+	now := time.Now()
+	var removed int64
+	for period, days := range map[string]int{RollupHour: hourlyDays, RollupDay: dailyDays} {
+		if days <= 0 {
+			continue
+		}
+		result := db.Where("period = ? AND start < ?", period, now.AddDate(0, 0, -days).Unix()).Delete(model.TrafficRollup{})
+		if result.Error != nil {
+			return removed, result.Error
+		}
+		removed += result.RowsAffected
+	}
+	return removed, nil
+}
@@ -90,9 +90,12 @@ func (w *WebhookService) WebhookHandler(wr http.ResponseWriter, r *http.Request)
 
 	tx := database.GetDB().Begin()
 	var err error
+	var events []ClientEvent
 	defer func() {
 		if err == nil {
-			tx.Commit()
+			if tx.Commit().Error == nil {
+				fireClientEvents(events)
+			}
 			wr.WriteHeader(http.StatusOK)
 		} else {
 			jsonWebhook, _ := json.MarshalIndent(notification, "", "  ")
@@ -133,7 +136,7 @@ func (w *WebhookService) WebhookHandler(wr http.ResponseWriter, r *http.Request)
 	switch notification.Event {
 	case Succeeded:
 		logger.Debug("notification event == payment.succeeded: ok")
-		applied, err = w.tgbotService.handleSucceededPayment(tx, &payment)
+		applied, events, err = w.tgbotService.handleSucceededPayment(tx, &payment)
 		if err != nil {
 			return
 		}
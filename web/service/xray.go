@@ -3,9 +3,13 @@ package service
 import (
 	"encoding/json"
 	"errors"
+	"strconv"
 	"sync"
 
+	"x-ui/database"
+	"x-ui/database/model"
 	"x-ui/logger"
+	"x-ui/web/entity"
 	"x-ui/xray"
 
 	"go.uber.org/atomic"
@@ -74,63 +78,72 @@ func (s *XrayService) GetXrayConfig() (*xray.Config, error) {
 
 	s.inboundService.AddTraffic(nil, nil)
 
-	inbounds, err := s.inboundService.GetAllInbounds()
+	inbounds, err := s.inboundService.GetXrayInbounds()
 	if err != nil {
 		return nil, err
 	}
+	throttleOutbound, err := s.settingService.GetThrottleOutbound()
+	if err != nil {
+		return nil, err
+	}
+	throttleLevel, err := s.settingService.GetThrottleLevel()
+	if err != nil {
+		return nil, err
+	}
+	speedTiers, err := s.settingService.GetSpeedTiers()
+	if err != nil {
+		return nil, err
+	}
+	tierLevels := make(map[string]int, len(speedTiers))
+	for _, tier := range speedTiers {
+		tierLevels[tier.Name] = tier.Level
+	}
+	customerTiers, err := customerSpeedTiers()
+	if err != nil {
+		return nil, err
+	}
+	var throttledEmails []string
 	for _, inbound := range inbounds {
 		if !inbound.Enable {
 			continue
 		}
-		// get settings clients
-		settings := map[string]interface{}{}
-		json.Unmarshal([]byte(inbound.Settings), &settings)
-		clients, ok := settings["clients"].([]interface{})
-		if ok {
-			// check users active or not
-			clientStats := inbound.ClientStats
-			for _, clientTraffic := range clientStats {
-				indexDecrease := 0
-				for index, client := range clients {
-					c := client.(map[string]interface{})
-					if c["email"] == clientTraffic.Email {
-						if !clientTraffic.Enable {
-							clients = RemoveIndex(clients, index-indexDecrease)
-							indexDecrease++
-							logger.Infof("Remove Inbound User %s due to expiration or traffic limit", c["email"])
-						}
-					}
-				}
+		// only the enabled clients within their limits reach xray
+		disabled := map[string]bool{}
+		throttled := map[string]bool{}
+		for _, clientTraffic := range inbound.ClientStats {
+			if !clientTraffic.Enable {
+				disabled[clientTraffic.Email] = true
+			} else if clientTraffic.Throttled {
+				throttled[clientTraffic.Email] = true
 			}
-
-			// clear client config for additional parameters
-			var final_clients []interface{}
-			for _, client := range clients {
-				c := client.(map[string]interface{})
-				if c["enable"] != nil {
-					if enable, ok := c["enable"].(bool); ok && !enable {
-						continue
-					}
-				}
-				for key := range c {
-					if key != "email" && key != "id" && key != "password" && key != "flow" && key != "method" {
-						delete(c, key)
-					}
-					if c["flow"] == "xtls-rprx-vision-udp443" {
-						c["flow"] = "xtls-rprx-vision"
-					}
+		}
+		clients := make([]model.ClientRecord, 0, len(inbound.Clients))
+		for _, client := range inbound.Clients {
+			if disabled[client.Email] {
+				logger.Infof("Remove Inbound User %s due to expiration or traffic limit", client.Email)
+				continue
+			}
+			speedTier := client.SpeedTier
+			if speedTier == "" {
+				speedTier = customerTiers[client.Email]
+			}
+			if speedTier != "" {
+				level, ok := tierLevels[speedTier]
+				if ok {
+					client.Level = level
+				} else {
+					logger.Warningf("Speed tier %s of %s not found", speedTier, client.Email)
 				}
-				final_clients = append(final_clients, interface{}(c))
 			}
-
-			settings["clients"] = final_clients
-			modifiedSettings, err := json.MarshalIndent(settings, "", "  ")
-			if err != nil {
-				return nil, err
+			if throttled[client.Email] {
+				if throttleLevel > 0 {
+					client.Level = throttleLevel
+				}
+				throttledEmails = append(throttledEmails, client.Email)
 			}
-
-			inbound.Settings = string(modifiedSettings)
+			clients = append(clients, client)
 		}
+		inbound.Clients = clients
 
 		if len(inbound.StreamSettings) > 0 {
 			// Unmarshal stream JSON
@@ -160,9 +173,52 @@ func (s *XrayService) GetXrayConfig() (*xray.Config, error) {
 		inboundConfig := inbound.GenXrayInboundConfig()
 		xrayConfig.InboundConfigs = append(xrayConfig.InboundConfigs, *inboundConfig)
 	}
+
+	policyLevels := make([]int, 0, len(speedTiers)+1)
+	for _, tier := range speedTiers {
+		policyLevels = append(policyLevels, tier.Level)
+	}
+	if throttleLevel > 0 {
+		policyLevels = append(policyLevels, throttleLevel)
+	}
+	if len(policyLevels) > 0 {
+		policyConfig, err := addPolicyLevels(xrayConfig.Policy, speedTiers, policyLevels)
+		if err != nil {
+			return nil, err
+		}
+		xrayConfig.Policy = policyConfig
+	}
+
+	if throttleOutbound != "" && len(throttledEmails) > 0 {
+		routerConfig, err := addThrottleRule(xrayConfig.RouterConfig, throttleOutbound, throttledEmails)
+		if err != nil {
+			return nil, err
+		}
+		xrayConfig.RouterConfig = routerConfig
+	}
 	return xrayConfig, nil
 }
 
+// addThrottleRule puts a rule sending the throttled users to the throttle
+// outbound in front of the routing rules of the template.
+func addThrottleRule(routerConfig []byte, outboundTag string, emails []string) ([]byte, error) {
+	routing := map[string]interface{}{}
+	if len(routerConfig) > 0 {
+		err := json.Unmarshal(routerConfig, &routing)
+		if err != nil {
+			return nil, err
+		}
+	}
+	rules, _ := routing["rules"].([]interface{})
+	rule := map[string]interface{}{
+		"type":        "field",
+		"user":        emails,
+		"outboundTag": outboundTag,
+	}
+	routing["rules"] = append([]interface{}{rule}, rules...)
+	return json.MarshalIndent(routing, "", "  ")
+}
+
 func (s *XrayService) GetXrayTraffic() ([]*xray.Traffic, []*xray.ClientTraffic, error) {
 	if !s.IsXrayRunning() {
 		err := errors.New("xray is not running")
@@ -225,3 +281,79 @@ func (s *XrayService) SetToNeedRestart() {
 func (s *XrayService) IsNeedRestartAndSetFalse() bool {
 	return isNeedXrayRestart.CompareAndSwap(true, false)
 }
+
+// addPolicyLevels adds the policy levels used by the speed tiers and the
+// throttle level. Each starts from level 0 of the template, so the traffic
+// of its users is still counted, and the settings of the template for that
+// level and of its speed tier go on top.
+func addPolicyLevels(policyConfig []byte, tiers []*entity.SpeedTier, levels []int) ([]byte, error) {
+	policy := map[string]interface{}{}
+	if len(policyConfig) > 0 {
+		err := json.Unmarshal(policyConfig, &policy)
+		if err != nil {
+			return nil, err
+		}
+	}
+	policyLevels, _ := policy["levels"].(map[string]interface{})
+	if policyLevels == nil {
+		policyLevels = map[string]interface{}{}
+	}
+	base, _ := policyLevels["0"].(map[string]interface{})
+	for _, level := range levels {
+		key := strconv.Itoa(level)
+		merged := map[string]interface{}{}
+		for k, v := range base {
+			merged[k] = v
+		}
+		if existing, ok := policyLevels[key].(map[string]interface{}); ok {
+			for k, v := range existing {
+				merged[k] = v
+			}
+		}
+		for _, tier := range tiers {
+			if tier.Level == level {
+				for k, v := range tier.Policy {
+					merged[k] = v
+				}
+			}
+		}
+		policyLevels[key] = merged
+	}
+	policy["levels"] = policyLevels
+	return json.MarshalIndent(policy, "", "  ")
+}
+
+// clientLevel returns the policy level of a client added to xray over the
+// API: the throttle level while it is throttled, else the level of its own
+// speed tier or of the speed tier of its customer.
+func clientLevel(email string, speedTier string) int {
+	settingService := SettingService{}
+	db := database.GetDB()
+	var traffic xray.ClientTraffic
+	err := db.Model(xray.ClientTraffic{}).Select("throttled").Where("email = ?", email).Limit(1).Find(&traffic).Error
+	if err == nil && traffic.Throttled {
+		throttleLevel, err := settingService.GetThrottleLevel()
+		if err == nil && throttleLevel > 0 {
+			return throttleLevel
+		}
+	}
+	if speedTier == "" {
+		var customer model.Customer
+		err = db.Model(model.Customer{}).
+			Joins("JOIN customer_clients ON customer_clients.customer_id = customers.id").
+			Where("customer_clients.email = ?", email).
+			Limit(1).Find(&customer).Error
+		if err != nil {
+			return 0
+		}
+		speedTier = customer.SpeedTier
+	}
+	if speedTier == "" {
+		return 0
+	}
+	tier, err := settingService.GetSpeedTier(speedTier)
+	if err != nil || tier == nil {
+		return 0
+	}
+	return tier.Level
+}
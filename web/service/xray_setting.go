@@ -12,6 +12,12 @@ type XraySettingService struct {
 	SettingService
 }
 
+// As returns a copy of the service which records its changes in the audit
+// log under the given actor.
+func (s *XraySettingService) As(actor *AuditActor) *XraySettingService {
+	return &XraySettingService{SettingService: *s.SettingService.As(actor)}
+}
+
 func (s *XraySettingService) SaveXraySetting(newXraySettings string) error {
 	if err := s.CheckXrayConfig(newXraySettings); err != nil {
 		return err
@@ -298,25 +298,37 @@ func (s *Server) startTask() {
 	// check client ips from log file every day
 	s.cron.AddJob("@daily", job.NewClearLogsJob())
 
+	// drop traffic history past its retention every hour
+	s.cron.AddJob("@hourly", job.NewClearTrafficRollupsJob())
+
+	// purge deleted clients and inbounds past the recycle bin retention
+	s.cron.AddJob("@hourly", job.NewClearRecycleBinJob())
+
+	// reset traffic on the calendar boundaries of the reset schedules
+	s.cron.AddJob("@every 1m", job.NewTrafficResetJob())
+
 	// Make a traffic condition every day, 8:30
 	var entry cron.EntryID
 	isTgbotenabled, err := s.settingService.GetTgbotEnabled()
 	if (err == nil) && (isTgbotenabled) {
-		runtime, err := s.settingService.GetTgbotRuntime()
-		if err != nil || runtime == "" {
-			logger.Errorf("Add NewStatsNotifyJob error[%s], Runtime[%s] invalid, will run default", err, runtime)
-			runtime = "@daily"
-		}
-		logger.Infof("Tg notify enabled,run at %s", runtime)
-		_, err = s.cron.AddJob(runtime, job.NewStatsNotifyJob())
+		reports, err := s.settingService.GetReports()
 		if err != nil {
-			logger.Warning("Add NewStatsNotifyJob error", err)
-			return
+			logger.Warning("Get Telegram reports error", err)
+		}
+		for _, report := range reports {
+			logger.Infof("Tg report %s enabled,run at %s", report.Name, report.Schedule)
+			_, err = s.cron.AddJob(report.Schedule, job.NewStatsNotifyJob(report.Name))
+			if err != nil {
+				logger.Warning("Add NewStatsNotifyJob error", err)
+			}
 		}
 
 		// check for Telegram bot callback query hash storage reset
 		s.cron.AddJob("@every 2m", job.NewCheckHashStorageJob())
 
+		// remind customers about upcoming expiry
+		s.cron.AddJob("@every 30m", job.NewExpiryReminderJob())
+
 		// Check CPU load and alarm to TgBot if threshold passes
 		cpuThreshold, err := s.settingService.GetTgCpu()
 		if (err == nil) && (cpuThreshold > 0) {
@@ -138,12 +138,22 @@ func (x *XrayAPI) AddUser(Protocol string, inboundTag string, user map[string]in
 		return nil
 	}
 
+	// the policy level, given by the panel as int or from settings as float64
+	level := 0
+	switch value := user["level"].(type) {
+	case int:
+		level = value
+	case float64:
+		level = int(value)
+	}
+
 	client := *x.HandlerServiceClient
 
 	_, err := client.AlterInbound(context.Background(), &command.AlterInboundRequest{
 		Tag: inboundTag,
 		Operation: serial.ToTypedMessage(&command.AddUserOperation{
 			User: &protocol.User{
+				Level:   uint32(level),
 				Email:   user["email"].(string),
 				Account: account,
 			},
@@ -10,4 +10,10 @@ type ClientTraffic struct {
 	ExpiryTime int64  `json:"expiryTime" form:"expiryTime"`
 	Total      int64  `json:"total" form:"total"`
 	Reset      int    `json:"reset" form:"reset" gorm:"default:0"`
+	// Throttled clients used up their traffic but stay connected at a lower
+	// speed instead of being disabled.
+	Throttled bool `json:"throttled" form:"throttled" gorm:"default:false"`
+	// LastTrafficReset is when the traffic reset schedule last applied, in
+	// milliseconds.
+	LastTrafficReset int64 `json:"lastTrafficReset" form:"lastTrafficReset" gorm:"default:0"`
 }